@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditEntry 审计日志中的一条记录，每个请求一条
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Identity   string    `json:"identity"`
+	AuthMethod Method    `json:"auth_method,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Bucket     string    `json:"bucket,omitempty"`
+	Permission string    `json:"permission,omitempty"`
+	Status     int       `json:"status"`
+	LatencyMs  int64     `json:"latency_ms"`
+	// 认证或授权失败的原因
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLog 以json行的格式写入审计日志
+type AuditLog struct {
+	mutx   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog 追加写入path指定的文件，path为空时写入标准输出
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "" {
+		return NewAuditLog(os.Stdout), nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open audit log [%s] failed", path)
+	}
+	return &AuditLog{w: file, closer: file}, nil
+}
+
+func (l *AuditLog) Record(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "marshal audit entry failed")
+	}
+	l.mutx.Lock()
+	defer l.mutx.Unlock()
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+func (l *AuditLog) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
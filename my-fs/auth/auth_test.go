@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"my-fs/utils"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+func newTestTokens(t *testing.T) *TokenStore {
+	tokens, err := NewTokenStore([]*Token{
+		{Id: "reader", Secret: "reader-secret", Grants: []Grant{{Bucket: "photos", Permissions: []Permission{PermRead}}}},
+		{Id: "writer", Secret: "writer-secret", Grants: []Grant{{Bucket: AllBuckets, Permissions: []Permission{PermRead, PermWrite}}}},
+		{Id: "admin", Secret: "admin-secret", Grants: []Grant{{Bucket: AllBuckets, Permissions: []Permission{PermAdmin}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestToken_Allowed(t *testing.T) {
+	tokens := newTestTokens(t)
+	reader, _ := tokens.lookup("reader")
+	writer, _ := tokens.lookup("writer")
+	admin, _ := tokens.lookup("admin")
+	cases := []struct {
+		token  *Token
+		bucket string
+		perm   Permission
+		expect bool
+	}{
+		{reader, "photos", PermRead, true},
+		{reader, "photos", PermWrite, false},
+		{reader, "docs", PermRead, false},
+		{reader, AllBuckets, PermRead, false},
+		{writer, "docs", PermWrite, true},
+		{writer, "docs", PermDelete, false},
+		{writer, AllBuckets, PermAdmin, false},
+		{admin, "docs", PermDelete, true},
+		{admin, AllBuckets, PermAdmin, true},
+	}
+	for _, c := range cases {
+		if got := c.token.Allowed(c.bucket, c.perm); got != c.expect {
+			t.Errorf("%s %s on %s: expect %v, got %v", c.token.Id, c.perm, c.bucket, c.expect, got)
+		}
+	}
+
+	if _, err := NewTokenStore([]*Token{{Id: "x", Secret: "y", Grants: []Grant{{Bucket: "*", Permissions: []Permission{"root"}}}}}); err == nil {
+		t.Fatal("expect unknown permission to be rejected")
+	}
+	if _, err := NewTokenStore([]*Token{{Id: "x", Secret: "y", Quota: Quota{MaxBytes: -1}}}); err == nil {
+		t.Fatal("expect negative quota to be rejected")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	tokens := newTestTokens(t)
+	authenticator := NewAuthenticator(tokens)
+	writer, _ := tokens.lookup("writer")
+	authenticate := func(r *http.Request) (*Identity, error) {
+		return authenticator.Authenticate(r)
+	}
+
+	// Bearer token
+	r := httptest.NewRequest(http.MethodGet, "/read?chunkid=a", nil)
+	r.Header.Set("Authorization", "Bearer reader-secret")
+	if identity, err := authenticate(r); err != nil || identity.Id() != "reader" || identity.Method != MethodBearer {
+		t.Fatalf("bearer: %+v %v", identity, err)
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := authenticate(r); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect ErrUnauthenticated for wrong bearer, got %v", err)
+	}
+	if _, err := authenticate(httptest.NewRequest(http.MethodGet, "/read", nil)); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect ErrUnauthenticated without credentials, got %v", err)
+	}
+
+	// HMAC签名，篡改参数或请求体后签名失效
+	body := []byte(`{"data":"hello"}`)
+	r = httptest.NewRequest(http.MethodPost, "/write?bucket=docs&key=a", bytes.NewReader(body))
+	SignRequest(r, writer, body)
+	if identity, err := authenticate(r); err != nil || identity.Id() != "writer" || identity.Method != MethodHMAC {
+		t.Fatalf("hmac: %+v %v", identity, err)
+	}
+	tampered := httptest.NewRequest(http.MethodPost, "/write?bucket=other&key=a", bytes.NewReader(body))
+	tampered.Header = r.Header.Clone()
+	if _, err := authenticate(tampered); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect tampered query to be rejected, got %v", err)
+	}
+	tampered = httptest.NewRequest(http.MethodPost, "/write?bucket=docs&key=a", strings.NewReader(`{"data":"evil"}`))
+	tampered.Header = r.Header.Clone()
+	if _, err := authenticate(tampered); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect tampered body to be rejected, got %v", err)
+	}
+	stale := httptest.NewRequest(http.MethodGet, "/read?chunkid=a", nil)
+	SignRequest(stale, writer, nil)
+	stale.Header.Set(HeaderDate, "1")
+	if _, err := authenticate(stale); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect stale signature to be rejected, got %v", err)
+	}
+
+	// 预签名url只能用于读取
+	signed, err := Presign(writer, "/read", url.Values{"chunkid": {"a"}, "bucket": {"docs"}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/read?"+signed.Encode(), nil)
+	identity, err := authenticate(r)
+	if err != nil || identity.Method != MethodPresigned {
+		t.Fatalf("presigned: %+v %v", identity, err)
+	}
+	if !identity.Allowed("docs", PermRead) || identity.Allowed("docs", PermWrite) {
+		t.Fatal("presigned url should only allow read")
+	}
+	signed.Set("chunkid", "b")
+	if _, err = authenticate(httptest.NewRequest(http.MethodGet, "/read?"+signed.Encode(), nil)); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect presigned url for another chunk to be rejected, got %v", err)
+	}
+	signed.Set("chunkid", "a")
+	signed.Set(QueryExpires, "1")
+	if _, err = authenticate(httptest.NewRequest(http.MethodGet, "/read?"+signed.Encode(), nil)); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("expect expired presigned url to be rejected, got %v", err)
+	}
+	if _, err = Presign(writer, "/read", nil, 30*24*time.Hour); err == nil {
+		t.Fatal("expect presign expiry to be limited")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	audit := new(bytes.Buffer)
+	engine := gin.New()
+	engine.Use(Middleware(NewAuthenticator(newTestTokens(t)), NewAuditLog(audit)))
+	engine.GET("/read", Require(PermRead, func(ctx *gin.Context) string { return ctx.Query("bucket") }), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	})
+
+	request := func(secret, bucket string) int {
+		r := httptest.NewRequest(http.MethodGet, "/read?bucket="+bucket, nil)
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := request("reader-secret", "photos"); code != http.StatusOK {
+		t.Fatalf("expect 200, got %d", code)
+	}
+	if code := request("reader-secret", "docs"); code != http.StatusForbidden {
+		t.Fatalf("expect 403, got %d", code)
+	}
+	if code := request("", "photos"); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401, got %d", code)
+	}
+
+	// 每个请求一条审计日志
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(audit)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expect 3 audit entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Identity != "reader" || e.Bucket != "photos" || e.Status != http.StatusOK || e.Error != "" {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+	if e := entries[1]; e.Status != http.StatusForbidden || e.Permission != "read" || e.Error == "" {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+	if e := entries[2]; e.Identity != "anonymous" || e.Status != http.StatusUnauthorized {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+
+	// 没有开启认证时允许所有请求，仍然记录审计日志
+	open := gin.New()
+	audit.Reset()
+	open.Use(Middleware(nil, NewAuditLog(audit)))
+	open.GET("/admin", Require(PermAdmin, func(*gin.Context) string { return AllBuckets }), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	})
+	w := httptest.NewRecorder()
+	open.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if w.Code != http.StatusOK || !strings.Contains(audit.String(), `"identity":"anonymous"`) {
+		t.Fatalf("unexpected open access %d %s", w.Code, audit.String())
+	}
+}
+
+func TestSigV4Authenticator(t *testing.T) {
+	authenticator := NewAuthenticator(newTestTokens(t))
+	signer := v4.NewSigner(credentials.NewStaticCredentials("writer", "writer-secret", ""))
+	signer.DisableURIPathEscaping = true
+	newRequest := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPut, "http://localhost:9000/photos/a%20b.txt?partNumber=1&uploadId=x", nil)
+		if _, err := signer.Sign(r, strings.NewReader(body), "s3", "us-east-1", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+		return r
+	}
+
+	identity, err := authenticator.Authenticate(newRequest("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Token.Id != "writer" || identity.Method != MethodSigV4 {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	// 签名不覆盖请求体，读取到末尾时才发现请求体被修改
+	r := newRequest("hello")
+	r.Body = ioutil.NopCloser(strings.NewReader("tampered"))
+	if _, err = authenticator.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(r.Body); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("tampered body should be rejected, got %v", err)
+	}
+
+	r = newRequest("hello")
+	r.URL.RawQuery = "partNumber=2&uploadId=x"
+	if _, err = authenticator.Authenticate(r); errors.Cause(err) != utils.ErrUnauthenticated {
+		t.Fatalf("modified query should be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// hmacScheme HMAC签名请求的Authorization头的前缀
+	hmacScheme = "MYFS-HMAC-SHA256"
+	// HeaderDate HMAC签名请求的签名时间，unix秒
+	HeaderDate = "X-Myfs-Date"
+	// HeaderContentSha256 请求体的sha256，为UnsignedPayload时不校验请求体
+	HeaderContentSha256 = "X-Myfs-Content-Sha256"
+	UnsignedPayload     = "UNSIGNED-PAYLOAD"
+
+	// 预签名url的参数
+	QueryCredential = "X-Myfs-Credential"
+	QueryExpires    = "X-Myfs-Expires"
+	QuerySignature  = "X-Myfs-Signature"
+
+	// maxClockSkew HMAC签名时间与服务器时间允许的最大误差
+	maxClockSkew = 5 * time.Minute
+	// MaxPresignExpiry 预签名url的最长有效期
+	MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// Method 请求的认证方式
+type Method string
+
+const (
+	MethodNone      Method = "none"
+	MethodBearer    Method = "bearer"
+	MethodHMAC      Method = "hmac"
+	MethodPresigned Method = "presigned"
+	MethodSigV4     Method = "sigv4"
+)
+
+// Identity 认证后的请求身份
+type Identity struct {
+	// 没有开启认证时为nil
+	Token  *Token
+	Method Method
+}
+
+// Id 审计日志中记录的身份
+func (i *Identity) Id() string {
+	if i.Token == nil {
+		return "anonymous"
+	}
+	return i.Token.Id
+}
+
+// Allowed 是否拥有对bucket的perm权限，没有开启认证时允许所有操作，预签名url只能读取
+func (i *Identity) Allowed(bucket string, perm Permission) bool {
+	if i.Method == MethodNone {
+		return true
+	}
+	if i.Method == MethodPresigned && perm != PermRead {
+		return false
+	}
+	return i.Token.Allowed(bucket, perm)
+}
+
+// Authenticator 认证请求，请求中没有该方式的凭证时返回utils.ErrNoCredentials，凭证无效时返回utils.ErrUnauthenticated
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain 依次使用每种方式认证，使用第一个找到凭证的方式的结果
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		identity, err := a.Authenticate(r)
+		if errors.Cause(err) == utils.ErrNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errors.Wrap(utils.ErrUnauthenticated, "no credentials")
+}
+
+// NewAuthenticator 支持Bearer token、HMAC签名、预签名url以及S3客户端的SigV4签名
+func NewAuthenticator(tokens *TokenStore) Authenticator {
+	return Chain{&presignAuthenticator{tokens}, &hmacAuthenticator{tokens}, &sigV4Authenticator{tokens}, &bearerAuthenticator{tokens}}
+}
+
+// bearerAuthenticator 请求头为Authorization: Bearer <secret>
+type bearerAuthenticator struct {
+	tokens *TokenStore
+}
+
+func (a *bearerAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, utils.ErrNoCredentials
+	}
+	token, ok := a.tokens.bySecret[hashSecret(strings.TrimPrefix(header, "Bearer "))]
+	if !ok {
+		return nil, errors.Wrap(utils.ErrUnauthenticated, "unknown bearer token")
+	}
+	return &Identity{Token: token, Method: MethodBearer}, nil
+}
+
+// hmacAuthenticator 请求头为Authorization: MYFS-HMAC-SHA256 Credential=<id>, Signature=<hex>
+// 签名的内容见stringToSign，签名时间为X-Myfs-Date
+type hmacAuthenticator struct {
+	tokens *TokenStore
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, hmacScheme+" ") {
+		return nil, utils.ErrNoCredentials
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(header, hmacScheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	token, ok := a.tokens.lookup(fields["Credential"])
+	if !ok {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "unknown credential [%s]", fields["Credential"])
+	}
+	date := r.Header.Get(HeaderDate)
+	signedAt, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "invalid %s", HeaderDate)
+	}
+	if skew := time.Since(time.Unix(signedAt, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "request signed %s ago", skew)
+	}
+	contentHash := r.Header.Get(HeaderContentSha256)
+	if contentHash == "" {
+		contentHash = UnsignedPayload
+	}
+	expected := sign(token.Secret, stringToSign(r.Method, r.URL.Path, r.URL.Query(), date, contentHash))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return nil, errors.Wrap(utils.ErrUnauthenticated, "signature mismatch")
+	}
+	// 签名正确之后才读取请求体，请求体的大小由limits.Limiter在认证之前限制
+	if contentHash != UnsignedPayload {
+		if err = verifyBody(r, contentHash); err != nil {
+			return nil, err
+		}
+	}
+	return &Identity{Token: token, Method: MethodHMAC}, nil
+}
+
+// verifyBody 读取请求体校验sha256，之后重新设置请求体供处理函数读取
+func verifyBody(r *http.Request, contentHash string) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return errors.Wrap(err, "read request body failed")
+		}
+		r.Body.Close()
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != contentHash {
+		return errors.Wrapf(utils.ErrUnauthenticated, "%s mismatch", HeaderContentSha256)
+	}
+	return nil
+}
+
+// presignAuthenticator 预签名url，只能用于GET或HEAD请求，并且只有读取权限
+type presignAuthenticator struct {
+	tokens *TokenStore
+}
+
+func (a *presignAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	query := r.URL.Query()
+	if query.Get(QuerySignature) == "" {
+		return nil, utils.ErrNoCredentials
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "presigned url can not be used for %s", r.Method)
+	}
+	token, ok := a.tokens.lookup(query.Get(QueryCredential))
+	if !ok {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "unknown credential [%s]", query.Get(QueryCredential))
+	}
+	expires, err := strconv.ParseInt(query.Get(QueryExpires), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "invalid %s", QueryExpires)
+	}
+	if time.Now().Unix() > expires {
+		return nil, errors.Wrap(utils.ErrUnauthenticated, "presigned url expired")
+	}
+	expected := sign(token.Secret, stringToSign(http.MethodGet, r.URL.Path, query, query.Get(QueryExpires), UnsignedPayload))
+	if !hmac.Equal([]byte(expected), []byte(query.Get(QuerySignature))) {
+		return nil, errors.Wrap(utils.ErrUnauthenticated, "signature mismatch")
+	}
+	return &Identity{Token: token, Method: MethodPresigned}, nil
+}
+
+// stringToSign 签名的内容，依次为请求方法、路径、排序后的参数(不包括签名)、时间以及请求体的sha256
+func stringToSign(method, path string, query url.Values, timestamp, contentHash string) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if key != QuerySignature {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join([]string{method, path, strings.Join(params, "&"), timestamp, contentHash}, "\n")
+}
+
+func sign(secret, content string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(content))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 使用token对请求进行HMAC签名，body为nil时不签名请求体
+func SignRequest(r *http.Request, token *Token, body []byte) {
+	date := strconv.FormatInt(time.Now().Unix(), 10)
+	contentHash := UnsignedPayload
+	if body != nil {
+		sum := sha256.Sum256(body)
+		contentHash = hex.EncodeToString(sum[:])
+	}
+	r.Header.Set(HeaderDate, date)
+	r.Header.Set(HeaderContentSha256, contentHash)
+	signature := sign(token.Secret, stringToSign(r.Method, r.URL.Path, r.URL.Query(), date, contentHash))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Signature=%s", hmacScheme, token.Id, signature))
+}
+
+// Presign 生成在expiry之后过期的预签名参数，附加到path的GET请求上使用
+func Presign(token *Token, path string, query url.Values, expiry time.Duration) (url.Values, error) {
+	if expiry <= 0 || expiry > MaxPresignExpiry {
+		return nil, errors.Errorf("presign expiry must be between 0 and %s", MaxPresignExpiry)
+	}
+	signed := url.Values{}
+	for key, values := range query {
+		signed[key] = append([]string{}, values...)
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	signed.Set(QueryCredential, token.Id)
+	signed.Set(QueryExpires, expires)
+	signed.Set(QuerySignature, sign(token.Secret, stringToSign(http.MethodGet, path, signed, expires, UnsignedPayload)))
+	return signed, nil
+}
+
+// BearerTransport 为请求添加Bearer token，用于节点之间的请求
+type BearerTransport struct {
+	Secret string
+	Base   http.RoundTripper
+}
+
+func (t *BearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.Secret)
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"my-fs/model"
+	"my-fs/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	identityKey = "auth.identity"
+	auditKey    = "auth.audit"
+)
+
+// anonymous 没有开启认证时所有请求的身份
+var anonymous = &Identity{Method: MethodNone}
+
+// ErrorHandler 认证或授权失败时写入响应，status为401或403
+type ErrorHandler func(ctx *gin.Context, status int, msg string)
+
+func jsonError(ctx *gin.Context, status int, msg string) {
+	ctx.AbortWithStatusJSON(status, model.NewErrorRespWithCode(status, msg))
+}
+
+// Middleware 认证请求并记录审计日志，authenticator为nil时不认证，所有请求都被允许
+// 需要在路由的Require之前执行
+func Middleware(authenticator Authenticator, audit *AuditLog) gin.HandlerFunc {
+	return MiddlewareWithErrorHandler(authenticator, audit, jsonError)
+}
+
+// MiddlewareWithErrorHandler 与Middleware相同，认证失败时由onError写入响应，例如S3网关返回xml格式的错误
+func MiddlewareWithErrorHandler(authenticator Authenticator, audit *AuditLog, onError ErrorHandler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		entry := &AuditEntry{
+			Time:       start,
+			RemoteAddr: ctx.ClientIP(),
+			Method:     ctx.Request.Method,
+			Path:       ctx.Request.URL.Path,
+		}
+		ctx.Set(auditKey, entry)
+		defer func() {
+			entry.Status = ctx.Writer.Status()
+			entry.LatencyMs = time.Since(start).Milliseconds()
+			if audit != nil {
+				if err := audit.Record(entry); err != nil {
+					log.Printf("write audit log failed: %s", err)
+				}
+			}
+		}()
+
+		identity := anonymous
+		if authenticator != nil {
+			var err error
+			if identity, err = authenticator.Authenticate(ctx.Request); err != nil {
+				entry.Identity, entry.Error = "anonymous", err.Error()
+				status := http.StatusUnauthorized
+				// 校验签名时读取的请求体超过限制
+				if errors.Cause(err) == utils.ErrBodyTooLarge {
+					status = http.StatusRequestEntityTooLarge
+				}
+				onError(ctx, status, err.Error())
+				ctx.Abort()
+				return
+			}
+		}
+		entry.Identity, entry.AuthMethod = identity.Id(), identity.Method
+		ctx.Set(identityKey, identity)
+		ctx.Next()
+	}
+}
+
+// IdentityFrom 返回Middleware认证后的身份
+func IdentityFrom(ctx *gin.Context) *Identity {
+	if identity, ok := ctx.Get(identityKey); ok {
+		return identity.(*Identity)
+	}
+	return anonymous
+}
+
+// Authorize 检查请求的身份是否拥有对bucket的perm权限，并记录到审计日志中，没有权限时返回拒绝的原因
+// 用于无法在路由上使用Require的处理函数，例如根据请求内容决定权限的S3网关
+func Authorize(ctx *gin.Context, bucket string, perm Permission) (string, bool) {
+	entry, _ := ctx.Get(auditKey)
+	if entry != nil {
+		entry.(*AuditEntry).Bucket, entry.(*AuditEntry).Permission = bucket, string(perm)
+	}
+	if IdentityFrom(ctx).Allowed(bucket, perm) {
+		return "", true
+	}
+	msg := "permission " + string(perm) + " on bucket " + bucket + " is denied"
+	if entry != nil {
+		entry.(*AuditEntry).Error = msg
+	}
+	return msg, false
+}
+
+// Require 要求请求的身份拥有对bucket的perm权限，bucket返回AllBuckets时要求对所有bucket授权
+func Require(perm Permission, bucket func(*gin.Context) string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if msg, ok := Authorize(ctx, bucket(ctx), perm); !ok {
+			jsonError(ctx, http.StatusForbidden, msg)
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sigV4Scheme S3客户端使用的AWS Signature Version 4
+	sigV4Scheme = "AWS4-HMAC-SHA256"
+	// sigV4DateFormat X-Amz-Date的格式
+	sigV4DateFormat = "20060102T150405Z"
+	// sigV4StreamingPrefix 分块签名的请求体，暂不支持
+	sigV4StreamingPrefix = "STREAMING-"
+)
+
+// sigV4Authenticator S3客户端的签名，access key为token的id，secret key为token的secret
+// 请求头为Authorization: AWS4-HMAC-SHA256 Credential=<id>/<date>/<region>/<service>/aws4_request, SignedHeaders=..., Signature=<hex>
+type sigV4Authenticator struct {
+	tokens *TokenStore
+}
+
+func (a *sigV4Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, sigV4Scheme+" ") {
+		return nil, utils.ErrNoCredentials
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(header, sigV4Scheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	// scope为<id>/<date>/<region>/<service>/aws4_request
+	scope := strings.Split(fields["Credential"], "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "invalid credential [%s]", fields["Credential"])
+	}
+	token, ok := a.tokens.lookup(scope[0])
+	if !ok {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "unknown credential [%s]", scope[0])
+	}
+	date := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse(sigV4DateFormat, date)
+	if err != nil || !strings.HasPrefix(date, scope[1]) {
+		return nil, errors.Wrap(utils.ErrUnauthenticated, "invalid X-Amz-Date")
+	}
+	if skew := time.Since(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "request signed %s ago", skew)
+	}
+	contentHash := r.Header.Get("X-Amz-Content-Sha256")
+	if contentHash == "" {
+		contentHash = UnsignedPayload
+	}
+	if strings.HasPrefix(contentHash, sigV4StreamingPrefix) {
+		return nil, errors.Wrapf(utils.ErrUnauthenticated, "payload signing %s is not supported", contentHash)
+	}
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	canonical := sigV4CanonicalRequest(r, signedHeaders, contentHash)
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{sigV4Scheme, date, strings.Join(scope[1:], "/"), hex.EncodeToString(sum[:])}, "\n")
+
+	key := []byte("AWS4" + token.Secret)
+	for _, part := range scope[1:] {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return nil, errors.Wrap(utils.ErrUnauthenticated, "signature mismatch")
+	}
+	// 签名只覆盖请求体的sha256，读取请求体时再校验，不需要把请求体读入内存
+	if contentHash != UnsignedPayload && r.Body != nil {
+		r.Body = &verifiedBody{ReadCloser: r.Body, digest: sha256.New(), expected: contentHash}
+	}
+	return &Identity{Token: token, Method: MethodSigV4}, nil
+}
+
+// sigV4CanonicalRequest 与aws-sdk的签名方式相同，S3的路径不会再次编码
+func sigV4CanonicalRequest(r *http.Request, signedHeaders []string, contentHash string) string {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.Replace(r.URL.Query().Encode(), "+", "%20", -1)
+
+	sort.Strings(signedHeaders)
+	headers := make([]string, 0, len(signedHeaders))
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			values := r.Header.Values(name)
+			for i := range values {
+				values[i] = strings.Join(strings.Fields(values[i]), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers = append(headers, name+":"+value)
+	}
+	return strings.Join([]string{
+		r.Method, path, query,
+		strings.Join(headers, "\n") + "\n",
+		strings.Join(signedHeaders, ";"),
+		contentHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+// verifiedBody 读取到请求体末尾时校验sha256，不一致时返回utils.ErrUnauthenticated
+type verifiedBody struct {
+	io.ReadCloser
+	digest   hash.Hash
+	expected string
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.digest.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.digest.Sum(nil)) != b.expected {
+		return n, errors.Wrap(utils.ErrUnauthenticated, "X-Amz-Content-Sha256 mismatch")
+	}
+	return n, err
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Permission 对bucket的操作权限
+type Permission string
+
+const (
+	PermRead   Permission = "read"
+	PermWrite  Permission = "write"
+	PermDelete Permission = "delete"
+	// PermAdmin 包含所有的权限，以及修改bucket配置等管理操作
+	PermAdmin Permission = "admin"
+)
+
+// AllBuckets 授权给所有bucket，整个服务的管理操作需要对AllBuckets的PermAdmin权限
+const AllBuckets = "*"
+
+// Grant 对一个bucket授予的权限
+type Grant struct {
+	Bucket      string       `json:"bucket"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Quota token的配额，该token在所有bucket中写入的数据一起计算，0表示不限制
+type Quota struct {
+	MaxBytes   int64 `json:"max_bytes"`
+	MaxObjects int64 `json:"max_objects"`
+	// 每秒写入的字节数
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second"`
+}
+
+// Token API token，Secret用于Bearer认证以及HMAC签名
+type Token struct {
+	Id     string  `json:"id"`
+	Secret string  `json:"secret"`
+	Grants []Grant `json:"grants"`
+	Quota  Quota   `json:"quota"`
+}
+
+// Allowed 是否拥有对bucket的perm权限，bucket为AllBuckets时需要对所有bucket授权
+func (t *Token) Allowed(bucket string, perm Permission) bool {
+	for _, grant := range t.Grants {
+		if grant.Bucket != AllBuckets && grant.Bucket != bucket {
+			continue
+		}
+		for _, p := range grant.Permissions {
+			if p == perm || p == PermAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TokenStore 按id或secret查找token
+type TokenStore struct {
+	byId map[string]*Token
+	// secret的sha256到token，查找时不需要逐个比较secret
+	bySecret map[string]*Token
+}
+
+func NewTokenStore(tokens []*Token) (*TokenStore, error) {
+	s := &TokenStore{byId: make(map[string]*Token), bySecret: make(map[string]*Token)}
+	for _, token := range tokens {
+		if token.Id == "" || token.Secret == "" {
+			return nil, errors.New("token id and secret can not be empty")
+		}
+		if _, ok := s.byId[token.Id]; ok {
+			return nil, errors.Errorf("duplicate token id [%s]", token.Id)
+		}
+		for _, grant := range token.Grants {
+			for _, perm := range grant.Permissions {
+				switch perm {
+				case PermRead, PermWrite, PermDelete, PermAdmin:
+				default:
+					return nil, errors.Errorf("unknown permission [%s] of token [%s]", perm, token.Id)
+				}
+			}
+		}
+		if token.Quota.MaxBytes < 0 || token.Quota.MaxObjects < 0 || token.Quota.MaxBytesPerSecond < 0 {
+			return nil, errors.Errorf("quota of token [%s] can not be negative", token.Id)
+		}
+		s.byId[token.Id] = token
+		s.bySecret[hashSecret(token.Secret)] = token
+	}
+	return s, nil
+}
+
+// LoadTokens 从json文件中读取token列表
+func LoadTokens(tokenFile string) (*TokenStore, error) {
+	content, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read token file [%s] failed", tokenFile)
+	}
+	var tokens []*Token
+	if err = json.Unmarshal(content, &tokens); err != nil {
+		return nil, errors.Wrapf(err, "parse token file [%s] failed", tokenFile)
+	}
+	return NewTokenStore(tokens)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *TokenStore) lookup(id string) (*Token, bool) {
+	token, ok := s.byId[id]
+	return token, ok
+}
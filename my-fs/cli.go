@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"my-fs/config"
+	myfs "my-fs/fs"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// command 一个子命令，args为子命令之后的参数
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":         {"start the http and s3 servers (default)", runServe},
+	"fsck":          {"check that every record decodes and every index points at its record", runFsck},
+	"rebuild-index": {"rebuild all indexes and bucket usage from the data files", runRebuildIndex},
+	"compact":       {"reclaim space used by overwritten and deleted chunks", runCompact},
+	"export":        {"write live chunks into a myfs or tar archive", runExport},
+	"import":        {"load a myfs or tar archive keeping the chunk ids", runImport},
+	"stat":          {"show storage and bucket statistics", runStat},
+	"restore":       {"verify a snapshot and restore it into the empty configured store", runRestore},
+}
+
+// progressInterval 导出与导入时输出进度的间隔
+const progressInterval = time.Second
+
+// errUsage 参数错误，退出码为2
+var errUsage = errors.New("usage error")
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run 执行子命令并返回退出码，没有指定子命令时运行serve
+func run(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		return 0
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command [%s]\n", name)
+		printUsage()
+		return 2
+	}
+	err := cmd.run(args)
+	switch {
+	case err == nil, err == flag.ErrHelp:
+		return 0
+	case err == errUsage:
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		return 1
+	}
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: myfs <command> [-config file] [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nthe config file defaults to $%s, environment variables override it\n", config.EnvConfigPath)
+}
+
+// newFlagSet 创建子命令的参数，所有子命令都支持-config
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.String("config", os.Getenv(config.EnvConfigPath), "path of the YAML config file")
+	return flags
+}
+
+// loadConfig 解析参数并读取配置
+func loadConfig(flags *flag.FlagSet, args []string) (*config.Config, error) {
+	if err := parseFlags(flags, args, 0); err != nil {
+		return nil, err
+	}
+	return config.Load(flags.Lookup("config").Value.String())
+}
+
+// parseFlags 解析参数，要求正好有nargs个位置参数
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) error {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() != nargs {
+		fmt.Fprintf(os.Stderr, "expected %d arguments, got %v\n", nargs, flags.Args())
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func runServe(args []string) error {
+	conf, err := loadConfig(newFlagSet("serve"), args)
+	if err != nil {
+		return err
+	}
+	s, err := newServer(conf)
+	if err != nil {
+		return err
+	}
+	// 收到SIGINT或SIGTERM时优雅退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return s.Start(ctx)
+}
+
+// openOffline 离线命令直接打开存储，服务运行时索引数据库被锁定，无法打开
+func openOffline(conf *config.Config) (*myfs.FileManager, error) {
+	if conf.Cluster.NodeId != "" {
+		return nil, errors.New("offline commands do not support cluster mode, use the admin api of the leader")
+	}
+	opts, err := conf.StoreOptions()
+	if err != nil {
+		return nil, err
+	}
+	fm, err := myfs.NewFileManagerWithOptions(conf.Storage.FileStorePath, conf.Storage.IndexStorePath, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "open store failed, stop the server before running offline commands")
+	}
+	return fm, nil
+}
+
+// runOffline 读取配置并打开存储后执行fn，结束后关闭存储
+func runOffline(flags *flag.FlagSet, args []string, fn func(fm *myfs.FileManager) error) error {
+	conf, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	fm, err := openOffline(conf)
+	if err != nil {
+		return err
+	}
+	err = fn(fm)
+	if closeErr := fm.Close(); closeErr != nil && err == nil {
+		err = errors.Wrap(closeErr, "close store failed")
+	}
+	return err
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func runFsck(args []string) error {
+	return runOffline(newFlagSet("fsck"), args, func(fm *myfs.FileManager) error {
+		report, err := fm.Fsck()
+		if err != nil {
+			return err
+		}
+		if err = printJSON(os.Stdout, report); err != nil {
+			return err
+		}
+		if !report.Healthy() {
+			return errors.Errorf("found %d corrupt records and %d dangling indexes, run rebuild-index to repair the indexes",
+				len(report.CorruptRecords), len(report.DanglingIndexes))
+		}
+		return nil
+	})
+}
+
+func runRebuildIndex(args []string) error {
+	return runOffline(newFlagSet("rebuild-index"), args, func(fm *myfs.FileManager) error {
+		stats, err := fm.RebuildIndex()
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, stats)
+	})
+}
+
+func runCompact(args []string) error {
+	return runOffline(newFlagSet("compact"), args, func(fm *myfs.FileManager) error {
+		stats, err := fm.Compact()
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, stats)
+	})
+}
+
+func runStat(args []string) error {
+	return runOffline(newFlagSet("stat"), args, func(fm *myfs.FileManager) error {
+		stats, err := fm.StorageStats()
+		if err != nil {
+			return err
+		}
+		buckets, err := fm.ListBuckets()
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, map[string]interface{}{
+			"storage":     stats,
+			"buckets":     buckets,
+			"compression": fm.CompressionStats(),
+		})
+	})
+}
+
+// archiveFlags 导出与导入共用的过滤条件与进度参数
+func archiveFlags(flags *flag.FlagSet) func() *myfs.ArchiveOptions {
+	bucket := flags.String("bucket", "", "only include chunks of this bucket")
+	prefix := flags.String("prefix", "", "only include chunks whose id starts with this prefix")
+	progress := flags.Bool("progress", false, "report progress on stderr")
+	return func() *myfs.ArchiveOptions {
+		opts := &myfs.ArchiveOptions{Bucket: *bucket, Prefix: *prefix}
+		if *progress {
+			opts.Progress = progressPrinter(os.Stderr, flags.Name())
+		}
+		return opts
+	}
+}
+
+// progressPrinter 每秒最多输出一次进度
+func progressPrinter(w io.Writer, verb string) func(stats myfs.ArchiveStats) {
+	var last time.Time
+	return func(stats myfs.ArchiveStats) {
+		if now := time.Now(); now.Sub(last) >= progressInterval {
+			last = now
+			fmt.Fprintf(w, "%s: %d chunks, %d bytes\n", verb, stats.Chunks, stats.Bytes)
+		}
+	}
+}
+
+// runExport 归档写入-o指定的文件，为-时写入标准输出，此时统计信息输出到标准错误
+func runExport(args []string) error {
+	flags := newFlagSet("export")
+	output := flags.String("o", "-", "archive file to write, - for stdout")
+	format := flags.String("format", myfs.ArchiveFormatNative, "archive format, myfs or tar")
+	archiveOptions := archiveFlags(flags)
+	return runOffline(flags, args, func(fm *myfs.FileManager) error {
+		opts := archiveOptions()
+		opts.Format = *format
+		if err := myfs.CheckArchiveFormat(opts.Format); err != nil {
+			return err
+		}
+		if *output == "-" {
+			stats, err := fm.ExportWithOptions(os.Stdout, opts)
+			if err != nil {
+				return err
+			}
+			return printJSON(os.Stderr, stats)
+		}
+		file, err := os.Create(*output)
+		if err != nil {
+			return errors.Wrap(err, "create archive failed")
+		}
+		defer file.Close()
+		stats, err := fm.ExportWithOptions(file, opts)
+		if err != nil {
+			return err
+		}
+		if err = file.Sync(); err != nil {
+			return errors.Wrap(err, "sync archive failed")
+		}
+		return printJSON(os.Stdout, stats)
+	})
+}
+
+// runImport 读取-i指定的归档，为-时从标准输入读取，格式根据文件头识别
+func runImport(args []string) error {
+	flags := newFlagSet("import")
+	input := flags.String("i", "-", "archive file to read, - for stdin")
+	archiveOptions := archiveFlags(flags)
+	return runOffline(flags, args, func(fm *myfs.FileManager) error {
+		r := io.Reader(os.Stdin)
+		if *input != "-" {
+			file, err := os.Open(*input)
+			if err != nil {
+				return errors.Wrap(err, "open archive failed")
+			}
+			defer file.Close()
+			r = file
+		}
+		stats, err := fm.ImportWithOptions(r, archiveOptions())
+		if err != nil && stats != nil {
+			return errors.Wrapf(err, "import stopped after %d chunks", stats.Chunks)
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, stats)
+	})
+}
+
+// runRestore 校验快照并恢复到配置的数据目录与索引目录，两个目录都必须为空，-verify时只校验快照
+func runRestore(args []string) error {
+	flags := newFlagSet("restore")
+	verifyOnly := flags.Bool("verify", false, "only verify the checksums of the snapshot")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	dir := flags.Arg(0)
+	if *verifyOnly {
+		manifest, err := myfs.VerifySnapshot(dir)
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, manifest)
+	}
+	conf, err := config.Load(flags.Lookup("config").Value.String())
+	if err != nil {
+		return err
+	}
+	if conf.Cluster.NodeId != "" || len(conf.Storage.Erasure.ShardDirs) > 1 {
+		return errors.New("snapshots can only be restored into a single node store without erasure coding")
+	}
+	opts, err := conf.StoreOptions()
+	if err != nil {
+		return err
+	}
+	stats, err := myfs.RestoreSnapshot(dir, conf.Storage.FileStorePath, conf.Storage.IndexStorePath, opts)
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, stats)
+}
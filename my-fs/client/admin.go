@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Bucket bucket的配置以及用量，与服务端的fs.Bucket一致
+type Bucket struct {
+	Name  string
+	Quota struct {
+		// 0表示不限制
+		MaxBytes          int64
+		MaxObjects        int64
+		MaxBytesPerSecond int64
+	}
+	UsedBytes   int64
+	ObjectCount int64
+	// 创建时间，unix时间戳
+	CreatedAt  int64
+	Versioning bool
+}
+
+// StorageStats 数据文件中有效与可回收的空间
+type StorageStats struct {
+	Segments       int   `json:"segments"`
+	LiveBytes      int64 `json:"live_bytes"`
+	DeadBytes      int64 `json:"dead_bytes"`
+	LiveRecords    int   `json:"live_records"`
+	DeadRecords    int   `json:"dead_records"`
+	IndexEntries   int64 `json:"index_entries"`
+	VersionEntries int64 `json:"version_entries"`
+	Checkpoint     struct {
+		FileSeq int `json:"file_seq"`
+		Offset  int `json:"offset"`
+	} `json:"checkpoint"`
+}
+
+// TokenUsage 一个token写入的数据量
+type TokenUsage struct {
+	Token       string `json:"token"`
+	UsedBytes   int64  `json:"used_bytes"`
+	ObjectCount int64  `json:"object_count"`
+}
+
+// CompactionStats 一次压缩的结果
+type CompactionStats struct {
+	Segments       int   `json:"segments"`
+	LiveRecords    int   `json:"live_records"`
+	DroppedRecords int   `json:"dropped_records"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+}
+
+// FsckReport 一致性检查的结果
+type FsckReport struct {
+	Healthy  bool `json:"healthy"`
+	Segments int  `json:"segments"`
+	Records  int  `json:"records"`
+	// 无法读取或解码的记录，格式为<文件名>@<偏移量>
+	CorruptRecords []string `json:"corrupt_records"`
+	Indexes        int      `json:"indexes"`
+	// 指向的记录不存在或者与记录不一致的索引，格式为<bucket>/<id>[@<版本号>]
+	DanglingIndexes []string `json:"dangling_indexes"`
+}
+
+// ArchiveStats 导出或导入的统计信息
+type ArchiveStats struct {
+	Buckets int
+	Chunks  int
+	Bytes   int64
+	// 导入时被过滤条件跳过的chunk数量
+	Skipped int `json:",omitempty"`
+}
+
+// 归档格式，导入时服务端根据文件头自动识别
+const (
+	ArchiveFormatNative = "myfs"
+	ArchiveFormatTar    = "tar"
+)
+
+// ArchiveOptions 导出与导入的选项
+type ArchiveOptions struct {
+	// 导出的归档格式，为空时使用ArchiveFormatNative，导入时忽略
+	Format string
+	// 只包含该bucket中的chunk，为空时包含所有bucket
+	Bucket string
+	// 只包含id以Prefix开头的chunk
+	Prefix string
+}
+
+func (opts *ArchiveOptions) query() url.Values {
+	query := url.Values{}
+	if opts == nil {
+		return query
+	}
+	for name, value := range map[string]string{"format": opts.Format, "bucket": opts.Bucket, "prefix": opts.Prefix} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	return query
+}
+
+// Snapshot 服务端生成的快照，与fs.SnapshotManifest一致
+type Snapshot struct {
+	Id string
+	// 增量快照所基于的快照id，为空表示全量快照
+	Parent string
+	// 创建时间，unix纳秒
+	CreatedAt int64
+	FileSeq   int
+	Offset    int
+	Segments  []struct {
+		Seq    int
+		Size   int64
+		SHA256 string
+		// 保存该文件的快照id
+		Snapshot string
+	}
+	IndexEntries int
+	IndexSHA256  string
+	CopiedBytes  int64
+}
+
+// SegmentLocation 数据文件所在的位置，与fs.SegmentLocation一致
+type SegmentLocation struct {
+	Seq  int
+	Size int64
+	// local或者remote
+	Tier string
+	// 冷存储中的文件是否已经缓存在服务端本地
+	Cached bool
+	// 移到冷存储的时间，unix纳秒
+	TieredAt int64
+}
+
+// TierStats 一次分层移动的统计
+type TierStats struct {
+	Segments int   `json:"segments"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// ListBuckets 列出token有读取权限的bucket
+func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	var buckets []*Bucket
+	if _, err := c.call(ctx, &request{method: http.MethodGet, path: "/buckets", replayable: true}, &buckets); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// StorageStats 统计存储空间，需要读取所有的数据文件，需要admin权限
+func (c *Client) StorageStats(ctx context.Context) (*StorageStats, error) {
+	stats := new(StorageStats)
+	if _, err := c.call(ctx, &request{method: http.MethodGet, path: "/admin/stats", replayable: true}, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// TokenUsage 列出每个token写入的数据量，需要admin权限
+func (c *Client) TokenUsage(ctx context.Context) ([]*TokenUsage, error) {
+	var usages []*TokenUsage
+	if _, err := c.call(ctx, &request{method: http.MethodGet, path: "/admin/usage", replayable: true}, &usages); err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// Compact 压缩已经写满的数据文件，重复执行是安全的，需要admin权限
+func (c *Client) Compact(ctx context.Context) (*CompactionStats, error) {
+	stats := new(CompactionStats)
+	if _, err := c.call(ctx, &request{method: http.MethodPost, path: "/admin/compact", replayable: true}, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Fsck 检查所有记录与索引，不会修改数据，需要admin权限
+func (c *Client) Fsck(ctx context.Context) (*FsckReport, error) {
+	report := new(FsckReport)
+	if _, err := c.call(ctx, &request{method: http.MethodPost, path: "/admin/fsck", replayable: true}, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// SegmentLocations 列出每个数据文件保存在本地还是冷存储，需要admin权限
+func (c *Client) SegmentLocations(ctx context.Context) ([]*SegmentLocation, error) {
+	var locations []*SegmentLocation
+	if _, err := c.call(ctx, &request{method: http.MethodGet, path: "/admin/segments", replayable: true}, &locations); err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// Tier 立即将满足条件的数据文件移到冷存储，重复执行是安全的，需要admin权限
+func (c *Client) Tier(ctx context.Context) (*TierStats, error) {
+	stats := new(TierStats)
+	if _, err := c.call(ctx, &request{method: http.MethodPost, path: "/admin/tier", replayable: true}, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CreateSnapshot 在服务端配置的目录中生成快照，since不为空时生成基于该快照的增量快照，需要admin权限
+func (c *Client) CreateSnapshot(ctx context.Context, since string) (*Snapshot, error) {
+	query := url.Values{}
+	if since != "" {
+		query.Set("since", since)
+	}
+	snapshot := new(Snapshot)
+	// 快照不会修改数据，失败后重试是安全的
+	if _, err := c.call(ctx, &request{method: http.MethodPost, path: "/admin/snapshots", query: query, replayable: true}, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// ListSnapshots 列出服务端已经完成的快照，按创建时间排序，需要admin权限
+func (c *Client) ListSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	var snapshots []*Snapshot
+	if _, err := c.call(ctx, &request{method: http.MethodGet, path: "/admin/snapshots", replayable: true}, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// Export 将服务端满足过滤条件的chunk导出为归档写入w，opts为nil时导出所有chunk，需要admin权限
+// 数据开始写入w之后出错不会重试，w中的归档是不完整的
+func (c *Client) Export(ctx context.Context, w io.Writer, opts *ArchiveOptions) (*ArchiveStats, error) {
+	resp, err := c.do(ctx, &request{method: http.MethodGet, path: "/admin/export", query: opts.query(), replayable: true})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return nil, errors.Wrap(err, "download archive failed")
+	}
+	// 读取完响应体之后trailer才可用
+	if message := resp.Trailer.Get("X-Export-Error"); message != "" {
+		return nil, &Error{StatusCode: http.StatusInternalServerError, Message: message}
+	}
+	chunks, err := strconv.Atoi(resp.Trailer.Get("X-Export-Chunks"))
+	if err != nil {
+		return nil, errors.New("archive is truncated, the server did not report export stats")
+	}
+	stats := &ArchiveStats{Chunks: chunks}
+	stats.Buckets, _ = strconv.Atoi(resp.Trailer.Get("X-Export-Buckets"))
+	stats.Bytes, _ = strconv.ParseInt(resp.Trailer.Get("X-Export-Bytes"), 10, 64)
+	return stats, nil
+}
+
+// Import 将Export生成的归档或tar中满足过滤条件的chunk导入服务端，已经存在的id会被覆盖，需要admin权限
+// r实现了io.Seeker时失败后可以重试，否则只发送一次
+func (c *Client) Import(ctx context.Context, r io.Reader, opts *ArchiveOptions) (*ArchiveStats, error) {
+	body, replayable := readerBody(r)
+	stats := new(ArchiveStats)
+	if _, err := c.call(ctx, &request{
+		method:     http.MethodPost,
+		path:       "/admin/import",
+		query:      opts.query(),
+		header:     http.Header{"Content-Type": {"application/octet-stream"}},
+		body:       body,
+		replayable: replayable,
+	}, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 2 * time.Second
+	// 每个节点保持的空闲连接数量
+	defaultMaxIdleConns = 32
+)
+
+// Options Client的可选配置，零值表示使用默认值
+type Options struct {
+	// 为nil时使用带连接池的默认client
+	HTTPClient *http.Client
+	// 不为空时使用Bearer token认证
+	Token string
+	// 请求失败后的最大重试次数，负数表示不重试
+	MaxRetries int
+	// 第一次重试前等待的时间，之后每次翻倍，最多为MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (o *Options) withDefaults() *Options {
+	opts := Options{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.HTTPClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = defaultMaxIdleConns
+		opts.HTTPClient = &http.Client{Transport: transport}
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	return &opts
+}
+
+// Client my-fs http接口的客户端，可以被多个goroutine同时使用
+type Client struct {
+	endpoint *url.URL
+	opts     *Options
+}
+
+// New 创建访问endpoint的客户端，例如http://127.0.0.1:8080
+func New(endpoint string, opts *Options) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse endpoint [%s] failed", endpoint)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("endpoint [%s] should start with http:// or https://", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Client{endpoint: u, opts: opts.withDefaults()}, nil
+}
+
+// request 一次api调用，重试时会重新发送
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	// 返回请求体，每次发送前调用，为nil表示没有请求体
+	body func() (io.Reader, error)
+	// 请求体无法重新读取时为false，只发送一次
+	replayable bool
+}
+
+// response 服务端返回的JSON，与model.Response一致
+type response struct {
+	Code int             `json:"code"`
+	Data json.RawMessage `json:"data"`
+	Err  string          `json:"err"`
+}
+
+// do 发送请求，网络错误以及429、502、503、504会在退避之后重试，返回的响应状态码为2xx
+func (c *Client) do(ctx context.Context, req *request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req)
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+		retry := req.replayable && attempt < c.opts.MaxRetries && ctx.Err() == nil
+		if err == nil {
+			retry = retry && retryableStatus(resp.StatusCode)
+			apiErr := decodeError(resp)
+			if !retry {
+				return nil, apiErr
+			}
+			err = apiErr
+		}
+		if !retry {
+			return nil, err
+		}
+		if waitErr := c.backoff(ctx, attempt, resp); waitErr != nil {
+			return nil, errors.Wrapf(waitErr, "give up retrying after [%s]", err)
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req *request) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+	var body io.Reader
+	if req.body != nil {
+		var err error
+		if body, err = req.body(); err != nil {
+			return nil, err
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "build request failed")
+	}
+	for key, values := range req.header {
+		httpReq.Header[key] = values
+	}
+	if c.opts.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	resp, err := c.opts.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed", req.method, req.path)
+	}
+	return resp, nil
+}
+
+// backoff 等待下一次重试，服务端给出Retry-After时至少等待该时间，ctx被取消时返回错误
+func (c *Client) backoff(ctx context.Context, attempt int, resp *http.Response) error {
+	d := c.opts.MinBackoff << uint(attempt)
+	if d <= 0 || d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+	// 随机抖动，避免多个客户端同时重试
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > d {
+			d = time.Duration(seconds) * time.Second
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// decodeError 读取并关闭错误响应，响应体中的code优先于http状态码
+func decodeError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return apiErr
+	}
+	parsed := new(response)
+	if json.Unmarshal(body, parsed) == nil && parsed.Err != "" {
+		apiErr.Message = parsed.Err
+		if parsed.Code != 0 {
+			apiErr.StatusCode = parsed.Code
+		}
+	} else if text := strings.TrimSpace(string(body)); text != "" {
+		apiErr.Message = text
+	}
+	return apiErr
+}
+
+// call 发送请求并将响应中的data解码到out，out为nil时忽略data
+func (c *Client) call(ctx context.Context, req *request, out interface{}) (*http.Response, error) {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	parsed := new(response)
+	if err = json.NewDecoder(resp.Body).Decode(parsed); err != nil {
+		return nil, errors.Wrap(err, "decode response failed")
+	}
+	// 部分参数错误以200返回，错误码在响应体中
+	if parsed.Code != http.StatusOK {
+		return nil, &Error{StatusCode: parsed.Code, Message: parsed.Err}
+	}
+	if out != nil {
+		if err = json.Unmarshal(parsed.Data, out); err != nil {
+			return nil, errors.Wrap(err, "decode response data failed")
+		}
+	}
+	return resp, nil
+}
+
+// bytesBody 可以重复发送的请求体
+func bytesBody(data []byte) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		return bytes.NewReader(data), nil
+	}
+}
+
+// readerBody 以r作为请求体，r可以seek时每次发送前回到开始的位置，可以重试，否则只发送一次
+func readerBody(r io.Reader) (func() (io.Reader, error), bool) {
+	// 管道等文件实现了io.Seeker但无法seek
+	if seeker, ok := r.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return func() (io.Reader, error) {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, errors.Wrap(err, "rewind request body failed")
+				}
+				return r, nil
+			}, true
+		}
+	}
+	sent := false
+	return func() (io.Reader, error) {
+		if sent {
+			return nil, errors.New("request body can not be replayed")
+		}
+		sent = true
+		return r, nil
+	}, false
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"my-fs/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts *Options) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.MinBackoff = time.Millisecond
+	opts.MaxBackoff = 5 * time.Millisecond
+	c, err := New(server.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient_RetrySameIdempotencyKey(t *testing.T) {
+	var attempts int32
+	keys := make(chan string, 10)
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "hello" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"code":503,"err":"store is not ready"}`))
+			return
+		}
+		w.Write([]byte(`{"code":200,"data":{"BlockId":"a","Bucket":"default","Size":5}}`))
+	}, nil)
+
+	object, err := c.PutObject(context.Background(), strings.NewReader("hello"), &PutOptions{Key: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Id != "a" || object.Size != 5 || atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("unexpected object %+v after %d attempts", object, attempts)
+	}
+	close(keys)
+	first := <-keys
+	for key := range keys {
+		if first == "" || key != first {
+			t.Fatalf("idempotency key changed between retries: %q != %q", key, first)
+		}
+	}
+}
+
+func TestClient_NoRetry(t *testing.T) {
+	var attempts int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"code":503,"err":"store is not ready"}`))
+	}, nil)
+
+	// 不能seek的请求体只发送一次
+	body := ioutil.NopCloser(strings.NewReader("hello"))
+	_, err := c.PutObject(context.Background(), body, &PutOptions{Key: "a"})
+	if !errors.Is(err, utils.ErrNotReady) || atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("expected one failed attempt, got %v after %d attempts", err, attempts)
+	}
+
+	// 404不会重试
+	atomic.StoreInt32(&attempts, 0)
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":404,"err":"index not found"}`))
+	}, nil)
+	if _, err = c.Get(context.Background(), "a", nil); !errors.Is(err, utils.ErrIndexNotFound) || atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("expected one not found attempt, got %v after %d attempts", err, attempts)
+	}
+	if errors.Is(err, utils.ErrBucketNotFound) {
+		t.Fatal("index not found should not match bucket not found")
+	}
+}
+
+func TestClient_ContextCancel(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Stat(ctx, "a", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("backoff ignored the context")
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stat":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":401,"err":"unauthenticated"}`))
+		case "/delete":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":403,"err":"permission delete on bucket default is denied"}`))
+		default:
+			// 参数错误以200返回
+			w.Write([]byte(`{"code":400,"err":"chunk id can not be empty"}`))
+		}
+	}, &Options{Token: "secret"})
+
+	if _, err := c.Stat(context.Background(), "a", nil); !errors.Is(err, utils.ErrUnauthenticated) {
+		t.Fatalf("expected unauthenticated, got %v", err)
+	}
+	if err := c.Delete(context.Background(), "a", nil); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	_, err := c.List(context.Background(), "", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+	if _, err = New("127.0.0.1:8080", nil); err == nil {
+		t.Fatal("endpoint without scheme should be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"fmt"
+	"my-fs/utils"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPermissionDenied token没有访问该bucket的权限
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Error 服务端返回的错误，可以通过errors.Is与utils中对应的错误比较，例如
+// errors.Is(err, utils.ErrIndexNotFound)
+type Error struct {
+	// http状态码，服务端在响应体中给出的状态码优先
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("myfs: %d %s", e.StatusCode, e.Message)
+}
+
+// serverErrors 服务端返回的错误与状态码的对应关系，与main.go中的errorCode一致
+var serverErrors = map[error]int{
+	utils.ErrIndexNotFound:        http.StatusNotFound,
+	utils.ErrBucketNotFound:       http.StatusNotFound,
+	utils.ErrBucketExists:         http.StatusConflict,
+	utils.ErrBucketNotEmpty:       http.StatusConflict,
+	utils.ErrKeyExists:            http.StatusConflict,
+	utils.ErrIdempotencyConflict:  http.StatusUnprocessableEntity,
+	utils.ErrPreconditionFailed:   http.StatusPreconditionFailed,
+	utils.ErrQuotaExceeded:        http.StatusInsufficientStorage,
+	utils.ErrRateLimited:          http.StatusTooManyRequests,
+	utils.ErrTooManyRequests:      http.StatusTooManyRequests,
+	utils.ErrBodyTooLarge:         http.StatusRequestEntityTooLarge,
+	utils.ErrDecryptionFailed:     http.StatusInternalServerError,
+	utils.ErrEncryptionKeyMissing: http.StatusInternalServerError,
+	utils.ErrShardsUnavailable:    http.StatusInternalServerError,
+	utils.ErrReadOnly:             http.StatusServiceUnavailable,
+	utils.ErrNotReady:             http.StatusServiceUnavailable,
+	utils.ErrClosed:               http.StatusServiceUnavailable,
+	utils.ErrShuttingDown:         http.StatusServiceUnavailable,
+	utils.ErrNotLeader:            http.StatusMisdirectedRequest,
+	utils.ErrInvalidBucketName:    http.StatusBadRequest,
+	utils.ErrInvalidArchive:       http.StatusBadRequest,
+}
+
+// Is 状态码一致并且错误信息包含target时认为是同一个错误，所有的401都是utils.ErrUnauthenticated
+func (e *Error) Is(target error) bool {
+	switch target {
+	case utils.ErrUnauthenticated:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrPermissionDenied:
+		return e.StatusCode == http.StatusForbidden
+	}
+	code, ok := serverErrors[target]
+	return ok && code == e.StatusCode && strings.Contains(e.Message, target.Error())
+}
+
+// retryableStatus 服务端暂时无法处理请求，稍后重试可能成功
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// DefaultBucket 未指定bucket时使用的bucket，与服务端一致
+const DefaultBucket = "default"
+
+// Object chunk的元数据，与服务端的BlockIndex一致
+type Object struct {
+	Id     string `json:"BlockId"`
+	Bucket string
+	Size   int64
+	// 数据的md5，十六进制编码
+	ETag string
+	// 写入时间，unix纳秒
+	ModTime      int64
+	VersionId    string
+	DeleteMarker bool
+	// 过期时间，unix纳秒，为0表示不过期
+	ExpiresAt int64
+}
+
+// OverwriteMode key已经存在时的写入行为
+type OverwriteMode string
+
+const (
+	// OverwriteReplace 覆盖已有的chunk
+	OverwriteReplace OverwriteMode = "replace"
+	// OverwriteFail key已经存在时返回utils.ErrKeyExists
+	OverwriteFail OverwriteMode = "fail"
+	// OverwriteIfMatch 已有chunk的ETag等于IfMatch时才覆盖，否则返回utils.ErrPreconditionFailed
+	OverwriteIfMatch OverwriteMode = "ifmatch"
+)
+
+// PutOptions 写入的可选参数
+type PutOptions struct {
+	// 为空时使用DefaultBucket
+	Bucket string
+	// 为空时生成uuid作为id，此时key一定不存在
+	Key string
+	// 为空时覆盖已有的chunk
+	Overwrite OverwriteMode
+	IfMatch   string
+	// 重试时携带相同的幂等key，服务端不会重复写入，为空时每次调用生成一个新的幂等key
+	IdempotencyKey string
+	// 存活时间，大于0时chunk在写入TTL之后过期
+	TTL time.Duration
+}
+
+// GetOptions 读取的可选参数
+type GetOptions struct {
+	Bucket string
+	// 为空时读取最新的版本
+	VersionId string
+}
+
+// DeleteOptions 删除的可选参数
+type DeleteOptions struct {
+	Bucket string
+	// 不为空时永久删除该版本
+	VersionId string
+}
+
+// ListOptions 列出chunk的过滤条件
+type ListOptions struct {
+	Prefix     string
+	StartAfter string
+	// 0表示不限制
+	Limit int
+}
+
+func bucketOrDefault(bucket string) string {
+	if bucket == "" {
+		return DefaultBucket
+	}
+	return bucket
+}
+
+// objectPath 返回未转义的路径，发送时由url.URL转义，key中的/保持不变
+func objectPath(bucket, id string) string {
+	return "/objects/" + bucketOrDefault(bucket) + "/" + id
+}
+
+// Put 写入data，返回写入后的元数据
+func (c *Client) Put(ctx context.Context, data []byte, opts *PutOptions) (*Object, error) {
+	return c.put(ctx, bytesBody(data), true, opts)
+}
+
+// PutObject 以流的方式上传r中的数据，r实现了io.Seeker时失败后可以重试，否则只发送一次
+func (c *Client) PutObject(ctx context.Context, r io.Reader, opts *PutOptions) (*Object, error) {
+	body, replayable := readerBody(r)
+	return c.put(ctx, body, replayable, opts)
+}
+
+func (c *Client) put(ctx context.Context, body func() (io.Reader, error), replayable bool, opts *PutOptions) (*Object, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	key := opts.Key
+	overwrite := opts.Overwrite
+	if key == "" {
+		key = uuid.New().String()
+		overwrite = OverwriteFail
+	}
+	idempotencyKey := opts.IdempotencyKey
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.New().String()
+	}
+	query := url.Values{}
+	if overwrite != "" {
+		query.Set("overwrite", string(overwrite))
+	}
+	if opts.TTL > 0 {
+		query.Set("ttl", opts.TTL.String())
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Idempotency-Key", idempotencyKey)
+	if opts.IfMatch != "" {
+		header.Set("If-Match", opts.IfMatch)
+	}
+
+	object := new(Object)
+	if _, err := c.call(ctx, &request{
+		method:     http.MethodPut,
+		path:       objectPath(opts.Bucket, key),
+		query:      query,
+		header:     header,
+		body:       body,
+		replayable: replayable,
+	}, object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// Get 读取chunk的全部数据
+func (c *Client) Get(ctx context.Context, id string, opts *GetOptions) ([]byte, error) {
+	body, _, err := c.GetObject(ctx, id, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read chunk [%s] failed", id)
+	}
+	return data, nil
+}
+
+// GetObject 以流的方式下载chunk，返回数据以及ETag，调用方需要关闭返回的数据
+// 开始读取数据之后出错不会重试
+func (c *Client) GetObject(ctx context.Context, id string, opts *GetOptions) (io.ReadCloser, string, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	query := url.Values{}
+	if opts.VersionId != "" {
+		query.Set("version_id", opts.VersionId)
+	}
+	resp, err := c.do(ctx, &request{
+		method:     http.MethodGet,
+		path:       objectPath(opts.Bucket, id),
+		query:      query,
+		replayable: true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("ETag"), nil
+}
+
+// Stat 获取chunk的元数据，不读取数据
+func (c *Client) Stat(ctx context.Context, id string, opts *GetOptions) (*Object, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	query := url.Values{"chunkid": {id}, "bucket": {bucketOrDefault(opts.Bucket)}}
+	if opts.VersionId != "" {
+		query.Set("version_id", opts.VersionId)
+	}
+	object := new(Object)
+	if _, err := c.call(ctx, &request{
+		method:     http.MethodGet,
+		path:       "/stat",
+		query:      query,
+		replayable: true,
+	}, object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// Delete 删除chunk，开启版本控制的bucket中只写入删除标记，指定VersionId时永久删除该版本
+func (c *Client) Delete(ctx context.Context, id string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	query := url.Values{"chunkid": {id}, "bucket": {bucketOrDefault(opts.Bucket)}}
+	if opts.VersionId != "" {
+		query.Set("version_id", opts.VersionId)
+	}
+	// 重复删除同一个版本是安全的，重试时可能返回utils.ErrIndexNotFound
+	_, err := c.call(ctx, &request{
+		method:     http.MethodDelete,
+		path:       "/delete",
+		query:      query,
+		replayable: true,
+	}, nil)
+	return err
+}
+
+// List 列出bucket中的chunk，按id的字典序排序
+func (c *Client) List(ctx context.Context, bucket string, opts *ListOptions) ([]*Object, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.StartAfter != "" {
+		query.Set("start_after", opts.StartAfter)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var objects []*Object
+	if _, err := c.call(ctx, &request{
+		method:     http.MethodGet,
+		path:       "/buckets/" + bucketOrDefault(bucket) + "/chunks",
+		query:      query,
+		replayable: true,
+	}, &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"my-fs/auth"
+	"my-fs/client"
+	"my-fs/config"
+	"my-fs/model"
+	"my-fs/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// newTestServer 在进程内启动完整的服务，tokens不为空时开启认证
+func newTestServer(t *testing.T, tokens string) string {
+	return newTestServerWithConfig(t, tokens, nil)
+}
+
+// newTestServerWithConfig 与newTestServer相同，启动之前由configure修改配置
+func newTestServerWithConfig(t *testing.T, tokens string, configure func(conf *config.Config)) string {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	conf := config.Default()
+	conf.Storage.FileStorePath = filepath.Join(dir, "data")
+	conf.Storage.IndexStorePath = filepath.Join(dir, "index")
+	conf.Auth.AuditLog = filepath.Join(dir, "audit.log")
+	if tokens != "" {
+		conf.Auth.TokensFile = filepath.Join(dir, "tokens.json")
+		if err := ioutil.WriteFile(conf.Auth.TokensFile, []byte(tokens), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if configure != nil {
+		configure(conf)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.registerRoutes()
+	if err = s.recoverStore(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.engine)
+	t.Cleanup(func() {
+		server.Close()
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return server.URL
+}
+
+func TestClient_Integration(t *testing.T) {
+	c, err := client.New(newTestServer(t, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// 二进制数据以及包含/的key
+	data := []byte{0, 1, 2, 0xff, '\n', 0}
+	object, err := c.Put(ctx, data, &client.PutOptions{Key: "dir/a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Id != "dir/a.bin" || object.Bucket != client.DefaultBucket || object.Size != int64(len(data)) {
+		t.Fatalf("unexpected object %+v", object)
+	}
+	got, err := c.Get(ctx, "dir/a.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %v, got %v", data, got)
+	}
+	stat, err := c.Stat(ctx, "dir/a.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.ETag != object.ETag {
+		t.Fatalf("expected etag %s, got %s", object.ETag, stat.ETag)
+	}
+
+	// 设置存活时间的chunk返回过期时间
+	temporary, err := c.Put(ctx, []byte("preview"), &client.PutOptions{Key: "preview", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if temporary.ExpiresAt <= temporary.ModTime {
+		t.Fatalf("unexpected expiry of %+v", temporary)
+	}
+
+	// 流式上传与下载
+	large := bytes.Repeat([]byte("0123456789"), 100000)
+	if _, err = c.PutObject(ctx, bytes.NewReader(large), &client.PutOptions{Key: "large"}); err != nil {
+		t.Fatal(err)
+	}
+	body, etag, err := c.GetObject(ctx, "large", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, large) || etag == "" {
+		t.Fatalf("streamed download mismatch, err %v", err)
+	}
+
+	// 同一个幂等key只能用于重试相同的请求
+	retried, err := c.Put(ctx, []byte("first"), &client.PutOptions{Key: "idempotent", IdempotencyKey: "upload-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.Put(ctx, []byte("first"), &client.PutOptions{Key: "idempotent", IdempotencyKey: "upload-1"}); err != nil || again.Id != retried.Id {
+		t.Fatalf("retry should return %s, got %+v, %v", retried.Id, again, err)
+	}
+	_, err = c.Put(ctx, []byte("second"), &client.PutOptions{Key: "idempotent", IdempotencyKey: "upload-1"})
+	var conflict *client.Error
+	if !errors.Is(err, utils.ErrIdempotencyConflict) || !errors.As(err, &conflict) || conflict.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expect 422 for a reused idempotency key, got %v", err)
+	}
+	if err = c.Delete(ctx, "idempotent", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未指定key时生成id
+	generated, err := c.Put(ctx, []byte("anonymous"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Id == "" {
+		t.Fatal("expected a generated id")
+	}
+
+	// 相同的幂等key只写入一次
+	opts := &client.PutOptions{Key: "once", Overwrite: client.OverwriteFail, IdempotencyKey: "retry-1"}
+	first, err := c.Put(ctx, []byte("v1"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.Put(ctx, []byte("v1"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ModTime != first.ModTime {
+		t.Fatal("idempotent retry wrote the chunk twice")
+	}
+	if _, err = c.Put(ctx, []byte("v2"), &client.PutOptions{Key: "once", Overwrite: client.OverwriteFail}); !errors.Is(err, utils.ErrKeyExists) {
+		t.Fatalf("expected key exists, got %v", err)
+	}
+	if _, err = c.Put(ctx, []byte("v2"), &client.PutOptions{Key: "once", IfMatch: "stale"}); !errors.Is(err, utils.ErrPreconditionFailed) {
+		t.Fatalf("expected precondition failed, got %v", err)
+	}
+
+	objects, err := c.List(ctx, "", &client.ListOptions{Prefix: "dir/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Id != "dir/a.bin" {
+		t.Fatalf("unexpected list %+v", objects)
+	}
+
+	if err = c.Delete(ctx, "dir/a.bin", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get(ctx, "dir/a.bin", nil); !errors.Is(err, utils.ErrIndexNotFound) {
+		t.Fatalf("expected index not found, got %v", err)
+	}
+	if _, err = c.Stat(ctx, "dir/a.bin", nil); !errors.Is(err, utils.ErrIndexNotFound) {
+		t.Fatalf("expected index not found, got %v", err)
+	}
+	if _, err = c.List(ctx, "missing", nil); !errors.Is(err, utils.ErrBucketNotFound) {
+		t.Fatalf("expected bucket not found, got %v", err)
+	}
+
+	// 导出后导入到另一个服务
+	archive := new(bytes.Buffer)
+	exported, err := c.Export(ctx, archive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Chunks != 4 {
+		t.Fatalf("unexpected export stats %+v", exported)
+	}
+	other, err := client.New(newTestServer(t, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := other.Import(ctx, bytes.NewReader(archive.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Chunks != exported.Chunks || imported.Bytes != exported.Bytes {
+		t.Fatalf("imported %+v, exported %+v", imported, exported)
+	}
+	if got, err = other.Get(ctx, "large", nil); err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("imported chunk mismatch, err %v", err)
+	}
+	if _, err = other.Import(ctx, strings.NewReader("garbage"), nil); !errors.Is(err, utils.ErrInvalidArchive) {
+		t.Fatalf("expected invalid archive, got %v", err)
+	}
+
+	// 按前缀导出为tar，导入时只保留部分chunk
+	archive.Reset()
+	if exported, err = c.Export(ctx, archive, &client.ArchiveOptions{Format: client.ArchiveFormatTar, Prefix: "l"}); err != nil {
+		t.Fatal(err)
+	}
+	if exported.Chunks != 1 {
+		t.Fatalf("unexpected export stats %+v", exported)
+	}
+	if imported, err = other.Import(ctx, bytes.NewReader(archive.Bytes()), &client.ArchiveOptions{Prefix: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Chunks != 0 || imported.Skipped != 1 {
+		t.Fatalf("unexpected import stats %+v", imported)
+	}
+	var apiErr *client.Error
+	if _, err = c.Export(ctx, new(bytes.Buffer), &client.ArchiveOptions{Format: "zip"}); !errors.As(err, &apiErr) || apiErr.StatusCode != 400 {
+		t.Fatalf("expected bad request for an unknown format, got %v", err)
+	}
+	if _, err = c.Export(ctx, new(bytes.Buffer), &client.ArchiveOptions{Bucket: "missing"}); !errors.Is(err, utils.ErrBucketNotFound) {
+		t.Fatalf("expected bucket not found, got %v", err)
+	}
+}
+
+func TestClient_IntegrationAuth(t *testing.T) {
+	endpoint := newTestServer(t, `[
+		{"id":"reader","secret":"r-secret","grants":[{"bucket":"default","permissions":["read"]}]},
+		{"id":"writer","secret":"w-secret","grants":[{"bucket":"*","permissions":["read","write"]}],
+		 "quota":{"max_objects":1,"max_bytes_per_second":10}},
+		{"id":"admin","secret":"a-secret","grants":[{"bucket":"*","permissions":["admin"]}]}
+	]`)
+	ctx := context.Background()
+
+	anonymous, err := client.New(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = anonymous.Stat(ctx, "a", nil); !errors.Is(err, utils.ErrUnauthenticated) {
+		t.Fatalf("expected unauthenticated, got %v", err)
+	}
+
+	reader, err := client.New(endpoint, &client.Options{Token: "r-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reader.Put(ctx, []byte("data"), &client.PutOptions{Key: "a"}); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if _, err = reader.Get(ctx, "a", nil); !errors.Is(err, utils.ErrIndexNotFound) {
+		t.Fatalf("expected index not found, got %v", err)
+	}
+
+	// token的配额，限速的请求不重试，直接检查429
+	writer, err := client.New(endpoint, &client.Options{Token: "w-secret", MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Put(ctx, []byte("0123456789ab"), &client.PutOptions{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Put(ctx, []byte("a"), &client.PutOptions{Key: "a"}); !errors.Is(err, utils.ErrRateLimited) {
+		t.Fatalf("expected rate limited, got %v", err)
+	}
+	if _, err = writer.Put(ctx, []byte("b"), &client.PutOptions{Key: "b"}); !errors.Is(err, utils.ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	admin, err := client.New(endpoint, &client.Options{Token: "a-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usages, err := admin.TokenUsage(ctx)
+	if err != nil || len(usages) != 1 || usages[0].Token != "writer" || usages[0].UsedBytes != 12 || usages[0].ObjectCount != 1 {
+		t.Fatalf("unexpected token usage %+v, err %v", usages, err)
+	}
+}
+
+func TestClient_IntegrationLimits(t *testing.T) {
+	endpoint := newTestServerWithConfig(t, "", func(conf *config.Config) {
+		conf.Limits.MaxBodyBytes = 8
+		conf.Limits.Endpoints = []config.EndpointLimit{{Route: "GET /objects/:bucket/*key", RequestsPerSecond: 1}}
+	})
+	ctx := context.Background()
+	c, err := client.New(endpoint, &client.Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Put(ctx, []byte("123456789"), &client.PutOptions{Key: "a"}); !errors.Is(err, utils.ErrBodyTooLarge) {
+		t.Fatalf("expected body too large, got %v", err)
+	}
+	// 没有声明长度的请求体在读取时检查
+	if _, err = c.PutObject(ctx, io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789")),
+		&client.PutOptions{Key: "a"}); !errors.Is(err, utils.ErrBodyTooLarge) {
+		t.Fatalf("expected body too large for a streamed body, got %v", err)
+	}
+	if _, err = c.Put(ctx, []byte("12345678"), &client.PutOptions{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Get(ctx, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *client.Error
+	if _, err = c.Get(ctx, "a", nil); !errors.Is(err, utils.ErrTooManyRequests) || !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected too many requests, got %v", err)
+	}
+	// 其他接口不受该接口的频率限制
+	if _, err = c.Stat(ctx, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_IntegrationTiering(t *testing.T) {
+	endpoint := newTestServerWithConfig(t, "", func(conf *config.Config) {
+		conf.Storage.SegmentSize = 256
+		conf.Storage.Tiering.Target = filepath.Join(filepath.Dir(conf.Storage.FileStorePath), "cold")
+		conf.Storage.Tiering.MinAge = time.Nanosecond
+	})
+	ctx := context.Background()
+	c, err := client.New(endpoint, &client.Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 100)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err = c.Put(ctx, data, &client.PutOptions{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := c.Tier(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segments == 0 || stats.Bytes == 0 {
+		t.Fatalf("sealed segments should be tiered, got %+v", stats)
+	}
+	locations, err := c.SegmentLocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := 0
+	for _, location := range locations {
+		if location.Tier == "remote" {
+			remote++
+		}
+	}
+	if remote != stats.Segments || locations[len(locations)-1].Tier != "local" {
+		t.Fatalf("unexpected segment locations %+v", locations)
+	}
+	got, err := c.Get(ctx, "a", nil)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read tiered chunk failed, err %v", err)
+	}
+}
+
+// TestClient_IntegrationEncryptedETag 开启加密时读取与写入返回相同的ETag，并且不是明文的md5
+func TestClient_IntegrationEncryptedETag(t *testing.T) {
+	endpoint := newTestServerWithConfig(t, "", func(conf *config.Config) {
+		conf.Storage.MasterKeyFile = filepath.Join(filepath.Dir(conf.Storage.FileStorePath), "master.key")
+		if err := ioutil.WriteFile(conf.Storage.MasterKeyFile, []byte(strings.Repeat("01", 32)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ctx := context.Background()
+	c, err := client.New(endpoint, &client.Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("top secret payload")
+	object, err := c.Put(ctx, data, &client.PutOptions{Key: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := md5.Sum(data); object.ETag == hex.EncodeToString(sum[:]) {
+		t.Fatal("etag should not be the md5 of the plaintext")
+	}
+	body, etag, err := c.GetObject(ctx, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if etag != object.ETag {
+		t.Fatalf("read etag %s should equal the write etag %s", etag, object.ETag)
+	}
+	resp, err := http.Get(endpoint + "/read?chunkid=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("ETag"); got != object.ETag {
+		t.Fatalf("/read etag %s should equal the write etag %s", got, object.ETag)
+	}
+}
+
+// TestClient_IntegrationPresign 预签名url的有效期必须为正数，超过配置的最长有效期时被缩短
+func TestClient_IntegrationPresign(t *testing.T) {
+	endpoint := newTestServerWithConfig(t, `[
+		{"id":"reader","secret":"r-secret","grants":[{"bucket":"default","permissions":["read"]}]}
+	]`, func(conf *config.Config) {
+		conf.Auth.MaxPresignExpiry = time.Hour
+	})
+	presign := func(expires string) model.Response {
+		request, err := http.NewRequest(http.MethodGet, endpoint+"/presign?chunkid=a&expires="+expires, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer r-secret")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result model.Response
+		if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	for _, expires := range []string{"0s", "-1m"} {
+		if result := presign(expires); result.Code != http.StatusBadRequest {
+			t.Fatalf("expires %s should be rejected, got %+v", expires, result)
+		}
+	}
+	result := presign("48h")
+	signed, ok := result.Data.(string)
+	if result.Code != http.StatusOK || !ok {
+		t.Fatalf("unexpected presign response %+v", result)
+	}
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := strconv.ParseInt(parsed.Query().Get(auth.QueryExpires), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := time.Now().Add(time.Hour).Unix(); expiresAt > limit {
+		t.Fatalf("expiry should be clamped to 1h, got %d > %d", expiresAt, limit)
+	}
+}
@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	myfs "my-fs/fs"
+	"my-fs/utils"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+type testCluster struct {
+	t          *testing.T
+	transports []*raft.InmemTransport
+	nodes      []*Node
+	urls       []string
+}
+
+// startNode 启动一个节点，第一个节点初始化集群，之后的节点通过第一个节点加入
+func (c *testCluster) startNode(id string) *Node {
+	addr, transport := raft.NewInmemTransport("")
+	for _, peer := range c.transports {
+		peer.Connect(addr, transport)
+		transport.Connect(peer.LocalAddr(), peer)
+	}
+	c.transports = append(c.transports, transport)
+
+	// 节点创建之前就需要http地址
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	c.t.Cleanup(server.Close)
+
+	config := Config{
+		NodeId:    id,
+		HTTPAddr:  server.URL,
+		DataDir:   c.t.TempDir(),
+		Options:   &myfs.Options{MaxFileSize: 1024},
+		Transport: transport,
+	}
+	if len(c.nodes) == 0 {
+		config.Bootstrap = true
+	} else {
+		config.Join = c.urls[0]
+	}
+	node, err := NewNode(config)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	handler = node.Handler()
+	c.nodes = append(c.nodes, node)
+	c.urls = append(c.urls, server.URL)
+	return node
+}
+
+func (c *testCluster) leader(except *Node) *Node {
+	var leader *Node
+	waitUntil(c.t, "leader election", func() bool {
+		for _, node := range c.nodes {
+			if node != except && node.IsLeader() && !node.FileManager().ReadOnly() {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func waitUntil(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster_ReplicatesIndex(t *testing.T) {
+	c := &testCluster{t: t}
+	for i := 0; i < 3; i++ {
+		c.startNode(fmt.Sprintf("node-%d", i))
+	}
+	defer func() {
+		for _, node := range c.nodes {
+			node.Shutdown()
+		}
+	}()
+	leader := c.leader(nil)
+
+	// 写入完成后立即从其他节点读取，数据保存在leader上，通过http读取
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		data := bytes.Repeat([]byte{byte(i)}, 200)
+		if _, err := leader.FileManager().WriteWithKey(key, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range c.nodes {
+			got, err := node.FileManager().Read(key)
+			if err != nil {
+				t.Fatalf("read %s from %s: %v", key, node.config.NodeId, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %s from %s: unexpected data", key, node.config.NodeId)
+			}
+		}
+	}
+
+	if err := leader.FileManager().CreateBucket("photos", myfs.BucketQuota{MaxObjects: 5}); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes {
+		bucket, err := node.FileManager().GetBucket("photos")
+		if err != nil {
+			t.Fatalf("get bucket from %s: %v", node.config.NodeId, err)
+		}
+		if bucket.Quota.MaxObjects != 5 {
+			t.Fatalf("unexpected quota %+v on %s", bucket.Quota, node.config.NodeId)
+		}
+	}
+
+	for _, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		if _, err := node.FileManager().Write([]byte("x")); errors.Cause(err) != utils.ErrReadOnly {
+			t.Fatalf("expect ErrReadOnly on follower, got %v", err)
+		}
+	}
+
+	status, err := leader.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Voters) != 3 || len(status.Nodes) != 3 || status.Leader != leader.config.NodeId {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.Checkpoints[leader.config.NodeId] == nil {
+		t.Fatalf("leader checkpoint is not replicated: %+v", status.Checkpoints)
+	}
+}
+
+func TestCluster_LeaderFailover(t *testing.T) {
+	c := &testCluster{t: t}
+	for i := 0; i < 3; i++ {
+		c.startNode(fmt.Sprintf("node-%d", i))
+	}
+	defer func() {
+		for _, node := range c.nodes[1:] {
+			node.Shutdown()
+		}
+	}()
+	old := c.leader(nil)
+	if old != c.nodes[0] {
+		t.Fatalf("expect bootstrap node to be leader, got %s", old.config.NodeId)
+	}
+	if err := old.FileManager().CreateBucket("docs", myfs.BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 剩下的两个节点选出新的leader并继续接受写入
+	leader := c.leader(old)
+	if _, err := leader.FileManager().WriteWithKey("after", []byte("failover"), &myfs.WriteOptions{Bucket: "docs"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes[1:] {
+		got, err := node.FileManager().ReadWithOptions("after", &myfs.ReadOptions{Bucket: "docs"})
+		if err != nil || string(got) != "failover" {
+			t.Fatalf("read from %s: %q %v", node.config.NodeId, got, err)
+		}
+	}
+
+	// 移除已经下线的节点
+	if err := leader.Remove(old.config.NodeId); err != nil {
+		t.Fatal(err)
+	}
+	status, err := leader.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Voters) != 2 || len(status.Nodes) != 2 {
+		t.Fatalf("unexpected status after remove %+v", status)
+	}
+	for _, node := range c.nodes[1:] {
+		if node == leader {
+			continue
+		}
+		if err := node.Remove("node-1"); errors.Cause(err) != utils.ErrNotLeader {
+			t.Fatalf("expect ErrNotLeader on follower, got %v", err)
+		}
+	}
+}
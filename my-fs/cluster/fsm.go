@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+
+	myfs "my-fs/fs"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+const (
+	// opIndex 索引数据库的修改，Data是序列化后的IndexBatch
+	opIndex = "index"
+	// opAddNode 与opRemoveNode 维护节点的http地址
+	opAddNode    = "add-node"
+	opRemoveNode = "remove-node"
+)
+
+// NodeInfo 集群中一个节点的地址
+type NodeInfo struct {
+	Id string `json:"id"`
+	// raft通信的地址
+	RaftAddr string `json:"raft_addr"`
+	// 其他节点访问该节点http服务的地址，例如http://127.0.0.1:8080
+	HTTPAddr string `json:"http_addr"`
+}
+
+// command raft日志中的一条命令
+type command struct {
+	Op   string    `json:"op"`
+	Data []byte    `json:"data,omitempty"`
+	Node *NodeInfo `json:"node,omitempty"`
+}
+
+// fsm raft的状态机，索引的修改应用到本地的索引数据库，节点地址保存在内存中并随快照持久化
+type fsm struct {
+	store *myfs.ReplicatedIndexStore
+
+	mutx  sync.RWMutex
+	nodes map[string]*NodeInfo
+}
+
+var _ raft.FSM = &fsm{}
+
+func newFSM(store *myfs.ReplicatedIndexStore) *fsm {
+	return &fsm{store: store, nodes: make(map[string]*NodeInfo)}
+}
+
+// Apply 返回值是error，会通过ApplyFuture.Response返回给提交命令的节点
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	cmd := &command{}
+	if err := json.Unmarshal(l.Data, cmd); err != nil {
+		return errors.Wrap(err, "unmarshal raft command failed")
+	}
+	switch cmd.Op {
+	case opIndex:
+		return f.store.ApplyCommand(cmd.Data)
+	case opAddNode:
+		f.mutx.Lock()
+		f.nodes[cmd.Node.Id] = cmd.Node
+		f.mutx.Unlock()
+	case opRemoveNode:
+		f.mutx.Lock()
+		delete(f.nodes, cmd.Node.Id)
+		f.mutx.Unlock()
+	default:
+		return errors.Errorf("unknown raft command [%s]", cmd.Op)
+	}
+	return nil
+}
+
+func (f *fsm) node(id string) (*NodeInfo, bool) {
+	f.mutx.RLock()
+	defer f.mutx.RUnlock()
+	node, ok := f.nodes[id]
+	return node, ok
+}
+
+func (f *fsm) listNodes() []*NodeInfo {
+	f.mutx.RLock()
+	defer f.mutx.RUnlock()
+	nodes := make([]*NodeInfo, 0, len(f.nodes))
+	for _, node := range f.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Snapshot 快照的第一行是节点地址的json，之后是索引数据库的内容
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	nodes, err := json.Marshal(f.listNodes())
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal nodes failed")
+	}
+	snapshot, err := f.store.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{nodes: nodes, index: snapshot}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	reader := bufio.NewReader(rc)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return errors.Wrap(err, "read nodes from snapshot failed")
+	}
+	var nodes []*NodeInfo
+	if err = json.Unmarshal(line, &nodes); err != nil {
+		return errors.Wrap(err, "unmarshal nodes failed")
+	}
+	if err = f.store.Restore(reader); err != nil {
+		return err
+	}
+	f.mutx.Lock()
+	defer f.mutx.Unlock()
+	f.nodes = make(map[string]*NodeInfo)
+	for _, node := range nodes {
+		f.nodes[node.Id] = node
+	}
+	return nil
+}
+
+type fsmSnapshot struct {
+	nodes []byte
+	index *myfs.IndexSnapshot
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := func() error {
+		if _, err := sink.Write(append(s.nodes, '\n')); err != nil {
+			return err
+		}
+		return s.index.Dump(sink)
+	}()
+	if err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "persist snapshot failed")
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {
+	s.index.Release()
+}
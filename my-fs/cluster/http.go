@@ -0,0 +1,178 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+// Handler 集群内部使用的http接口，挂载在/cluster/下
+//
+//	GET    /cluster/status          集群状态
+//	POST   /cluster/join            节点加入集群，body为NodeInfo
+//	DELETE /cluster/nodes/<id>      节点移出集群
+//	GET    /cluster/read-index      leader已经应用的raft位置，用于其他节点的线性一致读
+//	GET    /cluster/record          读取本节点数据文件中的记录
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := n.Status()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, status)
+	})
+	mux.HandleFunc("/cluster/join", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		info := &NodeInfo{}
+		if err := json.NewDecoder(r.Body).Decode(info); err != nil || info.Id == "" || info.RaftAddr == "" {
+			http.Error(w, "invalid node info", http.StatusBadRequest)
+			return
+		}
+		if err := n.Join(info); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/cluster/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := n.Remove(strings.TrimPrefix(r.URL.Path, "/cluster/nodes/")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/cluster/read-index", func(w http.ResponseWriter, r *http.Request) {
+		index, err := n.readIndex()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, map[string]uint64{"index": index})
+	})
+	mux.HandleFunc("/cluster/record", func(w http.ResponseWriter, r *http.Request) {
+		seq, err1 := strconv.Atoi(r.URL.Query().Get("seq"))
+		offset, err2 := strconv.ParseUint(r.URL.Query().Get("offset"), 10, 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid seq or offset", http.StatusBadRequest)
+			return
+		}
+		record, err := n.fs.ReadRecord(seq, offset)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(record)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Cause(err) == utils.ErrNotLeader {
+		code = http.StatusMisdirectedRequest
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// client 访问其他节点的集群接口
+type client struct {
+	http *http.Client
+}
+
+func newClient(httpClient *http.Client) *client {
+	c := http.Client{}
+	if httpClient != nil {
+		c = *httpClient
+	}
+	if c.Timeout == 0 {
+		c.Timeout = applyTimeout
+	}
+	return &client{http: &c}
+}
+
+func (c *client) do(req *http.Request) ([]byte, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request %s failed", req.URL)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read response of %s failed", req.URL)
+	}
+	switch {
+	case resp.StatusCode == http.StatusMisdirectedRequest:
+		return nil, errors.Wrap(utils.ErrNotLeader, strings.TrimSpace(string(body)))
+	case resp.StatusCode >= 300:
+		return nil, errors.Errorf("request %s failed with status %d: %s", req.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// join 请求addr上的节点将info加入集群，leader还没有选出时会重试
+func (c *client) join(addr string, info *NodeInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(leaderWaitTimeout)
+	for {
+		req, err := http.NewRequest(http.MethodPost, addr+"/cluster/join", strings.NewReader(string(body)))
+		if err != nil {
+			return err
+		}
+		if _, err = c.do(req); err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *client) readIndex(addr string) (uint64, error) {
+	req, err := http.NewRequest(http.MethodGet, addr+"/cluster/read-index", nil)
+	if err != nil {
+		return 0, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Index uint64 `json:"index"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return 0, errors.Wrap(err, "unmarshal read index failed")
+	}
+	return resp.Index, nil
+}
+
+func (c *client) fetchRecord(addr string, seq int, offset uint64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/cluster/record?seq=%d&offset=%d", addr, seq, offset), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
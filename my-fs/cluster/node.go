@@ -0,0 +1,382 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	myfs "my-fs/fs"
+	"my-fs/utils"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// applyTimeout 提交一条raft命令的超时时间
+	applyTimeout = 10 * time.Second
+	// leaderWaitTimeout 初始化集群后等待选出leader的时间
+	leaderWaitTimeout = 10 * time.Second
+)
+
+// Config 集群节点的配置
+type Config struct {
+	NodeId string
+	// raft通信监听的地址
+	RaftAddr string
+	// 其他节点访问本节点http服务的地址
+	HTTPAddr string
+	// 数据文件、索引数据库以及raft日志的目录
+	DataDir string
+	// 是否作为第一个节点初始化集群，集群已经初始化过时忽略
+	Bootstrap bool
+	// 启动后通过该地址的节点加入集群，为空时等待其他节点调用Join
+	Join string
+	// FileManager的配置，NodeId和RecordFetcher由节点设置
+	Options *myfs.Options
+	// 访问其他节点的http client，其他节点开启认证时由client携带凭证，为nil时使用默认的client
+	HTTPClient *http.Client
+	// 不为nil时使用该transport，并且raft日志保存在内存中，用于在一个进程中运行多个节点的测试
+	Transport raft.Transport
+}
+
+// Node 集群中的一个节点，数据写入leader本地的数据文件，索引通过raft复制到所有节点，
+// 任何节点都可以读取，保存在其他节点上的数据通过http读取
+type Node struct {
+	config Config
+	raft   *raft.Raft
+	fsm    *fsm
+	store  *myfs.ReplicatedIndexStore
+	fs     *myfs.FileManager
+	client *client
+
+	notifyCh chan bool
+	doneCh   chan struct{}
+}
+
+var _ myfs.IndexLog = &Node{}
+var _ myfs.RecordFetcher = &Node{}
+
+func NewNode(config Config) (*Node, error) {
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create data dir failed")
+	}
+	n := &Node{
+		config:   config,
+		client:   newClient(config.HTTPClient),
+		notifyCh: make(chan bool, 16),
+		doneCh:   make(chan struct{}),
+	}
+	n.store = myfs.NewReplicatedIndexStore(config.NodeId, n)
+	if err := n.store.Open(filepath.Join(config.DataDir, "indexstore")); err != nil {
+		return nil, err
+	}
+	n.fsm = newFSM(n.store)
+	if err := n.startRaft(); err != nil {
+		n.store.Close()
+		return nil, err
+	}
+
+	opts := myfs.Options{}
+	if config.Options != nil {
+		opts = *config.Options
+	}
+	opts.NodeId = config.NodeId
+	opts.RecordFetcher = n
+	fm, err := myfs.NewFileManagerWithIndexStore(filepath.Join(config.DataDir, "filestore"), n.store, &opts)
+	if err != nil {
+		n.raft.Shutdown()
+		return nil, err
+	}
+	n.fs = fm
+	// 只有leader可以写入，之后根据leader的变化切换
+	fm.SetReadOnly(n.raft.State() != raft.Leader)
+	go n.watchLeadership()
+
+	if config.Join != "" {
+		if err = n.client.join(config.Join, n.info()); err != nil {
+			n.Shutdown()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *Node) startRaft() error {
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.config.NodeId)
+	conf.NotifyCh = n.notifyCh
+	conf.LogOutput = os.Stderr
+	conf.LogLevel = "WARN"
+
+	var logs raft.LogStore
+	var stable raft.StableStore
+	var snaps raft.SnapshotStore
+	transport := n.config.Transport
+	if transport != nil {
+		// 测试时在一个进程中运行多个节点，使用更短的超时加快选举
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		store := raft.NewInmemStore()
+		logs, stable, snaps = store, store, raft.NewInmemSnapshotStore()
+	} else {
+		boltStore, err := raftboltdb.NewBoltStore(filepath.Join(n.config.DataDir, "raft.db"))
+		if err != nil {
+			return errors.Wrap(err, "open raft log store failed")
+		}
+		logs, stable = boltStore, boltStore
+		if snaps, err = raft.NewFileSnapshotStore(n.config.DataDir, 2, os.Stderr); err != nil {
+			return errors.Wrap(err, "open raft snapshot store failed")
+		}
+		addr, err := net.ResolveTCPAddr("tcp", n.config.RaftAddr)
+		if err != nil {
+			return errors.Wrap(err, "resolve raft address failed")
+		}
+		if transport, err = raft.NewTCPTransport(n.config.RaftAddr, addr, 3, 10*time.Second, os.Stderr); err != nil {
+			return errors.Wrap(err, "create raft transport failed")
+		}
+	}
+
+	hasState, err := raft.HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return errors.Wrap(err, "check raft state failed")
+	}
+	if n.raft, err = raft.NewRaft(conf, n.fsm, logs, stable, snaps, transport); err != nil {
+		return errors.Wrap(err, "start raft failed")
+	}
+	if !n.config.Bootstrap || hasState {
+		return nil
+	}
+	err = n.raft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: conf.LocalID, Address: transport.LocalAddr()}},
+	}).Error()
+	if err != nil {
+		return errors.Wrap(err, "bootstrap cluster failed")
+	}
+	if err = n.waitForLeader(leaderWaitTimeout); err != nil {
+		return err
+	}
+	return n.apply(&command{Op: opAddNode, Node: n.info()})
+}
+
+func (n *Node) info() *NodeInfo {
+	raftAddr := n.config.RaftAddr
+	if n.config.Transport != nil {
+		raftAddr = string(n.config.Transport.LocalAddr())
+	}
+	return &NodeInfo{Id: n.config.NodeId, RaftAddr: raftAddr, HTTPAddr: n.config.HTTPAddr}
+}
+
+func (n *Node) waitForLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if addr, _ := n.raft.LeaderWithID(); addr != "" {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("timeout waiting for cluster leader")
+}
+
+// watchLeadership 成为leader时允许写入，失去leader时切换为只读
+func (n *Node) watchLeadership() {
+	for {
+		select {
+		case <-n.doneCh:
+			return
+		case isLeader := <-n.notifyCh:
+			n.fs.SetReadOnly(!isLeader)
+			if isLeader {
+				log.Printf("node %s became cluster leader", n.config.NodeId)
+			}
+		}
+	}
+}
+
+// FileManager 本节点的FileManager，只有leader可以写入
+func (n *Node) FileManager() *myfs.FileManager {
+	return n.fs
+}
+
+// IsLeader 本节点是否是leader
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader 返回leader的地址，没有leader时返回nil
+func (n *Node) Leader() *NodeInfo {
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return nil
+	}
+	if node, ok := n.fsm.node(string(id)); ok {
+		return node
+	}
+	return nil
+}
+
+// notLeaderError 返回带有leader地址的ErrNotLeader
+func (n *Node) notLeaderError() error {
+	if leader := n.Leader(); leader != nil {
+		return errors.Wrapf(utils.ErrNotLeader, "leader is %s at %s", leader.Id, leader.HTTPAddr)
+	}
+	return errors.Wrap(utils.ErrNotLeader, "no leader elected")
+}
+
+func (n *Node) apply(cmd *command) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeaderError()
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return errors.Wrap(err, "marshal raft command failed")
+	}
+	future := n.raft.Apply(data, applyTimeout)
+	if err = future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return n.notLeaderError()
+		}
+		return errors.Wrap(err, "apply raft command failed")
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Append 通过raft提交索引的修改
+func (n *Node) Append(data []byte) error {
+	return n.apply(&command{Op: opIndex, Data: data})
+}
+
+// ReadBarrier leader通过Barrier保证之前提交的修改都已经应用，
+// 其他节点向leader获取已经应用的位置，等待本节点应用到该位置
+func (n *Node) ReadBarrier() error {
+	if n.raft.State() == raft.Leader {
+		if err := n.raft.Barrier(applyTimeout).Error(); err != nil {
+			if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+				return n.notLeaderError()
+			}
+			return errors.Wrap(err, "raft barrier failed")
+		}
+		return nil
+	}
+	leader := n.Leader()
+	if leader == nil {
+		return n.notLeaderError()
+	}
+	index, err := n.client.readIndex(leader.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(applyTimeout)
+	for n.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return errors.Errorf("timeout waiting for raft index %d, applied %d", index, n.raft.AppliedIndex())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// readIndex leader确认自己仍然是leader，并且之前提交的修改都已经应用后，返回已经应用的位置
+func (n *Node) readIndex() (uint64, error) {
+	if n.raft.State() != raft.Leader {
+		return 0, n.notLeaderError()
+	}
+	if err := n.raft.Barrier(applyTimeout).Error(); err != nil {
+		return 0, errors.Wrap(err, "raft barrier failed")
+	}
+	return n.raft.AppliedIndex(), nil
+}
+
+// FetchRecord 通过http读取其他节点数据文件中的记录
+func (n *Node) FetchRecord(node string, seq int, offset uint64) ([]byte, error) {
+	info, ok := n.fsm.node(node)
+	if !ok {
+		return nil, errors.Errorf("unknown node [%s]", node)
+	}
+	return n.client.fetchRecord(info.HTTPAddr, seq, offset)
+}
+
+// Join 将节点加入集群，只能在leader上调用
+func (n *Node) Join(info *NodeInfo) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeaderError()
+	}
+	err := n.raft.AddVoter(raft.ServerID(info.Id), raft.ServerAddress(info.RaftAddr), 0, applyTimeout).Error()
+	if err != nil {
+		return errors.Wrapf(err, "add node [%s] failed", info.Id)
+	}
+	return n.apply(&command{Op: opAddNode, Node: info})
+}
+
+// Remove 将节点移出集群，只能在leader上调用
+func (n *Node) Remove(id string) error {
+	if n.raft.State() != raft.Leader {
+		return n.notLeaderError()
+	}
+	if err := n.raft.RemoveServer(raft.ServerID(id), 0, applyTimeout).Error(); err != nil {
+		return errors.Wrapf(err, "remove node [%s] failed", id)
+	}
+	return n.apply(&command{Op: opRemoveNode, Node: &NodeInfo{Id: id}})
+}
+
+// Status 集群的状态
+type Status struct {
+	NodeId string
+	State  string
+	Leader string
+	// raft配置中的投票节点
+	Voters []string
+	// 节点的地址以及最后复制的写入位置
+	Nodes       []*NodeInfo
+	Checkpoints map[string]*myfs.LogPosition
+	Applied     uint64
+}
+
+func (n *Node) Status() (*Status, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, errors.Wrap(err, "get raft configuration failed")
+	}
+	status := &Status{
+		NodeId:      n.config.NodeId,
+		State:       n.raft.State().String(),
+		Nodes:       n.fsm.listNodes(),
+		Checkpoints: make(map[string]*myfs.LogPosition),
+		Applied:     n.raft.AppliedIndex(),
+	}
+	if leader := n.Leader(); leader != nil {
+		status.Leader = leader.Id
+	}
+	for _, server := range future.Configuration().Servers {
+		status.Voters = append(status.Voters, string(server.ID))
+	}
+	for _, node := range status.Nodes {
+		cp, err := n.store.NodeCheckpoint(node.Id)
+		if err != nil {
+			return nil, err
+		}
+		if cp != nil {
+			status.Checkpoints[node.Id] = cp
+		}
+	}
+	return status, nil
+}
+
+// Shutdown 停止raft并关闭FileManager
+func (n *Node) Shutdown() error {
+	close(n.doneCh)
+	if err := n.raft.Shutdown().Error(); err != nil {
+		return errors.Wrap(err, "shutdown raft failed")
+	}
+	return n.fs.Close()
+}
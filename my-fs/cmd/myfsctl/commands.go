@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"my-fs/client"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func printObject(w io.Writer, object *client.Object) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "bucket:\t%s\n", object.Bucket)
+	fmt.Fprintf(tw, "key:\t%s\n", object.Id)
+	fmt.Fprintf(tw, "size:\t%d\n", object.Size)
+	fmt.Fprintf(tw, "etag:\t%s\n", object.ETag)
+	fmt.Fprintf(tw, "modified:\t%s\n", formatNanos(object.ModTime))
+	if object.VersionId != "" {
+		fmt.Fprintf(tw, "version:\t%s\n", object.VersionId)
+	}
+	if object.DeleteMarker {
+		fmt.Fprintf(tw, "delete marker:\ttrue\n")
+	}
+	if object.ExpiresAt > 0 {
+		fmt.Fprintf(tw, "expires:\t%s\n", formatNanos(object.ExpiresAt))
+	}
+	tw.Flush()
+}
+
+func setupPut(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	bucket := flags.String("bucket", "", "bucket to write, the server default bucket if empty")
+	key := flags.String("key", "", "key of the chunk, defaults to the file name, generated when reading stdin")
+	overwrite := flags.String("overwrite", "", "replace, fail or ifmatch when the key exists")
+	ifMatch := flags.String("if-match", "", "only overwrite the chunk with this etag")
+	ttl := flags.Duration("ttl", 0, "expire the chunk after this long, 0 to keep it forever")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return err
+		}
+		opts := &client.PutOptions{
+			Bucket:    *bucket,
+			Key:       *key,
+			Overwrite: client.OverwriteMode(*overwrite),
+			IfMatch:   *ifMatch,
+			TTL:       *ttl,
+		}
+		r := e.stdin
+		if path := positional[0]; path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return errors.Wrap(err, "open file failed")
+			}
+			defer file.Close()
+			r = file
+			if opts.Key == "" {
+				opts.Key = filepath.Base(path)
+			}
+		}
+		object, err := e.client.PutObject(ctx, r, opts)
+		if err != nil {
+			return err
+		}
+		return e.output(object, func(w io.Writer) { printObject(w, object) })
+	}
+}
+
+func setupGet(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	bucket := flags.String("bucket", "", "bucket to read")
+	version := flags.String("version", "", "version to read, the latest if empty")
+	output := flags.String("o", "-", "file to write, - for stdout")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return err
+		}
+		body, _, err := e.client.GetObject(ctx, positional[0], &client.GetOptions{Bucket: *bucket, VersionId: *version})
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if *output == "-" {
+			_, err = io.Copy(e.stdout, body)
+			return errors.Wrap(err, "download chunk failed")
+		}
+		// 先写入临时文件，下载失败时不会留下不完整的文件
+		tmp := *output + ".tmp"
+		file, err := os.Create(tmp)
+		if err != nil {
+			return errors.Wrap(err, "create file failed")
+		}
+		if _, err = io.Copy(file, body); err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp, *output)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return errors.Wrap(err, "download chunk failed")
+		}
+		return nil
+	}
+}
+
+func setupStat(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	bucket := flags.String("bucket", "", "bucket of the chunk")
+	version := flags.String("version", "", "version to show, the latest if empty")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return err
+		}
+		object, err := e.client.Stat(ctx, positional[0], &client.GetOptions{Bucket: *bucket, VersionId: *version})
+		if err != nil {
+			return err
+		}
+		return e.output(object, func(w io.Writer) { printObject(w, object) })
+	}
+}
+
+func setupRm(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	bucket := flags.String("bucket", "", "bucket of the chunk")
+	version := flags.String("version", "", "permanently delete this version")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return err
+		}
+		return e.client.Delete(ctx, positional[0], &client.DeleteOptions{Bucket: *bucket, VersionId: *version})
+	}
+}
+
+func setupLs(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	prefix := flags.String("prefix", "", "only list keys with this prefix")
+	startAfter := flags.String("start-after", "", "only list keys after this key")
+	limit := flags.Int("limit", 0, "list at most this many keys, 0 for no limit")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 1); err != nil {
+			return err
+		}
+		if len(positional) == 0 {
+			buckets, err := e.client.ListBuckets(ctx)
+			if err != nil {
+				return err
+			}
+			return e.output(buckets, func(w io.Writer) {
+				tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "NAME\tOBJECTS\tBYTES\tVERSIONING\tCREATED")
+				for _, bucket := range buckets {
+					fmt.Fprintf(tw, "%s\t%d\t%d\t%t\t%s\n", bucket.Name, bucket.ObjectCount, bucket.UsedBytes,
+						bucket.Versioning, formatSeconds(bucket.CreatedAt))
+				}
+				tw.Flush()
+			})
+		}
+		objects, err := e.client.List(ctx, positional[0], &client.ListOptions{
+			Prefix:     *prefix,
+			StartAfter: *startAfter,
+			Limit:      *limit,
+		})
+		if err != nil {
+			return err
+		}
+		return e.output(objects, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "KEY\tSIZE\tMODIFIED\tETAG")
+			for _, object := range objects {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", object.Id, object.Size, formatNanos(object.ModTime), object.ETag)
+			}
+			tw.Flush()
+		})
+	}
+}
+
+func setupStats(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		stats, err := e.client.StorageStats(ctx)
+		if err != nil {
+			return err
+		}
+		return e.output(stats, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "segments:\t%d\n", stats.Segments)
+			fmt.Fprintf(tw, "live:\t%d records, %d bytes\n", stats.LiveRecords, stats.LiveBytes)
+			fmt.Fprintf(tw, "reclaimable:\t%d records, %d bytes\n", stats.DeadRecords, stats.DeadBytes)
+			fmt.Fprintf(tw, "indexes:\t%d latest, %d versions\n", stats.IndexEntries, stats.VersionEntries)
+			fmt.Fprintf(tw, "checkpoint:\tfile %d offset %d\n", stats.Checkpoint.FileSeq, stats.Checkpoint.Offset)
+			tw.Flush()
+		})
+	}
+}
+
+func setupCompact(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		stats, err := e.client.Compact(ctx)
+		if err != nil {
+			return err
+		}
+		return e.output(stats, func(w io.Writer) {
+			fmt.Fprintf(w, "compacted %d segments, kept %d records, dropped %d records, reclaimed %d bytes\n",
+				stats.Segments, stats.LiveRecords, stats.DroppedRecords, stats.ReclaimedBytes)
+		})
+	}
+}
+
+func setupFsck(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		report, err := e.client.Fsck(ctx)
+		if err != nil {
+			return err
+		}
+		err = e.output(report, func(w io.Writer) {
+			fmt.Fprintf(w, "checked %d records in %d segments and %d indexes\n", report.Records, report.Segments, report.Indexes)
+			fmt.Fprintf(w, "corrupt records: %s\n", joinOrNone(report.CorruptRecords))
+			fmt.Fprintf(w, "dangling indexes: %s\n", joinOrNone(report.DanglingIndexes))
+		})
+		if err != nil {
+			return err
+		}
+		if !report.Healthy {
+			return errors.Errorf("found %d corrupt records and %d dangling indexes",
+				len(report.CorruptRecords), len(report.DanglingIndexes))
+		}
+		return nil
+	}
+}
+
+func printArchiveStats(w io.Writer, action string, stats *client.ArchiveStats) {
+	fmt.Fprintf(w, "%s %d chunks, %d bytes, %d buckets", action, stats.Chunks, stats.Bytes, stats.Buckets)
+	if stats.Skipped > 0 {
+		fmt.Fprintf(w, ", skipped %d chunks", stats.Skipped)
+	}
+	fmt.Fprintln(w)
+}
+
+// progressInterval 导出与导入时输出进度的间隔
+const progressInterval = time.Second
+
+// progress 统计归档传输的字节数，每秒最多向out输出一次进度
+type progress struct {
+	out    io.Writer
+	action string
+	r      io.Reader
+	w      io.Writer
+	bytes  int64
+	last   time.Time
+}
+
+func (p *progress) add(n int) {
+	p.bytes += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		fmt.Fprintf(p.out, "%s %d bytes\n", p.action, p.bytes)
+	}
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.add(n)
+	return n, err
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.add(n)
+	return n, err
+}
+
+// Seek 使重试时可以重新读取归档，r不支持时返回错误，请求只发送一次
+func (p *progress) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := p.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("archive is not seekable")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err == nil {
+		p.bytes = pos
+	}
+	return pos, err
+}
+
+// archiveFlags 导出与导入共用的过滤条件与进度参数
+func archiveFlags(flags *flag.FlagSet) (*client.ArchiveOptions, *bool) {
+	opts := &client.ArchiveOptions{}
+	flags.StringVar(&opts.Bucket, "bucket", "", "only include chunks of this bucket")
+	flags.StringVar(&opts.Prefix, "prefix", "", "only include chunks whose id starts with this prefix")
+	return opts, flags.Bool("progress", false, "report transferred bytes on stderr")
+}
+
+// setupExport 归档写入-o指定的文件，为-时写入标准输出，此时统计信息输出到标准错误
+func setupExport(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	output := flags.String("o", "-", "archive file to write, - for stdout")
+	opts, showProgress := archiveFlags(flags)
+	flags.StringVar(&opts.Format, "format", client.ArchiveFormatNative, "archive format, myfs or tar")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		w := e.stdout
+		var file *os.File
+		if *output != "-" {
+			var err error
+			if file, err = os.Create(*output); err != nil {
+				return errors.Wrap(err, "create archive failed")
+			}
+			defer file.Close()
+			w = file
+		}
+		if *showProgress {
+			w = &progress{out: e.stderr, action: "exported", w: w}
+		}
+		stats, err := e.client.Export(ctx, w, opts)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			printArchiveStats(e.stderr, "exported", stats)
+			return nil
+		}
+		if err = file.Sync(); err != nil {
+			return errors.Wrap(err, "sync archive failed")
+		}
+		return e.output(stats, func(w io.Writer) { printArchiveStats(w, "exported", stats) })
+	}
+}
+
+// setupImport 读取-i指定的归档，为-时从标准输入读取，格式由服务端根据文件头识别
+func setupImport(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	input := flags.String("i", "-", "archive file to read, - for stdin")
+	opts, showProgress := archiveFlags(flags)
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		r := e.stdin
+		if *input != "-" {
+			file, err := os.Open(*input)
+			if err != nil {
+				return errors.Wrap(err, "open archive failed")
+			}
+			defer file.Close()
+			r = file
+		}
+		if *showProgress {
+			r = &progress{out: e.stderr, action: "uploaded", r: r}
+		}
+		stats, err := e.client.Import(ctx, r, opts)
+		if err != nil {
+			return err
+		}
+		return e.output(stats, func(w io.Writer) { printArchiveStats(w, "imported", stats) })
+	}
+}
+
+func printSnapshot(w io.Writer, snapshot *client.Snapshot) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "id:\t%s\n", snapshot.Id)
+	if snapshot.Parent != "" {
+		fmt.Fprintf(tw, "parent:\t%s\n", snapshot.Parent)
+	}
+	fmt.Fprintf(tw, "created:\t%s\n", formatNanos(snapshot.CreatedAt))
+	fmt.Fprintf(tw, "checkpoint:\tfile %d offset %d\n", snapshot.FileSeq, snapshot.Offset)
+	fmt.Fprintf(tw, "segments:\t%d, %d bytes copied\n", len(snapshot.Segments), snapshot.CopiedBytes)
+	fmt.Fprintf(tw, "index entries:\t%d\n", snapshot.IndexEntries)
+	tw.Flush()
+}
+
+func setupSnapshot(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	since := flags.String("since", "", "take an incremental snapshot based on this snapshot id")
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		snapshot, err := e.client.CreateSnapshot(ctx, *since)
+		if err != nil {
+			return err
+		}
+		return e.output(snapshot, func(w io.Writer) { printSnapshot(w, snapshot) })
+	}
+}
+
+func setupSnapshots(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		snapshots, err := e.client.ListSnapshots(ctx)
+		if err != nil {
+			return err
+		}
+		return e.output(snapshots, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tPARENT\tCREATED\tSEGMENTS\tCOPIED")
+			for _, snapshot := range snapshots {
+				parent := snapshot.Parent
+				if parent == "" {
+					parent = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", snapshot.Id, parent, formatNanos(snapshot.CreatedAt),
+					len(snapshot.Segments), snapshot.CopiedBytes)
+			}
+			tw.Flush()
+		})
+	}
+}
+
+func setupTier(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		stats, err := e.client.Tier(ctx)
+		if err != nil {
+			return err
+		}
+		return e.output(stats, func(w io.Writer) {
+			fmt.Fprintf(w, "tiered %d segments, %d bytes\n", stats.Segments, stats.Bytes)
+		})
+	}
+}
+
+func setupSegments(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, positional []string) error {
+		if err := checkArgs(positional, 0, 0); err != nil {
+			return err
+		}
+		locations, err := e.client.SegmentLocations(ctx)
+		if err != nil {
+			return err
+		}
+		return e.output(locations, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "SEQ\tSIZE\tTIER\tCACHED\tTIERED")
+			for _, location := range locations {
+				tiered := "-"
+				if location.TieredAt > 0 {
+					tiered = formatNanos(location.TieredAt)
+				}
+				fmt.Fprintf(tw, "%d\t%d\t%s\t%t\t%s\n", location.Seq, location.Size, location.Tier, location.Cached, tiered)
+			}
+			tw.Flush()
+		})
+	}
+}
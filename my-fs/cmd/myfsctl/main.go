@@ -0,0 +1,231 @@
+// myfsctl 通过http接口管理my-fs的命令行工具
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"my-fs/client"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	envEndpoint     = "MYFS_ENDPOINT"
+	envToken        = "MYFS_TOKEN"
+	defaultEndpoint = "http://127.0.0.1:8080"
+)
+
+// 退出码，脚本可以据此区分失败的原因
+const (
+	exitOK = iota
+	// 其他错误，例如参数错误以外的本地错误、冲突以及预检查失败
+	exitError
+	exitUsage
+	// chunk或bucket不存在
+	exitNotFound
+	// 未认证或者没有权限
+	exitAuth
+	// 服务端错误、服务不可用或者无法连接服务端
+	exitServer
+)
+
+// errUsage 参数错误，退出码为2
+var errUsage = errors.New("usage error")
+
+// env 一次命令执行的输入输出以及公共参数
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// 以JSON格式输出
+	json   bool
+	client *client.Client
+}
+
+// command 一个子命令，setup注册子命令的参数，返回的函数在参数解析之后执行
+type command struct {
+	usage   string
+	summary string
+	setup   func(flags *flag.FlagSet) func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = map[string]command{
+	"put":       {"put [-bucket b] [-key k] [-overwrite mode] [-ttl d] <file|->", "upload a file, the key defaults to the file name", setupPut},
+	"get":       {"get [-bucket b] [-version v] [-o file] <key>", "download a chunk to a file or stdout", setupGet},
+	"stat":      {"stat [-bucket b] [-version v] <key>", "show the metadata of a chunk", setupStat},
+	"rm":        {"rm [-bucket b] [-version v] <key>", "delete a chunk", setupRm},
+	"ls":        {"ls [-prefix p] [-start-after k] [-limit n] [bucket]", "list buckets, or the chunks of a bucket", setupLs},
+	"stats":     {"stats", "show storage statistics", setupStats},
+	"compact":   {"compact", "reclaim space used by overwritten and deleted chunks", setupCompact},
+	"fsck":      {"fsck", "check every record and index, exits 1 when problems are found", setupFsck},
+	"export":    {"export [-o file] [-format myfs|tar] [-bucket b] [-prefix p]", "write live chunks into an archive", setupExport},
+	"import":    {"import [-i file] [-bucket b] [-prefix p]", "load a myfs or tar archive keeping the chunk ids", setupImport},
+	"snapshot":  {"snapshot [-since id]", "take a snapshot in the snapshot dir of the server", setupSnapshot},
+	"snapshots": {"snapshots", "list the snapshots in the snapshot dir of the server", setupSnapshots},
+	"tier":      {"tier", "move cold sealed segments to the tiering target now", setupTier},
+	"segments":  {"segments", "show whether each segment is local or tiered", setupSegments},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run 执行子命令并返回退出码
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command [%s]\n", name)
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: myfsctl %s\n\n", cmd.usage)
+		flags.PrintDefaults()
+	}
+	endpoint := flags.String("endpoint", envOrDefault(envEndpoint, defaultEndpoint), "address of the my-fs http api, $"+envEndpoint)
+	token := flags.String("token", os.Getenv(envToken), "bearer token, $"+envToken)
+	jsonOutput := flags.Bool("json", false, "print results as JSON")
+	timeout := flags.Duration("timeout", 0, "give up after this long, 0 for no limit")
+	retries := flags.Int("retries", 0, "retries of failed requests, 0 for the default and negative to disable")
+	fn := cmd.setup(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	c, err := client.New(*endpoint, &client.Options{Token: *token, MaxRetries: *retries})
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return exitUsage
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	e := &env{stdin: stdin, stdout: stdout, stderr: stderr, json: *jsonOutput, client: c}
+	err = fn(ctx, e, flags.Args())
+	if err == errUsage {
+		flags.Usage()
+	} else if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+	}
+	return exitCode(err)
+}
+
+// exitCode 根据错误的类型返回退出码
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if err == errUsage {
+		return exitUsage
+	}
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusNotFound:
+			return exitNotFound
+		case apiErr.StatusCode == http.StatusUnauthorized, apiErr.StatusCode == http.StatusForbidden:
+			return exitAuth
+		case apiErr.StatusCode >= http.StatusInternalServerError, apiErr.StatusCode == http.StatusTooManyRequests:
+			return exitServer
+		}
+		return exitError
+	}
+	var netErr *url.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return exitServer
+	}
+	return exitError
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage: myfsctl <command> [-endpoint url] [-token t] [-json] [flags] [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, "\nexit codes: %d ok, %d error, %d usage, %d not found, %d unauthenticated or denied, %d server error or unreachable\n",
+		exitOK, exitError, exitUsage, exitNotFound, exitAuth, exitServer)
+}
+
+func envOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// output -json时输出v，否则调用text输出可读的格式
+func (e *env) output(v interface{}, text func(w io.Writer)) error {
+	if e.json {
+		encoder := json.NewEncoder(e.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	text(e.stdout)
+	return nil
+}
+
+// checkArgs 检查位置参数的数量，min与max相同表示固定数量
+func checkArgs(args []string, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return errUsage
+	}
+	return nil
+}
+
+func formatNanos(nanos int64) string {
+	if nanos == 0 {
+		return "-"
+	}
+	return time.Unix(0, nanos).Format(time.RFC3339)
+}
+
+func formatSeconds(seconds int64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return time.Unix(seconds, 0).Format(time.RFC3339)
+}
+
+// joinOrNone 逗号分隔，为空时返回none
+func joinOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
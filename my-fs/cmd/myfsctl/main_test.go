@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRun_ExitCodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":401,"err":"unauthenticated"}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/stat":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":404,"err":"index not found"}`))
+		case "/admin/fsck":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"code":503,"err":"store is read only"}`))
+		case "/buckets":
+			w.Write([]byte(`{"code":200,"data":[{"Name":"default","ObjectCount":2,"UsedBytes":10}]}`))
+		case "/objects/default/a":
+			w.Write([]byte("hello"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":403,"err":"permission admin on bucket * is denied"}`))
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		args   []string
+		code   int
+		stdout string
+	}{
+		{[]string{"ls"}, exitOK, "default"},
+		{[]string{"ls", "-json"}, exitOK, `"ObjectCount": 2`},
+		{[]string{"get", "a"}, exitOK, "hello"},
+		{[]string{"stat", "a"}, exitNotFound, ""},
+		{[]string{"compact"}, exitAuth, ""},
+		{[]string{"tier"}, exitAuth, ""},
+		{[]string{"fsck"}, exitServer, ""},
+		{[]string{"stat"}, exitUsage, ""},
+		{[]string{"bogus"}, exitUsage, ""},
+	}
+	for _, c := range cases {
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		args := append([]string{c.args[0], "-endpoint", server.URL, "-token", "secret", "-retries", "-1"}, c.args[1:]...)
+		if code := run(context.Background(), args, nil, stdout, stderr); code != c.code {
+			t.Fatalf("%v: expected exit code %d, got %d, stderr %s", c.args, c.code, code, stderr)
+		}
+		if !strings.Contains(stdout.String(), c.stdout) {
+			t.Fatalf("%v: expected %q in output %q", c.args, c.stdout, stdout)
+		}
+	}
+
+	stderr := new(bytes.Buffer)
+	if code := run(context.Background(), []string{"ls", "-endpoint", server.URL}, nil, new(bytes.Buffer), stderr); code != exitAuth {
+		t.Fatalf("expected auth exit code without token, got %d, stderr %s", code, stderr)
+	}
+}
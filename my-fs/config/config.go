@@ -0,0 +1,629 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"my-fs/auth"
+	myfs "my-fs/fs"
+	"my-fs/limits"
+	"my-fs/tier"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvConfigPath 未通过命令行指定配置文件时，从该环境变量读取配置文件的路径
+const EnvConfigPath = "MYFS_CONFIG"
+
+const (
+	defaultHTTPAddr        = ":8080"
+	defaultS3Addr          = ":9000"
+	defaultShutdownTimeout = 30 * time.Second
+	// 纠删码默认的校验分片数量
+	defaultParityShards = 2
+	// 请求体默认的最大字节数
+	defaultMaxBodyBytes = 64 << 20
+)
+
+// Config my-fs服务的全部配置，先读取YAML配置文件，再由环境变量覆盖，
+// 每个字段的env标签为覆盖它的环境变量
+type Config struct {
+	Server      ServerConfig      `yaml:"server"`
+	Storage     StorageConfig     `yaml:"storage"`
+	Auth        AuthConfig        `yaml:"auth"`
+	TLS         TLSConfig         `yaml:"tls"`
+	Cluster     ClusterConfig     `yaml:"cluster"`
+	Replication ReplicationConfig `yaml:"replication"`
+	Limits      LimitsConfig      `yaml:"limits"`
+}
+
+// ServerConfig 监听地址与退出
+type ServerConfig struct {
+	HTTPAddr string `yaml:"http_addr" env:"HTTP_ADDR"`
+	S3Addr   string `yaml:"s3_addr" env:"S3_ADDR"`
+	// 退出时等待正在处理的请求完成的最长时间
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// StorageConfig 存储引擎的配置，数值为0时使用引擎的默认值
+type StorageConfig struct {
+	// 数据文件的目录，使用逗号分隔多个目录时开启纠删码，每个目录保存一个分片
+	FileStorePath string `yaml:"file_store_path" env:"FILE_STORE_PATH"`
+	// 索引数据库的目录，集群模式下不需要
+	IndexStorePath string `yaml:"index_store_path" env:"INDEX_STORE_PATH"`
+	// 单个数据文件的最大字节数
+	SegmentSize int `yaml:"segment_size" env:"SEGMENT_SIZE"`
+	// 数据文件的同步策略，可选always、periodic、none
+	SyncPolicy string `yaml:"sync_policy" env:"SYNC_POLICY"`
+	// sync_policy为periodic时的同步间隔
+	SyncInterval time.Duration `yaml:"sync_interval" env:"SYNC_INTERVAL"`
+	// 读取缓存保存的chunk数量，0表示不缓存
+	CacheSize int `yaml:"cache_size" env:"CACHE_SIZE"`
+	// 新写入的chunk使用的压缩算法，可选none、snappy、zstd
+	Compression string `yaml:"compression" env:"COMPRESSION"`
+	// 主密钥文件，为空时从MYFS_MASTER_KEY环境变量读取主密钥，只加密数据文件，索引中的元数据不加密
+	MasterKeyFile string `yaml:"master_key_file" env:"MASTER_KEY_FILE"`
+	// 幂等key的保留时间
+	IdempotencyWindow time.Duration `yaml:"idempotency_window" env:"IDEMPOTENCY_WINDOW"`
+	// 清理过期chunk的间隔
+	ExpirySweepInterval time.Duration `yaml:"expiry_sweep_interval" env:"EXPIRY_SWEEP_INTERVAL"`
+	// 数据目录所在磁盘至少保留的空闲字节数，低于该值时拒绝写入，0表示不检查
+	MinFreeBytes int64 `yaml:"min_free_bytes" env:"MIN_FREE_BYTES"`
+	// 纠删码模式下定期修复丢失分片的间隔，0表示不定期修复
+	RepairInterval time.Duration `yaml:"repair_interval" env:"REPAIR_INTERVAL"`
+	// 快照保存的目录，为空时不能通过接口生成快照，与数据目录在同一个文件系统时使用硬链接
+	SnapshotDir string        `yaml:"snapshot_dir" env:"SNAPSHOT_DIR"`
+	Erasure     ErasureConfig `yaml:"erasure"`
+	Tiering     TieringConfig `yaml:"tiering"`
+}
+
+// ErasureConfig 纠删码配置，配置了多个目录时开启
+type ErasureConfig struct {
+	ShardDirs []string `yaml:"shard_dirs"`
+	// 默认为目录数量减去校验分片数量
+	DataShards int `yaml:"data_shards" env:"ERASURE_DATA_SHARDS"`
+	// 默认为2
+	ParityShards int `yaml:"parity_shards" env:"ERASURE_PARITY_SHARDS"`
+}
+
+// TieringConfig 冷热分层，配置了target时把较旧或者较长时间没有读取的数据文件移到冷存储
+type TieringConfig struct {
+	// 冷存储，本地目录或者"s3://<bucket>/<prefix>"
+	Target string `yaml:"target" env:"TIER_TARGET"`
+	// target为s3时的对象存储地址，为空时使用AWS
+	S3Endpoint  string `yaml:"s3_endpoint" env:"TIER_S3_ENDPOINT"`
+	S3Region    string `yaml:"s3_region" env:"TIER_S3_REGION"`
+	S3AccessKey string `yaml:"s3_access_key" env:"TIER_S3_ACCESS_KEY"`
+	S3SecretKey string `yaml:"s3_secret_key" env:"TIER_S3_SECRET_KEY"`
+	// 数据文件最后修改超过该时间后移出，0表示不按修改时间移出
+	MinAge time.Duration `yaml:"min_age" env:"TIER_MIN_AGE"`
+	// 数据文件超过该时间没有读取后移出，0表示不按读取时间移出
+	ColdAfter time.Duration `yaml:"cold_after" env:"TIER_COLD_AFTER"`
+	// 检查需要移出的文件的间隔，0表示只通过接口触发
+	Interval time.Duration `yaml:"interval" env:"TIER_INTERVAL"`
+	// 缓存从冷存储下载的文件的目录，为空时不缓存
+	CacheDir string `yaml:"cache_dir" env:"TIER_CACHE_DIR"`
+	// 缓存的最大字节数，0表示不限制
+	CacheBytes int64 `yaml:"cache_bytes" env:"TIER_CACHE_BYTES"`
+}
+
+// AuthConfig 认证与审计日志
+type AuthConfig struct {
+	// token文件，为空时不认证请求
+	TokensFile string `yaml:"tokens_file" env:"AUTH_TOKENS_FILE"`
+	// 审计日志文件，为空时写入标准输出
+	AuditLog string `yaml:"audit_log" env:"AUDIT_LOG"`
+	// 访问其他节点时使用的Bearer token
+	PeerToken string `yaml:"peer_token" env:"PEER_TOKEN"`
+	// 预签名url的最长有效期，请求的有效期超过时被缩短，为0时使用auth.MaxPresignExpiry
+	MaxPresignExpiry time.Duration `yaml:"max_presign_expiry" env:"MAX_PRESIGN_EXPIRY"`
+}
+
+// TLSConfig 证书配置，cert_file与key_file都不为空时使用https
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE"`
+	// 不为空时要求客户端提供该CA签发的证书
+	ClientCAFile string `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// 用于验证其他节点的证书
+	PeerCAFile string `yaml:"peer_ca_file" env:"PEER_CA_FILE"`
+}
+
+// ClusterConfig 集群配置，配置了node_id时以集群模式运行，file_store_path作为节点的数据目录
+type ClusterConfig struct {
+	NodeId string `yaml:"node_id" env:"CLUSTER_NODE_ID"`
+	// raft通信的地址
+	RaftAddr string `yaml:"raft_addr" env:"CLUSTER_RAFT_ADDR"`
+	// 其他节点访问本节点的地址，默认为http(s)://<raft地址的host>:<http端口>
+	HTTPAddr string `yaml:"http_addr" env:"CLUSTER_HTTP_ADDR"`
+	// 第一个节点设置为true
+	Bootstrap bool `yaml:"bootstrap" env:"CLUSTER_BOOTSTRAP"`
+	// 其他节点通过该节点加入集群
+	Join string `yaml:"join" env:"CLUSTER_JOIN"`
+}
+
+// ReplicationConfig 主从复制配置
+type ReplicationConfig struct {
+	// 不为空时作为该地址的主节点的从节点
+	ReplicaOf string `yaml:"replica_of" env:"REPLICA_OF"`
+}
+
+// LimitsConfig http接口的请求体大小与请求频率限制，数值为0表示不限制
+type LimitsConfig struct {
+	// 请求体的最大字节数
+	MaxBodyBytes int64 `yaml:"max_body_bytes" env:"MAX_BODY_BYTES"`
+	// 每个客户端ip与每个token每秒的请求数，ip在认证之前检查，认证失败的请求同样计算
+	RequestsPerSecond int `yaml:"requests_per_second" env:"REQUESTS_PER_SECOND"`
+	// 允许的突发请求数，0表示等于requests_per_second
+	Burst int `yaml:"burst" env:"REQUEST_BURST"`
+	// 单独限制的接口，每个接口的请求频率单独计算
+	Endpoints []EndpointLimit `yaml:"endpoints"`
+}
+
+// EndpointLimit 一个接口的限制，为0的字段使用limits中的值，-1表示不限制
+type EndpointLimit struct {
+	// 方法与路由，例如"POST /write"，路由与注册的路由相同，省略方法时对所有方法生效
+	Route             string `yaml:"route"`
+	MaxBodyBytes      int64  `yaml:"max_body_bytes"`
+	RequestsPerSecond int    `yaml:"requests_per_second"`
+	// requests_per_second不为0时，0表示等于requests_per_second
+	Burst int `yaml:"burst"`
+}
+
+// defaultImportBodyBytes 导入的归档默认最大1GB，更大的归档需要在endpoints中配置
+const defaultImportBodyBytes = 1 << 30
+
+// defaultEndpointLimits 默认单独限制的接口，endpoints中配置了相同的接口时被覆盖
+var defaultEndpointLimits = []EndpointLimit{
+	// 导入的归档可能远大于普通的请求
+	{Route: "POST /admin/import", MaxBodyBytes: defaultImportBodyBytes},
+}
+
+// Default 返回默认配置
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			HTTPAddr:        defaultHTTPAddr,
+			S3Addr:          defaultS3Addr,
+			ShutdownTimeout: defaultShutdownTimeout,
+		},
+		Storage: StorageConfig{
+			SyncPolicy:  "always",
+			Compression: "none",
+		},
+		Limits: LimitsConfig{
+			MaxBodyBytes: defaultMaxBodyBytes,
+		},
+	}
+}
+
+// Load 读取配置文件，path为空时只使用默认值与环境变量，之后检查配置是否有效
+func Load(path string) (*Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	conf := Default()
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read config file [%s] failed", path)
+		}
+		// 不认识的字段通常是拼写错误，直接报错
+		if err = yaml.UnmarshalStrict(content, conf); err != nil {
+			return nil, errors.Wrapf(err, "parse config file [%s] failed", path)
+		}
+	}
+	if err := conf.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	conf.applyDefaults()
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// applyEnv 使用环境变量覆盖配置，空的环境变量被忽略
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if err := applyEnv(reflect.ValueOf(c).Elem(), lookup); err != nil {
+		return err
+	}
+	// FILE_STORE_PATH配置了多个目录时开启纠删码
+	if dirs := strings.Split(c.Storage.FileStorePath, ","); len(dirs) > 1 {
+		c.Storage.Erasure.ShardDirs = dirs
+		c.Storage.FileStorePath = dirs[0]
+	}
+	return nil
+}
+
+func applyEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, fieldType := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		name := fieldType.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return errors.Wrapf(err, "invalid value [%s] of %s", value, name)
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Int, field.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return errors.Errorf("unsupported config field type %s", field.Type())
+	}
+	return nil
+}
+
+// applyDefaults 补全依赖其他字段的默认值
+func (c *Config) applyDefaults() {
+	erasure := &c.Storage.Erasure
+	if len(erasure.ShardDirs) > 1 {
+		if erasure.ParityShards == 0 {
+			erasure.ParityShards = defaultParityShards
+		}
+		if erasure.DataShards == 0 {
+			erasure.DataShards = len(erasure.ShardDirs) - erasure.ParityShards
+		}
+		if c.Storage.FileStorePath == "" {
+			c.Storage.FileStorePath = erasure.ShardDirs[0]
+		}
+	}
+}
+
+// ValidationError 配置中的所有错误
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate 检查配置是否有效，返回的ValidationError包含所有有问题的字段
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(field, format string, args ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.HTTPAddr == "" {
+		problem("server.http_addr", "can not be empty")
+	}
+	if c.Server.S3Addr == "" {
+		problem("server.s3_addr", "can not be empty")
+	}
+	if c.Server.HTTPAddr != "" && c.Server.HTTPAddr == c.Server.S3Addr {
+		problem("server.s3_addr", "must differ from server.http_addr [%s]", c.Server.HTTPAddr)
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		problem("server.shutdown_timeout", "can not be negative")
+	}
+
+	if c.Auth.MaxPresignExpiry < 0 || c.Auth.MaxPresignExpiry > auth.MaxPresignExpiry {
+		problem("auth.max_presign_expiry", "must be between 0 and %s", auth.MaxPresignExpiry)
+	}
+
+	storage := &c.Storage
+	if storage.FileStorePath == "" {
+		problem("storage.file_store_path", "can not be empty")
+	}
+	if storage.IndexStorePath == "" && c.Cluster.NodeId == "" {
+		problem("storage.index_store_path", "can not be empty unless cluster.node_id is set")
+	}
+	if storage.SegmentSize < 0 {
+		problem("storage.segment_size", "can not be negative")
+	}
+	if _, err := ParseSyncPolicy(storage.SyncPolicy); err != nil {
+		problem("storage.sync_policy", "%s", err)
+	}
+	if storage.SyncInterval < 0 {
+		problem("storage.sync_interval", "can not be negative")
+	}
+	if storage.CacheSize < 0 {
+		problem("storage.cache_size", "can not be negative")
+	}
+	if _, err := ParseCompression(storage.Compression); err != nil {
+		problem("storage.compression", "%s", err)
+	}
+	if storage.IdempotencyWindow < 0 {
+		problem("storage.idempotency_window", "can not be negative")
+	}
+	if storage.ExpirySweepInterval < 0 {
+		problem("storage.expiry_sweep_interval", "can not be negative")
+	}
+	if storage.MinFreeBytes < 0 {
+		problem("storage.min_free_bytes", "can not be negative")
+	}
+	if storage.RepairInterval < 0 {
+		problem("storage.repair_interval", "can not be negative")
+	}
+	if erasure := storage.Erasure; len(erasure.ShardDirs) > 0 {
+		if len(erasure.ShardDirs) < 2 {
+			problem("storage.erasure.shard_dirs", "needs at least 2 dirs, got %d", len(erasure.ShardDirs))
+		}
+		if erasure.DataShards < 1 || erasure.ParityShards < 1 {
+			problem("storage.erasure", "data_shards %d and parity_shards %d must both be positive",
+				erasure.DataShards, erasure.ParityShards)
+		} else if erasure.DataShards+erasure.ParityShards != len(erasure.ShardDirs) {
+			problem("storage.erasure", "data_shards %d plus parity_shards %d must equal the %d shard dirs",
+				erasure.DataShards, erasure.ParityShards, len(erasure.ShardDirs))
+		}
+	}
+	tiering := storage.Tiering
+	if tiering.MinAge < 0 || tiering.ColdAfter < 0 || tiering.Interval < 0 || tiering.CacheBytes < 0 {
+		problem("storage.tiering", "min_age, cold_after, interval and cache_bytes can not be negative")
+	}
+	if tiering.Target != "" {
+		if _, _, err := parseS3Target(tiering.Target); err != nil {
+			problem("storage.tiering.target", "%s", err)
+		}
+		if tiering.MinAge == 0 && tiering.ColdAfter == 0 {
+			problem("storage.tiering", "min_age or cold_after is required when target is set")
+		}
+		if len(storage.Erasure.ShardDirs) > 0 {
+			problem("storage.tiering.target", "can not be used with erasure coding")
+		}
+	} else if tiering.MinAge != 0 || tiering.ColdAfter != 0 || tiering.Interval != 0 || tiering.CacheDir != "" {
+		problem("storage.tiering.target", "is required when other tiering options are set")
+	}
+
+	limitsConf := c.Limits
+	if limitsConf.MaxBodyBytes < 0 {
+		problem("limits.max_body_bytes", "can not be negative")
+	}
+	if limitsConf.RequestsPerSecond < 0 {
+		problem("limits.requests_per_second", "can not be negative")
+	}
+	if limitsConf.Burst < 0 {
+		problem("limits.burst", "can not be negative")
+	}
+	routes := make(map[string]bool)
+	for i, endpoint := range limitsConf.Endpoints {
+		field := fmt.Sprintf("limits.endpoints[%d]", i)
+		route, err := normalizeRoute(endpoint.Route)
+		if err != nil {
+			problem(field+".route", "%s", err)
+		} else if routes[route] {
+			problem(field+".route", "duplicate route [%s]", route)
+		}
+		routes[route] = true
+		if endpoint.MaxBodyBytes < -1 || endpoint.RequestsPerSecond < -1 || endpoint.Burst < -1 {
+			problem(field, "limits can not be less than -1")
+		}
+	}
+
+	tls := c.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		problem("tls", "cert_file and key_file must be set together")
+	}
+	if tls.ClientCAFile != "" && tls.CertFile == "" {
+		problem("tls.client_ca_file", "requires cert_file and key_file")
+	}
+
+	cluster := c.Cluster
+	if cluster.NodeId != "" {
+		if cluster.RaftAddr == "" {
+			problem("cluster.raft_addr", "can not be empty when cluster.node_id is set")
+		}
+		if cluster.Bootstrap && cluster.Join != "" {
+			problem("cluster", "bootstrap and join can not be set together")
+		}
+		if c.Replication.ReplicaOf != "" {
+			problem("replication.replica_of", "can not be used in cluster mode")
+		}
+	} else if cluster.RaftAddr != "" || cluster.Bootstrap || cluster.Join != "" {
+		problem("cluster.node_id", "is required when other cluster options are set")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ParseSyncPolicy 解析数据文件的同步策略，空字符串表示always
+func ParseSyncPolicy(policy string) (myfs.SyncPolicy, error) {
+	switch policy {
+	case "", "always":
+		return myfs.SyncAlways, nil
+	case "periodic":
+		return myfs.SyncPeriodic, nil
+	case "none":
+		return myfs.SyncNone, nil
+	default:
+		return 0, errors.Errorf("unknown sync policy [%s], expect always, periodic or none", policy)
+	}
+}
+
+// ParseCompression 解析压缩算法，空字符串表示不压缩
+func ParseCompression(compression string) (myfs.Compression, error) {
+	switch compression {
+	case "", "none":
+		return myfs.CompressionNone, nil
+	case "snappy":
+		return myfs.CompressionSnappy, nil
+	case "zstd":
+		return myfs.CompressionZstd, nil
+	default:
+		return 0, errors.Errorf("unknown compression [%s], expect none, snappy or zstd", compression)
+	}
+}
+
+// parseS3Target 解析"s3://<bucket>/<prefix>"，不是s3地址时返回false
+func parseS3Target(target string) (tier.S3Options, bool, error) {
+	const scheme = "s3://"
+	if !strings.HasPrefix(target, scheme) {
+		return tier.S3Options{}, false, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(target, scheme), "/", 2)
+	if parts[0] == "" {
+		return tier.S3Options{}, false, errors.Errorf("invalid target [%s], expect s3://<bucket>/<prefix>", target)
+	}
+	opts := tier.S3Options{Bucket: parts[0]}
+	if len(parts) == 2 {
+		opts.Prefix = parts[1]
+	}
+	return opts, true, nil
+}
+
+// tierStore 根据target创建冷存储
+func (t TieringConfig) tierStore() (myfs.TierStore, error) {
+	opts, isS3, err := parseS3Target(t.Target)
+	if err != nil {
+		return nil, err
+	}
+	if !isS3 {
+		return tier.NewDirStore(t.Target)
+	}
+	opts.Endpoint = t.S3Endpoint
+	opts.Region = t.S3Region
+	opts.AccessKey = t.S3AccessKey
+	opts.SecretKey = t.S3SecretKey
+	return tier.NewS3Store(opts)
+}
+
+// normalizeRoute 检查接口的路由，返回"<METHOD> <route>"或者"<route>"
+func normalizeRoute(route string) (string, error) {
+	fields := strings.Fields(route)
+	switch {
+	case len(fields) == 1 && strings.HasPrefix(fields[0], "/"):
+		return fields[0], nil
+	case len(fields) == 2 && strings.HasPrefix(fields[1], "/"):
+		return strings.ToUpper(fields[0]) + " " + fields[1], nil
+	default:
+		return "", errors.Errorf("invalid route [%s], expect a route such as \"POST /write\" or \"/write\"", route)
+	}
+}
+
+// inheritLimit endpoints中的值为0时使用全局的值，-1表示不限制
+func inheritLimit(value, global int64) int64 {
+	switch value {
+	case 0:
+		return global
+	case -1:
+		return 0
+	default:
+		return value
+	}
+}
+
+// LimitRules 生成limits.New的全局规则与每个接口的规则
+func (c *Config) LimitRules() (limits.Rule, map[string]limits.Rule) {
+	global := limits.Rule{
+		MaxBodyBytes:      c.Limits.MaxBodyBytes,
+		RequestsPerSecond: c.Limits.RequestsPerSecond,
+		Burst:             c.Limits.Burst,
+	}
+	routes := make(map[string]limits.Rule)
+	endpoints := append(append([]EndpointLimit(nil), defaultEndpointLimits...), c.Limits.Endpoints...)
+	for _, endpoint := range endpoints {
+		route, err := normalizeRoute(endpoint.Route)
+		if err != nil {
+			continue
+		}
+		rule := limits.Rule{
+			MaxBodyBytes:      inheritLimit(endpoint.MaxBodyBytes, global.MaxBodyBytes),
+			RequestsPerSecond: int(inheritLimit(int64(endpoint.RequestsPerSecond), int64(global.RequestsPerSecond))),
+			Burst:             int(inheritLimit(int64(endpoint.Burst), 0)),
+		}
+		// 接口使用全局的请求频率时突发请求数也使用全局的值
+		if endpoint.RequestsPerSecond == 0 && endpoint.Burst == 0 {
+			rule.Burst = global.Burst
+		}
+		routes[route] = rule
+	}
+	return global, routes
+}
+
+// StoreOptions 根据存储配置生成FileManager的选项，会读取主密钥
+func (c *Config) StoreOptions() (*myfs.Options, error) {
+	storage := c.Storage
+	syncPolicy, err := ParseSyncPolicy(storage.SyncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := ParseCompression(storage.Compression)
+	if err != nil {
+		return nil, err
+	}
+	// 主密钥优先从master_key_file读取，其次是MYFS_MASTER_KEY环境变量
+	masterKey, err := myfs.LoadMasterKey(storage.MasterKeyFile, "MYFS_MASTER_KEY")
+	if err != nil {
+		return nil, err
+	}
+	opts := &myfs.Options{
+		MaxFileSize:         storage.SegmentSize,
+		Compression:         compression,
+		MasterKey:           masterKey,
+		IdempotencyWindow:   storage.IdempotencyWindow,
+		CacheSize:           storage.CacheSize,
+		SyncPolicy:          syncPolicy,
+		SyncInterval:        storage.SyncInterval,
+		ExpirySweepInterval: storage.ExpirySweepInterval,
+		MinFreeBytes:        storage.MinFreeBytes,
+	}
+	if len(storage.Erasure.ShardDirs) > 1 {
+		opts.Erasure = myfs.ErasureCoding{
+			ShardDirs:    storage.Erasure.ShardDirs,
+			DataShards:   storage.Erasure.DataShards,
+			ParityShards: storage.Erasure.ParityShards,
+		}
+	}
+	if tiering := storage.Tiering; tiering.Target != "" {
+		store, err := tiering.tierStore()
+		if err != nil {
+			return nil, err
+		}
+		opts.Tiering = myfs.TieringOptions{
+			Store:      store,
+			MinAge:     tiering.MinAge,
+			ColdAfter:  tiering.ColdAfter,
+			Interval:   tiering.Interval,
+			CacheDir:   tiering.CacheDir,
+			CacheBytes: tiering.CacheBytes,
+		}
+	}
+	return opts, nil
+}
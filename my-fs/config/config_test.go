@@ -0,0 +1,259 @@
+package config
+
+import (
+	"io/ioutil"
+	myfs "my-fs/fs"
+	"my-fs/limits"
+	"my-fs/tier"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "myfs.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// lookupIn 使用map代替环境变量
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  http_addr: ":8081"
+  shutdown_timeout: 5s
+storage:
+  file_store_path: /data/files
+  index_store_path: /data/index
+  segment_size: 1048576
+  sync_policy: periodic
+  sync_interval: 200ms
+  cache_size: 128
+  compression: zstd
+tls:
+  cert_file: /etc/myfs/cert.pem
+  key_file: /etc/myfs/key.pem
+`)
+	// 环境变量覆盖配置文件
+	conf, err := load(path, lookupIn(map[string]string{"CACHE_SIZE": "256", "S3_ADDR": ":9001", "MIN_FREE_BYTES": "10737418240"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Server.HTTPAddr != ":8081" || conf.Server.S3Addr != ":9001" || conf.Server.ShutdownTimeout != 5*time.Second {
+		t.Fatalf("unexpected server config %+v", conf.Server)
+	}
+	if conf.TLS.CertFile != "/etc/myfs/cert.pem" || conf.TLS.KeyFile != "/etc/myfs/key.pem" {
+		t.Fatalf("unexpected tls config %+v", conf.TLS)
+	}
+
+	opts, err := conf.StoreOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &myfs.Options{
+		MaxFileSize:  1048576,
+		Compression:  myfs.CompressionZstd,
+		CacheSize:    256,
+		SyncPolicy:   myfs.SyncPeriodic,
+		SyncInterval: 200 * time.Millisecond,
+		MinFreeBytes: 10 << 30,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Fatalf("unexpected store options %+v", opts)
+	}
+}
+
+func TestLoad_EnvOnly(t *testing.T) {
+	conf, err := load("", lookupIn(map[string]string{
+		"FILE_STORE_PATH":       "/disk1,/disk2,/disk3,/disk4",
+		"INDEX_STORE_PATH":      "/index",
+		"ERASURE_PARITY_SHARDS": "1",
+		"CLUSTER_BOOTSTRAP":     "false",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Server.HTTPAddr != defaultHTTPAddr || conf.Server.ShutdownTimeout != defaultShutdownTimeout {
+		t.Fatalf("expect defaults, got %+v", conf.Server)
+	}
+	erasure := conf.Storage.Erasure
+	if conf.Storage.FileStorePath != "/disk1" || len(erasure.ShardDirs) != 4 || erasure.DataShards != 3 || erasure.ParityShards != 1 {
+		t.Fatalf("unexpected erasure config %+v", conf.Storage)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+		env     map[string]string
+		expect  []string
+	}{
+		{
+			name:    "unknown field",
+			content: "storage:\n  file_store_pth: /data\n",
+			expect:  []string{"file_store_pth"},
+		},
+		{
+			name:   "invalid env value",
+			env:    map[string]string{"SEGMENT_SIZE": "64MB"},
+			expect: []string{"SEGMENT_SIZE", "64MB"},
+		},
+		{
+			name: "all problems are reported",
+			content: `
+storage:
+  file_store_path: /data
+  sync_policy: sometimes
+  compression: lz4
+  cache_size: -1
+tls:
+  cert_file: cert.pem
+cluster:
+  raft_addr: 127.0.0.1:7000
+`,
+			expect: []string{
+				"storage.index_store_path", "storage.sync_policy", "sometimes",
+				"storage.compression", "lz4", "storage.cache_size", "tls: cert_file and key_file", "cluster.node_id",
+			},
+		},
+		{
+			name:    "endpoint limits",
+			content: "storage:\n  index_store_path: /index\nlimits:\n  endpoints:\n    - route: write\n    - route: /read\n      burst: -2\n",
+			expect:  []string{"limits.endpoints[0].route", "limits.endpoints[1]: limits can not be less than -1"},
+		},
+		{
+			name:    "erasure shards",
+			content: "storage:\n  index_store_path: /index\n  erasure:\n    shard_dirs: [/a, /b, /c]\n    data_shards: 2\n    parity_shards: 2\n",
+			expect:  []string{"must equal the 3 shard dirs"},
+		},
+		{
+			name:    "tiering",
+			content: "storage:\n  index_store_path: /index\n  tiering:\n    target: s3:///prefix\n    cache_bytes: -1\n",
+			expect:  []string{"storage.tiering.target: invalid target", "can not be negative", "min_age or cold_after is required"},
+		},
+		{
+			name:   "presign expiry",
+			env:    map[string]string{"INDEX_STORE_PATH": "/index", "FILE_STORE_PATH": "/data", "MAX_PRESIGN_EXPIRY": "720h"},
+			expect: []string{"auth.max_presign_expiry"},
+		},
+		{
+			name:   "tiering without target",
+			env:    map[string]string{"INDEX_STORE_PATH": "/index", "FILE_STORE_PATH": "/data", "TIER_MIN_AGE": "24h"},
+			expect: []string{"storage.tiering.target: is required"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := ""
+			if c.content != "" {
+				path = writeConfig(t, c.content)
+			}
+			_, err := load(path, lookupIn(c.env))
+			if err == nil {
+				t.Fatal("expect config to be rejected")
+			}
+			for _, expect := range c.expect {
+				if !strings.Contains(err.Error(), expect) {
+					t.Errorf("expect error to mention %q, got %s", expect, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_Tiering(t *testing.T) {
+	dir := t.TempDir()
+	conf, err := load("", lookupIn(map[string]string{
+		"FILE_STORE_PATH":  filepath.Join(dir, "data"),
+		"INDEX_STORE_PATH": filepath.Join(dir, "index"),
+		"TIER_TARGET":      filepath.Join(dir, "cold"),
+		"TIER_COLD_AFTER":  "72h",
+		"TIER_CACHE_BYTES": "1048576",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := conf.StoreOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := opts.Tiering.Store.(*tier.DirStore); !ok || opts.Tiering.ColdAfter != 72*time.Hour || opts.Tiering.CacheBytes != 1<<20 {
+		t.Fatalf("unexpected tiering options %+v", opts.Tiering)
+	}
+
+	conf.Storage.Tiering.Target = "s3://cold/node-1"
+	conf.Storage.Tiering.S3Endpoint = "http://127.0.0.1:9000"
+	if opts, err = conf.StoreOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := opts.Tiering.Store.(*tier.S3Store); !ok {
+		t.Fatalf("expect an s3 store, got %T", opts.Tiering.Store)
+	}
+	s3Opts, isS3, err := parseS3Target("s3://cold/node-1/data")
+	if err != nil || !isS3 || s3Opts.Bucket != "cold" || s3Opts.Prefix != "node-1/data" {
+		t.Fatalf("unexpected s3 target %+v, err %v", s3Opts, err)
+	}
+}
+
+func TestConfig_LimitRules(t *testing.T) {
+	path := writeConfig(t, `
+storage:
+  file_store_path: /data/files
+  index_store_path: /data/index
+limits:
+  max_body_bytes: 1024
+  requests_per_second: 10
+  burst: 20
+  endpoints:
+    - route: post  /write
+      requests_per_second: 100
+    - route: /read
+      max_body_bytes: -1
+    - route: POST /admin/import
+      max_body_bytes: 1048576
+`)
+	conf, err := load(path, lookupIn(map[string]string{"REQUESTS_PER_SECOND": "5"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	global, routes := conf.LimitRules()
+	if want := (limits.Rule{MaxBodyBytes: 1024, RequestsPerSecond: 5, Burst: 20}); global != want {
+		t.Fatalf("unexpected global rule %+v", global)
+	}
+	want := map[string]limits.Rule{
+		// 单独配置请求频率时不使用全局的突发请求数
+		"POST /write":        {MaxBodyBytes: 1024, RequestsPerSecond: 100},
+		"/read":              {RequestsPerSecond: 5, Burst: 20},
+		"POST /admin/import": {MaxBodyBytes: 1048576, RequestsPerSecond: 5, Burst: 20},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("unexpected route rules %+v", routes)
+	}
+
+	// 导入的请求体默认有单独的限制
+	_, routes = Default().LimitRules()
+	if rule := routes["POST /admin/import"]; rule.MaxBodyBytes != defaultImportBodyBytes {
+		t.Fatalf("import should have its own body limit, got %+v", rule)
+	}
+}
+
+func TestLoad_Example(t *testing.T) {
+	conf, err := load("../myfs.example.yaml", lookupIn(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Storage.SegmentSize != 64*1024*1024 || conf.Storage.IdempotencyWindow != 24*time.Hour {
+		t.Fatalf("unexpected storage config %+v", conf.Storage)
+	}
+}
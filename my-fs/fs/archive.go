@@ -0,0 +1,427 @@
+package fs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"my-fs/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// archiveMagic 归档文件的开头，最后一个字节为格式版本
+const archiveMagic = "MYFSARC\x01"
+
+const (
+	// ArchiveFormatNative 长度前缀的归档格式，为默认格式
+	ArchiveFormatNative = "myfs"
+	// ArchiveFormatTar tar格式，每个chunk为名称是bucket/id的文件
+	ArchiveFormatTar = "tar"
+)
+
+const (
+	// 导出时每次列出的索引数量
+	exportPageSize = 1000
+	// 单条元数据的最大长度，防止损坏的归档导致分配过多内存
+	maxArchiveHeaderSize = 64 * 1024
+	// tar中保存etag与过期时间的PAX记录，使用扩展属性的形式，其他tar工具不会警告
+	tarETagRecord    = "SCHILY.xattr.user.myfs.etag"
+	tarExpiresRecord = "SCHILY.xattr.user.myfs.expires_at"
+	// tar文件头的大小以及ustar标识的位置
+	tarBlockSize   = 512
+	tarMagicOffset = 257
+)
+
+// ArchiveEntry 归档中一个chunk的元数据，之后紧跟Size字节的数据
+type ArchiveEntry struct {
+	Bucket  string
+	Id      string
+	Size    int64
+	ETag    string
+	ModTime int64 `json:",omitempty"`
+	// 过期时间，unix纳秒，导入时已经过期的chunk被跳过
+	ExpiresAt int64 `json:",omitempty"`
+}
+
+// ArchiveStats 导出或导入的统计信息
+type ArchiveStats struct {
+	Buckets int
+	Chunks  int
+	Bytes   int64
+	// 导入时被过滤条件跳过或者已经过期的chunk数量
+	Skipped int `json:",omitempty"`
+}
+
+// ArchiveOptions 导出与导入的选项
+type ArchiveOptions struct {
+	// 导出的归档格式，为空时使用ArchiveFormatNative，导入时根据文件头自动识别
+	Format string
+	// 只包含该bucket中的chunk，为空时包含所有bucket
+	Bucket string
+	// 只包含id以Prefix开头的chunk
+	Prefix string
+	// 每处理完一个chunk调用一次，参数为当前的统计信息
+	Progress func(stats ArchiveStats)
+}
+
+func (opts *ArchiveOptions) match(bucket, id string) bool {
+	return (opts.Bucket == "" || opts.Bucket == bucket) && strings.HasPrefix(id, opts.Prefix)
+}
+
+func (opts *ArchiveOptions) progress(stats *ArchiveStats) {
+	if opts.Progress != nil {
+		opts.Progress(*stats)
+	}
+}
+
+// archiveWriter 按照某种格式写入chunk
+type archiveWriter interface {
+	writeEntry(entry *ArchiveEntry, data []byte) error
+	close() error
+}
+
+// archiveReader 按照某种格式读取chunk，归档结束时返回io.EOF
+type archiveReader interface {
+	next() (*ArchiveEntry, []byte, error)
+}
+
+// Export 使用默认格式将所有bucket中最新版本的chunk连同id与元数据写入w
+func (fm *FileManager) Export(w io.Writer) (*ArchiveStats, error) {
+	return fm.ExportWithOptions(w, nil)
+}
+
+// ExportWithOptions 将满足过滤条件的chunk写入w，默认格式中每条记录为
+// varint编码的元数据长度、JSON编码的ArchiveEntry以及chunk的数据
+func (fm *FileManager) ExportWithOptions(w io.Writer, opts *ArchiveOptions) (*ArchiveStats, error) {
+	if opts == nil {
+		opts = &ArchiveOptions{}
+	}
+	var buckets []string
+	if opts.Bucket != "" {
+		if _, err := fm.GetBucket(opts.Bucket); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, opts.Bucket)
+	} else {
+		all, err := fm.ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range all {
+			buckets = append(buckets, bucket.Name)
+		}
+	}
+	writer, err := newArchiveWriter(w, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ArchiveStats{}
+	for _, bucket := range buckets {
+		if err = fm.exportBucket(writer, bucket, opts, stats); err != nil {
+			return stats, errors.Wrapf(err, "export bucket [%s] failed", bucket)
+		}
+		stats.Buckets++
+	}
+	return stats, writer.close()
+}
+
+func (fm *FileManager) exportBucket(writer archiveWriter, bucket string, opts *ArchiveOptions, stats *ArchiveStats) error {
+	listOpts := &ListOptions{Prefix: opts.Prefix, Limit: exportPageSize}
+	for {
+		indexes, err := fm.List(bucket, listOpts)
+		if err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			data, err := fm.ReadWithOptions(index.BlockId, &ReadOptions{Bucket: bucket})
+			if errors.Cause(err) == utils.ErrIndexNotFound {
+				// 列出之后被删除
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			sum := md5.Sum(data)
+			if err = writer.writeEntry(&ArchiveEntry{
+				Bucket:    bucket,
+				Id:        index.BlockId,
+				Size:      int64(len(data)),
+				ETag:      hex.EncodeToString(sum[:]),
+				ModTime:   index.ModTime,
+				ExpiresAt: index.ExpiresAt,
+			}, data); err != nil {
+				return err
+			}
+			stats.Chunks++
+			stats.Bytes += int64(len(data))
+			opts.progress(stats)
+		}
+		if len(indexes) < exportPageSize {
+			return nil
+		}
+		listOpts.StartAfter = indexes[len(indexes)-1].BlockId
+	}
+}
+
+// Import 导入归档中所有的chunk
+func (fm *FileManager) Import(r io.Reader) (*ArchiveStats, error) {
+	return fm.ImportWithOptions(r, nil)
+}
+
+// ImportWithOptions 读取Export生成的归档或tar，使用原有的id写入满足过滤条件的chunk，
+// 已经存在的id会被覆盖，不存在的bucket会被创建。数据的md5与元数据中的ETag不一致时
+// 返回ErrInvalidArchive，之前的记录已经写入
+func (fm *FileManager) ImportWithOptions(r io.Reader, opts *ArchiveOptions) (*ArchiveStats, error) {
+	if opts == nil {
+		opts = &ArchiveOptions{}
+	}
+	reader, err := newArchiveReader(r)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ArchiveStats{}
+	created := make(map[string]bool)
+	for {
+		entry, data, err := reader.next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		if !opts.match(entry.Bucket, entry.Id) || (entry.ExpiresAt > 0 && entry.ExpiresAt <= time.Now().UnixNano()) {
+			stats.Skipped++
+			continue
+		}
+		if !created[entry.Bucket] {
+			err = fm.CreateBucket(entry.Bucket, BucketQuota{})
+			if err != nil && errors.Cause(err) != utils.ErrBucketExists {
+				return stats, err
+			}
+			if err == nil {
+				stats.Buckets++
+			}
+			created[entry.Bucket] = true
+		}
+		if _, err = fm.WriteWithKey(entry.Id, data, &WriteOptions{Bucket: entry.Bucket, ExpiresAt: entry.ExpiresAt}); err != nil {
+			return stats, errors.Wrapf(err, "import chunk [%s/%s] failed", entry.Bucket, entry.Id)
+		}
+		stats.Chunks++
+		stats.Bytes += entry.Size
+		opts.progress(stats)
+	}
+}
+
+// CheckArchiveFormat 检查导出的格式是否支持
+func CheckArchiveFormat(format string) error {
+	switch format {
+	case "", ArchiveFormatNative, ArchiveFormatTar:
+		return nil
+	default:
+		return errors.Errorf("unknown archive format [%s]", format)
+	}
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	writer := bufio.NewWriter(w)
+	switch format {
+	case "", ArchiveFormatNative:
+		if _, err := writer.WriteString(archiveMagic); err != nil {
+			return nil, errors.Wrap(err, "write archive header failed")
+		}
+		return &nativeWriter{writer: writer}, nil
+	case ArchiveFormatTar:
+		return &tarWriter{writer: writer, tw: tar.NewWriter(writer)}, nil
+	default:
+		return nil, CheckArchiveFormat(format)
+	}
+}
+
+// newArchiveReader 根据文件头识别归档的格式
+func newArchiveReader(r io.Reader) (archiveReader, error) {
+	reader := bufio.NewReader(r)
+	if magic, _ := reader.Peek(len(archiveMagic)); string(magic) == archiveMagic {
+		reader.Discard(len(archiveMagic))
+		return &nativeReader{reader: reader}, nil
+	}
+	// 没有任何文件的tar只包含全为0的结束块
+	block, _ := reader.Peek(tarBlockSize)
+	if len(block) == tarBlockSize && (bytes.HasPrefix(block[tarMagicOffset:], []byte("ustar")) || bytes.Count(block, []byte{0}) == tarBlockSize) {
+		return &tarReader{tr: tar.NewReader(reader)}, nil
+	}
+	return nil, errors.Wrap(utils.ErrInvalidArchive, "unknown archive header")
+}
+
+type nativeWriter struct {
+	writer *bufio.Writer
+}
+
+func (w *nativeWriter) writeEntry(entry *ArchiveEntry, data []byte) error {
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "marshal archive entry failed")
+	}
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(header)))
+	for _, part := range [][]byte{lenBuf[:n], header, data} {
+		if _, err = w.writer.Write(part); err != nil {
+			return errors.Wrap(err, "write archive entry failed")
+		}
+	}
+	return nil
+}
+
+func (w *nativeWriter) close() error {
+	return errors.Wrap(w.writer.Flush(), "flush archive failed")
+}
+
+type nativeReader struct {
+	reader *bufio.Reader
+}
+
+// next 读取下一条记录并校验数据
+func (r *nativeReader) next() (*ArchiveEntry, []byte, error) {
+	headerLen, err := binary.ReadUvarint(r.reader)
+	if err == io.EOF {
+		return nil, nil, io.EOF
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(utils.ErrInvalidArchive, "read entry length failed")
+	}
+	if headerLen == 0 || headerLen > maxArchiveHeaderSize {
+		return nil, nil, errors.Wrapf(utils.ErrInvalidArchive, "entry header of %d bytes", headerLen)
+	}
+	header := make([]byte, headerLen)
+	if _, err = io.ReadFull(r.reader, header); err != nil {
+		return nil, nil, errors.Wrap(utils.ErrInvalidArchive, "truncated entry header")
+	}
+	entry := new(ArchiveEntry)
+	if err = json.Unmarshal(header, entry); err != nil {
+		return nil, nil, errors.Wrapf(utils.ErrInvalidArchive, "decode entry header failed: %s", err)
+	}
+	if entry.Id == "" || entry.Size < 0 {
+		return nil, nil, errors.Wrapf(utils.ErrInvalidArchive, "entry [%s/%s] has no id or a negative size", entry.Bucket, entry.Id)
+	}
+	data, err := readArchiveData(r.reader, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkArchiveETag(entry, data); err != nil {
+		return nil, nil, err
+	}
+	entry.Bucket = bucketOrDefault(entry.Bucket)
+	return entry, data, nil
+}
+
+type tarWriter struct {
+	writer *bufio.Writer
+	tw     *tar.Writer
+}
+
+// writeEntry 文件名为bucket/id，etag保存在PAX记录中
+func (w *tarWriter) writeEntry(entry *ArchiveEntry, data []byte) error {
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       entry.Bucket + "/" + entry.Id,
+		Size:       entry.Size,
+		Mode:       0644,
+		ModTime:    time.Unix(0, entry.ModTime),
+		PAXRecords: map[string]string{tarETagRecord: entry.ETag},
+		Format:     tar.FormatPAX,
+	}
+	if entry.ExpiresAt > 0 {
+		header.PAXRecords[tarExpiresRecord] = strconv.FormatInt(entry.ExpiresAt, 10)
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return errors.Wrap(err, "write archive entry failed")
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return errors.Wrap(err, "write archive entry failed")
+	}
+	return nil
+}
+
+func (w *tarWriter) close() error {
+	if err := w.tw.Close(); err != nil {
+		return errors.Wrap(err, "close archive failed")
+	}
+	return errors.Wrap(w.writer.Flush(), "flush archive failed")
+}
+
+type tarReader struct {
+	tr *tar.Reader
+}
+
+// next 跳过目录等非普通文件，其他工具生成的tar没有etag时不校验数据
+func (r *tarReader) next() (*ArchiveEntry, []byte, error) {
+	for {
+		header, err := r.tr.Next()
+		if err == io.EOF {
+			return nil, nil, io.EOF
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(utils.ErrInvalidArchive, "read tar header failed: %s", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		i := strings.Index(name, "/")
+		if i <= 0 || i == len(name)-1 {
+			return nil, nil, errors.Wrapf(utils.ErrInvalidArchive, "tar entry [%s] is not named bucket/id", header.Name)
+		}
+		entry := &ArchiveEntry{
+			Bucket:  name[:i],
+			Id:      name[i+1:],
+			Size:    header.Size,
+			ETag:    header.PAXRecords[tarETagRecord],
+			ModTime: header.ModTime.UnixNano(),
+		}
+		if expiresAt, ok := header.PAXRecords[tarExpiresRecord]; ok {
+			if entry.ExpiresAt, err = strconv.ParseInt(expiresAt, 10, 64); err != nil {
+				return nil, nil, errors.Wrapf(utils.ErrInvalidArchive, "tar entry [%s] has an invalid expiry [%s]", header.Name, expiresAt)
+			}
+		}
+		data, err := readArchiveData(r.tr, entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry.ETag != "" {
+			if err = checkArchiveETag(entry, data); err != nil {
+				return nil, nil, err
+			}
+		}
+		return entry, data, nil
+	}
+}
+
+// readArchiveData 读取entry.Size字节的数据，按实际读到的数据分配内存，
+// 记录中声明的大小超过剩余的输入时返回ErrInvalidArchive，而不是预先分配声明的大小
+func readArchiveData(r io.Reader, entry *ArchiveEntry) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, entry.Size))
+	// tar在数据不足时返回io.ErrUnexpectedEOF，其他错误例如请求体超过限制原样返回
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrapf(err, "read data of chunk [%s/%s] failed", entry.Bucket, entry.Id)
+	}
+	if err != nil || int64(len(data)) != entry.Size {
+		return nil, errors.Wrapf(utils.ErrInvalidArchive, "truncated data of chunk [%s/%s]", entry.Bucket, entry.Id)
+	}
+	return data, nil
+}
+
+func checkArchiveETag(entry *ArchiveEntry, data []byte) error {
+	sum := md5.Sum(data)
+	if hex.EncodeToString(sum[:]) != entry.ETag {
+		return errors.Wrapf(utils.ErrInvalidArchive, "chunk [%s/%s] does not match etag [%s]", entry.Bucket, entry.Id, entry.ETag)
+	}
+	return nil
+}
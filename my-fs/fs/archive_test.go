@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"my-fs/utils"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileManager_ExportImport(t *testing.T) {
+	src := newTestFileManager(t)
+	if err := src.CreateBucket("photos", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	// 超过一页，检查分页
+	for i := 0; i < exportPageSize+5; i++ {
+		id := fmt.Sprintf("key-%04d", i)
+		if _, err := src.WriteWithKey(id, []byte("data-"+id), nil); err != nil {
+			t.Fatal(err)
+		}
+		want[DefaultBucket+"/"+id] = "data-" + id
+	}
+	if _, err := src.WriteWithKey("cat.jpg", []byte("meow"), &WriteOptions{Bucket: "photos"}); err != nil {
+		t.Fatal(err)
+	}
+	want["photos/cat.jpg"] = "meow"
+	if err := src.Delete("key-0000"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, DefaultBucket+"/key-0000")
+
+	archive := new(bytes.Buffer)
+	stats, err := src.Export(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Buckets != 2 || stats.Chunks != len(want) {
+		t.Fatalf("unexpected export stats %+v", stats)
+	}
+	data := archive.Bytes()
+
+	dst := newTestFileManager(t)
+	if stats, err = dst.Import(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Buckets != 1 || stats.Chunks != len(want) {
+		t.Fatalf("unexpected import stats %+v", stats)
+	}
+	for name, value := range want {
+		bucket, id := DefaultBucket, name[len(DefaultBucket)+1:]
+		if name == "photos/cat.jpg" {
+			bucket, id = "photos", "cat.jpg"
+		}
+		got, err := dst.ReadWithOptions(id, &ReadOptions{Bucket: bucket})
+		if err != nil || string(got) != value {
+			t.Fatalf("read %s after import: got %q, %v", name, got, err)
+		}
+	}
+
+	// 损坏的数据与截断的归档都会被拒绝
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err = newTestFileManager(t).Import(bytes.NewReader(corrupted)); errors.Cause(err) != utils.ErrInvalidArchive {
+		t.Fatalf("expect ErrInvalidArchive for corrupted data, got %v", err)
+	}
+	if _, err = newTestFileManager(t).Import(bytes.NewReader(data[:len(data)-1])); errors.Cause(err) != utils.ErrInvalidArchive {
+		t.Fatalf("expect ErrInvalidArchive for truncated archive, got %v", err)
+	}
+	if _, err = newTestFileManager(t).Import(bytes.NewReader([]byte("not an archive"))); errors.Cause(err) != utils.ErrInvalidArchive {
+		t.Fatalf("expect ErrInvalidArchive for unknown header, got %v", err)
+	}
+}
+
+// TestFileManager_ImportHugeSize 记录声明的大小远超过实际数据时不会按声明的大小分配内存
+func TestFileManager_ImportHugeSize(t *testing.T) {
+	const huge = 9e18
+	native := new(bytes.Buffer)
+	writer, err := newArchiveWriter(native, ArchiveFormatNative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.writeEntry(&ArchiveEntry{Bucket: DefaultBucket, Id: "huge", Size: huge}, []byte("tiny")); err != nil {
+		t.Fatal(err)
+	}
+	writer.close()
+
+	crafted := new(bytes.Buffer)
+	tw := tar.NewWriter(crafted)
+	if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "default/huge", Mode: 0644, Size: huge}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("tiny"))
+	tw.Flush()
+
+	fm := newTestFileManager(t)
+	for name, archive := range map[string][]byte{"native": native.Bytes(), "tar": crafted.Bytes()} {
+		if _, err = fm.Import(bytes.NewReader(archive)); errors.Cause(err) != utils.ErrInvalidArchive {
+			t.Fatalf("expect ErrInvalidArchive for a %s entry with a huge size, got %v", name, err)
+		}
+	}
+}
+
+func TestFileManager_ExportImportTar(t *testing.T) {
+	src := newTestFileManager(t)
+	if err := src.CreateBucket("photos", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"2021/a.jpg", "2021/b.jpg", "2022/c.jpg"} {
+		if _, err := src.WriteWithKey(id, []byte("data-"+id), &WriteOptions{Bucket: "photos"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := src.WriteWithKey("2021/other", []byte("other"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 导出时按bucket与前缀过滤
+	archive := new(bytes.Buffer)
+	var progress []ArchiveStats
+	stats, err := src.ExportWithOptions(archive, &ArchiveOptions{
+		Format:   ArchiveFormatTar,
+		Bucket:   "photos",
+		Prefix:   "2021/",
+		Progress: func(stats ArchiveStats) { progress = append(progress, stats) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Buckets != 1 || stats.Chunks != 2 || len(progress) != 2 || progress[1].Chunks != 2 {
+		t.Fatalf("unexpected export stats %+v, progress %+v", stats, progress)
+	}
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	header, err := tr.Next()
+	if err != nil || header.Name != "photos/2021/a.jpg" || header.PAXRecords[tarETagRecord] == "" {
+		t.Fatalf("unexpected tar header %+v, err %v", header, err)
+	}
+	if _, err = src.ExportWithOptions(new(bytes.Buffer), &ArchiveOptions{Bucket: "missing"}); errors.Cause(err) != utils.ErrBucketNotFound {
+		t.Fatalf("expect ErrBucketNotFound, got %v", err)
+	}
+	if _, err = src.ExportWithOptions(new(bytes.Buffer), &ArchiveOptions{Format: "zip"}); err == nil {
+		t.Fatal("expect an error for an unknown format")
+	}
+
+	// 导入时同样可以过滤
+	dst := newTestFileManager(t)
+	if stats, err = dst.ImportWithOptions(bytes.NewReader(archive.Bytes()), &ArchiveOptions{Prefix: "2021/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks != 1 || stats.Skipped != 1 {
+		t.Fatalf("unexpected import stats %+v", stats)
+	}
+	if got, err := dst.ReadWithOptions("2021/b.jpg", &ReadOptions{Bucket: "photos"}); err != nil || string(got) != "data-2021/b.jpg" {
+		t.Fatalf("read after import: got %q, %v", got, err)
+	}
+	if _, err = dst.ReadWithOptions("2021/a.jpg", &ReadOptions{Bucket: "photos"}); errors.Cause(err) != utils.ErrIndexNotFound {
+		t.Fatalf("expect ErrIndexNotFound for a filtered chunk, got %v", err)
+	}
+
+	// 其他工具生成的tar，包含目录并且没有etag
+	handmade := new(bytes.Buffer)
+	tw := tar.NewWriter(handmade)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./docs/", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./docs/readme.txt", Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	if stats, err = dst.Import(bytes.NewReader(handmade.Bytes())); err != nil || stats.Chunks != 1 {
+		t.Fatalf("unexpected import stats %+v, err %v", stats, err)
+	}
+	if got, err := dst.ReadWithOptions("readme.txt", &ReadOptions{Bucket: "docs"}); err != nil || string(got) != "hello" {
+		t.Fatalf("read after import: got %q, %v", got, err)
+	}
+
+	// etag不一致的tar会被拒绝
+	corrupted := append([]byte(nil), archive.Bytes()...)
+	i := bytes.Index(corrupted, []byte("data-2021/a.jpg"))
+	corrupted[i] ^= 0xff
+	if _, err = newTestFileManager(t).Import(bytes.NewReader(corrupted)); errors.Cause(err) != utils.ErrInvalidArchive {
+		t.Fatalf("expect ErrInvalidArchive for corrupted data, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package fs
+
+import (
+	"log"
+	"my-fs/utils"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBucket 未指定bucket时使用的默认bucket
+const DefaultBucket = "default"
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// Bucket 存储桶，不同的bucket拥有独立的索引前缀与配额
+type Bucket struct {
+	Name string
+	// 配额，0表示不限制
+	Quota BucketQuota
+	// 已经使用的字节数
+	UsedBytes int64
+	// 已经保存的chunk数量
+	ObjectCount int64
+	// 创建时间，unix时间戳
+	CreatedAt int64
+	// 是否开启了版本控制
+	Versioning bool
+}
+
+// BucketQuota bucket的配额限制，也用于限制写入者的用量
+type BucketQuota struct {
+	MaxBytes   int64
+	MaxObjects int64
+	// 每秒写入的字节数，允许一秒的突发写入
+	MaxBytesPerSecond int64
+}
+
+// checkQuota 检测写入size字节的新chunk后是否会超过配额
+func (b *Bucket) checkQuota(size int64) error {
+	return checkUsage(utils.QuotaScopeBucket, b.Name, b.Quota, b.UsedBytes, b.ObjectCount, size)
+}
+
+// CheckQuota 检测再写入size字节的新chunk是否会超过bucket的配额，用于在写入之前提前检查，
+// 例如S3网关接收分段时检查分段将要合并到的bucket
+func (b *Bucket) CheckQuota(size int64) error {
+	return b.checkQuota(size)
+}
+
+func checkBucketName(name string) error {
+	if !bucketNameRegexp.MatchString(name) {
+		return errors.Wrapf(utils.ErrInvalidBucketName, "bucket name [%s]", name)
+	}
+	return nil
+}
+
+// CreateBucket 创建一个新的bucket
+func (fm *FileManager) CreateBucket(name string, quota BucketQuota) error {
+	if err := checkBucketName(name); err != nil {
+		return err
+	}
+	if err := fm.checkWritable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	_, err := fm.indexStore.FetchBucket(name)
+	if err == nil {
+		return errors.Wrapf(utils.ErrBucketExists, "bucket [%s]", name)
+	}
+	if errors.Cause(err) != utils.ErrBucketNotFound {
+		return err
+	}
+	return fm.indexStore.SaveBucket(&Bucket{
+		Name:      name,
+		Quota:     quota,
+		CreatedAt: time.Now().Unix(),
+	}, true)
+}
+
+// SetBucketQuota 修改bucket的配额，已经超出配额的数据不会被删除，只是无法继续写入
+func (fm *FileManager) SetBucketQuota(name string, quota BucketQuota) error {
+	if err := fm.checkWritable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	bucket, err := fm.indexStore.FetchBucket(name)
+	if err != nil {
+		return err
+	}
+	bucket.Quota = quota
+	return fm.indexStore.SaveBucket(bucket, true)
+}
+
+// DeleteBucket 删除bucket，如果bucket中仍有数据，只有force为true时才会删除
+// bucket中的数据只删除索引，文件中的记录留给之后的压缩处理
+func (fm *FileManager) DeleteBucket(name string, force bool) error {
+	if name == DefaultBucket {
+		return errors.Wrap(utils.ErrInvalidBucketName, "default bucket can not be deleted")
+	}
+	if err := fm.checkWritable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	bucket, err := fm.indexStore.FetchBucket(name)
+	if err != nil {
+		return err
+	}
+	if !force {
+		indexes, err := fm.indexStore.ListIndex(name, &ListOptions{Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(indexes) > 0 || bucket.ObjectCount > 0 {
+			return errors.Wrapf(utils.ErrBucketNotEmpty, "bucket [%s] holds %d objects", name, bucket.ObjectCount)
+		}
+	} else if err = fm.releaseOwnerUsage(name); err != nil {
+		return err
+	}
+	delete(fm.limiters, utils.QuotaScopeBucket+"/"+name)
+	return fm.indexStore.DeleteBucket(name, true)
+}
+
+// releaseOwnerUsage 强制删除bucket之前，从写入者的用量中扣除bucket中的数据
+// 与删除bucket不是原子的，中间宕机时写入者的用量会偏小，重建索引可以修正
+func (fm *FileManager) releaseOwnerUsage(name string) error {
+	scanner, ok := fm.indexStore.(indexScanner)
+	if !ok {
+		return nil
+	}
+	owners := fm.newOwnerUsages()
+	err := scanner.scanIndexes(func(index *BlockIndex, version bool) error {
+		// 有版本号的最新数据已经在版本中计算
+		if index.Bucket != name || index.DeleteMarker || (!version && index.VersionId != "") {
+			return nil
+		}
+		return owners.add(index.Owner, -index.Size, -1)
+	})
+	if err != nil || len(owners.usages) == 0 {
+		return err
+	}
+	batch := new(IndexBatch)
+	owners.save(batch)
+	return fm.indexStore.WriteBatch(batch, true)
+}
+
+// GetBucket 获取bucket的元数据以及使用情况
+func (fm *FileManager) GetBucket(name string) (*Bucket, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	return fm.indexStore.FetchBucket(name)
+}
+
+// ListBuckets 列出所有的bucket
+func (fm *FileManager) ListBuckets() ([]*Bucket, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	return fm.indexStore.ListBuckets()
+}
+
+// List 列出bucket中的block索引，按id的字典序排序
+func (fm *FileManager) List(bucket string, opts *ListOptions) ([]*BlockIndex, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	if _, err := fm.indexStore.FetchBucket(bucket); err != nil {
+		return nil, err
+	}
+	return fm.listUnexpired(bucket, opts)
+}
+
+// listUnexpired 列出没有过期的索引，过期的索引被跳过，由之后的分页补齐Limit
+func (fm *FileManager) listUnexpired(bucket string, opts *ListOptions) ([]*BlockIndex, error) {
+	page := ListOptions{}
+	if opts != nil {
+		page = *opts
+	}
+	limit := page.Limit
+	now := time.Now().UnixNano()
+	var indexes []*BlockIndex
+	for {
+		listed, err := fm.indexStore.ListIndex(bucket, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range listed {
+			if !index.expired(now) {
+				indexes = append(indexes, index)
+			}
+		}
+		if limit <= 0 || len(listed) < page.Limit || len(indexes) >= limit {
+			return indexes, nil
+		}
+		page.StartAfter = listed[len(listed)-1].BlockId
+		page.Limit = limit - len(indexes)
+	}
+}
+
+// legacyIndexLister 可以列出旧版本没有bucket的索引的索引数据库
+type legacyIndexLister interface {
+	listLegacyIndexes() (bool, []*BlockIndex, error)
+}
+
+// migrateLegacyIndexes 将旧版本没有bucket的索引一次性移到默认bucket中，之后只按bucket读取索引，
+// 迁移与用量的更新在同一个batch中写入，默认bucket中已经存在相同id时保留新的索引
+func (fm *FileManager) migrateLegacyIndexes() error {
+	lister, ok := fm.indexStore.(legacyIndexLister)
+	if !ok {
+		return nil
+	}
+	migrated, indexes, err := lister.listLegacyIndexes()
+	if err != nil || migrated {
+		return err
+	}
+	bucket, err := fm.indexStore.FetchBucket(DefaultBucket)
+	if errors.Cause(err) == utils.ErrBucketNotFound {
+		// 集群中还没有leader创建默认bucket，下次打开时再迁移
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	batch := new(IndexBatch)
+	owners := fm.newOwnerUsages()
+	for _, index := range indexes {
+		batch.DeleteIndex("", index.BlockId)
+		if _, err = fm.indexStore.FetchBucketIndex(DefaultBucket, index.BlockId); err == nil {
+			continue
+		} else if err != utils.ErrIndexNotFound {
+			return err
+		}
+		index.Bucket = DefaultBucket
+		batch.PutIndex(index)
+		bucket.UsedBytes += index.Size
+		bucket.ObjectCount++
+		if err = owners.add(index.Owner, index.Size, 1); err != nil {
+			return err
+		}
+	}
+	if len(indexes) > 0 {
+		batch.PutBucket(bucket)
+		owners.save(batch)
+		log.Printf("migrate %d legacy indexes to bucket [%s]", len(indexes), DefaultBucket)
+	}
+	batch.MarkLegacyMigrated()
+	return fm.indexStore.WriteBatch(batch, true)
+}
+
+// ensureDefaultBucket 确保默认bucket存在
+func (fm *FileManager) ensureDefaultBucket() error {
+	err := fm.CreateBucket(DefaultBucket, BucketQuota{})
+	if errors.Cause(err) == utils.ErrBucketExists {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package fs
+
+import (
+	"bytes"
+	"my-fs/utils"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newTestFileManager(t *testing.T) *FileManager {
+	dir := t.TempDir()
+	fm, err := NewFileManager(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	return fm
+}
+
+func TestFileManager_BucketIsolation(t *testing.T) {
+	fm := newTestFileManager(t)
+	if err := fm.CreateBucket("team-a", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.CreateBucket("team-a", BucketQuota{}); errors.Cause(err) != utils.ErrBucketExists {
+		t.Fatalf("err should be ErrBucketExists, got %v", err)
+	}
+
+	id, err := fm.WriteWithOptions([]byte("hello"), &WriteOptions{Bucket: "team-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fm.ReadWithOptions(id, &ReadOptions{Bucket: "team-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("hello")) {
+		t.Fatalf("read %q, want hello", data)
+	}
+	if _, err = fm.Read(id); err != utils.ErrIndexNotFound {
+		t.Fatalf("chunk should not be visible in default bucket, err=%v", err)
+	}
+
+	defaultId, err := fm.Write([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes, err := fm.List("team-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].BlockId != id {
+		t.Fatalf("team-a should only list %s, got %v", id, indexes)
+	}
+	indexes, err = fm.List(DefaultBucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].BlockId != defaultId {
+		t.Fatalf("default bucket should only list %s, got %v", defaultId, indexes)
+	}
+
+	if _, err = fm.WriteWithOptions([]byte("x"), &WriteOptions{Bucket: "missing"}); errors.Cause(err) != utils.ErrBucketNotFound {
+		t.Fatalf("err should be ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestFileManager_BucketQuota(t *testing.T) {
+	fm := newTestFileManager(t)
+	if err := fm.CreateBucket("small", BucketQuota{MaxBytes: 10, MaxObjects: 2}); err != nil {
+		t.Fatal(err)
+	}
+	opts := &WriteOptions{Bucket: "small"}
+	if _, err := fm.WriteWithOptions([]byte("0123456789a"), opts); errors.Cause(err) != utils.ErrQuotaExceeded {
+		t.Fatalf("err should be ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := fm.WriteWithOptions([]byte("0123"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fm.WriteWithOptions([]byte("4567"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fm.WriteWithOptions([]byte("8"), opts); errors.Cause(err) != utils.ErrQuotaExceeded {
+		t.Fatalf("err should be ErrQuotaExceeded, got %v", err)
+	}
+
+	bucket, err := fm.GetBucket("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.UsedBytes != 8 || bucket.ObjectCount != 2 {
+		t.Fatalf("bucket usage should be 8 bytes and 2 objects, got %d and %d", bucket.UsedBytes, bucket.ObjectCount)
+	}
+}
+
+func TestFileManager_DeleteBucket(t *testing.T) {
+	fm := newTestFileManager(t)
+	if err := fm.CreateBucket("tmp", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fm.WriteWithOptions([]byte("data"), &WriteOptions{Bucket: "tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteBucket("tmp", false); errors.Cause(err) != utils.ErrBucketNotEmpty {
+		t.Fatalf("err should be ErrBucketNotEmpty, got %v", err)
+	}
+	if err = fm.DeleteBucket("tmp", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.GetBucket("tmp"); err != utils.ErrBucketNotFound {
+		t.Fatalf("err should be ErrBucketNotFound, got %v", err)
+	}
+	if _, err = fm.indexStore.FetchBucketIndex("tmp", id); err != utils.ErrIndexNotFound {
+		t.Fatalf("index should be removed with the bucket, err=%v", err)
+	}
+	if err = fm.DeleteBucket(DefaultBucket, true); errors.Cause(err) != utils.ErrInvalidBucketName {
+		t.Fatalf("default bucket should not be deleted, err=%v", err)
+	}
+}
+
+func TestIndexStore_ListIndex(t *testing.T) {
+	fm := newTestFileManager(t)
+	for _, id := range []string{"a1", "a2", "a3", "b1"} {
+		if err := fm.indexStore.SaveIndex(&BlockIndex{Bucket: DefaultBucket, BlockId: id}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexes, err := fm.List(DefaultBucket, &ListOptions{Prefix: "a", StartAfter: "a1", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].BlockId != "a2" {
+		t.Fatalf("should list a2, got %v", indexes)
+	}
+}
+
+// TestFileManager_LegacyIndexMigration 没有bucket之前写入的索引在打开时移到默认bucket，之后不再按原始key读取
+func TestFileManager_LegacyIndexMigration(t *testing.T) {
+	dir := t.TempDir()
+	fileStorePath, indexStorePath := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	fm, err := NewFileManager(fileStorePath, indexStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.CreateBucket("team-a", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("secret", []byte("secret-of-a"), &WriteOptions{Bucket: "team-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("old", []byte("legacy"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟旧版本的索引：key为chunk的id，值中没有bucket，默认bucket的用量中也没有统计
+	index, err := fm.indexStore.FetchBucketIndex(DefaultBucket, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := fm.indexStore.FetchBucket(DefaultBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket.UsedBytes, bucket.ObjectCount = 0, 0
+	index.Bucket = ""
+	batch := new(IndexBatch)
+	batch.DeleteIndex(DefaultBucket, "old")
+	batch.PutIndex(index)
+	batch.PutBucket(bucket)
+	batch.batch.Delete([]byte(legacyMigratedKey))
+	if err = fm.indexStore.WriteBatch(batch, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm, err = NewFileManager(fileStorePath, indexStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if data, err := fm.Read("old"); err != nil || string(data) != "legacy" {
+		t.Fatalf("legacy chunk should be readable, got %q, err %v", data, err)
+	}
+	if _, err = fm.indexStore.FetchIndex("old"); err != utils.ErrIndexNotFound {
+		t.Fatalf("legacy key should be removed, err %v", err)
+	}
+	indexes, err := fm.List(DefaultBucket, nil)
+	if err != nil || len(indexes) != 1 || indexes[0].BlockId != "old" {
+		t.Fatalf("legacy chunk should be listed, got %v, err %v", indexes, err)
+	}
+	if bucket, err = fm.GetBucket(DefaultBucket); err != nil || bucket.ObjectCount != 1 || bucket.UsedBytes != int64(len("legacy")) {
+		t.Fatalf("legacy chunk should be counted in the default bucket, got %+v, err %v", bucket, err)
+	}
+
+	// 其他记录的key不能作为默认bucket中的id读取
+	for _, id := range []string{"index/team-a/secret", "bucket/default", "bucket/team-a", legacyMigratedKey} {
+		if _, err = fm.Read(id); err != utils.ErrIndexNotFound {
+			t.Fatalf("read of %s should not find anything, err %v", id, err)
+		}
+		if _, err = fm.Stat(id, nil); err != utils.ErrIndexNotFound {
+			t.Fatalf("stat of %s should not find anything, err %v", id, err)
+		}
+	}
+
+	if err = fm.Delete("old"); err != nil {
+		t.Fatal(err)
+	}
+	if bucket, err = fm.GetBucket(DefaultBucket); err != nil || bucket.ObjectCount != 0 || bucket.UsedBytes != 0 {
+		t.Fatalf("usage should be released, got %+v, err %v", bucket, err)
+	}
+}
@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"log"
+	pb "my-fs/proto"
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+// CompactionStats 一次压缩的统计信息
+type CompactionStats struct {
+	// 被压缩删除的文件数量
+	Segments int
+	// 仍然被引用，被搬迁到当前文件中的记录数量
+	LiveRecords int
+	// 被丢弃的记录数量
+	DroppedRecords int
+	// 释放的磁盘空间
+	ReclaimedBytes int64
+}
+
+// Compact 压缩所有已经写满的文件，仍然被索引或版本引用的记录会被追加到当前文件中，之后删除原文件
+// 被覆盖、删除的chunk以及删除记录会被丢弃，删除标记只要对应的版本仍然存在就会被保留
+func (fm *FileManager) Compact() (*CompactionStats, error) {
+	// 从节点的文件布局必须与主节点一致
+	if err := fm.checkWritable(); err != nil {
+		return nil, err
+	}
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	fm.writeMutx.Lock()
+	lastFileSeq := fm.checkpoint.lastFileSeq
+	fm.writeMutx.Unlock()
+
+	stats := &CompactionStats{}
+	// 从旧到新依次压缩，保证压缩某个文件时比它更旧的记录都已经被处理过，删除记录可以安全地丢弃
+	for _, seq := range seqs {
+		if seq >= lastFileSeq {
+			break
+		}
+		if err := fm.compactFile(seq, stats); err != nil {
+			return stats, errors.Wrapf(err, "compact file [%s] failed", buildFileName(seq))
+		}
+	}
+	if stats.Segments > 0 {
+		log.Printf("compacted %d files, moved %d records, dropped %d records, reclaimed %d bytes",
+			stats.Segments, stats.LiveRecords, stats.DroppedRecords, stats.ReclaimedBytes)
+	}
+	return stats, nil
+}
+
+func (fm *FileManager) compactFile(seq int, stats *CompactionStats) error {
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	fileSize, err := fm.segmentSize(seq)
+	if err != nil {
+		return err
+	}
+	stream, err := fm.openSegmentStream(seq, 0)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+
+	batch := new(IndexBatch)
+	var movedBytes int64
+	for {
+		chunkBytes, placement, err := stream.nextChunkBytesAndPlacement()
+		if err == utils.ErrUnexpectedEndOfFile || (err == nil && chunkBytes == nil) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// 重新写入时会使用当前的数据密钥加密
+		chunk, err := fm.decodeChunk(chunkBytes)
+		if err != nil {
+			return err
+		}
+		latest, version, err := fm.referencedIndexes(chunk, seq, placement.chunkStartOffset)
+		if err != nil {
+			return err
+		}
+		if latest == nil && version == nil {
+			stats.DroppedRecords++
+			continue
+		}
+
+		moved, err := fm.appendChunk(chunk)
+		if err != nil {
+			return err
+		}
+		movedBytes += stream.offset() - placement.chunkStartOffset
+		stats.LiveRecords++
+		if latest != nil {
+			latest.FSeq, latest.Offset = moved.FSeq, moved.Offset
+			batch.PutIndex(latest)
+		}
+		if version != nil {
+			version.FSeq, version.Offset = moved.FSeq, moved.Offset
+			batch.PutVersion(version)
+		}
+	}
+
+	// 更新索引与删除文件之间不能有读取，否则可能读到旧的位置
+	fm.segmentMutx.Lock()
+	defer fm.segmentMutx.Unlock()
+	if batch.Len() > 0 {
+		if err = fm.indexStore.WriteBatch(batch, true); err != nil {
+			return err
+		}
+	}
+	if err = fm.removeSegment(seq); err != nil {
+		return err
+	}
+	stats.Segments++
+	stats.ReclaimedBytes += fileSize - movedBytes
+	return nil
+}
+
+// referencedIndexes 返回仍然指向(seq, offset)处记录的最新索引以及版本，都为nil表示该记录可以丢弃
+func (fm *FileManager) referencedIndexes(chunk *pb.Chunk, seq int, offset int64) (*BlockIndex, *BlockIndex, error) {
+	// 删除记录与永久删除版本的记录只用于覆盖更旧的记录，更旧的记录已经被压缩，可以丢弃
+	if chunk.Purge || (chunk.Deleted && chunk.VersionId == "") {
+		return nil, nil, nil
+	}
+	pointsHere := func(index *BlockIndex) bool {
+		return index.Node == fm.opts.NodeId && index.FSeq == seq && index.Offset == uint64(offset)
+	}
+
+	var latest, version *BlockIndex
+	index, err := fm.indexStore.FetchBucketIndex(chunk.Bucket, chunk.Id)
+	if err != nil && err != utils.ErrIndexNotFound {
+		return nil, nil, err
+	}
+	if err == nil && pointsHere(index) {
+		latest = index
+	}
+	if chunk.VersionId != "" {
+		index, err = fm.indexStore.FetchVersion(chunk.Bucket, chunk.Id, chunk.VersionId)
+		if err != nil && err != utils.ErrIndexNotFound {
+			return nil, nil, err
+		}
+		if err == nil && pointsHere(index) {
+			version = index
+		}
+	}
+	return latest, version, nil
+}
@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileManager_Compact(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	fm, err := NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.CreateBucket("versioned", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.SetBucketVersioning("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("key-%d", i), payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 覆盖和删除一半的数据
+	for i := 0; i < 5; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("key-%d", i), []byte("new"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = fm.Delete(fmt.Sprintf("key-%d", i+5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := fm.WriteWithKey("doc", []byte("old"), &WriteOptions{Bucket: "versioned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteWithOptions("doc", &DeleteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	// 写入足够多的数据，保证上面的记录都在已经写满的文件中
+	for i := 0; i < 3; i++ {
+		if _, err = fm.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filesBefore, err := listFileSeqs(fileStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := fm.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segments == 0 || stats.DroppedRecords == 0 || stats.ReclaimedBytes <= 0 {
+		t.Fatalf("compaction should reclaim space, got %+v", stats)
+	}
+	filesAfter, err := listFileSeqs(fileStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filesAfter[0] <= filesBefore[0] {
+		t.Fatalf("old files should be removed, before %v, after %v", filesBefore, filesAfter)
+	}
+
+	check := func(fm *FileManager) {
+		for i := 0; i < 5; i++ {
+			data, err := fm.Read(fmt.Sprintf("key-%d", i))
+			if err != nil || string(data) != "new" {
+				t.Fatalf("key-%d should be new, got %q, err=%v", i, data, err)
+			}
+			if _, err = fm.Read(fmt.Sprintf("key-%d", i+5)); err == nil {
+				t.Fatalf("key-%d should stay deleted", i+5)
+			}
+		}
+		// 删除标记和旧版本仍然被版本引用，压缩后保持一致
+		versions, err := fm.ListVersions("versioned", "doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || !versions[0].DeleteMarker {
+			t.Fatalf("unexpected versions %v", versions)
+		}
+		data, err := fm.ReadWithOptions("doc", &ReadOptions{Bucket: "versioned", VersionId: old.VersionId})
+		if err != nil || string(data) != "old" {
+			t.Fatalf("old version should be readable, got %q, err=%v", data, err)
+		}
+	}
+	check(fm)
+	fm.Close()
+
+	fm, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	check(fm)
+	// 再次压缩时，搬迁过来的记录仍然有效
+	if _, err = fm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(fm)
+}
@@ -0,0 +1,106 @@
+package fs
+
+import (
+	pb "my-fs/proto"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression chunk的压缩算法
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// minCompressSize 小于该大小的payload不压缩
+const minCompressSize = 64
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// CompressionStats 自启动以来的压缩统计
+type CompressionStats struct {
+	// 写入的原始payload大小
+	RawBytes int64
+	// 实际保存的payload大小
+	StoredBytes int64
+	// 被压缩的chunk数量
+	CompressedChunks int64
+	// 因为压缩没有效果而保存原始数据的chunk数量
+	SkippedChunks int64
+}
+
+// Ratio 返回保存的大小与原始大小的比值，越小表示压缩效果越好
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.RawBytes)
+}
+
+func (fm *FileManager) CompressionStats() CompressionStats {
+	return CompressionStats{
+		RawBytes:         atomic.LoadInt64(&fm.compressionStats.RawBytes),
+		StoredBytes:      atomic.LoadInt64(&fm.compressionStats.StoredBytes),
+		CompressedChunks: atomic.LoadInt64(&fm.compressionStats.CompressedChunks),
+		SkippedChunks:    atomic.LoadInt64(&fm.compressionStats.SkippedChunks),
+	}
+}
+
+// compress 使用配置的算法压缩payload，压缩后没有变小时返回原始数据
+func (fm *FileManager) compress(data []byte) ([]byte, pb.Codec) {
+	compression := fm.opts.Compression
+	if compression == CompressionNone || len(data) < minCompressSize {
+		fm.recordCompression(len(data), len(data), false)
+		return data, pb.Codec_NONE
+	}
+
+	var compressed []byte
+	var codec pb.Codec
+	switch compression {
+	case CompressionSnappy:
+		compressed, codec = snappy.Encode(nil, data), pb.Codec_SNAPPY
+	case CompressionZstd:
+		compressed, codec = zstdEncoder.EncodeAll(data, nil), pb.Codec_ZSTD
+	}
+	if compressed == nil || len(compressed) >= len(data) {
+		fm.recordCompression(len(data), len(data), false)
+		return data, pb.Codec_NONE
+	}
+	fm.recordCompression(len(data), len(compressed), true)
+	return compressed, codec
+}
+
+func (fm *FileManager) recordCompression(rawSize, storedSize int, compressed bool) {
+	atomic.AddInt64(&fm.compressionStats.RawBytes, int64(rawSize))
+	atomic.AddInt64(&fm.compressionStats.StoredBytes, int64(storedSize))
+	if compressed {
+		atomic.AddInt64(&fm.compressionStats.CompressedChunks, 1)
+	} else if fm.opts.Compression != CompressionNone {
+		atomic.AddInt64(&fm.compressionStats.SkippedChunks, 1)
+	}
+}
+
+// decompress 根据chunk记录的压缩算法还原payload
+func decompress(chunk *pb.Chunk) ([]byte, error) {
+	switch chunk.Codec {
+	case pb.Codec_NONE:
+		return chunk.Payload, nil
+	case pb.Codec_SNAPPY:
+		data, err := snappy.Decode(nil, chunk.Payload)
+		return data, errors.Wrapf(err, "snappy decode chunk [%s] failed", chunk.Id)
+	case pb.Codec_ZSTD:
+		data, err := zstdDecoder.DecodeAll(chunk.Payload, nil)
+		return data, errors.Wrapf(err, "zstd decode chunk [%s] failed", chunk.Id)
+	default:
+		return nil, errors.Errorf("unknown codec %d of chunk [%s]", chunk.Codec, chunk.Id)
+	}
+}
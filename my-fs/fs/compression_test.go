@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	pb "my-fs/proto"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileManager_Compression(t *testing.T) {
+	for _, compression := range []Compression{CompressionSnappy, CompressionZstd} {
+		dir := t.TempDir()
+		fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+			&Options{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		text := bytes.Repeat([]byte(`{"level":"info","msg":"request served"}`), 100)
+		random := make([]byte, 4096)
+		if _, err = rand.Read(random); err != nil {
+			t.Fatal(err)
+		}
+		textId, err := fm.Write(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		randomId, err := fm.Write(random)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for id, want := range map[string][]byte{textId: text, randomId: random} {
+			data, err := fm.Read(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Fatalf("compression %d: data of chunk %s changed", compression, id)
+			}
+		}
+
+		// 文本被压缩，随机数据压缩没有效果，保存原始数据
+		textIndex, _ := fm.Stat(textId, nil)
+		textChunk, err := fm.readChunk(textIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if textChunk.Codec == pb.Codec_NONE || len(textChunk.Payload) >= len(text) || textIndex.Size != int64(len(text)) {
+			t.Fatalf("compression %d: text should be compressed", compression)
+		}
+		randomIndex, _ := fm.Stat(randomId, nil)
+		randomChunk, err := fm.readChunk(randomIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if randomChunk.Codec != pb.Codec_NONE {
+			t.Fatalf("compression %d: random data should be stored raw", compression)
+		}
+
+		stats := fm.CompressionStats()
+		if stats.CompressedChunks != 1 || stats.SkippedChunks != 1 || stats.Ratio() >= 1 {
+			t.Fatalf("compression %d: unexpected stats %+v", compression, stats)
+		}
+		fm.Close()
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// diskFree 返回dir所在磁盘上非特权用户可用的字节数
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, errors.Wrapf(err, "statfs [%s] failed", dir)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
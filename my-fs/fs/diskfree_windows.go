@@ -0,0 +1,8 @@
+package fs
+
+import "math"
+
+// diskFree windows上不检查磁盘空间，总是返回最大值
+func diskFree(dir string) (int64, error) {
+	return math.MaxInt64, nil
+}
@@ -0,0 +1,364 @@
+package fs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	pb "my-fs/proto"
+	"my-fs/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// encryptedRecordMagic 加密记录的第一个字节，chunk序列化后的第一个字节不可能是该值
+	encryptedRecordMagic = 0xec
+	// MasterKeySize 主密钥与数据密钥的长度，使用AES-256
+	MasterKeySize = 32
+	// etagKeyInfo 从数据密钥派生ETag密钥时使用的信息
+	etagKeyInfo = "my-fs etag"
+)
+
+// DataKey 被主密钥加密后保存在索引数据库中的数据密钥
+type DataKey struct {
+	Version uint64
+	// 主密钥加密后的数据密钥，格式为nonce+密文
+	WrappedKey []byte
+	// 创建时间，unix时间戳
+	CreatedAt int64
+}
+
+// keyring 保存解密后的数据密钥，新的记录使用active版本加密
+type keyring struct {
+	mutx   sync.RWMutex
+	master cipher.AEAD
+	keys   map[uint64]cipher.AEAD
+	active uint64
+	// 计算ETag的密钥，由第一个数据密钥派生，数据密钥轮换与压缩重新加密之后ETag不变
+	etagKey []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != MasterKeySize {
+		return nil, errors.Errorf("key should be %d bytes, got %d", MasterKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create aes cipher failed")
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealWith(aead cipher.AEAD, plain, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plain, additional)
+}
+
+func openWith(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], additional)
+}
+
+// seal 使用active版本的数据密钥加密记录，格式为magic+密钥版本(varint)+nonce+密文
+func (k *keyring) seal(plain []byte) []byte {
+	k.mutx.RLock()
+	defer k.mutx.RUnlock()
+
+	header := make([]byte, 1+binary.MaxVarintLen64)
+	header[0] = encryptedRecordMagic
+	n := binary.PutUvarint(header[1:], k.active)
+	header = header[:1+n]
+	return append(header, sealWith(k.keys[k.active], plain, header)...)
+}
+
+func (k *keyring) open(record []byte) ([]byte, error) {
+	version, n := binary.Uvarint(record[1:])
+	if n <= 0 {
+		return nil, errors.Wrap(utils.ErrDecryptionFailed, "invalid key version")
+	}
+	k.mutx.RLock()
+	aead, ok := k.keys[version]
+	k.mutx.RUnlock()
+	if !ok {
+		return nil, errors.Wrapf(utils.ErrDecryptionFailed, "data key version %d is not found", version)
+	}
+	plain, err := openWith(aead, record[1+n:], record[:1+n])
+	if err != nil {
+		return nil, errors.Wrapf(utils.ErrDecryptionFailed, "data key version %d: %s", version, err)
+	}
+	return plain, nil
+}
+
+// etag 使用HMAC-SHA256计算数据的ETag，截取与md5相同的长度，还没有第一个数据密钥时返回false
+func (k *keyring) etag(data []byte) (string, bool) {
+	k.mutx.RLock()
+	defer k.mutx.RUnlock()
+	if k.etagKey == nil {
+		return "", false
+	}
+	return hex.EncodeToString(hmacSum(k.etagKey, data)[:md5.Size]), true
+}
+
+func hmacSum(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// etag 计算chunk的ETag，开启加密时使用密钥计算HMAC，明文的md5可以用来验证猜测的内容
+// 索引中的id、bucket、大小等元数据不加密。写入的记录加密之后一定已经有第一个数据密钥
+func (fm *FileManager) etag(data []byte) string {
+	if fm.keyring != nil {
+		if tag, ok := fm.keyring.etag(data); ok {
+			return tag
+		}
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *keyring) hasKey(version uint64) bool {
+	k.mutx.RLock()
+	defer k.mutx.RUnlock()
+	_, ok := k.keys[version]
+	return ok
+}
+
+func (k *keyring) hasActiveKey() bool {
+	k.mutx.RLock()
+	defer k.mutx.RUnlock()
+	_, ok := k.keys[k.active]
+	return ok
+}
+
+// openKeyring 使用主密钥解密所有的数据密钥，store中还没有数据密钥时生成第一个
+func (fm *FileManager) openKeyring(masterKey []byte) error {
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return errors.Wrap(err, "invalid master key")
+	}
+	dataKeys, err := fm.indexStore.ListDataKeys()
+	if err != nil {
+		return err
+	}
+	k := &keyring{master: master, keys: make(map[uint64]cipher.AEAD)}
+	for _, dataKey := range dataKeys {
+		if err = k.addDataKey(dataKey); err != nil {
+			return err
+		}
+	}
+	fm.keyring = k
+	if len(dataKeys) == 0 {
+		_, err = fm.newDataKey()
+		if errors.Cause(err) == utils.ErrNotLeader {
+			// 集群模式下由leader生成，第一次写入或读取时再加载
+			err = nil
+		}
+	}
+	return err
+}
+
+// reloadDataKeys 加载store中新增的数据密钥，集群模式下其他节点生成的密钥通过索引复制过来
+func (fm *FileManager) reloadDataKeys() error {
+	dataKeys, err := fm.indexStore.ListDataKeys()
+	if err != nil {
+		return err
+	}
+	for _, dataKey := range dataKeys {
+		if fm.keyring.hasKey(dataKey.Version) {
+			continue
+		}
+		if err = fm.keyring.addDataKey(dataKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *keyring) addDataKey(dataKey *DataKey) error {
+	key, err := openWith(k.master, dataKey.WrappedKey, nil)
+	if err != nil {
+		return errors.Wrapf(utils.ErrWrongMasterKey, "unwrap data key version %d failed", dataKey.Version)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	k.mutx.Lock()
+	defer k.mutx.Unlock()
+	k.keys[dataKey.Version] = aead
+	if dataKey.Version == 1 {
+		k.etagKey = hmacSum(key, []byte(etagKeyInfo))
+	}
+	if dataKey.Version > k.active {
+		k.active = dataKey.Version
+	}
+	return nil
+}
+
+// newDataKey 生成新的数据密钥并作为active版本，调用方需要保证没有并发的轮换
+func (fm *FileManager) newDataKey() (uint64, error) {
+	key := make([]byte, MasterKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return 0, errors.Wrap(err, "generate data key failed")
+	}
+	fm.keyring.mutx.RLock()
+	dataKey := &DataKey{
+		Version:    fm.keyring.active + 1,
+		WrappedKey: sealWith(fm.keyring.master, key, nil),
+		CreatedAt:  time.Now().Unix(),
+	}
+	fm.keyring.mutx.RUnlock()
+	if err := fm.indexStore.SaveDataKey(dataKey, true); err != nil {
+		return 0, err
+	}
+	return dataKey.Version, fm.keyring.addDataKey(dataKey)
+}
+
+// RotateDataKey 生成新的数据密钥，之后的写入使用新的密钥加密
+// 当前文件会被封存，之后的压缩会使用新的密钥重新加密所有仍然有效的记录
+func (fm *FileManager) RotateDataKey() (uint64, error) {
+	if fm.keyring == nil {
+		return 0, errors.New("encryption is not enabled")
+	}
+	if err := fm.checkWritable(); err != nil {
+		return 0, err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	version, err := fm.newDataKey()
+	if err != nil {
+		return 0, err
+	}
+	if fm.checkpoint.lastFileSize > 0 {
+		if err = fm.moveToNextFile(); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// RotateMasterKey 使用新的主密钥重新加密所有的数据密钥，数据本身不需要重新加密
+func (fm *FileManager) RotateMasterKey(newMasterKey []byte) error {
+	if fm.keyring == nil {
+		return errors.New("encryption is not enabled")
+	}
+	master, err := newAEAD(newMasterKey)
+	if err != nil {
+		return errors.Wrap(err, "invalid master key")
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	dataKeys, err := fm.indexStore.ListDataKeys()
+	if err != nil {
+		return err
+	}
+	for _, dataKey := range dataKeys {
+		key, err := openWith(fm.keyring.master, dataKey.WrappedKey, nil)
+		if err != nil {
+			return errors.Wrapf(utils.ErrWrongMasterKey, "unwrap data key version %d failed", dataKey.Version)
+		}
+		dataKey.WrappedKey = sealWith(master, key, nil)
+		if err = fm.indexStore.SaveDataKey(dataKey, true); err != nil {
+			return err
+		}
+	}
+	fm.keyring.mutx.Lock()
+	fm.keyring.master = master
+	fm.keyring.mutx.Unlock()
+	return nil
+}
+
+// encodeChunk 序列化chunk，开启加密时加密整个记录
+func (fm *FileManager) encodeChunk(block *pb.Chunk) ([]byte, error) {
+	data, err := proto.Marshal(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal block failed")
+	}
+	if fm.keyring != nil {
+		if !fm.keyring.hasActiveKey() {
+			// 成为leader之前没有可用的数据密钥
+			if err = fm.reloadDataKeys(); err != nil {
+				return nil, err
+			}
+			if !fm.keyring.hasActiveKey() {
+				if _, err = fm.newDataKey(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		data = fm.keyring.seal(data)
+	}
+	return data, nil
+}
+
+// decodeChunk 反序列化文件中的记录，加密的记录使用记录中的密钥版本解密
+func (fm *FileManager) decodeChunk(data []byte) (*pb.Chunk, error) {
+	if len(data) > 0 && data[0] == encryptedRecordMagic {
+		if fm.keyring == nil {
+			return nil, utils.ErrEncryptionKeyMissing
+		}
+		if version, n := binary.Uvarint(data[1:]); n > 0 && !fm.keyring.hasKey(version) {
+			if err := fm.reloadDataKeys(); err != nil {
+				return nil, err
+			}
+		}
+		plain, err := fm.keyring.open(data)
+		if err != nil {
+			return nil, err
+		}
+		data = plain
+	}
+	chunk := new(pb.Chunk)
+	if err := proto.Unmarshal(data, chunk); err != nil {
+		return nil, errors.Wrap(err, "proto unmarshal chunk failed")
+	}
+	return chunk, nil
+}
+
+// LoadMasterKey 从密钥文件或者环境变量中读取主密钥，密钥使用hex或base64编码
+// 密钥文件优先，两者都没有配置时返回nil，表示不开启加密
+func LoadMasterKey(keyFile string, envVar string) ([]byte, error) {
+	var encoded string
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read master key file [%s] failed", keyFile)
+		}
+		encoded = string(content)
+	} else if envVar != "" {
+		encoded = os.Getenv(envVar)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	return nil, errors.Errorf("master key should be %d bytes encoded in hex or base64", MasterKeySize)
+}
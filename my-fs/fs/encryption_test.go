@@ -0,0 +1,226 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"my-fs/utils"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// recordKeyVersions 返回所有数据文件中记录使用的数据密钥版本，未加密的记录为0
+func recordKeyVersions(t *testing.T, rootDir string) []uint64 {
+	seqs, err := listFileSeqs(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []uint64
+	for _, seq := range seqs {
+		stream, err := newFileStream(rootDir, seq, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			chunkBytes, _, err := stream.nextChunkBytesAndPlacement()
+			if err == utils.ErrUnexpectedEndOfFile || (err == nil && chunkBytes == nil) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var version uint64
+			if chunkBytes[0] == encryptedRecordMagic {
+				version, _ = binary.Uvarint(chunkBytes[1:])
+			}
+			versions = append(versions, version)
+		}
+		stream.close()
+	}
+	return versions
+}
+
+func TestFileManager_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	masterKey := bytes.Repeat([]byte{1}, MasterKeySize)
+	fm, err := NewFileManagerWithOptions(fileStore, indexStore, &Options{MasterKey: masterKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("top secret payload")
+	id, err := fm.WriteWithKey("secret-chunk", secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ETag不是明文的md5，无法用来验证猜测的内容
+	if sum := md5.Sum(secret); len(id.ETag) != 2*md5.Size || id.ETag == hex.EncodeToString(sum[:]) {
+		t.Fatalf("etag of an encrypted chunk should not be the md5 of the plaintext, got %s", id.ETag)
+	}
+	fm.Close()
+
+	// 数据文件中不应该出现明文
+	seqs, err := listFileSeqs(fileStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentPath := buildFilePath(fileStore, seqs[0])
+	content, err := ioutil.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, secret) || bytes.Contains(content, []byte(id.BlockId)) {
+		t.Fatal("segment file should not contain plaintext")
+	}
+
+	fm, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MasterKey: masterKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fm.Read("secret-chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, secret) {
+		t.Fatalf("expect %q, got %q", secret, data)
+	}
+	fm.Close()
+
+	// 错误的主密钥无法打开
+	wrongKey := bytes.Repeat([]byte{2}, MasterKeySize)
+	if _, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MasterKey: wrongKey}); errors.Cause(err) != utils.ErrWrongMasterKey {
+		t.Fatalf("expect ErrWrongMasterKey, got %v", err)
+	}
+
+	// 没有配置主密钥时读取加密的记录
+	fm, err = NewFileManager(fileStore, indexStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.Read("secret-chunk"); errors.Cause(err) != utils.ErrEncryptionKeyMissing {
+		t.Fatalf("expect ErrEncryptionKeyMissing, got %v", err)
+	}
+	fm.Close()
+
+	// 被篡改的记录
+	content[len(content)-1] ^= 0xff
+	if err = ioutil.WriteFile(segmentPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fm, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MasterKey: masterKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if _, err = fm.Read("secret-chunk"); errors.Cause(err) != utils.ErrDecryptionFailed {
+		t.Fatalf("expect ErrDecryptionFailed, got %v", err)
+	}
+}
+
+func TestFileManager_RotateDataKey(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	// 先写入未加密的数据，再开启加密
+	fm, err := NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("plain-%d", i), payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fm.Close()
+
+	masterKey := bytes.Repeat([]byte{1}, MasterKeySize)
+	fm, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 256, MasterKey: masterKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("encrypted-%d", i), payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := fm.Stat("encrypted-0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := fm.RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expect key version 2, got %d", version)
+	}
+	if _, err = fm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range recordKeyVersions(t, fileStore) {
+		if v != version {
+			t.Fatalf("all records should be encrypted with key version %d, got %d", version, v)
+		}
+	}
+
+	// 轮换主密钥后使用新的主密钥打开
+	newMasterKey := bytes.Repeat([]byte{3}, MasterKeySize)
+	if err = fm.RotateMasterKey(newMasterKey); err != nil {
+		t.Fatal(err)
+	}
+	fm.Close()
+	if _, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MasterKey: masterKey}); errors.Cause(err) != utils.ErrWrongMasterKey {
+		t.Fatalf("expect ErrWrongMasterKey, got %v", err)
+	}
+	fm, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 256, MasterKey: newMasterKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	// 重新加密与轮换主密钥之后，重建索引得到相同的ETag
+	if _, err = fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := fm.Stat("encrypted-0", nil); err != nil || after.ETag != before.ETag {
+		t.Fatalf("etag should not change after key rotation, got %+v, err %v", after, err)
+	}
+	for _, prefix := range []string{"plain", "encrypted"} {
+		for i := 0; i < 3; i++ {
+			data, err := fm.Read(fmt.Sprintf("%s-%d", prefix, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("unexpected payload of %s-%d", prefix, i)
+			}
+		}
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, MasterKeySize)
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := ioutil.WriteFile(keyFile, []byte(fmt.Sprintf("%x\n", key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMasterKey(keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded, key) {
+		t.Fatal("unexpected master key")
+	}
+
+	t.Setenv("TEST_MYFS_MASTER_KEY", "too-short")
+	if _, err = LoadMasterKey("", "TEST_MYFS_MASTER_KEY"); err == nil {
+		t.Fatal("short master key should be rejected")
+	}
+	if loaded, err = LoadMasterKey("", "TEST_MYFS_UNSET_KEY"); err != nil || loaded != nil {
+		t.Fatalf("expect no master key, got %v %v", loaded, err)
+	}
+}
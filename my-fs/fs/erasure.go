@@ -0,0 +1,590 @@
+package fs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"my-fs/utils"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+)
+
+// shardChecksumSize 每个分片记录末尾的crc32校验和
+const shardChecksumSize = 4
+
+// ErasureCoding 纠删码配置，DataShards为0时不开启
+// 开启后每条记录被切分为DataShards个数据分片以及ParityShards个校验分片，分别保存在ShardDirs的每个目录中，
+// 最多ParityShards个目录丢失或损坏时仍然可以读取
+type ErasureCoding struct {
+	DataShards   int
+	ParityShards int
+	// 每个分片保存的目录，数量必须等于DataShards+ParityShards，应该位于不同的磁盘
+	ShardDirs []string
+}
+
+func (e ErasureCoding) enabled() bool {
+	return e.DataShards > 0
+}
+
+// erasureStore 纠删码模式下的数据文件
+// 同一条记录的所有分片大小相同，因此每个目录中的文件布局完全一致，索引中的(seq, offset)对所有目录都有效
+// 分片记录的格式为 原始记录长度(varint) + 分片数据 + crc32
+type erasureStore struct {
+	dataShards int
+	dirs       []string
+	encoder    reedsolomon.Encoder
+	// 当前写入的文件，无法打开的目录为nil
+	files []*os.File
+	seq   int
+	// 上报每个分片文件fsync的耗时
+	metrics Metrics
+}
+
+func newErasureStore(conf ErasureCoding) (*erasureStore, error) {
+	if conf.DataShards <= 0 || conf.ParityShards <= 0 {
+		return nil, errors.Errorf("invalid erasure coding %d+%d", conf.DataShards, conf.ParityShards)
+	}
+	if len(conf.ShardDirs) != conf.DataShards+conf.ParityShards {
+		return nil, errors.Errorf("erasure coding %d+%d requires %d shard dirs, got %d",
+			conf.DataShards, conf.ParityShards, conf.DataShards+conf.ParityShards, len(conf.ShardDirs))
+	}
+	encoder, err := reedsolomon.New(conf.DataShards, conf.ParityShards)
+	if err != nil {
+		return nil, errors.Wrap(err, "create reed-solomon encoder failed")
+	}
+	for _, dir := range conf.ShardDirs {
+		// 丢失的磁盘不影响启动，之后通过修复补齐
+		if _, err = createDirIfMissing(dir); err != nil {
+			log.Printf("shard dir [%s] is unavailable: %s", dir, err)
+		}
+	}
+	return &erasureStore{
+		dataShards: conf.DataShards,
+		dirs:       conf.ShardDirs,
+		encoder:    encoder,
+		files:      make([]*os.File, len(conf.ShardDirs)),
+		metrics:    noopMetrics{},
+	}, nil
+}
+
+// shardSize 长度为recordLen的记录切分后每个分片的大小
+func (s *erasureStore) shardSize(recordLen int) int {
+	return (recordLen + s.dataShards - 1) / s.dataShards
+}
+
+// recordSize 长度为recordLen的记录在每个目录中占用的大小
+func (s *erasureStore) recordSize(recordLen int) int {
+	header := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(header, uint64(recordLen)) + s.shardSize(recordLen) + shardChecksumSize
+}
+
+// open 打开seq对应的文件用于写入
+func (s *erasureStore) open(seq int) error {
+	s.close()
+	opened := 0
+	for i, dir := range s.dirs {
+		file, err := os.OpenFile(buildFilePath(dir, seq), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			log.Printf("open shard file in [%s] failed: %s", dir, err)
+			continue
+		}
+		s.files[i] = file
+		opened++
+	}
+	s.seq = seq
+	if opened < s.dataShards {
+		return errors.Wrapf(utils.ErrShardsUnavailable, "only %d of %d shard dirs are writable", opened, len(s.dirs))
+	}
+	return nil
+}
+
+// encodeShards 将记录切分并生成每个目录中的分片记录
+func (s *erasureStore) encodeShards(record []byte) ([][]byte, error) {
+	shards, err := s.encoder.Split(record)
+	if err != nil {
+		return nil, errors.Wrap(err, "split record failed")
+	}
+	if err = s.encoder.Encode(shards); err != nil {
+		return nil, errors.Wrap(err, "encode parity shards failed")
+	}
+	header := make([]byte, binary.MaxVarintLen64)
+	header = header[:binary.PutUvarint(header, uint64(len(record)))]
+	encoded := make([][]byte, len(shards))
+	for i, shard := range shards {
+		buf := make([]byte, 0, len(header)+len(shard)+shardChecksumSize)
+		buf = append(append(buf, header...), shard...)
+		sum := make([]byte, shardChecksumSize)
+		binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(buf))
+		encoded[i] = append(buf, sum...)
+	}
+	return encoded, nil
+}
+
+// write 将记录的分片写入每个目录的offset处，至少写入DataShards个分片才算成功，缺失的分片由修复补齐
+// sync为false时不同步，由调用方之后调用sync
+func (s *erasureStore) write(offset int, record []byte, sync bool) error {
+	shards, err := s.encodeShards(record)
+	if err != nil {
+		return err
+	}
+	written := 0
+	for i, file := range s.files {
+		if file == nil {
+			continue
+		}
+		if _, err = file.WriteAt(shards[i], int64(offset)); err == nil && sync {
+			syncStart := time.Now()
+			err = file.Sync()
+			s.metrics.ObserveFsync(time.Since(syncStart))
+		}
+		if err != nil {
+			log.Printf("write shard into [%s] failed: %s", s.dirs[i], err)
+			continue
+		}
+		written++
+	}
+	if written < s.dataShards {
+		return errors.Wrapf(utils.ErrShardsUnavailable, "only %d of %d shards are written", written, len(s.dirs))
+	}
+	return nil
+}
+
+// truncate 清理所有目录中offset之后的数据
+func (s *erasureStore) truncate(offset int) error {
+	for i, file := range s.files {
+		if file == nil {
+			continue
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "stat shard file in [%s] failed", s.dirs[i])
+		}
+		if stat.Size() <= int64(offset) {
+			continue
+		}
+		if err = file.Truncate(int64(offset)); err != nil {
+			return errors.Wrapf(err, "truncate shard file in [%s] failed", s.dirs[i])
+		}
+	}
+	return nil
+}
+
+// sync 同步所有打开的分片文件，至少同步DataShards个分片才算成功
+func (s *erasureStore) sync() error {
+	synced, opened := 0, 0
+	for i, file := range s.files {
+		if file == nil {
+			continue
+		}
+		opened++
+		syncStart := time.Now()
+		err := file.Sync()
+		s.metrics.ObserveFsync(time.Since(syncStart))
+		if err != nil {
+			log.Printf("sync shard file in [%s] failed: %s", s.dirs[i], err)
+			continue
+		}
+		synced++
+	}
+	if synced < s.dataShards {
+		return errors.Wrapf(utils.ErrShardsUnavailable, "only %d of %d shard files are synced", synced, opened)
+	}
+	return nil
+}
+
+func (s *erasureStore) close() error {
+	var firstErr error
+	for i, file := range s.files {
+		if file == nil {
+			continue
+		}
+		if err := file.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.files[i] = nil
+	}
+	return firstErr
+}
+
+// readShard 读取目录中(seq, offset)处的分片，返回原始记录的长度，文件不存在、长度不足或者校验失败时返回错误
+func (s *erasureStore) readShard(dir string, seq int, offset int64) ([]byte, int, error) {
+	file, err := os.Open(buildFilePath(dir, seq))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	header := make([]byte, binary.MaxVarintLen64)
+	n, err := file.ReadAt(header, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	recordLen, headerLen := binary.Uvarint(header[:n])
+	if headerLen <= 0 || recordLen == 0 {
+		return nil, 0, utils.ErrUnexpectedEndOfFile
+	}
+	buf := make([]byte, headerLen+s.shardSize(int(recordLen))+shardChecksumSize)
+	if _, err = file.ReadAt(buf, offset); err != nil {
+		return nil, 0, utils.ErrUnexpectedEndOfFile
+	}
+	body := buf[:len(buf)-shardChecksumSize]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(body):]) {
+		return nil, 0, errors.Errorf("shard checksum mismatch at %d", offset)
+	}
+	return body[headerLen:], int(recordLen), nil
+}
+
+// readShards 读取所有目录中(seq, offset)处的分片，无法读取的分片为nil
+func (s *erasureStore) readShards(seq int, offset int64) ([][]byte, int, int) {
+	shards := make([][]byte, len(s.dirs))
+	recordLens := make([]int, len(s.dirs))
+	// 每个原始长度对应的有效分片数量，正常情况下同一位置的有效分片长度都相同
+	counts := make(map[int]int)
+	for i, dir := range s.dirs {
+		shard, recordLen, err := s.readShard(dir, seq, offset)
+		if err != nil {
+			continue
+		}
+		shards[i], recordLens[i] = shard, recordLen
+		counts[recordLen]++
+	}
+	recordLen, valid := 0, 0
+	for l, count := range counts {
+		if count > valid {
+			recordLen, valid = l, count
+		}
+	}
+	// 只保留与多数一致的分片
+	for i := range shards {
+		if recordLens[i] != recordLen {
+			shards[i] = nil
+		}
+	}
+	return shards, recordLen, valid
+}
+
+// readRecord 读取(seq, offset)处的记录，最多ParityShards个分片缺失时通过校验分片恢复
+func (s *erasureStore) readRecord(seq int, offset int64) ([]byte, int, error) {
+	shards, recordLen, valid := s.readShards(seq, offset)
+	if valid < s.dataShards {
+		return nil, 0, errors.Wrapf(utils.ErrShardsUnavailable, "only %d shards of file [%s] at %d are readable",
+			valid, buildFileName(seq), offset)
+	}
+	if valid < len(s.dirs) {
+		if err := s.encoder.ReconstructData(shards); err != nil {
+			return nil, 0, errors.Wrapf(err, "reconstruct record of file [%s] at %d failed", buildFileName(seq), offset)
+		}
+	}
+	record := make([]byte, 0, recordLen)
+	for _, shard := range shards[:s.dataShards] {
+		record = append(record, shard...)
+	}
+	return record[:recordLen], s.recordSize(recordLen), nil
+}
+
+// listSeqs 返回所有目录中文件序号的并集
+func (s *erasureStore) listSeqs() ([]int, error) {
+	seen := make(map[int]bool)
+	for _, dir := range s.dirs {
+		seqs, err := listFileSeqs(dir)
+		if err != nil {
+			// 丢失的目录不影响其他目录
+			continue
+		}
+		for _, seq := range seqs {
+			seen[seq] = true
+		}
+	}
+	seqs := make([]int, 0, len(seen))
+	for seq := range seen {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// segmentSize 返回所有目录中seq对应文件的最大大小
+func (s *erasureStore) segmentSize(seq int) (int64, error) {
+	var maxSize int64
+	for _, dir := range s.dirs {
+		_, size, err := fileExists(buildFilePath(dir, seq))
+		if err != nil {
+			return 0, err
+		}
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	return maxSize, nil
+}
+
+// removeSegment 删除所有目录中seq对应的文件
+func (s *erasureStore) removeSegment(seq int) error {
+	for _, dir := range s.dirs {
+		filePath := buildFilePath(dir, seq)
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove file [%s] failed", filePath)
+		}
+	}
+	return nil
+}
+
+// erasureStream 按顺序读取所有目录中同一个文件的记录
+type erasureStream struct {
+	store         *erasureStore
+	fSeq          int
+	currentOffset int64
+	end           int64
+}
+
+func (s *erasureStore) newStream(seq int, startOffset int64) (*erasureStream, error) {
+	end, err := s.segmentSize(seq)
+	if err != nil {
+		return nil, err
+	}
+	return &erasureStream{store: s, fSeq: seq, currentOffset: startOffset, end: end}, nil
+}
+
+// nextChunkBytesAndPlacement 与fileStream相同，读完时返回nil，末尾的记录不完整时返回ErrUnexpectedEndOfFile
+func (s *erasureStream) nextChunkBytesAndPlacement() ([]byte, *chunkPlacement, error) {
+	if s.currentOffset >= s.end {
+		return nil, nil, nil
+	}
+	record, size, err := s.store.readRecord(s.fSeq, s.currentOffset)
+	if errors.Cause(err) == utils.ErrShardsUnavailable {
+		return nil, nil, utils.ErrUnexpectedEndOfFile
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	placement := &chunkPlacement{
+		fSeq:             s.fSeq,
+		chunkStartOffset: s.currentOffset,
+		chunkBytesOffset: s.currentOffset + int64(size-len(record)),
+	}
+	s.currentOffset += int64(size)
+	return record, placement, nil
+}
+
+func (s *erasureStream) offset() int64 {
+	return s.currentOffset
+}
+
+func (s *erasureStream) close() error {
+	return nil
+}
+
+// scanToEnd 从startOffset开始读取到最后一条完整的记录，返回之后的位置以及记录数量
+func (s *erasureStore) scanToEnd(seq int, startOffset int64) (int64, int64, error) {
+	stream, err := s.newStream(seq, startOffset)
+	if err != nil {
+		return 0, 0, err
+	}
+	var records int64
+	for {
+		record, _, err := stream.nextChunkBytesAndPlacement()
+		if err == utils.ErrUnexpectedEndOfFile || (err == nil && record == nil) {
+			return stream.currentOffset, records, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		records++
+	}
+}
+
+// constructCheckpoint 没有保存checkpoint时，从所有目录的文件中恢复
+func (s *erasureStore) constructCheckpoint() (*checkpoint, error) {
+	seqs, err := s.listSeqs()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) == 0 {
+		return &checkpoint{1, 0}, nil
+	}
+	lastFileSeq := seqs[len(seqs)-1]
+	offset, _, err := s.scanToEnd(lastFileSeq, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint{lastFileSeq: lastFileSeq, lastFileSize: int(offset)}, nil
+}
+
+// syncCheckpoint checkpoint之后可能还有已经写入但是没有保存checkpoint的记录
+func (s *erasureStore) syncCheckpoint(cp *checkpoint) error {
+	offset, _, err := s.scanToEnd(cp.lastFileSeq, int64(cp.lastFileSize))
+	if err != nil {
+		return err
+	}
+	cp.lastFileSize = int(offset)
+	return nil
+}
+
+// segmentStream 按顺序读取一个数据文件中的记录
+type segmentStream interface {
+	nextChunkBytesAndPlacement() ([]byte, *chunkPlacement, error)
+	// offset 下一条记录的位置
+	offset() int64
+	close() error
+}
+
+// listSegments 返回所有数据文件的序号
+func (fm *FileManager) listSegments() ([]int, error) {
+	if fm.erasure != nil {
+		return fm.erasure.listSeqs()
+	}
+	seqs, err := listFileSeqs(fm.rootDir)
+	if err != nil || fm.tiering == nil {
+		return seqs, err
+	}
+	return fm.tiering.mergeSeqs(seqs), nil
+}
+
+func (fm *FileManager) segmentSize(seq int) (int64, error) {
+	if fm.erasure != nil {
+		return fm.erasure.segmentSize(seq)
+	}
+	_, size, err := fm.statSegment(seq)
+	return size, err
+}
+
+func (fm *FileManager) openSegmentStream(seq int, offset int64) (segmentStream, error) {
+	if fm.erasure != nil {
+		return fm.erasure.newStream(seq, offset)
+	}
+	return fm.openFileStream(seq, offset)
+}
+
+func (fm *FileManager) removeSegment(seq int) error {
+	if fm.erasure != nil {
+		return fm.erasure.removeSegment(seq)
+	}
+	if fm.tieredSegment(seq) != nil {
+		return fm.tiering.remove(seq)
+	}
+	filePath := buildFilePath(fm.rootDir, seq)
+	if err := os.Remove(filePath); err != nil {
+		return errors.Wrapf(err, "remove file [%s] failed", filePath)
+	}
+	return nil
+}
+
+// RepairStats 一次修复的统计
+type RepairStats struct {
+	// 检查的文件数量
+	Segments int
+	// 检查的记录数量
+	Records int
+	// 重新生成的分片数量
+	RepairedShards int
+	// 无法恢复的记录数量，有效分片少于DataShards
+	LostRecords int
+}
+
+// RepairShards 检查所有文件中每条记录的分片，重新生成丢失或损坏的分片
+func (fm *FileManager) RepairShards() (*RepairStats, error) {
+	if fm.erasure == nil {
+		return nil, errors.New("erasure coding is not enabled")
+	}
+	seqs, err := fm.erasure.listSeqs()
+	if err != nil {
+		return nil, err
+	}
+	stats := &RepairStats{}
+	for _, seq := range seqs {
+		if err = fm.repairSegment(seq, stats); err != nil {
+			return stats, errors.WithMessagef(err, "repair file [%s] failed", buildFileName(seq))
+		}
+	}
+	if stats.RepairedShards > 0 || stats.LostRecords > 0 {
+		log.Printf("repaired %d shards of %d records, %d records are lost", stats.RepairedShards, stats.Records, stats.LostRecords)
+	}
+	return stats, nil
+}
+
+func (fm *FileManager) repairSegment(seq int, stats *RepairStats) error {
+	// 与写入以及压缩互斥，当前文件修复时不会有新的记录
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	s := fm.erasure
+	end, err := s.segmentSize(seq)
+	if err != nil {
+		return err
+	}
+	if seq == fm.checkpoint.lastFileSeq {
+		end = int64(fm.checkpoint.lastFileSize)
+	}
+	for _, dir := range s.dirs {
+		if _, err = createDirIfMissing(dir); err != nil {
+			return err
+		}
+	}
+	var offset int64
+	for offset < end {
+		shards, recordLen, valid := s.readShards(seq, offset)
+		if valid < s.dataShards {
+			// 无法确定记录的长度，之后的记录也无法定位
+			stats.LostRecords++
+			break
+		}
+		stats.Records++
+		if valid < len(s.dirs) {
+			if err = fm.repairRecord(seq, offset, shards, recordLen); err != nil {
+				return err
+			}
+			stats.RepairedShards += len(s.dirs) - valid
+		}
+		offset += int64(s.recordSize(recordLen))
+	}
+	stats.Segments++
+	if seq == fm.checkpoint.lastFileSeq {
+		// 重新打开当前文件，之前丢失的目录可以继续写入
+		return s.open(seq)
+	}
+	return nil
+}
+
+// repairRecord 恢复缺失的分片并写入对应的目录
+func (fm *FileManager) repairRecord(seq int, offset int64, shards [][]byte, recordLen int) error {
+	s := fm.erasure
+	missing := make([]bool, len(shards))
+	for i, shard := range shards {
+		missing[i] = shard == nil
+	}
+	if err := s.encoder.Reconstruct(shards); err != nil {
+		return errors.Wrapf(err, "reconstruct shards at %d failed", offset)
+	}
+	record := make([]byte, 0, recordLen)
+	for _, shard := range shards[:s.dataShards] {
+		record = append(record, shard...)
+	}
+	encoded, err := s.encodeShards(record[:recordLen])
+	if err != nil {
+		return err
+	}
+	for i, dir := range s.dirs {
+		if !missing[i] {
+			continue
+		}
+		file, err := os.OpenFile(buildFilePath(dir, seq), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "open shard file in [%s] failed", dir)
+		}
+		if _, err = file.WriteAt(encoded[i], offset); err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return errors.Wrapf(err, "write shard into [%s] failed", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+func newErasureTestOptions(dir string) *Options {
+	shardDirs := make([]string, 6)
+	for i := range shardDirs {
+		shardDirs[i] = filepath.Join(dir, fmt.Sprintf("disk-%d", i))
+	}
+	return &Options{
+		MaxFileSize: 128,
+		Erasure:     ErasureCoding{DataShards: 4, ParityShards: 2, ShardDirs: shardDirs},
+	}
+}
+
+func TestFileManager_ErasureCoding(t *testing.T) {
+	dir := t.TempDir()
+	opts := newErasureTestOptions(dir)
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	fm, err := NewFileManagerWithOptions(fileStore, indexStore, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		payloads[key] = bytes.Repeat([]byte{byte(i)}, 50+i)
+		if _, err = fm.WriteWithKey(key, payloads[key], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkAll := func(fm *FileManager) {
+		t.Helper()
+		for key, payload := range payloads {
+			data, err := fm.Read(key)
+			if err != nil || !bytes.Equal(data, payload) {
+				t.Fatalf("read %s: %v", key, err)
+			}
+		}
+	}
+	checkAll(fm)
+
+	// 每个目录只保存分片，大小约为原始数据的1/4
+	seqs, err := listFileSeqs(opts.Erasure.ShardDirs[0])
+	if err != nil || len(seqs) < 2 {
+		t.Fatalf("expect multiple files in shard dir, got %v %v", seqs, err)
+	}
+
+	// 丢失两个目录、损坏一个目录后仍然可以读取
+	if err = os.RemoveAll(opts.Erasure.ShardDirs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(opts.Erasure.ShardDirs[4]); err != nil {
+		t.Fatal(err)
+	}
+	checkAll(fm)
+	corrupt := buildFilePath(opts.Erasure.ShardDirs[2], seqs[0])
+	original, err := os.ReadFile(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(corrupt, bytes.Repeat([]byte{0xff}, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.Read("key-0"); errors.Cause(err) != utils.ErrShardsUnavailable {
+		t.Fatalf("expect ErrShardsUnavailable with 3 shards lost, got %v", err)
+	}
+	if err = os.WriteFile(corrupt, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 修复后补齐丢失的分片，之后可以再丢失另外两个目录
+	stats, err := fm.RepairShards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RepairedShards == 0 || stats.LostRecords != 0 {
+		t.Fatalf("unexpected repair stats %+v", stats)
+	}
+	if stats, err = fm.RepairShards(); err != nil || stats.RepairedShards != 0 {
+		t.Fatalf("expect nothing to repair, got %+v %v", stats, err)
+	}
+	for _, i := range []int{0, 3} {
+		if err = os.RemoveAll(opts.Erasure.ShardDirs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkAll(fm)
+
+	// 丢失目录的情况下重启，继续写入以及压缩
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fm, err = NewFileManagerWithOptions(fileStore, indexStore, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	checkAll(fm)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		payloads[key] = []byte("overwritten")
+		if _, err = fm.WriteWithKey(key, payloads[key], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compacted, err := fm.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.Segments == 0 || compacted.DroppedRecords == 0 {
+		t.Fatalf("unexpected compaction stats %+v", compacted)
+	}
+	checkAll(fm)
+	if _, err = fm.ReadLog(LogPosition{}, 1024); err == nil {
+		t.Fatal("expect replication to be rejected with erasure coding")
+	}
+}
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"context"
+	"log"
+	"my-fs/utils"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 每次从过期时间索引中读取的记录数量
+const expirySweepBatch = 1000
+
+// ExpireChunks 清理在当前时间之前过期的chunk，返回清理的数量
+// 没有版本号的chunk写入删除标记，版本被永久删除，之后由压缩回收空间
+func (fm *FileManager) ExpireChunks() (int, error) {
+	now := time.Now().UnixNano()
+	expired := 0
+	for {
+		records, err := fm.indexStore.ListExpired(now, expirySweepBatch)
+		if err != nil {
+			return expired, err
+		}
+		for _, record := range records {
+			ok, err := fm.expireChunk(record)
+			if err != nil {
+				return expired, errors.Wrapf(err, "expire chunk [%s/%s] failed", record.Bucket, record.BlockId)
+			}
+			if ok {
+				expired++
+			}
+		}
+		if len(records) < expirySweepBatch {
+			return expired, nil
+		}
+	}
+}
+
+// expireChunk 删除记录指向的chunk，chunk已经被覆盖或删除时只删除过期时间索引，返回是否删除了chunk
+func (fm *FileManager) expireChunk(record *ExpiryRecord) (bool, error) {
+	if err := fm.checkWritable(); err != nil {
+		return false, err
+	}
+	// 检查与删除之间不能有写入，否则可能删除新写入的chunk
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	bucket, err := fm.indexStore.FetchBucket(record.Bucket)
+	var index *BlockIndex
+	if err == nil {
+		if record.VersionId != "" {
+			index, err = fm.indexStore.FetchVersion(record.Bucket, record.BlockId, record.VersionId)
+		} else {
+			index, err = fm.indexStore.FetchBucketIndex(record.Bucket, record.BlockId)
+		}
+	}
+	switch errors.Cause(err) {
+	case nil:
+	case utils.ErrBucketNotFound, utils.ErrIndexNotFound:
+		index = nil
+	default:
+		return false, err
+	}
+
+	current := index != nil && index.ExpiresAt == record.ExpiresAt && index.VersionId == record.VersionId
+	if current && record.VersionId != "" {
+		err = fm.deleteVersion(bucket, record.BlockId, record.VersionId)
+	} else if current {
+		err = fm.deleteLatest(bucket, index)
+	}
+	if err != nil {
+		return false, err
+	}
+	// 删除chunk与删除过期时间索引之间宕机时，重新处理该记录只会删除过期时间索引
+	batch := new(IndexBatch)
+	batch.DeleteExpiry(record)
+	return current, fm.indexStore.WriteBatch(batch, false)
+}
+
+// expireChunksLoop 定期清理过期的chunk，只读或者不是leader时跳过
+func (fm *FileManager) expireChunksLoop(ctx context.Context) {
+	ticker := time.NewTicker(fm.opts.ExpirySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := fm.ExpireChunks()
+			if n > 0 {
+				log.Printf("expired %d chunks", n)
+			}
+			switch errors.Cause(err) {
+			case nil, utils.ErrReadOnly, utils.ErrNotLeader, utils.ErrClosed:
+			default:
+				log.Printf("expire chunks failed, err=%s", err)
+			}
+		}
+	}
+}
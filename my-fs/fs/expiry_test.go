@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"bytes"
+	"my-fs/utils"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileManager_ExpireChunks(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *FileManager {
+		// 由测试调用ExpireChunks，后台清理不会执行
+		fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+			&Options{ExpirySweepInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fm
+	}
+	fm := open()
+	ttl := 200 * time.Millisecond
+	for _, key := range []string{"a-temp", "c-renewed"} {
+		if _, err := fm.WriteWithKey(key, []byte(key), &WriteOptions{TTL: ttl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fm.WriteWithKey("b-keep", []byte("keep"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// 覆盖时不设置过期时间，原来的过期时间失效
+	if _, err := fm.WriteWithKey("c-renewed", []byte("renewed"), nil); err != nil {
+		t.Fatal(err)
+	}
+	index, err := fm.Stat("a-temp", nil)
+	if err != nil || index.ExpiresAt == 0 {
+		t.Fatalf("unexpected index %+v, err %v", index, err)
+	}
+	if _, err = fm.WriteWithOptions([]byte("data"), &WriteOptions{TTL: -time.Second}); err == nil {
+		t.Fatal("negative ttl should be rejected")
+	}
+	time.Sleep(ttl)
+
+	// 过期之后清理之前，读取与列出时都不存在
+	if _, err = fm.Read("a-temp"); errors.Cause(err) != utils.ErrIndexNotFound {
+		t.Fatalf("expect ErrIndexNotFound for an expired chunk, got %v", err)
+	}
+	indexes, err := fm.List(DefaultBucket, &ListOptions{Limit: 1})
+	if err != nil || len(indexes) != 1 || indexes[0].BlockId != "b-keep" {
+		t.Fatalf("unexpected list %+v, err %v", indexes, err)
+	}
+	// 过期的key可以使用OverwriteFail写入
+	if _, err = fm.WriteWithKey("a-temp", []byte("again"), &WriteOptions{Overwrite: OverwriteFail, TTL: ttl}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ttl)
+	fm.Close()
+
+	// 重启之后仍然过期，清理时跳过已经被覆盖的chunk
+	fm = open()
+	defer fm.Close()
+	if _, err = fm.Read("a-temp"); errors.Cause(err) != utils.ErrIndexNotFound {
+		t.Fatalf("expect ErrIndexNotFound after restart, got %v", err)
+	}
+	n, err := fm.ExpireChunks()
+	if err != nil || n != 1 {
+		t.Fatalf("expect 1 expired chunk, got %d, err %v", n, err)
+	}
+	if n, err = fm.ExpireChunks(); err != nil || n != 0 {
+		t.Fatalf("expect nothing left to expire, got %d, err %v", n, err)
+	}
+	if data, err := fm.Read("c-renewed"); err != nil || string(data) != "renewed" {
+		t.Fatalf("renewed chunk should be kept, got %q, %v", data, err)
+	}
+	bucket, err := fm.GetBucket(DefaultBucket)
+	if err != nil || bucket.ObjectCount != 2 {
+		t.Fatalf("unexpected bucket %+v, err %v", bucket, err)
+	}
+
+	// 重建索引时从记录中恢复过期时间
+	if _, err = fm.WriteWithKey("d-rebuilt", []byte("rebuilt"), &WriteOptions{TTL: ttl}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ttl)
+	if n, err = fm.ExpireChunks(); err != nil || n != 1 {
+		t.Fatalf("expect 1 expired chunk after rebuild, got %d, err %v", n, err)
+	}
+
+	// 开启版本控制的bucket中过期的版本被永久删除
+	if err = fm.CreateBucket("versioned", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.SetBucketVersioning("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+	opts := &WriteOptions{Bucket: "versioned"}
+	if _, err = fm.WriteWithKey("doc", []byte("v1"), opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.TTL = ttl
+	if _, err = fm.WriteWithKey("doc", []byte("v2"), opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ttl)
+	if n, err = fm.ExpireChunks(); err != nil || n != 1 {
+		t.Fatalf("expect 1 expired version, got %d, err %v", n, err)
+	}
+	versions, err := fm.ListVersions("versioned", "doc")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("unexpected versions %+v, err %v", versions, err)
+	}
+	if data, err := fm.ReadWithOptions("doc", &ReadOptions{Bucket: "versioned"}); err != nil || string(data) != "v1" {
+		t.Fatalf("expect the previous version to become the latest, got %q, %v", data, err)
+	}
+
+	// 导出时保留过期时间，导入时跳过已经过期的chunk
+	if _, err = fm.WriteWithKey("e-hour", []byte("hour"), &WriteOptions{TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("f-short", []byte("short"), &WriteOptions{TTL: ttl}); err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if _, err = fm.ExportWithOptions(archive, &ArchiveOptions{Format: ArchiveFormatTar, Bucket: DefaultBucket}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ttl)
+	dst := newTestFileManager(t)
+	stats, err := dst.Import(archive)
+	if err != nil || stats.Skipped != 1 {
+		t.Fatalf("unexpected import stats %+v, err %v", stats, err)
+	}
+	want, _ := fm.Stat("e-hour", nil)
+	if got, err := dst.Stat("e-hour", nil); err != nil || got.ExpiresAt != want.ExpiresAt {
+		t.Fatalf("expect expiry %d after import, got %+v, %v", want.ExpiresAt, got, err)
+	}
+}
@@ -28,12 +28,19 @@ func newFileStream(rootDir string, fileSeq int, startOffset int64) (*fileStream,
 	if err != nil {
 		return nil, errors.Wrapf(err, "open file [%s] failed", filePath)
 	}
+	return newFileStreamFromFile(file, fileSeq, startOffset)
+}
 
-	var newPosition int64
-	if newPosition, err = file.Seek(startOffset, 0); err != nil {
+// newFileStreamFromFile 从已经打开的数据文件创建fileStream，出错时关闭文件
+func newFileStreamFromFile(file *os.File, fileSeq int, startOffset int64) (*fileStream, error) {
+	filePath := file.Name()
+	newPosition, err := file.Seek(startOffset, 0)
+	if err != nil {
+		file.Close()
 		return nil, errors.Wrapf(err, "seek file [%s] to startOffset %d failed", filePath, startOffset)
 	}
 	if newPosition != startOffset {
+		file.Close()
 		return nil, errors.Wrapf(err, "Could not seek block file [%s] to startOffset [%d]. New position = [%d]",
 			filePath, startOffset, newPosition)
 	}
@@ -100,6 +107,10 @@ func (s *fileStream) nextChunkBytesAndPlacement() ([]byte, *chunkPlacement, erro
 	return chunkBytes, chunkPlacement, nil
 }
 
+func (s *fileStream) offset() int64 {
+	return s.currentOffset
+}
+
 func (s *fileStream) close() error {
 	return s.file.Close()
 }
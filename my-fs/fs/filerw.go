@@ -36,6 +36,10 @@ func (f *fileWriter) write(data []byte, sync bool) error {
 	return nil
 }
 
+func (f *fileWriter) sync() error {
+	return f.file.Sync()
+}
+
 func (f *fileWriter) truncate(targetSize int) error {
 	stat, err := f.file.Stat()
 	if err != nil {
@@ -1,11 +1,14 @@
 package fs
 
 import (
+	"context"
 	"fmt"
 	"log"
 	pb "my-fs/proto"
 	"my-fs/utils"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
@@ -27,26 +30,103 @@ var _ FS = &FileManager{}
 
 type FileManager struct {
 	rootDir    string
+	opts       *Options
 	checkpoint *checkpoint
 	mutx       sync.Mutex // 用于保护fileManager维护的cp
+	// checkpoint更新时关闭并替换，由mutx保护
+	logAppended chan struct{}
+	writeMutx  sync.Mutex // 用于串行化写入以及bucket元数据的修改
+	// 读取时持有读锁，压缩删除文件时持有写锁
+	segmentMutx sync.RWMutex
+	// 最后一次生成的版本号的时间，保证版本号单调递增
+	lastVersionTime int64
+	// 自启动以来的压缩统计
+	compressionStats CompressionStats
+	// 数据密钥，没有开启加密时为nil
+	keyring *keyring
+	// 从节点为1，只能通过ApplyLog写入
+	readOnly int32
+	// Close之后为1，拒绝所有的写入
+	closed int32
+	// 写入失败后无法修剪数据文件时为1，拒绝所有的写入，重启后由恢复流程修剪
+	appendFailed int32
+	// 写入速度限制，key为<范围>/<名称>，由writeMutx保护
+	limiters map[string]*rateLimiter
+	// 数据文件中有还没有同步的写入，由writeMutx保护
+	dirty      bool
 	writer     *fileWriter
-	indexStore IndexStore // 文件索引数据库
+	erasure    *erasureStore // 开启纠删码时不为nil，此时writer为nil
+	tiering    *tiering      // 冷热分层，Options.Tiering.Store为nil时为nil
+	cache      *recordCache  // 读取缓存，Options.CacheSize为0时为nil
+	indexStore IndexStore    // 文件索引数据库
+	cancel     context.CancelFunc
+	loops      sync.WaitGroup // 后台任务，Close时等待退出
 }
 
 func NewFileManager(fileStorePath string, indexStorePath string) (*FileManager, error) {
-	// 不管存不存在，都创建存储用文件夹
-	if _, err := createDirIfMissing(fileStorePath); err != nil {
-		return nil, err
-	}
+	return NewFileManagerWithOptions(fileStorePath, indexStorePath, nil)
+}
+
+func NewFileManagerWithOptions(fileStorePath string, indexStorePath string, opts *Options) (*FileManager, error) {
 	// 创建索引数据库
 	indexStore := &indexStore{}
 	if err := indexStore.Open(indexStorePath); err != nil {
 		return nil, err
 	}
+	return NewFileManagerWithIndexStore(fileStorePath, indexStore, opts)
+}
 
+// NewFileManagerWithIndexStore 使用已经打开的索引数据库创建FileManager，集群模式下使用ReplicatedIndexStore
+// 创建失败时indexStore以及已经打开的数据文件会被关闭
+func NewFileManagerWithIndexStore(fileStorePath string, indexStore IndexStore, opts *Options) (*FileManager, error) {
+	recoveryStart := time.Now()
 	fs := &FileManager{
 		rootDir:    fileStorePath,
+		opts:       opts.withDefaults(),
 		indexStore: indexStore,
+		limiters:   make(map[string]*rateLimiter),
+	}
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		indexStore.Close()
+		if fs.erasure != nil {
+			fs.erasure.close()
+		} else if fs.writer != nil {
+			fs.writer.close()
+		}
+	}()
+	// 不管存不存在，都创建存储用文件夹
+	if _, err := createDirIfMissing(fileStorePath); err != nil {
+		return nil, err
+	}
+	if fs.opts.CacheSize > 0 {
+		fs.cache = newRecordCache(fs.opts.CacheSize)
+	}
+	if len(fs.opts.MasterKey) > 0 {
+		if err := fs.openKeyring(fs.opts.MasterKey); err != nil {
+			return nil, err
+		}
+	}
+	if fs.opts.Erasure.enabled() {
+		erasure, err := newErasureStore(fs.opts.Erasure)
+		if err != nil {
+			return nil, err
+		}
+		erasure.metrics = fs.opts.Metrics
+		fs.erasure = erasure
+	}
+	if fs.opts.Tiering.Store != nil {
+		if fs.erasure != nil {
+			return nil, errors.New("tiering is not supported with erasure coding")
+		}
+		tiering, err := newTiering(fileStorePath, fs.opts.Tiering)
+		if err != nil {
+			return nil, err
+		}
+		fs.tiering = tiering
 	}
 	// 读取最后保存的checkpoint
 	cp, err := fs.loadCheckpoint()
@@ -56,7 +136,16 @@ func NewFileManager(fileStorePath string, indexStorePath string) (*FileManager,
 	// checkpoint不存在，初始化
 	if cp == nil {
 		log.Println("construct checkpoint from file storage")
-		if cp, err = constructCheckpointFromFiles(fileStorePath); err != nil {
+		if fs.erasure != nil {
+			cp, err = fs.erasure.constructCheckpoint()
+		} else {
+			cp, err = constructCheckpointFromFiles(fileStorePath)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if fs.erasure != nil {
+		if err := fs.erasure.syncCheckpoint(cp); err != nil {
 			return nil, err
 		}
 	} else {
@@ -71,17 +160,64 @@ func NewFileManager(fileStorePath string, indexStorePath string) (*FileManager,
 		return nil, err
 	}
 	fs.checkpoint = cp
-	// 利用checkpoint中的数据生成writer
-	fWriter, err := newFileWriter(buildFilePath(fileStorePath, cp.lastFileSeq))
-	if err != nil {
-		return nil, err
+	if fs.erasure != nil {
+		if err = fs.erasure.open(cp.lastFileSeq); err != nil {
+			return nil, err
+		}
+	} else {
+		// 利用checkpoint中的数据生成writer
+		fWriter, err := newFileWriter(buildFilePath(fileStorePath, cp.lastFileSeq))
+		if err != nil {
+			return nil, err
+		}
+		fs.writer = fWriter
 	}
-	fs.writer = fWriter
 	// 修剪不完整的数据
-	if err = fs.writer.truncate(cp.lastFileSize); err != nil {
+	if err = fs.truncate(cp.lastFileSize); err != nil {
+		return nil, err
+	}
+	fs.opts.Metrics.ObserveRecovery(time.Since(recoveryStart))
+	// 集群中只有leader可以修改索引，其他节点跳过初始化
+	if err = fs.ensureDefaultBucket(); err != nil && errors.Cause(err) != utils.ErrNotLeader {
+		return nil, err
+	}
+	if err = fs.migrateLegacyIndexes(); err != nil && errors.Cause(err) != utils.ErrNotLeader {
+		return nil, err
+	}
+	if err = fs.purgeExpiredIdempotencyRecords(); err != nil && errors.Cause(err) != utils.ErrNotLeader {
 		return nil, err
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	fs.cancel = cancel
+	fs.loops.Add(3)
+	go func() {
+		defer fs.loops.Done()
+		fs.purgeIdempotencyRecordsLoop(ctx)
+	}()
+	go func() {
+		defer fs.loops.Done()
+		fs.expireChunksLoop(ctx)
+	}()
+	go func() {
+		defer fs.loops.Done()
+		fs.reportStorageMetricsLoop(ctx)
+	}()
+	if fs.tiering != nil && fs.opts.Tiering.Interval > 0 {
+		fs.loops.Add(1)
+		go func() {
+			defer fs.loops.Done()
+			fs.tierLoop(ctx)
+		}()
+	}
+	if fs.opts.SyncPolicy == SyncPeriodic {
+		fs.loops.Add(1)
+		go func() {
+			defer fs.loops.Done()
+			fs.syncLoop(ctx)
+		}()
+	}
 
+	succeeded = true
 	return fs, nil
 }
 
@@ -130,6 +266,23 @@ func (fm *FileManager) updateCheckpoint(cp *checkpoint) {
 	defer fm.mutx.Unlock()
 
 	fm.checkpoint = cp
+	fm.opts.Metrics.SetCheckpoint(cp.lastFileSeq, cp.lastFileSize)
+	if fm.logAppended != nil {
+		close(fm.logAppended)
+		fm.logAppended = nil
+	}
+}
+
+// LogAppended 返回一个channel，之后写入位置移动时被关闭，不需要持有writeMutx，
+// 复制服务在调用ReadLog之前获取，没有新记录时不需要反复调用ReadLog
+func (fm *FileManager) LogAppended() <-chan struct{} {
+	fm.mutx.Lock()
+	defer fm.mutx.Unlock()
+
+	if fm.logAppended == nil {
+		fm.logAppended = make(chan struct{})
+	}
+	return fm.logAppended
 }
 
 func buildFileName(seq int) string {
@@ -140,115 +293,659 @@ func buildFilePath(rootDir string, seq int) string {
 	return rootDir + "/" + buildFileName(seq)
 }
 
+// WriteOptions 写入chunk时的可选参数
+type WriteOptions struct {
+	// 写入的bucket，为空时使用DefaultBucket
+	Bucket string
+	// 指定chunk的id，为空时生成uuid，id已经存在时的行为由Overwrite决定
+	Key string
+	// Key已经存在时的写入行为
+	Overwrite OverwriteMode
+	// Overwrite为OverwriteIfMatch时，已有chunk的ETag必须等于IfMatch
+	IfMatch string
+	// 幂等key，在Options.IdempotencyWindow内同一个写入者使用相同的幂等key写入同一个bucket时，
+	// 不会重复写入，而是返回第一次写入的chunk，id或数据与第一次写入不同时返回ErrIdempotencyConflict。
+	// http接口通过Idempotency-Key请求头设置，
+	// my-fs没有gRPC接口，proto中只定义了数据文件中的记录格式
+	IdempotencyKey string
+	// 存活时间，大于0时chunk在写入TTL之后过期，过期的chunk读取时不存在，之后被后台清理
+	TTL time.Duration
+	// 过期时间，unix纳秒，大于0时优先于TTL，例如导入时保留原来的过期时间
+	ExpiresAt int64
+	// 写入者，即API token的id，chunk计入该写入者的用量，为空时不统计
+	Owner string
+	// 写入者的配额，由调用方根据token的配置给出，与bucket的配额同时生效
+	OwnerQuota BucketQuota
+}
+
+// OverwriteMode 使用指定的key写入时，key已经存在的处理方式
+type OverwriteMode int
+
+const (
+	// OverwriteReplace 覆盖已有的chunk
+	OverwriteReplace OverwriteMode = iota
+	// OverwriteFail key已经存在时返回ErrKeyExists
+	OverwriteFail
+	// OverwriteIfMatch 只有已有chunk的ETag与IfMatch相同时才覆盖，否则返回ErrPreconditionFailed
+	OverwriteIfMatch
+)
+
+// ReadOptions 读取chunk时的可选参数
+type ReadOptions struct {
+	// 读取的bucket，为空时使用DefaultBucket
+	Bucket string
+	// 读取指定的版本，为空时读取最新的版本
+	VersionId string
+}
+
+// DeleteOptions 删除chunk时的可选参数
+type DeleteOptions struct {
+	// 删除的bucket，为空时使用DefaultBucket
+	Bucket string
+	// 永久删除指定的版本，为空时在开启版本控制的bucket中写入删除标记
+	VersionId string
+}
+
+func bucketOrDefault(bucket string) string {
+	if bucket == "" {
+		return DefaultBucket
+	}
+	return bucket
+}
+
 func (fm *FileManager) Read(blockId string) ([]byte, error) {
-	index, err := fm.indexStore.FetchIndex(blockId)
+	return fm.ReadWithOptions(blockId, nil)
+}
+
+func (fm *FileManager) ReadWithOptions(blockId string, opts *ReadOptions) ([]byte, error) {
+	data, _, err := fm.ReadWithIndex(blockId, opts)
+	return data, err
+}
+
+// ReadWithIndex 读取chunk的数据以及读取时使用的索引，响应中的ETag等元数据与数据一致
+func (fm *FileManager) ReadWithIndex(blockId string, opts *ReadOptions) ([]byte, *BlockIndex, error) {
+	start := time.Now()
+	data, index, err := fm.read(blockId, opts)
+	fm.opts.Metrics.ObserveOperation(OpRead, time.Since(start), err)
+	if err == nil {
+		fm.opts.Metrics.AddBytesRead(len(data))
+	}
+	return data, index, err
+}
+
+func (fm *FileManager) read(blockId string, opts *ReadOptions) ([]byte, *BlockIndex, error) {
+	// 防止读取过程中文件被压缩删除
+	fm.segmentMutx.RLock()
+	defer fm.segmentMutx.RUnlock()
+
+	index, err := fm.Stat(blockId, opts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if fm.cache == nil {
+		chunk, err := fm.readChunk(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := decompress(chunk)
+		return data, index, err
 	}
 
-	stream, err := newFileStream(fm.rootDir, index.FSeq, int64(index.Offset))
+	key := recordKey{node: index.Node, seq: index.FSeq, offset: index.Offset}
+	if data, ok := fm.cache.get(key); ok {
+		fm.opts.Metrics.CacheAccess(true)
+		return copyBytes(data), index, nil
+	}
+	fm.opts.Metrics.CacheAccess(false)
+	chunk, err := fm.readChunk(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := decompress(chunk)
 	if err != nil {
+		return nil, nil, err
+	}
+	// 调用方可能修改返回的数据，缓存中保存一份拷贝
+	fm.cache.add(key, copyBytes(data))
+	return data, index, nil
+}
+
+func copyBytes(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
+
+// Stat 获取chunk的索引信息，不读取数据，已经过期的chunk返回ErrIndexNotFound
+func (fm *FileManager) Stat(blockId string, opts *ReadOptions) (*BlockIndex, error) {
+	index, err := fm.stat(blockId, opts)
+	if err == nil && index.expired(time.Now().UnixNano()) {
+		return nil, errors.Wrapf(utils.ErrIndexNotFound, "chunk [%s] expired", blockId)
+	}
+	return index, err
+}
+
+// stat 获取chunk的索引信息，包括已经过期但是还没有清理的chunk
+func (fm *FileManager) stat(blockId string, opts *ReadOptions) (*BlockIndex, error) {
+	if opts == nil {
+		opts = &ReadOptions{}
+	}
+	if err := fm.readBarrier(); err != nil {
 		return nil, err
 	}
-	defer stream.close()
-	chunkBytes, err := stream.scanForNextChunk()
+	bucket := bucketOrDefault(opts.Bucket)
+	if opts.VersionId != "" {
+		index, err := fm.indexStore.FetchVersion(bucket, blockId, opts.VersionId)
+		if err == nil && index.DeleteMarker {
+			return nil, errors.Wrapf(utils.ErrIndexNotFound, "version [%s] is a delete marker", opts.VersionId)
+		}
+		return index, err
+	}
+	return fm.indexStore.FetchBucketIndex(bucket, blockId)
+}
+
+// readBarrier 集群模式下等待本节点追上已经提交的索引修改，保证可以读到之前完成的写入
+func (fm *FileManager) readBarrier() error {
+	if barrier, ok := fm.indexStore.(readBarrier); ok {
+		return barrier.ReadBarrier()
+	}
+	return nil
+}
+
+// readChunk 根据索引读取文件中的chunk，保存在其他节点上的chunk通过RecordFetcher读取
+func (fm *FileManager) readChunk(index *BlockIndex) (*pb.Chunk, error) {
+	if index.Node != fm.opts.NodeId {
+		if fm.opts.RecordFetcher == nil {
+			return nil, errors.Errorf("chunk [%s] is stored on node [%s]", index.BlockId, index.Node)
+		}
+		chunkBytes, err := fm.opts.RecordFetcher.FetchRecord(index.Node, index.FSeq, index.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return fm.decodeChunk(chunkBytes)
+	}
+	chunkBytes, err := fm.ReadRecord(index.FSeq, index.Offset)
 	if err != nil {
 		return nil, err
 	}
-	chunk := new(pb.Chunk)
-	if err := proto.Unmarshal(chunkBytes, chunk); err != nil {
-		return nil, errors.Wrap(err, "proto unmarshal chunk failed")
+	return fm.decodeChunk(chunkBytes)
+}
+
+// ReadRecord 读取本节点数据文件中(seq, offset)处的原始记录，不包括长度前缀
+func (fm *FileManager) ReadRecord(seq int, offset uint64) ([]byte, error) {
+	if fm.erasure != nil {
+		record, _, err := fm.erasure.readRecord(seq, int64(offset))
+		return record, err
 	}
-	return chunk.Payload, nil
+	return fm.readLocalRecord(seq, int64(offset))
 }
 
 func (fm *FileManager) Write(data []byte) (string, error) {
-	// 序列化数据
-	id := uuid.New().String()
-	block := &pb.Chunk{
-		Id:      id,
-		Payload: data,
+	return fm.WriteWithOptions(data, nil)
+}
+
+func (fm *FileManager) WriteWithOptions(data []byte, opts *WriteOptions) (string, error) {
+	index, err := fm.write(data, opts)
+	if err != nil {
+		return "", err
+	}
+	return index.BlockId, nil
+}
+
+// WriteWithKey 使用调用方指定的key写入chunk，返回写入后的索引，opts中的Key会被忽略
+func (fm *FileManager) WriteWithKey(key string, data []byte, opts *WriteOptions) (*BlockIndex, error) {
+	if key == "" {
+		return nil, errors.New("key can not be empty")
+	}
+	keyOpts := WriteOptions{}
+	if opts != nil {
+		keyOpts = *opts
 	}
-	data, err := proto.Marshal(block)
+	keyOpts.Key = key
+	return fm.write(data, &keyOpts)
+}
+
+func (fm *FileManager) write(data []byte, opts *WriteOptions) (*BlockIndex, error) {
+	start := time.Now()
+	index, err := fm.writeChunk(data, opts)
+	fm.opts.Metrics.ObserveOperation(OpWrite, time.Since(start), err)
+	if err == nil {
+		fm.opts.Metrics.AddBytesWritten(len(data))
+	}
+	return index, err
+}
+
+func (fm *FileManager) writeChunk(data []byte, opts *WriteOptions) (*BlockIndex, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	if opts.TTL < 0 {
+		return nil, errors.Errorf("ttl [%s] can not be negative", opts.TTL)
+	}
+	if err := fm.checkWritable(); err != nil {
+		return nil, err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	bucket, err := fm.indexStore.FetchBucket(bucketOrDefault(opts.Bucket))
 	if err != nil {
-		return "", errors.Wrap(err, "marshal block failed")
+		return nil, err
+	}
+	var requestHash string
+	if opts.IdempotencyKey != "" {
+		requestHash = idempotentRequestHash(opts.Key, data)
+		index, err := fm.fetchIdempotentWrite(bucket.Name, opts.Owner, opts.IdempotencyKey, requestHash)
+		if err != nil || index != nil {
+			return index, err
+		}
+	}
+
+	id := opts.Key
+	var oldIndex *BlockIndex
+	if id == "" {
+		id = uuid.New().String()
+	} else {
+		oldIndex, err = fm.indexStore.FetchBucketIndex(bucket.Name, id)
+		if err != nil && err != utils.ErrIndexNotFound {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	// 已经过期的chunk视为不存在，但是仍然占用配额，直到被覆盖或者清理
+	existing := oldIndex
+	if existing != nil && existing.expired(now.UnixNano()) {
+		existing = nil
+	}
+	if err = checkOverwrite(id, existing, opts); err != nil {
+		return nil, err
+	}
+	expiresAt := opts.ExpiresAt
+	if expiresAt <= 0 && opts.TTL > 0 {
+		expiresAt = now.Add(opts.TTL).UnixNano()
+	}
+	var versionId string
+	if bucket.Versioning {
+		versionId = fm.nextVersionId()
+	}
+	// 覆盖已有的chunk时，先扣除旧chunk占用的配额，开启版本控制时旧的版本仍然保留
+	owners := fm.newOwnerUsages()
+	if oldIndex != nil && oldIndex.VersionId == "" {
+		bucket.UsedBytes -= oldIndex.Size
+		bucket.ObjectCount--
+		if err = owners.add(oldIndex.Owner, -oldIndex.Size, -1); err != nil {
+			return nil, err
+		}
+	}
+	size := int64(len(data))
+	if err = bucket.checkQuota(size); err != nil {
+		return nil, err
+	}
+	if err = owners.checkQuota(opts.Owner, opts.OwnerQuota, size); err != nil {
+		return nil, err
+	}
+	if err = fm.checkDiskFree(size); err != nil {
+		return nil, err
+	}
+	// 其他检查都通过之后才扣除写入速度的令牌
+	if err = fm.admitRate(size, now,
+		rateLimit{utils.QuotaScopeBucket, bucket.Name, bucket.Quota.MaxBytesPerSecond},
+		rateLimit{utils.QuotaScopeToken, opts.Owner, opts.OwnerQuota.MaxBytesPerSecond}); err != nil {
+		return nil, err
+	}
+
+	payload, codec := fm.compress(data)
+	index, err := fm.appendChunk(&pb.Chunk{
+		Id:        id,
+		Payload:   payload,
+		Bucket:    bucket.Name,
+		VersionId: versionId,
+		Codec:     codec,
+		ExpiresAt: expiresAt,
+		Owner:     opts.Owner,
+		WrittenAt: now.UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	index.Size = size
+	index.ETag = fm.etag(data)
+	index.ModTime = now.UnixNano()
+	index.VersionId = versionId
+	index.ExpiresAt = expiresAt
+	index.Owner = opts.Owner
+
+	// 更新索引以及bucket和写入者的使用情况，被覆盖的chunk记录留给之后的压缩处理
+	bucket.UsedBytes += index.Size
+	bucket.ObjectCount++
+	if err = owners.add(opts.Owner, index.Size, 1); err != nil {
+		return nil, err
+	}
+	batch := new(IndexBatch)
+	batch.PutIndex(index)
+	if versionId != "" {
+		batch.PutVersion(index)
+	}
+	batch.PutBucket(bucket)
+	owners.save(batch)
+	if opts.IdempotencyKey != "" {
+		batch.PutIdempotencyRecord(opts.IdempotencyKey, &IdempotencyRecord{
+			Bucket:      bucket.Name,
+			Owner:       opts.Owner,
+			BlockId:     id,
+			RequestHash: requestHash,
+			ExpiresAt:   time.Now().Add(fm.opts.IdempotencyWindow).UnixNano(),
+		})
+	}
+	if err = fm.indexStore.WriteBatch(batch, true); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// checkOverwrite 根据写入选项检测是否允许写入id，oldIndex为nil表示id不存在
+func checkOverwrite(id string, oldIndex *BlockIndex, opts *WriteOptions) error {
+	switch opts.Overwrite {
+	case OverwriteFail:
+		if oldIndex != nil {
+			return errors.Wrapf(utils.ErrKeyExists, "key [%s]", id)
+		}
+	case OverwriteIfMatch:
+		if oldIndex == nil || oldIndex.ETag != opts.IfMatch {
+			return errors.Wrapf(utils.ErrPreconditionFailed, "key [%s] does not match etag [%s]", id, opts.IfMatch)
+		}
+	}
+	return nil
+}
+
+func (fm *FileManager) Delete(blockId string) error {
+	return fm.DeleteWithOptions(blockId, nil)
+}
+
+// DeleteWithOptions 删除chunk，文件中写入一条删除标记，原有的记录留给之后的压缩处理
+// 开启版本控制的bucket中，删除只会写入一个新的删除标记版本，指定VersionId时才会永久删除该版本
+func (fm *FileManager) DeleteWithOptions(blockId string, opts *DeleteOptions) error {
+	start := time.Now()
+	err := fm.delete(blockId, opts)
+	fm.opts.Metrics.ObserveOperation(OpDelete, time.Since(start), err)
+	return err
+}
+
+func (fm *FileManager) delete(blockId string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	if err := fm.checkWritable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	bucket, err := fm.indexStore.FetchBucket(bucketOrDefault(opts.Bucket))
+	if err != nil {
+		return err
+	}
+	if opts.VersionId != "" {
+		return fm.deleteVersion(bucket, blockId, opts.VersionId)
+	}
+	index, err := fm.indexStore.FetchBucketIndex(bucket.Name, blockId)
+	if err != nil {
+		return err
+	}
+	return fm.deleteLatest(bucket, index)
+}
+
+// deleteLatest 写入删除标记并删除最新的索引，调用方需要持有writeMutx
+func (fm *FileManager) deleteLatest(bucket *Bucket, index *BlockIndex) error {
+	blockId := index.BlockId
+	var versionId string
+	if bucket.Versioning {
+		versionId = fm.nextVersionId()
+	}
+	marker, err := fm.appendChunk(&pb.Chunk{
+		Id:        blockId,
+		Bucket:    bucket.Name,
+		Deleted:   true,
+		VersionId: versionId,
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := new(IndexBatch)
+	batch.DeleteIndex(bucket.Name, blockId)
+	if versionId != "" {
+		marker.VersionId = versionId
+		marker.DeleteMarker = true
+		marker.ModTime = time.Now().UnixNano()
+		batch.PutVersion(marker)
+	}
+	// 没有版本号的chunk会被删除，需要释放配额
+	if index.VersionId == "" {
+		bucket.UsedBytes -= index.Size
+		bucket.ObjectCount--
+		owners := fm.newOwnerUsages()
+		if err = owners.add(index.Owner, -index.Size, -1); err != nil {
+			return err
+		}
+		owners.save(batch)
+	}
+	batch.PutBucket(bucket)
+	return fm.indexStore.WriteBatch(batch, true)
+}
+
+// appendChunk 将chunk追加到当前文件中，并更新checkpoint，返回chunk对应的索引
+func (fm *FileManager) appendChunk(block *pb.Chunk) (*BlockIndex, error) {
+	// 等待写锁期间FileManager可能已经被关闭
+	if err := fm.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := fm.checkAppendable(); err != nil {
+		return nil, err
+	}
+	// 压缩搬迁的chunk保留最初的写入时间
+	if block.WrittenAt == 0 {
+		block.WrittenAt = time.Now().UnixNano()
+	}
+	// 序列化数据
+	data, err := fm.encodeChunk(block)
+	if err != nil {
+		return nil, err
 	}
 	dataLen := len(data)
 	encodedDataLen := proto.EncodeVarint(uint64(dataLen))
-	totalLenToAppend := dataLen+len(encodedDataLen)
+	totalLenToAppend := dataLen + len(encodedDataLen)
+	if fm.erasure != nil {
+		totalLenToAppend = fm.erasure.recordSize(dataLen)
+	}
 	currentOffset := fm.checkpoint.lastFileSize
 	// 写入文件
 	// 判断文件是否已经超过最大大小
-	if fm.checkpoint.lastFileSize + totalLenToAppend > maxFileSize {
+	if fm.checkpoint.lastFileSize+totalLenToAppend > fm.opts.MaxFileSize && fm.checkpoint.lastFileSize > 0 {
 		// 超过大小，重新创建一个文件，并写入数据
-		fm.moveToNextFile()
+		if err = fm.moveToNextFile(); err != nil {
+			return nil, err
+		}
 		currentOffset = 0
 	}
 	// 没有超过，正常写入
-	err = fm.writer.write(encodedDataLen, false)
-	if err == nil {
-		err = fm.writer.write(data, true)
+	syncWrite := fm.opts.SyncPolicy == SyncAlways
+	if fm.erasure != nil {
+		err = fm.erasure.write(currentOffset, data, syncWrite)
+	} else {
+		err = fm.writer.write(encodedDataLen, false)
+		if err == nil {
+			err = fm.writer.write(data, false)
+		}
+		if err == nil && syncWrite {
+			syncStart := time.Now()
+			err = fm.writer.sync()
+			fm.opts.Metrics.ObserveFsync(time.Since(syncStart))
+		}
 	}
 	if err != nil {
 		// 出错了，修剪文件
-		err1 := fm.truncate(currentOffset)
-		if err1 != nil {
-			panic(fmt.Sprintf("truncate file failed, err=%s", err1))
-		}
-		return "", errors.Wrap(err, "write data into file failed")
+		fm.rollback(currentOffset)
+		return nil, errors.Wrap(err, "write data into file failed")
 	}
+	fm.dirty = !syncWrite
 
 	// 更新checkpoint
 	newCP := &checkpoint{
-		lastFileSeq: fm.checkpoint.lastFileSeq,
+		lastFileSeq:  fm.checkpoint.lastFileSeq,
 		lastFileSize: currentOffset + totalLenToAppend,
 	}
 	if err = fm.saveCheckpoint(newCP, false); err != nil {
-		err1 := fm.truncate(currentOffset)
-		if err1 != nil {
-			panic(fmt.Sprintf("truncate file failed, err=%s", err1))
-		}
-		return "", errors.Wrap(err, "save checkpoint failed")
+		fm.rollback(currentOffset)
+		return nil, errors.Wrap(err, "save checkpoint failed")
 	}
-	
-	// 更新索引
-	if err = fm.indexStore.SaveIndex(&BlockIndex{
-		FSeq:    fm.checkpoint.lastFileSeq,
-		BlockId: id,
+	fm.updateCheckpoint(newCP)
+
+	return &BlockIndex{
+		Node:    fm.opts.NodeId,
+		FSeq:    newCP.lastFileSeq,
+		BlockId: block.Id,
 		Offset:  uint64(currentOffset),
-	}, true); err != nil {
-		return "", err
+		Bucket:  block.Bucket,
+		Size:    int64(len(block.Payload)),
+	}, nil
+}
+
+// rollback 写入失败后修剪掉不完整的数据，修剪也失败时之后的写入会接在不完整的数据后面，
+// 因此拒绝所有的写入，重启时由恢复流程按照checkpoint修剪
+func (fm *FileManager) rollback(offset int) {
+	if err := fm.truncate(offset); err != nil {
+		atomic.StoreInt32(&fm.appendFailed, 1)
+		log.Printf("truncate file failed, writes are rejected until restart, err=%s", err)
 	}
-	fm.updateCheckpoint(newCP)
-	return id, nil
 }
 
-func (fm *FileManager) moveToNextFile() {
+// checkAppendable 检查数据文件是否可以继续追加
+func (fm *FileManager) checkAppendable() error {
+	if atomic.LoadInt32(&fm.appendFailed) == 1 {
+		return errors.Wrap(utils.ErrReadOnly, "data file could not be rolled back after a failed write, restart to recover")
+	}
+	return nil
+}
+
+func (fm *FileManager) moveToNextFile() error {
+	return fm.moveToFile(fm.checkpoint.lastFileSeq + 1)
+}
+
+// moveToFile 切换到seq对应的文件继续写入，无法打开新文件时继续使用当前文件
+func (fm *FileManager) moveToFile(seq int) error {
 	// 更新checkpoint
 	newCheckpoint := &checkpoint{
-		lastFileSeq:  fm.checkpoint.lastFileSeq + 1,
+		lastFileSeq:  seq,
 		lastFileSize: 0,
 	}
 	// 更新writer
-	nextWriter, err := newFileWriter(buildFilePath(fm.rootDir, newCheckpoint.lastFileSeq))
-	if err != nil {
-		panic(fmt.Sprintf("could not open writer for next file, err=%s", err))
+	if fm.erasure != nil {
+		if err := fm.erasure.open(seq); err != nil {
+			return errors.Wrap(err, "could not open writer for next file")
+		}
+	} else {
+		nextWriter, err := newFileWriter(buildFilePath(fm.rootDir, newCheckpoint.lastFileSeq))
+		if err != nil {
+			return errors.Wrap(err, "could not open writer for next file")
+		}
+		// 封存的文件之后不会再写入，切换前同步没有同步的写入
+		if fm.dirty {
+			if err = fm.syncData(); err != nil {
+				log.Printf("sync sealed file failed: %s", err)
+			}
+		}
+		fm.writer.close()
+		fm.writer = nextWriter
 	}
-	fm.writer.close()
-	fm.writer = nextWriter
+	fm.dirty = false
 	// 保存checkpoint
 	fm.saveCheckpoint(newCheckpoint, true)
 	fm.updateCheckpoint(newCheckpoint)
+	return nil
 }
 
 // truncate 清理损坏的数据
 func (fm *FileManager) truncate(offset int) error {
+	// 修剪之后的位置会被新的记录重用
+	if fm.cache != nil {
+		fm.cache.purge()
+	}
+	if fm.erasure != nil {
+		return fm.erasure.truncate(offset)
+	}
 	return fm.writer.truncate(offset)
 }
 
+// Close 拒绝新的写入，等待正在进行的写入完成后同步数据文件以及checkpoint，之后关闭索引数据库与数据文件
+// 重复调用时直接返回
 func (fm *FileManager) Close() error {
-	if err := fm.indexStore.Close(); err != nil {
-		return err
+	if !atomic.CompareAndSwapInt32(&fm.closed, 0, 1) {
+		return nil
+	}
+	fm.cancel()
+	fm.loops.Wait()
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	keep(errors.Wrap(fm.syncData(), "sync data file failed"))
+	fm.mutx.Lock()
+	cp := *fm.checkpoint
+	fm.mutx.Unlock()
+	keep(fm.saveCheckpoint(&cp, true))
+	keep(fm.indexStore.Close())
+	if fm.erasure != nil {
+		keep(fm.erasure.close())
+	} else {
+		keep(fm.writer.close())
+	}
+	return firstErr
+}
+
+// syncData 同步当前写入的数据文件，调用方需要持有writeMutx
+func (fm *FileManager) syncData() error {
+	var err error
+	if fm.erasure != nil {
+		err = fm.erasure.sync()
+	} else {
+		syncStart := time.Now()
+		err = fm.writer.sync()
+		fm.opts.Metrics.ObserveFsync(time.Since(syncStart))
+	}
+	if err == nil {
+		fm.dirty = false
+	}
+	return err
+}
+
+// syncLoop SyncPeriodic策略下定期同步数据文件，直到ctx被取消
+func (fm *FileManager) syncLoop(ctx context.Context) {
+	ticker := time.NewTicker(fm.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fm.writeMutx.Lock()
+		if fm.dirty {
+			if err := fm.syncData(); err != nil {
+				log.Printf("periodic sync failed: %s", err)
+			}
+		}
+		fm.writeMutx.Unlock()
+	}
+}
+
+// checkOpen 关闭之后返回ErrClosed
+func (fm *FileManager) checkOpen() error {
+	if atomic.LoadInt32(&fm.closed) == 1 {
+		return utils.ErrClosed
 	}
-	return fm.writer.close()
+	return nil
 }
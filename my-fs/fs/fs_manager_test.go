@@ -1,8 +1,16 @@
 package fs
 
 import (
+	"fmt"
+	"io/ioutil"
+	"my-fs/utils"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -74,3 +82,212 @@ func TestFileManager_Write(t *testing.T) {
 	}
 	t.Log(string(readBytes))
 }
+
+func TestFileManager_WriteWithKeyAndDelete(t *testing.T) {
+	fm := newTestFileManager(t)
+	opts := &WriteOptions{Key: "report.json"}
+	if _, err := fm.WriteWithOptions([]byte("v1"), opts); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fm.WriteWithOptions([]byte("version2"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "report.json" {
+		t.Fatalf("id should be report.json, got %s", id)
+	}
+	data, err := fm.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "version2" {
+		t.Fatalf("read %q, want version2", data)
+	}
+	bucket, err := fm.GetBucket(DefaultBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.UsedBytes != 8 || bucket.ObjectCount != 1 {
+		t.Fatalf("overwrite should replace usage, got %d bytes and %d objects", bucket.UsedBytes, bucket.ObjectCount)
+	}
+
+	if err = fm.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.Read(id); err != utils.ErrIndexNotFound {
+		t.Fatalf("err should be ErrIndexNotFound, got %v", err)
+	}
+	if bucket, err = fm.GetBucket(DefaultBucket); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.UsedBytes != 0 || bucket.ObjectCount != 0 {
+		t.Fatalf("usage should be empty after delete, got %d bytes and %d objects", bucket.UsedBytes, bucket.ObjectCount)
+	}
+}
+
+func TestFileManager_WriteWithKeyOverwriteModes(t *testing.T) {
+	fm := newTestFileManager(t)
+	first, err := fm.WriteWithKey("config", []byte("a=1"), &WriteOptions{Overwrite: OverwriteFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("config", []byte("a=2"), &WriteOptions{Overwrite: OverwriteFail}); errors.Cause(err) != utils.ErrKeyExists {
+		t.Fatalf("err should be ErrKeyExists, got %v", err)
+	}
+
+	ifMatch := &WriteOptions{Overwrite: OverwriteIfMatch, IfMatch: first.ETag}
+	second, err := fm.WriteWithKey("config", []byte("a=2"), ifMatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一次的ETag已经过期，再次使用时应该失败
+	if _, err = fm.WriteWithKey("config", []byte("a=3"), ifMatch); errors.Cause(err) != utils.ErrPreconditionFailed {
+		t.Fatalf("err should be ErrPreconditionFailed, got %v", err)
+	}
+	if _, err = fm.WriteWithKey("missing", []byte("x"), ifMatch); errors.Cause(err) != utils.ErrPreconditionFailed {
+		t.Fatalf("err should be ErrPreconditionFailed, got %v", err)
+	}
+
+	data, err := fm.Read("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a=2" || second.ETag == first.ETag {
+		t.Fatalf("read %q, want a=2", data)
+	}
+}
+
+func TestFileManager_Close(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	fm, err := NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭时正在进行的写入要么完成，要么返回ErrClosed
+	var mutx sync.Mutex
+	var written []string
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				id, err := fm.Write([]byte(fmt.Sprintf("worker-%d-%d", worker, j)))
+				if errors.Cause(err) == utils.ErrClosed {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mutx.Lock()
+				written = append(written, id)
+				mutx.Unlock()
+			}
+		}(i)
+	}
+	for {
+		mutx.Lock()
+		n := len(written)
+		mutx.Unlock()
+		if n >= 100 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if _, err = fm.Write([]byte("late")); errors.Cause(err) != utils.ErrClosed {
+		t.Fatalf("expect ErrClosed after close, got %v", err)
+	}
+	if err = fm.Close(); err != nil {
+		t.Fatalf("expect repeated close to succeed, got %v", err)
+	}
+
+	// 重新打开后checkpoint与数据文件一致，所有完成的写入都可以读到
+	fm, err = NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	size, err := fm.segmentSize(fm.checkpoint.lastFileSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(fm.checkpoint.lastFileSize) != size {
+		t.Fatalf("checkpoint offset %d does not match file size %d", fm.checkpoint.lastFileSize, size)
+	}
+	for _, id := range written {
+		if _, err = fm.Read(id); err != nil {
+			t.Fatalf("read %s after reopen failed: %s", id, err)
+		}
+	}
+}
+
+// TestFileManager_OpenFailure 创建失败时关闭索引数据库，同一个进程中可以重新打开
+func TestFileManager_OpenFailure(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	if err := ioutil.WriteFile(fileStore, []byte("not a dir"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileManager(fileStore, indexStore); err == nil {
+		t.Fatal("expect a file store path that is a file to be rejected")
+	}
+	if err := os.Remove(fileStore); err != nil {
+		t.Fatal(err)
+	}
+	fm, err := NewFileManager(fileStore, indexStore)
+	if err != nil {
+		t.Fatalf("reopen after a failed open: %s", err)
+	}
+	fm.Close()
+}
+
+func TestFileManager_SyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncPeriodic, SyncNone} {
+		dir := t.TempDir()
+		fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+		opts := &Options{MaxFileSize: 256, SyncPolicy: policy, SyncInterval: time.Millisecond}
+		fm, err := NewFileManagerWithOptions(fileStore, indexStore, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for i := 0; i < 20; i++ {
+			id, err := fm.Write([]byte(fmt.Sprintf("record-%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if policy == SyncPeriodic {
+			time.Sleep(10 * time.Millisecond)
+			fm.writeMutx.Lock()
+			dirty := fm.dirty
+			fm.writeMutx.Unlock()
+			if dirty {
+				t.Fatal("expect periodic sync to flush pending writes")
+			}
+		}
+		if err = fm.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		fm, err = NewFileManagerWithOptions(fileStore, indexStore, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range ids {
+			data, err := fm.Read(id)
+			if err != nil || string(data) != fmt.Sprintf("record-%d", i) {
+				t.Fatalf("policy %d: read %s after reopen got %q, %v", policy, id, data, err)
+			}
+		}
+		fm.Close()
+	}
+}
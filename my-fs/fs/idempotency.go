@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"my-fs/utils"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// idempotentRequestHash 写入请求的摘要，相同的幂等key只能用于重试相同id与数据的请求
+func idempotentRequestHash(key string, data []byte) string {
+	digest := sha256.Sum256(data)
+	hash := sha256.Sum256(append([]byte(key+"\x00"), digest[:]...))
+	return hex.EncodeToString(hash[:])
+}
+
+// fetchIdempotentWrite 查找写入者的幂等key对应的第一次写入，没有找到或者已经过期时返回nil
+// 第一次写入的请求与requestHash不一致时返回ErrIdempotencyConflict
+func (fm *FileManager) fetchIdempotentWrite(bucket, owner, key, requestHash string) (*BlockIndex, error) {
+	record, err := fm.indexStore.FetchIdempotencyRecord(bucket, owner, key)
+	if err != nil || record == nil || record.ExpiresAt <= time.Now().UnixNano() {
+		return nil, err
+	}
+	// 旧版本的记录没有保存请求的摘要
+	if record.RequestHash != "" && record.RequestHash != requestHash {
+		return nil, errors.Wrapf(utils.ErrIdempotencyConflict, "idempotency key [%s]", key)
+	}
+	index, err := fm.indexStore.FetchBucketIndex(bucket, record.BlockId)
+	if err == utils.ErrIndexNotFound {
+		// 第一次写入的chunk已经被删除，仍然返回原来的id
+		return &BlockIndex{Bucket: bucket, BlockId: record.BlockId}, nil
+	}
+	return index, err
+}
+
+func (fm *FileManager) purgeExpiredIdempotencyRecords() error {
+	n, err := fm.indexStore.DeleteExpiredIdempotencyRecords(time.Now().UnixNano())
+	if n > 0 {
+		log.Printf("purged %d expired idempotency keys", n)
+	}
+	return err
+}
+
+// purgeIdempotencyRecordsLoop 定期清理过期的幂等key
+func (fm *FileManager) purgeIdempotencyRecordsLoop(ctx context.Context) {
+	interval := fm.opts.IdempotencyWindow
+	if interval > maxIdempotencyPurgeInterval {
+		interval = maxIdempotencyPurgeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fm.purgeExpiredIdempotencyRecords(); err != nil {
+				log.Printf("purge expired idempotency keys failed, err=%s", err)
+			}
+		}
+	}
+}
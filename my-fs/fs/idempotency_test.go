@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"my-fs/utils"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileManager_IdempotentWrite(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	fm, err := NewFileManager(fileStore, indexStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &WriteOptions{IdempotencyKey: "request-1"}
+	id1, err := fm.WriteWithOptions([]byte("payload"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := fm.WriteWithOptions([]byte("payload"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 != id2 {
+		t.Fatalf("retry should return %s, got %s", id1, id2)
+	}
+	id3, err := fm.WriteWithOptions([]byte("payload"), &WriteOptions{IdempotencyKey: "request-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id3 == id1 {
+		t.Fatal("different idempotency keys should write different chunks")
+	}
+	fm.Close()
+
+	// 幂等key保存在索引数据库中，重启之后仍然有效
+	fm, err = NewFileManager(fileStore, indexStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	id4, err := fm.WriteWithOptions([]byte("payload"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id4 != id1 {
+		t.Fatalf("retry after restart should return %s, got %s", id1, id4)
+	}
+	bucket, err := fm.GetBucket(DefaultBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.ObjectCount != 2 {
+		t.Fatalf("bucket should hold 2 chunks, got %d", bucket.ObjectCount)
+	}
+}
+
+func TestFileManager_IdempotencyWindow(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{IdempotencyWindow: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	opts := &WriteOptions{IdempotencyKey: "request-1"}
+	id1, err := fm.WriteWithOptions([]byte("payload"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	id2, err := fm.WriteWithOptions([]byte("payload"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 {
+		t.Fatal("expired idempotency key should write a new chunk")
+	}
+	if err = fm.purgeExpiredIdempotencyRecords(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFileManager_IdempotencyConflict 幂等key按写入者隔离，同一个写入者用于不同的请求时返回冲突
+func TestFileManager_IdempotencyConflict(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManager(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	alice := &WriteOptions{Owner: "alice", IdempotencyKey: "request-1"}
+	id1, err := fm.WriteWithOptions([]byte("payload"), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 其他写入者使用相同的幂等key不会拿到alice写入的chunk
+	id2, err := fm.WriteWithOptions([]byte("payload"), &WriteOptions{Owner: "bob", IdempotencyKey: "request-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 {
+		t.Fatal("idempotency keys of different owners should not collide")
+	}
+
+	if _, err = fm.WriteWithOptions([]byte("other payload"), alice); errors.Cause(err) != utils.ErrIdempotencyConflict {
+		t.Fatalf("reusing the key with different data should conflict, got %v", err)
+	}
+	withKey := &WriteOptions{Owner: "alice", IdempotencyKey: "request-1", Key: "doc"}
+	if _, err = fm.WriteWithOptions([]byte("payload"), withKey); errors.Cause(err) != utils.ErrIdempotencyConflict {
+		t.Fatalf("reusing the key with a different id should conflict, got %v", err)
+	}
+	id3, err := fm.WriteWithOptions([]byte("payload"), alice)
+	if err != nil || id3 != id1 {
+		t.Fatalf("retry should return %s, got %s, %v", id1, id3, err)
+	}
+}
@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// IndexBatch 一组需要原子写入索引数据库的修改，序列化失败的错误会在写入时返回
+type IndexBatch struct {
+	batch leveldb.Batch
+	err   error
+}
+
+func (b *IndexBatch) put(key []byte, v interface{}, name string) {
+	if b.err != nil {
+		return
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		b.err = errors.Wrapf(err, "marshal %s failed", name)
+		return
+	}
+	b.batch.Put(key, value)
+}
+
+// PutIndex 保存block索引，设置了过期时间时同时保存过期时间索引
+func (b *IndexBatch) PutIndex(index *BlockIndex) {
+	b.put(indexKey(index.Bucket, index.BlockId), index, "block index")
+	b.putExpiry(index)
+}
+
+// DeleteIndex 删除bucket中的block索引
+func (b *IndexBatch) DeleteIndex(bucket, id string) {
+	b.batch.Delete(indexKey(bucket, id))
+}
+
+// PutVersion 保存block的一个版本，设置了过期时间时同时保存过期时间索引
+func (b *IndexBatch) PutVersion(index *BlockIndex) {
+	b.put(versionKey(index.Bucket, index.BlockId, index.VersionId), index, "version")
+	b.putExpiry(index)
+}
+
+// putExpiry 索引被覆盖或删除时不会删除过期时间索引，由清理过期chunk时校验
+func (b *IndexBatch) putExpiry(index *BlockIndex) {
+	if index.ExpiresAt > 0 {
+		record := &ExpiryRecord{
+			Bucket:    index.Bucket,
+			BlockId:   index.BlockId,
+			VersionId: index.VersionId,
+			ExpiresAt: index.ExpiresAt,
+		}
+		b.put(expiryKey(record), record, "expiry record")
+	}
+}
+
+// DeleteExpiry 删除一条过期时间索引
+func (b *IndexBatch) DeleteExpiry(record *ExpiryRecord) {
+	b.batch.Delete(expiryKey(record))
+}
+
+// DeleteVersion 删除block的一个版本
+func (b *IndexBatch) DeleteVersion(bucket, id, versionId string) {
+	b.batch.Delete(versionKey(bucket, id, versionId))
+}
+
+// MarkLegacyMigrated 记录旧版本的索引已经迁移到默认bucket
+func (b *IndexBatch) MarkLegacyMigrated() {
+	b.batch.Put([]byte(legacyMigratedKey), []byte("1"))
+}
+
+// PutBucket 保存bucket元数据
+func (b *IndexBatch) PutBucket(bucket *Bucket) {
+	b.put(bucketKey(bucket.Name), bucket, "bucket")
+}
+
+// PutOwnerUsage 保存写入者的用量
+func (b *IndexBatch) PutOwnerUsage(usage *OwnerUsage) {
+	b.put(ownerKey(usage.Owner), usage, "owner usage")
+}
+
+// DeleteOwnerUsage 删除写入者的用量
+func (b *IndexBatch) DeleteOwnerUsage(owner string) {
+	b.batch.Delete(ownerKey(owner))
+}
+
+// PutIdempotencyRecord 保存幂等key的记录
+func (b *IndexBatch) PutIdempotencyRecord(key string, record *IdempotencyRecord) {
+	b.put(idempotencyKey(record.Bucket, record.Owner, key), record, "idempotency record")
+}
+
+// PutReplicaPosition 保存从节点已经应用的位置，与对应的索引修改一起原子写入
+func (b *IndexBatch) PutReplicaPosition(pos LogPosition) {
+	b.put([]byte(replicaPositionKey), pos, "replica position")
+}
+
+// DeleteReplicaPosition 删除从节点的复制位置，节点提升为主节点后不再是从节点
+func (b *IndexBatch) DeleteReplicaPosition() {
+	b.batch.Delete([]byte(replicaPositionKey))
+}
+
+// Len 返回batch中修改的数量
+func (b *IndexBatch) Len() int {
+	return b.batch.Len()
+}
@@ -2,32 +2,171 @@ package fs
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"my-fs/utils"
+	"strings"
 )
 
 type IndexStore interface {
 	Open(string) error
 	SaveIndex(*BlockIndex, bool) error
 	FetchIndex(string) (*BlockIndex, error)
+	FetchBucketIndex(string, string) (*BlockIndex, error)
+	DeleteIndex(string, string, bool) error
+	ListIndex(string, *ListOptions) ([]*BlockIndex, error)
+	FetchVersion(string, string, string) (*BlockIndex, error)
+	ListVersions(string, string) ([]*BlockIndex, error)
+	WriteBatch(*IndexBatch, bool) error
+	SaveBucket(*Bucket, bool) error
+	FetchBucket(string) (*Bucket, error)
+	DeleteBucket(string, bool) error
+	ListBuckets() ([]*Bucket, error)
+	ListExpired(int64, int) ([]*ExpiryRecord, error)
+	FetchOwnerUsage(string) (*OwnerUsage, error)
+	ListOwnerUsage() ([]*OwnerUsage, error)
+	FetchIdempotencyRecord(string, string, string) (*IdempotencyRecord, error)
+	DeleteExpiredIdempotencyRecords(int64) (int, error)
+	SaveDataKey(*DataKey, bool) error
+	ListDataKeys() ([]*DataKey, error)
+	FetchReplicaPosition() (*LogPosition, error)
+	ClearIndexes(bool) error
 	SaveCheckpoint(*checkpoint, bool) error
 	FetchCheckpoint() (*checkpoint, error)
 	Close() error
 }
 
 const (
-	checkpointKey = "checkpoint"
+	checkpointKey   = "checkpoint"
+	bucketKeyPrefix = "bucket/"
+	indexKeyPrefix  = "index/"
+	// 幂等key的记录，格式为idempotency/<bucket>/<owner>\x00<key>
+	idempotencyKeyPrefix = "idempotency/"
+	// 版本记录，格式为version/<bucket>/<id>\x00<versionId>
+	versionKeyPrefix = "version/"
+	// 主密钥加密后的数据密钥，格式为datakey/<version>
+	dataKeyPrefix = "datakey/"
+	// 从节点已经应用的主节点位置
+	replicaPositionKey = "replication/position"
+	// 设置了过期时间的chunk，格式为expiry/<过期时间>/<bucket>/<id>\x00<versionId>，按过期时间排序
+	expiryKeyPrefix = "expiry/"
+	// 写入者的用量，格式为owner/<owner>
+	ownerKeyPrefix = "owner/"
+	// 旧版本没有bucket的索引已经迁移到默认bucket的标记
+	legacyMigratedKey = "migration/legacy-index"
 )
 
 type BlockIndex struct {
+	// 集群模式下保存该block的节点id
+	Node string `json:",omitempty"`
 	// 文件的序号
 	FSeq int
 	// block的唯一Id
 	BlockId string
 	// 偏移量
 	Offset uint64
+	// 所属的bucket，为空表示旧版本没有bucket的索引
+	Bucket string `json:",omitempty"`
+	// payload的大小
+	Size int64 `json:",omitempty"`
+	// payload的md5，十六进制编码
+	ETag string `json:",omitempty"`
+	// 写入时间，unix纳秒
+	ModTime int64 `json:",omitempty"`
+	// 开启版本控制时的版本号
+	VersionId string `json:",omitempty"`
+	// 为true时表示该版本是删除标记，Offset指向删除标记的记录
+	DeleteMarker bool `json:",omitempty"`
+	// 过期时间，unix纳秒，为0表示不过期
+	ExpiresAt int64 `json:",omitempty"`
+	// 写入者，即API token的id，为空表示没有认证的写入
+	Owner string `json:",omitempty"`
+}
+
+// expired 判断chunk在now时是否已经过期
+func (index *BlockIndex) expired(now int64) bool {
+	return index.ExpiresAt > 0 && index.ExpiresAt <= now
+}
+
+// ListOptions 列出bucket中索引时的过滤条件
+type ListOptions struct {
+	// 只返回以Prefix开头的id
+	Prefix string
+	// 只返回字典序大于StartAfter的id
+	StartAfter string
+	// 最多返回的数量，0表示不限制
+	Limit int
+}
+
+// IdempotencyRecord 幂等key与第一次写入的chunk的对应关系
+type IdempotencyRecord struct {
+	Bucket  string
+	Owner   string `json:",omitempty"`
+	BlockId string
+	// 第一次写入的请求的摘要，包括chunk的id与数据
+	RequestHash string `json:",omitempty"`
+	// 过期时间，unix纳秒
+	ExpiresAt int64
+}
+
+// ExpiryRecord 过期时间索引中的一条记录，指向设置了过期时间的chunk或版本
+type ExpiryRecord struct {
+	Bucket    string
+	BlockId   string
+	VersionId string `json:",omitempty"`
+	ExpiresAt int64
+}
+
+// bucketKey 生成bucket元数据在索引数据库中的key
+func bucketKey(name string) []byte {
+	return []byte(bucketKeyPrefix + name)
+}
+
+// indexKey 生成block索引在索引数据库中的key，bucket为空时使用旧版本的key
+func indexKey(bucket, id string) []byte {
+	if bucket == "" {
+		return []byte(id)
+	}
+	return []byte(indexKeyPrefix + bucket + "/" + id)
+}
+
+// versionPrefix 同一个id所有版本的key前缀，使用\x00分隔，避免与其他id的版本混在一起
+func versionPrefix(bucket, id string) []byte {
+	return []byte(versionKeyPrefix + bucket + "/" + id + "\x00")
+}
+
+func versionKey(bucket, id, versionId string) []byte {
+	return append(versionPrefix(bucket, id), versionId...)
+}
+
+// idempotencyKey 幂等key按写入者隔离，不同的token使用相同的幂等key互不影响
+func idempotencyKey(bucket, owner, key string) []byte {
+	return []byte(idempotencyKeyPrefix + bucket + "/" + owner + "\x00" + key)
+}
+
+// expiryKey 过期时间补零保证按时间排序
+func expiryKey(record *ExpiryRecord) []byte {
+	return []byte(fmt.Sprintf("%s%020d/%s/%s\x00%s", expiryKeyPrefix, record.ExpiresAt, record.Bucket, record.BlockId, record.VersionId))
+}
+
+func ownerKey(owner string) []byte {
+	return []byte(ownerKeyPrefix + owner)
+}
+
+// dataKeyKey 数据密钥的key，版本号补零保证按版本排序
+func dataKeyKey(version uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", dataKeyPrefix, version))
+}
+
+func writeOptions(sync bool) *opt.WriteOptions {
+	opts := &opt.WriteOptions{}
+	if sync {
+		opts.Sync = true
+	}
+	return opts
 }
 
 var _ IndexStore = &indexStore{}
@@ -36,6 +175,19 @@ type indexStore struct {
 	db *leveldb.DB
 }
 
+// Size 索引数据库中所有sstable的大小
+func (i *indexStore) Size() (int64, error) {
+	var stats leveldb.DBStats
+	if err := i.db.Stats(&stats); err != nil {
+		return 0, errors.Wrap(err, "read index store stats failed")
+	}
+	var size int64
+	for _, levelSize := range stats.LevelSizes {
+		size += levelSize
+	}
+	return size, nil
+}
+
 func (i *indexStore) Open(dbPath string) error {
 	db, err := leveldb.OpenFile(dbPath, nil)
 	if err != nil {
@@ -46,22 +198,20 @@ func (i *indexStore) Open(dbPath string) error {
 }
 
 func (i *indexStore) SaveIndex(index *BlockIndex, sync bool) error {
-	indexBytes, err := json.Marshal(index)
-	if err != nil {
-		return errors.Wrap(err, "save block index failed")
-	}
-	opts := &opt.WriteOptions{}
-	if sync {
-		opts.Sync = true
-	}
-	return i.db.Put([]byte(index.BlockId), indexBytes, opts)
+	batch := new(IndexBatch)
+	batch.PutIndex(index)
+	return i.WriteBatch(batch, sync)
 }
 
 func (i *indexStore) FetchIndex(id string) (*BlockIndex, error) {
+	return i.FetchBucketIndex("", id)
+}
+
+func (i *indexStore) FetchBucketIndex(bucket, id string) (*BlockIndex, error) {
 	if i.db == nil {
 		return nil, errors.New("index store is empty")
 	}
-	indexBytes, err := i.db.Get([]byte(id), nil)
+	indexBytes, err := i.db.Get(indexKey(bucket, id), nil)
 	if err == leveldb.ErrNotFound {
 		return nil, utils.ErrIndexNotFound
 	}
@@ -76,20 +226,401 @@ func (i *indexStore) FetchIndex(id string) (*BlockIndex, error) {
 	return index, nil
 }
 
+func (i *indexStore) DeleteIndex(bucket, id string, sync bool) error {
+	return i.db.Delete(indexKey(bucket, id), writeOptions(sync))
+}
+
+func (i *indexStore) ListIndex(bucket string, opts *ListOptions) ([]*BlockIndex, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	keyPrefix := indexKey(bucket, "")
+	iter := i.db.NewIterator(util.BytesPrefix(indexKey(bucket, opts.Prefix)), nil)
+	defer iter.Release()
+
+	var indexes []*BlockIndex
+	if opts.StartAfter != "" {
+		// Seek定位到第一个大于等于StartAfter的key，相等时需要跳过
+		startKey := indexKey(bucket, opts.StartAfter)
+		if iter.Seek(startKey) && string(iter.Key()) == string(startKey) {
+			iter.Next()
+		}
+	} else {
+		iter.First()
+	}
+	for ; iter.Valid(); iter.Next() {
+		if opts.Limit > 0 && len(indexes) >= opts.Limit {
+			break
+		}
+		index := &BlockIndex{}
+		if err := json.Unmarshal(iter.Value(), index); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal blockIndex [%s] failed", iter.Key()[len(keyPrefix):])
+		}
+		indexes = append(indexes, index)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return indexes, nil
+}
+
+func (i *indexStore) FetchVersion(bucket, id, versionId string) (*BlockIndex, error) {
+	indexBytes, err := i.db.Get(versionKey(bucket, id, versionId), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, utils.ErrIndexNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get version from store failed")
+	}
+
+	index := &BlockIndex{}
+	if err = json.Unmarshal(indexBytes, index); err != nil {
+		return nil, errors.Wrap(err, "unmarshal blockIndex failed")
+	}
+	return index, nil
+}
+
+// ListVersions 列出id的所有版本，版本号从旧到新排序
+func (i *indexStore) ListVersions(bucket, id string) ([]*BlockIndex, error) {
+	iter := i.db.NewIterator(util.BytesPrefix(versionPrefix(bucket, id)), nil)
+	defer iter.Release()
+
+	var versions []*BlockIndex
+	for iter.Next() {
+		index := &BlockIndex{}
+		if err := json.Unmarshal(iter.Value(), index); err != nil {
+			return nil, errors.Wrap(err, "unmarshal blockIndex failed")
+		}
+		versions = append(versions, index)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return versions, nil
+}
+
+// listLegacyIndexes 列出旧版本没有bucket时写入的索引，已经迁移过时返回true
+// 旧版本的key就是chunk的id，可能与其他记录的前缀相同，所以通过值中的BlockId与key相同来识别
+func (i *indexStore) listLegacyIndexes() (bool, []*BlockIndex, error) {
+	if _, err := i.db.Get([]byte(legacyMigratedKey), nil); err == nil {
+		return true, nil, nil
+	} else if err != leveldb.ErrNotFound {
+		return false, nil, errors.Wrap(err, "get legacy index migration marker failed")
+	}
+	iter := i.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var indexes []*BlockIndex
+	for iter.Next() {
+		index := &BlockIndex{}
+		if err := json.Unmarshal(iter.Value(), index); err != nil {
+			continue
+		}
+		if index.Bucket == "" && index.BlockId == string(iter.Key()) {
+			indexes = append(indexes, index)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return false, nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return false, indexes, nil
+}
+
+// scanIndexes 遍历所有的最新索引以及版本
+func (i *indexStore) scanIndexes(fn func(index *BlockIndex, version bool) error) error {
+	for _, prefix := range []string{indexKeyPrefix, versionKeyPrefix} {
+		if err := i.scanPrefix(prefix, func(index *BlockIndex) error {
+			return fn(index, prefix == versionKeyPrefix)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *indexStore) scanPrefix(prefix string, fn func(index *BlockIndex) error) error {
+	iter := i.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		index := &BlockIndex{}
+		if err := json.Unmarshal(iter.Value(), index); err != nil {
+			return errors.Wrapf(err, "unmarshal blockIndex [%s] failed", iter.Key())
+		}
+		if err := fn(index); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return errors.Wrap(err, "iterate index store failed")
+	}
+	return nil
+}
+
+// WriteBatch 原子地写入batch中的所有修改
+func (i *indexStore) WriteBatch(batch *IndexBatch, sync bool) error {
+	if batch.err != nil {
+		return batch.err
+	}
+	return i.db.Write(&batch.batch, writeOptions(sync))
+}
+
+func (i *indexStore) SaveBucket(bucket *Bucket, sync bool) error {
+	bucketBytes, err := json.Marshal(bucket)
+	if err != nil {
+		return errors.Wrap(err, "save bucket failed")
+	}
+	return i.db.Put(bucketKey(bucket.Name), bucketBytes, writeOptions(sync))
+}
+
+func (i *indexStore) FetchBucket(name string) (*Bucket, error) {
+	bucketBytes, err := i.db.Get(bucketKey(name), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, utils.ErrBucketNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get bucket from store failed")
+	}
+
+	bucket := &Bucket{}
+	if err = json.Unmarshal(bucketBytes, bucket); err != nil {
+		return nil, errors.Wrap(err, "unmarshal bucket failed")
+	}
+	return bucket, nil
+}
+
+// DeleteBucket 删除bucket的元数据以及其中所有的block索引、版本和幂等key
+func (i *indexStore) DeleteBucket(name string, sync bool) error {
+	batch, err := i.deleteBucketBatch(name)
+	if err != nil {
+		return err
+	}
+	return i.db.Write(batch, writeOptions(sync))
+}
+
+func (i *indexStore) deleteBucketBatch(name string) (*leveldb.Batch, error) {
+	batch := new(leveldb.Batch)
+	for _, prefix := range []string{indexKeyPrefix, versionKeyPrefix, idempotencyKeyPrefix} {
+		iter := i.db.NewIterator(util.BytesPrefix([]byte(prefix+name+"/")), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, errors.Wrap(err, "iterate index store failed")
+		}
+	}
+	batch.Delete(bucketKey(name))
+	return batch, nil
+}
+
+func (i *indexStore) ListBuckets() ([]*Bucket, error) {
+	iter := i.db.NewIterator(util.BytesPrefix([]byte(bucketKeyPrefix)), nil)
+	defer iter.Release()
+
+	var buckets []*Bucket
+	for iter.Next() {
+		bucket := &Bucket{}
+		if err := json.Unmarshal(iter.Value(), bucket); err != nil {
+			return nil, errors.Wrap(err, "unmarshal bucket failed")
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return buckets, nil
+}
+
+func (i *indexStore) FetchIdempotencyRecord(bucket, owner, key string) (*IdempotencyRecord, error) {
+	recordBytes, err := i.db.Get(idempotencyKey(bucket, owner, key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get idempotency record from store failed")
+	}
+
+	record := &IdempotencyRecord{}
+	if err = json.Unmarshal(recordBytes, record); err != nil {
+		return nil, errors.Wrap(err, "unmarshal idempotency record failed")
+	}
+	return record, nil
+}
+
+// DeleteExpiredIdempotencyRecords 删除在now之前过期的幂等key，返回删除的数量
+func (i *indexStore) DeleteExpiredIdempotencyRecords(now int64) (int, error) {
+	batch, err := i.expiredIdempotencyBatch(now)
+	if err != nil || batch.Len() == 0 {
+		return 0, err
+	}
+	return batch.Len(), i.db.Write(batch, nil)
+}
+
+func (i *indexStore) expiredIdempotencyBatch(now int64) (*leveldb.Batch, error) {
+	batch := new(leveldb.Batch)
+	iter := i.db.NewIterator(util.BytesPrefix([]byte(idempotencyKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		record := &IdempotencyRecord{}
+		if err := json.Unmarshal(iter.Value(), record); err != nil || record.ExpiresAt <= now {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return batch, nil
+}
+
+// ListExpired 按过期时间顺序列出最多limit条在now之前过期的记录，记录指向的索引可能已经被覆盖或删除
+func (i *indexStore) ListExpired(now int64, limit int) ([]*ExpiryRecord, error) {
+	iter := i.db.NewIterator(util.BytesPrefix([]byte(expiryKeyPrefix)), nil)
+	defer iter.Release()
+
+	var records []*ExpiryRecord
+	for iter.Next() && len(records) < limit {
+		record := &ExpiryRecord{}
+		if err := json.Unmarshal(iter.Value(), record); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal expiry record [%s] failed", iter.Key())
+		}
+		if record.ExpiresAt > now {
+			break
+		}
+		records = append(records, record)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return records, nil
+}
+
+// FetchOwnerUsage 获取写入者的用量，没有记录时返回用量为0的记录
+func (i *indexStore) FetchOwnerUsage(owner string) (*OwnerUsage, error) {
+	usageBytes, err := i.db.Get(ownerKey(owner), nil)
+	if err == leveldb.ErrNotFound {
+		return &OwnerUsage{Owner: owner}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get owner usage from store failed")
+	}
+
+	usage := &OwnerUsage{}
+	if err = json.Unmarshal(usageBytes, usage); err != nil {
+		return nil, errors.Wrap(err, "unmarshal owner usage failed")
+	}
+	return usage, nil
+}
+
+func (i *indexStore) ListOwnerUsage() ([]*OwnerUsage, error) {
+	iter := i.db.NewIterator(util.BytesPrefix([]byte(ownerKeyPrefix)), nil)
+	defer iter.Release()
+
+	var usages []*OwnerUsage
+	for iter.Next() {
+		usage := &OwnerUsage{}
+		if err := json.Unmarshal(iter.Value(), usage); err != nil {
+			return nil, errors.Wrap(err, "unmarshal owner usage failed")
+		}
+		usages = append(usages, usage)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return usages, nil
+}
+
+func (i *indexStore) SaveDataKey(dataKey *DataKey, sync bool) error {
+	dataKeyBytes, err := json.Marshal(dataKey)
+	if err != nil {
+		return errors.Wrap(err, "marshal data key failed")
+	}
+	return i.db.Put(dataKeyKey(dataKey.Version), dataKeyBytes, writeOptions(sync))
+}
+
+// ListDataKeys 列出所有的数据密钥，按版本从小到大排序
+func (i *indexStore) ListDataKeys() ([]*DataKey, error) {
+	iter := i.db.NewIterator(util.BytesPrefix([]byte(dataKeyPrefix)), nil)
+	defer iter.Release()
+
+	var dataKeys []*DataKey
+	for iter.Next() {
+		dataKey := &DataKey{}
+		if err := json.Unmarshal(iter.Value(), dataKey); err != nil {
+			return nil, errors.Wrap(err, "unmarshal data key failed")
+		}
+		dataKeys = append(dataKeys, dataKey)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return dataKeys, nil
+}
+
+// FetchReplicaPosition 获取从节点已经应用的位置，不存在时返回nil
+func (i *indexStore) FetchReplicaPosition() (*LogPosition, error) {
+	value, err := i.db.Get([]byte(replicaPositionKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch replica position from index store failed")
+	}
+	pos := &LogPosition{}
+	if err = json.Unmarshal(value, pos); err != nil {
+		return nil, errors.Wrap(err, "unmarshal replica position failed")
+	}
+	return pos, nil
+}
+
+// ClearIndexes 删除所有的block索引、版本和幂等key，bucket元数据、数据密钥以及checkpoint保留
+func (i *indexStore) ClearIndexes(sync bool) error {
+	batch, err := i.clearIndexesBatch()
+	if err != nil {
+		return err
+	}
+	return i.db.Write(batch, writeOptions(sync))
+}
+
+func (i *indexStore) clearIndexesBatch() (*leveldb.Batch, error) {
+	kept := []string{checkpointKey, bucketKeyPrefix, dataKeyPrefix, replicaPositionKey, legacyMigratedKey}
+	iter := i.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		key := string(iter.Key())
+		keep := false
+		for _, prefix := range kept {
+			if strings.HasPrefix(key, prefix) {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			batch.Delete([]byte(key))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate index store failed")
+	}
+	return batch, nil
+}
+
 func (i *indexStore) SaveCheckpoint(c *checkpoint, sync bool) error {
 	cpBytes, err := c.marshal()
 	if err != nil {
 		return err
 	}
-	opts := &opt.WriteOptions{}
-	if sync {
-		opts.Sync = true
-	}
-	return i.db.Put([]byte(checkpointKey), cpBytes, opts)
+	return i.db.Put([]byte(checkpointKey), cpBytes, writeOptions(sync))
 }
 
 func (i *indexStore) FetchCheckpoint() (*checkpoint, error) {
-	cpBytes, err := i.db.Get([]byte(checkpointKey), nil)
+	return i.fetchCheckpoint([]byte(checkpointKey))
+}
+
+func (i *indexStore) fetchCheckpoint(key []byte) (*checkpoint, error) {
+	cpBytes, err := i.db.Get(key, nil)
 	if err == leveldb.ErrNotFound {
 		return nil, nil
 	}
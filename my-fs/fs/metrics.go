@@ -0,0 +1,170 @@
+package fs
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// 定期上报数据文件与索引大小的间隔
+const storageMetricsInterval = 30 * time.Second
+
+// Operation 上报指标时的操作类型
+type Operation string
+
+const (
+	OpWrite  Operation = "write"
+	OpRead   Operation = "read"
+	OpDelete Operation = "delete"
+)
+
+// Metrics FileManager上报运行指标的接口，通过Options.Metrics接入，为nil时不上报
+// 实现需要是并发安全的
+type Metrics interface {
+	// ObserveOperation 一次读取、写入或删除的耗时，err不为nil表示操作失败
+	ObserveOperation(op Operation, d time.Duration, err error)
+	// AddBytesWritten 写入的数据大小，不包括压缩与加密的影响
+	AddBytesWritten(n int)
+	// AddBytesRead 读取的数据大小
+	AddBytesRead(n int)
+	// ObserveFsync 一次fsync的耗时，纠删码模式下每个分片文件都会上报
+	ObserveFsync(d time.Duration)
+	// SetSegments 当前所有数据文件的大小，key为文件的序号
+	SetSegments(sizes map[int]int64)
+	// SetIndexSize 索引数据库占用的磁盘空间
+	SetIndexSize(bytes int64)
+	// SetCheckpoint 当前写入的文件序号以及偏移量
+	SetCheckpoint(seq int, offset int)
+	// CacheAccess 读取缓存是否命中
+	CacheAccess(hit bool)
+	// ObserveRecovery 启动时恢复checkpoint以及修剪不完整数据的耗时
+	ObserveRecovery(d time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOperation(Operation, time.Duration, error) {}
+func (noopMetrics) AddBytesWritten(int)                              {}
+func (noopMetrics) AddBytesRead(int)                                 {}
+func (noopMetrics) ObserveFsync(time.Duration)                       {}
+func (noopMetrics) SetSegments(map[int]int64)                        {}
+func (noopMetrics) SetIndexSize(int64)                               {}
+func (noopMetrics) SetCheckpoint(int, int)                           {}
+func (noopMetrics) CacheAccess(bool)                                 {}
+func (noopMetrics) ObserveRecovery(time.Duration)                    {}
+
+// sizer 可以统计占用空间的索引数据库
+type sizer interface {
+	Size() (int64, error)
+}
+
+// reportStorageMetrics 上报数据文件、索引以及checkpoint的状态
+func (fm *FileManager) reportStorageMetrics() error {
+	fm.mutx.Lock()
+	cp := *fm.checkpoint
+	fm.mutx.Unlock()
+	fm.opts.Metrics.SetCheckpoint(cp.lastFileSeq, cp.lastFileSize)
+
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return err
+	}
+	sizes := make(map[int]int64, len(seqs))
+	fm.segmentMutx.RLock()
+	for _, seq := range seqs {
+		// 文件可能刚刚被压缩删除
+		if size, err := fm.segmentSize(seq); err == nil {
+			sizes[seq] = size
+		}
+	}
+	fm.segmentMutx.RUnlock()
+	fm.opts.Metrics.SetSegments(sizes)
+
+	if s, ok := fm.indexStore.(sizer); ok {
+		size, err := s.Size()
+		if err != nil {
+			return err
+		}
+		fm.opts.Metrics.SetIndexSize(size)
+	}
+	return nil
+}
+
+func (fm *FileManager) reportStorageMetricsLoop(ctx context.Context) {
+	ticker := time.NewTicker(storageMetricsInterval)
+	defer ticker.Stop()
+	for {
+		if err := fm.reportStorageMetrics(); err != nil {
+			log.Printf("report storage metrics failed: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recordKey 缓存中记录的位置
+type recordKey struct {
+	node   string
+	seq    int
+	offset uint64
+}
+
+type cacheEntry struct {
+	key  recordKey
+	data []byte
+}
+
+// recordCache 按位置缓存解码后的chunk数据，记录写入后不会被修改，位置只有在修剪文件时才会被重用
+type recordCache struct {
+	mutx     sync.Mutex
+	capacity int
+	entries  map[recordKey]*list.Element
+	lru      *list.List
+}
+
+func newRecordCache(capacity int) *recordCache {
+	return &recordCache{
+		capacity: capacity,
+		entries:  make(map[recordKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *recordCache) get(key recordKey) ([]byte, bool) {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+func (c *recordCache) add(key recordKey, data []byte) {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).data = data
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *recordCache) purge() {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	c.entries = make(map[recordKey]*list.Element)
+	c.lru.Init()
+}
@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mutx         sync.Mutex
+	operations   map[Operation]int
+	failures     map[Operation]int
+	bytesWritten int
+	bytesRead    int
+	fsyncs       int
+	segments     map[int]int64
+	indexSize    int64
+	seq, offset  int
+	hits, misses int
+	recoveries   int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{operations: map[Operation]int{}, failures: map[Operation]int{}}
+}
+
+func (m *recordingMetrics) ObserveOperation(op Operation, d time.Duration, err error) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.operations[op]++
+	if err != nil {
+		m.failures[op]++
+	}
+}
+
+func (m *recordingMetrics) AddBytesWritten(n int) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.bytesWritten += n
+}
+
+func (m *recordingMetrics) AddBytesRead(n int) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.bytesRead += n
+}
+
+func (m *recordingMetrics) ObserveFsync(time.Duration) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.fsyncs++
+}
+
+func (m *recordingMetrics) SetSegments(sizes map[int]int64) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.segments = sizes
+}
+
+func (m *recordingMetrics) SetIndexSize(bytes int64) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.indexSize = bytes
+}
+
+func (m *recordingMetrics) SetCheckpoint(seq int, offset int) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.seq, m.offset = seq, offset
+}
+
+func (m *recordingMetrics) CacheAccess(hit bool) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *recordingMetrics) ObserveRecovery(time.Duration) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.recoveries++
+}
+
+func TestFileManager_Metrics(t *testing.T) {
+	dir := t.TempDir()
+	metrics := newRecordingMetrics()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{Metrics: metrics, CacheSize: 1, MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if metrics.recoveries != 1 {
+		t.Fatalf("expect recovery to be reported once, got %d", metrics.recoveries)
+	}
+
+	first, err := fm.Write(bytes.Repeat([]byte("a"), 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := fm.Write(bytes.Repeat([]byte("b"), 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.Read("missing"); err == nil {
+		t.Fatal("expect reading missing chunk to fail")
+	}
+
+	// 缓存只能保存一个chunk，交替读取时都不会命中
+	for _, id := range []string{first, first, second, first} {
+		data, err := fm.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 修改返回的数据不影响缓存
+		data[0] = 'x'
+	}
+	data, err := fm.Read(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 'a' {
+		t.Fatal("cached data was modified by the caller")
+	}
+	if err = fm.Delete(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.operations[OpWrite] != 2 || metrics.operations[OpRead] != 6 || metrics.operations[OpDelete] != 1 {
+		t.Fatalf("unexpected operation counts %v", metrics.operations)
+	}
+	if metrics.failures[OpRead] != 1 || metrics.failures[OpWrite] != 0 {
+		t.Fatalf("unexpected failure counts %v", metrics.failures)
+	}
+	if metrics.bytesWritten != 300 || metrics.bytesRead != 4*200+100 {
+		t.Fatalf("unexpected bytes written %d, read %d", metrics.bytesWritten, metrics.bytesRead)
+	}
+	if metrics.hits != 2 || metrics.misses != 3 {
+		t.Fatalf("expect 2 cache hits and 3 misses, got %d and %d", metrics.hits, metrics.misses)
+	}
+	// 两次写入以及一条删除记录
+	if metrics.fsyncs != 3 {
+		t.Fatalf("expect 3 fsyncs, got %d", metrics.fsyncs)
+	}
+
+	if err = fm.reportStorageMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	// 第二次写入超过了文件的最大大小
+	if len(metrics.segments) != 2 {
+		t.Fatalf("unexpected segments %v", metrics.segments)
+	}
+	if size, ok := metrics.segments[metrics.seq]; !ok || int64(metrics.offset) != size {
+		t.Fatalf("checkpoint %d/%d does not match segments %v", metrics.seq, metrics.offset, metrics.segments)
+	}
+}
@@ -0,0 +1,79 @@
+package fs
+
+import "time"
+
+const (
+	defaultIdempotencyWindow = 24 * time.Hour
+	// 清理过期幂等key的最大间隔
+	maxIdempotencyPurgeInterval = time.Hour
+	defaultSyncInterval         = time.Second
+	defaultExpirySweepInterval  = time.Minute
+)
+
+// SyncPolicy 数据文件的同步策略
+type SyncPolicy int
+
+const (
+	// SyncAlways 每次写入后同步，默认的策略
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic 每隔SyncInterval同步一次，宕机时可能丢失最近写入的记录
+	SyncPeriodic
+	// SyncNone 只在切换文件和关闭时同步，其余由操作系统决定何时写回
+	SyncNone
+)
+
+// Options FileManager的可选配置，零值表示使用默认值
+type Options struct {
+	// 单个数据文件的最大大小，超过后写入下一个文件
+	MaxFileSize int
+	// 新写入的chunk使用的压缩算法，压缩后没有变小的chunk仍然保存原始数据
+	Compression Compression
+	// 主密钥，不为空时使用AES-GCM加密所有新写入的记录，可以通过LoadMasterKey读取
+	// 只加密数据文件，索引数据库中的id、bucket、大小等元数据不加密，ETag使用由数据密钥派生的HMAC
+	MasterKey []byte
+	// 幂等key的保留时间，超过该时间后相同的幂等key会重新写入
+	IdempotencyWindow time.Duration
+	// 纠删码配置，开启后数据文件保存在ErasureCoding.ShardDirs中，不再使用fileStorePath
+	Erasure ErasureCoding
+	// 集群模式下本节点的id，写入的索引会记录该id
+	NodeId string
+	// 集群模式下读取保存在其他节点上的记录
+	RecordFetcher RecordFetcher
+	// 运行指标的上报接口，为nil时不上报
+	Metrics Metrics
+	// 读取缓存保存的chunk数量，0表示不缓存
+	CacheSize int
+	// 数据文件的同步策略，索引数据库总是同步写入
+	SyncPolicy SyncPolicy
+	// SyncPolicy为SyncPeriodic时的同步间隔
+	SyncInterval time.Duration
+	// 清理过期chunk的间隔，过期的chunk在清理之前读取时也不存在
+	ExpirySweepInterval time.Duration
+	// 数据目录所在磁盘至少保留的空闲字节数，写入后低于该值时拒绝写入，0表示不检查
+	MinFreeBytes int64
+	// 冷热分层，已封存的数据文件满足条件时被移到Tiering.Store，不支持纠删码
+	Tiering TieringOptions
+}
+
+func (o *Options) withDefaults() *Options {
+	opts := Options{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = maxFileSize
+	}
+	if opts.IdempotencyWindow <= 0 {
+		opts.IdempotencyWindow = defaultIdempotencyWindow
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	if opts.ExpirySweepInterval <= 0 {
+		opts.ExpirySweepInterval = defaultExpirySweepInterval
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = noopMetrics{}
+	}
+	return &opts
+}
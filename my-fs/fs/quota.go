@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"math"
+	"my-fs/utils"
+	"time"
+)
+
+// OwnerUsage 一个写入者(API token)保存的数据量，统计方式与bucket的用量相同
+type OwnerUsage struct {
+	Owner       string
+	UsedBytes   int64
+	ObjectCount int64
+}
+
+// checkUsage 检测用量为usedBytes、objectCount时，再写入size字节的新chunk是否会超过quota
+func checkUsage(scope, name string, quota BucketQuota, usedBytes, objectCount, size int64) error {
+	if quota.MaxBytes > 0 && usedBytes+size > quota.MaxBytes {
+		return &utils.QuotaError{Scope: scope, Name: name, Resource: utils.QuotaResourceBytes,
+			Used: usedBytes + size, Limit: quota.MaxBytes}
+	}
+	if quota.MaxObjects > 0 && objectCount+1 > quota.MaxObjects {
+		return &utils.QuotaError{Scope: scope, Name: name, Resource: utils.QuotaResourceObjects,
+			Used: objectCount + 1, Limit: quota.MaxObjects}
+	}
+	return nil
+}
+
+// ownerUsages 一次修改中涉及的写入者用量，同一个写入者只从索引数据库读取一次
+type ownerUsages struct {
+	store  IndexStore
+	usages map[string]*OwnerUsage
+}
+
+func (fm *FileManager) newOwnerUsages() *ownerUsages {
+	return &ownerUsages{store: fm.indexStore, usages: make(map[string]*OwnerUsage)}
+}
+
+func (u *ownerUsages) get(owner string) (*OwnerUsage, error) {
+	if usage, ok := u.usages[owner]; ok {
+		return usage, nil
+	}
+	usage, err := u.store.FetchOwnerUsage(owner)
+	if err != nil {
+		return nil, err
+	}
+	u.usages[owner] = usage
+	return usage, nil
+}
+
+// add 修改owner的用量，owner为空表示没有认证的写入，不统计
+func (u *ownerUsages) add(owner string, bytes, objects int64) error {
+	if owner == "" {
+		return nil
+	}
+	usage, err := u.get(owner)
+	if err != nil {
+		return err
+	}
+	usage.UsedBytes += bytes
+	usage.ObjectCount += objects
+	return nil
+}
+
+// checkQuota 检测owner写入size字节的新chunk后是否会超过quota
+func (u *ownerUsages) checkQuota(owner string, quota BucketQuota, size int64) error {
+	if owner == "" || (quota.MaxBytes <= 0 && quota.MaxObjects <= 0) {
+		return nil
+	}
+	usage, err := u.get(owner)
+	if err != nil {
+		return err
+	}
+	return checkUsage(utils.QuotaScopeToken, owner, quota, usage.UsedBytes, usage.ObjectCount, size)
+}
+
+// save 将修改过的用量加入batch
+func (u *ownerUsages) save(batch *IndexBatch) {
+	for _, usage := range u.usages {
+		batch.PutOwnerUsage(usage)
+	}
+}
+
+// GetOwnerUsage 获取写入者的用量，没有写入过的写入者用量为0
+func (fm *FileManager) GetOwnerUsage(owner string) (*OwnerUsage, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	return fm.indexStore.FetchOwnerUsage(owner)
+}
+
+// ListOwnerUsage 列出所有写入者的用量
+func (fm *FileManager) ListOwnerUsage() ([]*OwnerUsage, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	return fm.indexStore.ListOwnerUsage()
+}
+
+// rateLimiter 令牌桶，每秒补充rate个令牌，最多积累一秒的令牌
+// 令牌可以透支，超过rate的写入不会被一直拒绝，透支之后的写入需要等待令牌补齐
+type rateLimiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64, now time.Time) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: now}
+}
+
+// wait 补充令牌，返回令牌透支时需要等待的时间
+func (l *rateLimiter) wait(now time.Time) (time.Duration, bool) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(float64(l.rate), l.tokens+elapsed.Seconds()*float64(l.rate))
+		l.last = now
+	}
+	if l.tokens >= 0 {
+		return 0, false
+	}
+	return time.Duration(math.Ceil(-l.tokens / float64(l.rate) * float64(time.Second))), true
+}
+
+// rateLimit 一个写入速度限制，rate为每秒字节数，0表示不限制
+type rateLimit struct {
+	scope string
+	name  string
+	rate  int64
+}
+
+// admitRate 检测写入size字节是否超过limits中的任意一个限制，全部通过时才扣除令牌，调用方需要持有writeMutx
+func (fm *FileManager) admitRate(size int64, now time.Time, limits ...rateLimit) error {
+	limiters := make([]*rateLimiter, 0, len(limits))
+	for _, limit := range limits {
+		if limit.rate <= 0 || limit.name == "" {
+			continue
+		}
+		key := limit.scope + "/" + limit.name
+		limiter, ok := fm.limiters[key]
+		// 限制修改之后重新计算
+		if !ok || limiter.rate != limit.rate {
+			limiter = newRateLimiter(limit.rate, now)
+			fm.limiters[key] = limiter
+		}
+		if wait, limited := limiter.wait(now); limited {
+			return &utils.QuotaError{Scope: limit.scope, Name: limit.name, Resource: utils.QuotaResourceRate,
+				Limit: limit.rate, RetryAfter: wait}
+		}
+		limiters = append(limiters, limiter)
+	}
+	for _, limiter := range limiters {
+		limiter.tokens -= float64(size)
+	}
+	return nil
+}
+
+// checkDiskFree 检测写入size字节之后，数据目录所在磁盘的空闲空间是否低于Options.MinFreeBytes
+func (fm *FileManager) checkDiskFree(size int64) error {
+	if fm.opts.MinFreeBytes <= 0 {
+		return nil
+	}
+	dirs := []string{fm.rootDir}
+	if fm.erasure != nil {
+		dirs = fm.opts.Erasure.ShardDirs
+	}
+	for _, dir := range dirs {
+		free, err := diskFree(dir)
+		if err != nil {
+			// 纠删码模式下丢失的目录由修复处理，不影响写入
+			if fm.erasure != nil {
+				continue
+			}
+			return err
+		}
+		if free-size < fm.opts.MinFreeBytes {
+			return &utils.QuotaError{Scope: utils.QuotaScopeDisk, Name: dir, Resource: utils.QuotaResourceBytes,
+				Used: free - size, Limit: fm.opts.MinFreeBytes}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package fs
+
+import (
+	"my-fs/utils"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileManager_OwnerQuota(t *testing.T) {
+	fm := newTestFileManager(t)
+	if err := fm.CreateBucket("shared", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := &WriteOptions{Owner: "alice", OwnerQuota: BucketQuota{MaxBytes: 10, MaxObjects: 3}}
+	if _, err := fm.WriteWithKey("a", []byte("0123"), alice); err != nil {
+		t.Fatal(err)
+	}
+	alice.Bucket = "shared"
+	if _, err := fm.WriteWithKey("b", []byte("4567"), alice); err != nil {
+		t.Fatal(err)
+	}
+	// 配额按写入者统计，与bucket无关
+	_, err := fm.WriteWithKey("c", []byte("89a"), alice)
+	var quotaErr *utils.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != utils.QuotaScopeToken || quotaErr.Resource != utils.QuotaResourceBytes {
+		t.Fatalf("expect a token bytes quota error, got %v", err)
+	}
+	if errors.Cause(err) != utils.ErrQuotaExceeded {
+		t.Fatalf("err should be ErrQuotaExceeded, got %v", err)
+	}
+	// 其他写入者不受影响，覆盖时扣除旧chunk的用量
+	if _, err = fm.WriteWithKey("c", []byte("89a"), &WriteOptions{Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("b", []byte("45"), alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("c", []byte("cc"), &WriteOptions{Owner: "alice", OwnerQuota: alice.OwnerQuota}); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage := func(owner string, bytes, objects int64) {
+		t.Helper()
+		usage, err := fm.GetOwnerUsage(owner)
+		if err != nil || usage.UsedBytes != bytes || usage.ObjectCount != objects {
+			t.Fatalf("expect %s to use %d bytes and %d objects, got %+v, err %v", owner, bytes, objects, usage, err)
+		}
+	}
+	checkUsage("alice", 8, 3)
+	checkUsage("bob", 0, 0)
+
+	// 重建索引时从记录中恢复写入者
+	if _, err = fm.WriteWithKey("d", []byte("rebuilt"), &WriteOptions{Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage("alice", 15, 4)
+	checkUsage("bob", 0, 0)
+
+	// 删除释放配额，强制删除bucket释放其中所有的chunk
+	if err = fm.DeleteWithOptions("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage("alice", 11, 3)
+	if err = fm.DeleteBucket("shared", true); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage("alice", 9, 2)
+	if index, err := fm.Stat("d", nil); err != nil || index.Owner != "alice" {
+		t.Fatalf("expect owner alice, got %+v, err %v", index, err)
+	}
+}
+
+func TestFileManager_RateLimit(t *testing.T) {
+	fm := newTestFileManager(t)
+	if err := fm.CreateBucket("slow", BucketQuota{MaxBytesPerSecond: 100}); err != nil {
+		t.Fatal(err)
+	}
+	opts := &WriteOptions{Bucket: "slow"}
+	// 一秒的突发写入可以透支，之后需要等待
+	for i := 0; i < 2; i++ {
+		if _, err := fm.WriteWithOptions(make([]byte, 80), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := fm.WriteWithOptions([]byte("x"), opts)
+	var quotaErr *utils.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.RetryAfter <= 0 || quotaErr.RetryAfter > time.Second {
+		t.Fatalf("expect a rate limit error with retry after, got %v", err)
+	}
+	if errors.Cause(err) != utils.ErrRateLimited {
+		t.Fatalf("err should be ErrRateLimited, got %v", err)
+	}
+	// 其他bucket不受影响，写入者的限制同时生效
+	owner := &WriteOptions{Owner: "bulk", OwnerQuota: BucketQuota{MaxBytesPerSecond: 10}}
+	if _, err = fm.WriteWithOptions(make([]byte, 20), owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithOptions([]byte("y"), owner); errors.Cause(err) != utils.ErrRateLimited {
+		t.Fatalf("err should be ErrRateLimited for the owner, got %v", err)
+	}
+	// 被拒绝的写入不扣除其他限制的令牌
+	slowOwner := &WriteOptions{Bucket: "slow", Owner: "other", OwnerQuota: BucketQuota{MaxBytesPerSecond: 10}}
+	if _, err = fm.WriteWithOptions([]byte("z"), slowOwner); errors.Cause(err) != utils.ErrRateLimited {
+		t.Fatalf("err should be ErrRateLimited, got %v", err)
+	}
+	time.Sleep(quotaErr.RetryAfter)
+	if _, err = fm.WriteWithOptions([]byte("x"), opts); err != nil {
+		t.Fatalf("write should be admitted after waiting, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(100, now)
+	limiter.tokens -= 150
+	if wait, limited := limiter.wait(now); !limited || wait != 500*time.Millisecond {
+		t.Fatalf("expect to wait 500ms, got %s, %v", wait, limited)
+	}
+	if _, limited := limiter.wait(now.Add(500 * time.Millisecond)); limited {
+		t.Fatal("tokens should be refilled after waiting")
+	}
+	// 空闲时最多积累一秒的令牌
+	limiter.wait(now.Add(time.Hour))
+	if limiter.tokens != 100 {
+		t.Fatalf("expect 100 tokens, got %f", limiter.tokens)
+	}
+}
+
+func TestFileManager_DiskWatermark(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{MinFreeBytes: 1 << 62})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	_, err = fm.Write([]byte("data"))
+	var quotaErr *utils.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != utils.QuotaScopeDisk || errors.Cause(err) != utils.ErrQuotaExceeded {
+		t.Fatalf("expect a disk quota error, got %v", err)
+	}
+	// 删除不受水位限制
+	fm.opts.MinFreeBytes = 0
+	id, err := fm.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.opts.MinFreeBytes = 1 << 62
+	if err = fm.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+}
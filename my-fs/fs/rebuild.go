@@ -0,0 +1,255 @@
+package fs
+
+import (
+	"fmt"
+	"log"
+	pb "my-fs/proto"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RebuildStats 重建索引的统计信息
+type RebuildStats struct {
+	Segments int
+	Records  int
+	// 无法读取或解码而被跳过的记录，格式为<文件名>@<偏移量>
+	SkippedRecords []string
+	// 重建的最新版本索引数量
+	Indexes int
+	// 重建的版本记录数量
+	Versions int
+	// 重建时创建的bucket，原有的bucket元数据已经丢失
+	CreatedBuckets []string
+}
+
+// keyRecords 重建索引时一个id的最新索引与所有版本
+type keyRecords struct {
+	bucket   string
+	latest   *BlockIndex
+	versions map[string]*BlockIndex
+	// 已经重放的记录中最晚的写入时间
+	writtenAt int64
+}
+
+// RebuildIndex 清空所有的索引与版本，按顺序重放数据文件中的记录重新生成，并重新计算bucket的使用情况
+// bucket的配置与数据密钥保留，幂等key无法恢复，写入时间使用记录最初的写入时间
+// 压缩会把仍然被引用的旧版本搬迁到更新的文件中，记录之间按最初的写入时间判断先后
+// 集群模式下索引由raft维护，不支持重建
+func (fm *FileManager) RebuildIndex() (*RebuildStats, error) {
+	if fm.opts.NodeId != "" {
+		return nil, errors.New("rebuild index is not supported in cluster mode")
+	}
+	if err := fm.checkWritable(); err != nil {
+		return nil, err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	stats := &RebuildStats{}
+	keys := make(map[string]*keyRecords)
+	now := time.Now().UnixNano()
+	var err error
+	stats.Segments, err = fm.scanSegments(func(seq int, offset, size int64, chunk *pb.Chunk, chunkErr error) error {
+		stats.Records++
+		var data []byte
+		if chunkErr == nil && !chunk.Deleted {
+			data, chunkErr = decompress(chunk)
+		}
+		if chunkErr != nil {
+			stats.SkippedRecords = append(stats.SkippedRecords,
+				fmt.Sprintf("%s@%d: %s", buildFileName(seq), offset, chunkErr))
+			return nil
+		}
+		index := &BlockIndex{
+			Node:    fm.opts.NodeId,
+			FSeq:    seq,
+			BlockId: chunk.Id,
+			Offset:  uint64(offset),
+			Bucket:  bucketOrDefault(chunk.Bucket),
+			ModTime: chunk.WrittenAt,
+			// 已经过期的chunk由之后的清理删除
+			ExpiresAt: chunk.ExpiresAt,
+			Owner:     chunk.Owner,
+		}
+		// 没有记录写入时间的旧数据使用重建的时间
+		if index.ModTime == 0 {
+			index.ModTime = now
+		}
+		if !chunk.Deleted {
+			index.Size = int64(len(data))
+			index.ETag = fm.etag(data)
+		}
+		replayRecord(keys, chunk, index)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fm.indexStore.ClearIndexes(true); err != nil {
+		return nil, err
+	}
+	buckets, err := fm.rebuildBuckets(keys, stats)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(IndexBatch)
+	for _, records := range keys {
+		if records.latest != nil {
+			batch.PutIndex(records.latest)
+			stats.Indexes++
+		}
+		for _, version := range records.versions {
+			batch.PutVersion(version)
+			stats.Versions++
+		}
+	}
+	for _, bucket := range buckets {
+		batch.PutBucket(bucket)
+	}
+	for _, usage := range rebuildOwners(keys) {
+		batch.PutOwnerUsage(usage)
+	}
+	if err = fm.indexStore.WriteBatch(batch, true); err != nil {
+		return nil, err
+	}
+	// 缓存中的位置不受影响，但是被删除的chunk不应该再被读到
+	if fm.cache != nil {
+		fm.cache.purge()
+	}
+	log.Printf("rebuilt %d indexes and %d versions from %d records in %d files",
+		stats.Indexes, stats.Versions, stats.Records, stats.Segments)
+	return stats, nil
+}
+
+// replayRecord 将一条记录应用到keys上，index为记录对应的索引，规则与写入、删除时相同
+// 早于已经重放的记录写入的记录是被压缩搬迁的旧数据，只恢复版本，不会替换最新数据
+func replayRecord(keys map[string]*keyRecords, chunk *pb.Chunk, index *BlockIndex) {
+	key := index.Bucket + "/" + index.BlockId
+	records, ok := keys[key]
+	if !ok {
+		records = &keyRecords{bucket: index.Bucket, versions: make(map[string]*BlockIndex)}
+		keys[key] = records
+	}
+	relocated := chunk.WrittenAt != 0 && chunk.WrittenAt < records.writtenAt
+	if chunk.WrittenAt > records.writtenAt {
+		records.writtenAt = chunk.WrittenAt
+	}
+
+	switch {
+	case chunk.Purge:
+		delete(records.versions, chunk.VersionId)
+		// 没有版本号的最新数据不受影响，否则由剩下的最新版本作为最新数据
+		if records.latest == nil || records.latest.VersionId != "" {
+			records.latest = newestVersion(records.versions)
+		}
+	case chunk.VersionId != "":
+		index.VersionId = chunk.VersionId
+		index.DeleteMarker = chunk.Deleted
+		records.versions[chunk.VersionId] = index
+		if !relocated {
+			records.latest = newestVersion(records.versions)
+		}
+	case relocated:
+	case chunk.Deleted:
+		records.latest = nil
+	default:
+		records.latest = index
+	}
+	if records.latest == nil && len(records.versions) == 0 {
+		delete(keys, key)
+	}
+}
+
+// newestVersion 返回版本号最大的版本，最新的版本是删除标记或者没有版本时返回nil
+func newestVersion(versions map[string]*BlockIndex) *BlockIndex {
+	var newest *BlockIndex
+	for _, version := range versions {
+		if newest == nil || version.VersionId > newest.VersionId {
+			newest = version
+		}
+	}
+	if newest == nil || newest.DeleteMarker {
+		return nil
+	}
+	return newest
+}
+
+// rebuildOwners 根据重建的索引重新计算每个写入者的用量，计算方式与rebuildBuckets相同
+func rebuildOwners(keys map[string]*keyRecords) []*OwnerUsage {
+	owners := make(map[string]*OwnerUsage)
+	add := func(index *BlockIndex) {
+		if index.Owner == "" {
+			return
+		}
+		usage, ok := owners[index.Owner]
+		if !ok {
+			usage = &OwnerUsage{Owner: index.Owner}
+			owners[index.Owner] = usage
+		}
+		usage.UsedBytes += index.Size
+		usage.ObjectCount++
+	}
+	for _, records := range keys {
+		if records.latest != nil && records.latest.VersionId == "" {
+			add(records.latest)
+		}
+		for _, version := range records.versions {
+			if !version.DeleteMarker {
+				add(version)
+			}
+		}
+	}
+	result := make([]*OwnerUsage, 0, len(owners))
+	for _, usage := range owners {
+		result = append(result, usage)
+	}
+	return result
+}
+
+// rebuildBuckets 根据重建的索引重新计算每个bucket的使用情况，记录中出现但是已经不存在的bucket会被重新创建，
+// 包含版本的bucket会开启版本控制
+func (fm *FileManager) rebuildBuckets(keys map[string]*keyRecords, stats *RebuildStats) ([]*Bucket, error) {
+	existing, err := fm.indexStore.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[string]*Bucket)
+	for _, bucket := range existing {
+		bucket.UsedBytes, bucket.ObjectCount = 0, 0
+		buckets[bucket.Name] = bucket
+	}
+	created := make(map[string]bool)
+	for _, records := range keys {
+		bucket, ok := buckets[records.bucket]
+		if !ok {
+			bucket = &Bucket{Name: records.bucket, CreatedAt: time.Now().Unix()}
+			buckets[records.bucket] = bucket
+			created[records.bucket] = true
+			stats.CreatedBuckets = append(stats.CreatedBuckets, records.bucket)
+		}
+		// 有版本号的最新数据已经在版本中计算
+		if records.latest != nil && records.latest.VersionId == "" {
+			bucket.UsedBytes += records.latest.Size
+			bucket.ObjectCount++
+		}
+		for _, version := range records.versions {
+			if created[records.bucket] {
+				bucket.Versioning = true
+			}
+			if !version.DeleteMarker {
+				bucket.UsedBytes += version.Size
+				bucket.ObjectCount++
+			}
+		}
+	}
+	sort.Strings(stats.CreatedBuckets)
+
+	result := make([]*Bucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		result = append(result, bucket)
+	}
+	return result, nil
+}
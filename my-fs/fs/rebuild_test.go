@@ -0,0 +1,183 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// indexSnapshot 重建前后需要一致的索引状态，不包括写入时间
+type indexSnapshot struct {
+	FSeq      int
+	Offset    uint64
+	Size      int64
+	ETag      string
+	VersionId string
+	Marker    bool
+}
+
+func snapshotIndexes(t *testing.T, fm *FileManager, buckets []string) (map[string]indexSnapshot, map[string]*Bucket) {
+	indexes := make(map[string]indexSnapshot)
+	usage := make(map[string]*Bucket)
+	scanner := fm.indexStore.(indexScanner)
+	err := scanner.scanIndexes(func(index *BlockIndex, version bool) error {
+		name := index.Bucket + "/" + index.BlockId
+		if version {
+			name += "@" + index.VersionId
+		}
+		indexes[name] = indexSnapshot{index.FSeq, index.Offset, index.Size, index.ETag, index.VersionId, index.DeleteMarker}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range buckets {
+		bucket, err := fm.GetBucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usage[name] = &Bucket{Name: name, UsedBytes: bucket.UsedBytes, ObjectCount: bucket.ObjectCount, Versioning: bucket.Versioning}
+	}
+	return indexes, usage
+}
+
+func TestFileManager_RebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{MaxFileSize: 256, Compression: CompressionSnappy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.CreateBucket("versioned", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.SetBucketVersioning("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 100)
+	for i := 0; i < 6; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("key-%d", i), payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = fm.WriteWithKey("key-0", []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.Delete("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for i := 0; i < 3; i++ {
+		index, err := fm.WriteWithKey("doc", []byte(fmt.Sprintf("doc-%d", i)), &WriteOptions{Bucket: "versioned"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, index.VersionId)
+	}
+	// 永久删除最新的版本后，上一个版本成为最新的数据
+	if err = fm.DeleteWithOptions("doc", &DeleteOptions{Bucket: "versioned", VersionId: versions[2]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("gone", []byte("gone"), &WriteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteWithOptions("gone", &DeleteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	// 压缩会把仍然被引用的旧版本搬迁到当前文件中
+	for i := 0; i < 3; i++ {
+		if _, err = fm.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = fm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets := []string{DefaultBucket, "versioned"}
+	wantIndexes, wantUsage := snapshotIndexes(t, fm, buckets)
+	stats, err := fm.RebuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.SkippedRecords) != 0 || len(stats.CreatedBuckets) != 0 {
+		t.Fatalf("unexpected rebuild stats %+v", stats)
+	}
+	gotIndexes, gotUsage := snapshotIndexes(t, fm, buckets)
+	if !reflect.DeepEqual(wantIndexes, gotIndexes) {
+		t.Fatalf("rebuilt indexes differ\nwant %+v\ngot  %+v", wantIndexes, gotIndexes)
+	}
+	if !reflect.DeepEqual(wantUsage, gotUsage) {
+		t.Fatalf("rebuilt bucket usage differs, want %+v, got %+v", wantUsage, gotUsage)
+	}
+	data, err := fm.ReadWithOptions("doc", &ReadOptions{Bucket: "versioned"})
+	if err != nil || string(data) != "doc-1" {
+		t.Fatalf("expect doc-1 after rebuild, got %q, %v", data, err)
+	}
+
+	// 丢失的bucket会被重新创建
+	if err = fm.indexStore.DeleteBucket("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stats.CreatedBuckets, []string{"versioned"}) {
+		t.Fatalf("expect versioned to be created, got %v", stats.CreatedBuckets)
+	}
+	gotIndexes, gotUsage = snapshotIndexes(t, fm, buckets)
+	if !reflect.DeepEqual(wantIndexes, gotIndexes) || !reflect.DeepEqual(wantUsage, gotUsage) {
+		t.Fatalf("indexes differ after recreating bucket, got %+v, %+v", gotIndexes, gotUsage)
+	}
+}
+
+// TestFileManager_RebuildAfterCompaction 压缩把旧版本搬迁到关闭版本控制之后写入的数据后面，重建之后最新数据不变
+func TestFileManager_RebuildAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.CreateBucket("versioned", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.SetBucketVersioning("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 100)
+	if _, err = fm.WriteWithKey("doc", payload, &WriteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = fm.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fm.SetBucketVersioning("versioned", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("doc", []byte("latest"), &WriteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	// 仍然被引用的旧版本被搬迁到当前文件中，位于最新数据之后
+	stats, err := fm.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LiveRecords == 0 {
+		t.Fatalf("the old version should be relocated, got %+v", stats)
+	}
+
+	if _, err = fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fm.ReadWithOptions("doc", &ReadOptions{Bucket: "versioned"})
+	if err != nil || string(data) != "latest" {
+		t.Fatalf("expect the unversioned write to stay latest after rebuild, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,342 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// IndexLog 在集群中复制索引修改的日志，由cluster包使用raft实现
+type IndexLog interface {
+	// Append 提交一组修改，返回时修改已经提交，并且已经应用到本节点的索引数据库
+	// 不是leader时返回utils.ErrNotLeader
+	Append(data []byte) error
+	// ReadBarrier 等待本节点应用所有已经提交的修改，之后的读取可以看到之前完成的所有写入
+	ReadBarrier() error
+}
+
+// RecordFetcher 读取其他节点数据文件中的原始记录，集群模式下由cluster包实现
+type RecordFetcher interface {
+	FetchRecord(node string, seq int, offset uint64) ([]byte, error)
+}
+
+// readBarrier 集群模式下的索引数据库实现该接口，对外的读取操作之前调用
+type readBarrier interface {
+	ReadBarrier() error
+}
+
+var _ IndexStore = &ReplicatedIndexStore{}
+
+// ReplicatedIndexStore 集群模式下的索引数据库，所有的修改以IndexBatch为单位通过IndexLog复制，
+// 在每个节点上按照相同的顺序应用到本地的leveldb，读取直接读取本地的leveldb
+// 每个节点的checkpoint保存在checkpoint/<节点id>中，所有节点都能看到整个集群的checkpoint，
+// 但是节点自己的checkpoint只由自己写入，重放日志或者加载快照时不会被旧的值覆盖
+type ReplicatedIndexStore struct {
+	nodeId string
+	local  *indexStore
+	log    IndexLog
+}
+
+func NewReplicatedIndexStore(nodeId string, log IndexLog) *ReplicatedIndexStore {
+	return &ReplicatedIndexStore{nodeId: nodeId, local: &indexStore{}, log: log}
+}
+
+// Size 本地索引数据库的大小
+func (s *ReplicatedIndexStore) Size() (int64, error) {
+	return s.local.Size()
+}
+
+func (s *ReplicatedIndexStore) scanIndexes(fn func(index *BlockIndex, version bool) error) error {
+	return s.local.scanIndexes(fn)
+}
+
+func (s *ReplicatedIndexStore) listLegacyIndexes() (bool, []*BlockIndex, error) {
+	return s.local.listLegacyIndexes()
+}
+
+// nodeCheckpointKey 节点的checkpoint在索引数据库中的key
+func nodeCheckpointKey(nodeId string) []byte {
+	return []byte(checkpointKey + "/" + nodeId)
+}
+
+func (s *ReplicatedIndexStore) Open(dbPath string) error {
+	return s.local.Open(dbPath)
+}
+
+func (s *ReplicatedIndexStore) Close() error {
+	return s.local.Close()
+}
+
+// ReadBarrier 等待本节点追上集群中已经提交的修改
+func (s *ReplicatedIndexStore) ReadBarrier() error {
+	return s.log.ReadBarrier()
+}
+
+// ApplyCommand 将Append提交的修改应用到本地的索引数据库，由raft的状态机调用
+func (s *ReplicatedIndexStore) ApplyCommand(data []byte) error {
+	batch := new(leveldb.Batch)
+	if err := batch.Load(data); err != nil {
+		return errors.Wrap(err, "load index batch failed")
+	}
+	filtered := &skipKeyBatch{skip: string(nodeCheckpointKey(s.nodeId))}
+	if err := batch.Replay(filtered); err != nil {
+		return errors.Wrap(err, "replay index batch failed")
+	}
+	return s.local.db.Write(&filtered.batch, writeOptions(false))
+}
+
+// skipKeyBatch 复制batch中除skip以外的修改
+type skipKeyBatch struct {
+	skip  string
+	batch leveldb.Batch
+}
+
+func (b *skipKeyBatch) Put(key, value []byte) {
+	if string(key) != b.skip {
+		b.batch.Put(key, value)
+	}
+}
+
+func (b *skipKeyBatch) Delete(key []byte) {
+	if string(key) != b.skip {
+		b.batch.Delete(key)
+	}
+}
+
+func (s *ReplicatedIndexStore) append(batch *leveldb.Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	return s.log.Append(batch.Dump())
+}
+
+func (s *ReplicatedIndexStore) SaveIndex(index *BlockIndex, sync bool) error {
+	batch := new(IndexBatch)
+	batch.PutIndex(index)
+	return s.WriteBatch(batch, sync)
+}
+
+func (s *ReplicatedIndexStore) FetchIndex(id string) (*BlockIndex, error) {
+	return s.local.FetchIndex(id)
+}
+
+func (s *ReplicatedIndexStore) FetchBucketIndex(bucket, id string) (*BlockIndex, error) {
+	return s.local.FetchBucketIndex(bucket, id)
+}
+
+func (s *ReplicatedIndexStore) DeleteIndex(bucket, id string, sync bool) error {
+	batch := new(IndexBatch)
+	batch.DeleteIndex(bucket, id)
+	return s.WriteBatch(batch, sync)
+}
+
+func (s *ReplicatedIndexStore) ListIndex(bucket string, opts *ListOptions) ([]*BlockIndex, error) {
+	return s.local.ListIndex(bucket, opts)
+}
+
+func (s *ReplicatedIndexStore) FetchVersion(bucket, id, versionId string) (*BlockIndex, error) {
+	return s.local.FetchVersion(bucket, id, versionId)
+}
+
+func (s *ReplicatedIndexStore) ListVersions(bucket, id string) ([]*BlockIndex, error) {
+	return s.local.ListVersions(bucket, id)
+}
+
+// WriteBatch 复制batch中的修改，日志中的修改总是同步写入，所以忽略sync
+func (s *ReplicatedIndexStore) WriteBatch(batch *IndexBatch, sync bool) error {
+	if batch.err != nil {
+		return batch.err
+	}
+	return s.append(&batch.batch)
+}
+
+func (s *ReplicatedIndexStore) SaveBucket(bucket *Bucket, sync bool) error {
+	batch := new(IndexBatch)
+	batch.PutBucket(bucket)
+	return s.WriteBatch(batch, sync)
+}
+
+func (s *ReplicatedIndexStore) FetchBucket(name string) (*Bucket, error) {
+	return s.local.FetchBucket(name)
+}
+
+func (s *ReplicatedIndexStore) DeleteBucket(name string, sync bool) error {
+	batch, err := s.local.deleteBucketBatch(name)
+	if err != nil {
+		return err
+	}
+	return s.append(batch)
+}
+
+func (s *ReplicatedIndexStore) ListBuckets() ([]*Bucket, error) {
+	return s.local.ListBuckets()
+}
+
+func (s *ReplicatedIndexStore) ListExpired(now int64, limit int) ([]*ExpiryRecord, error) {
+	return s.local.ListExpired(now, limit)
+}
+
+func (s *ReplicatedIndexStore) FetchOwnerUsage(owner string) (*OwnerUsage, error) {
+	return s.local.FetchOwnerUsage(owner)
+}
+
+func (s *ReplicatedIndexStore) ListOwnerUsage() ([]*OwnerUsage, error) {
+	return s.local.ListOwnerUsage()
+}
+
+func (s *ReplicatedIndexStore) FetchIdempotencyRecord(bucket, owner, key string) (*IdempotencyRecord, error) {
+	return s.local.FetchIdempotencyRecord(bucket, owner, key)
+}
+
+func (s *ReplicatedIndexStore) DeleteExpiredIdempotencyRecords(now int64) (int, error) {
+	batch, err := s.local.expiredIdempotencyBatch(now)
+	if err != nil {
+		return 0, err
+	}
+	return batch.Len(), s.append(batch)
+}
+
+func (s *ReplicatedIndexStore) SaveDataKey(dataKey *DataKey, sync bool) error {
+	batch := new(IndexBatch)
+	batch.put(dataKeyKey(dataKey.Version), dataKey, "data key")
+	return s.WriteBatch(batch, sync)
+}
+
+func (s *ReplicatedIndexStore) ListDataKeys() ([]*DataKey, error) {
+	return s.local.ListDataKeys()
+}
+
+func (s *ReplicatedIndexStore) FetchReplicaPosition() (*LogPosition, error) {
+	return s.local.FetchReplicaPosition()
+}
+
+func (s *ReplicatedIndexStore) ClearIndexes(sync bool) error {
+	batch, err := s.local.clearIndexesBatch()
+	if err != nil {
+		return err
+	}
+	return s.append(batch)
+}
+
+// SaveCheckpoint 先保存到本地，再复制给其他节点，不是leader时只保存在本地
+func (s *ReplicatedIndexStore) SaveCheckpoint(cp *checkpoint, sync bool) error {
+	cpBytes, err := cp.marshal()
+	if err != nil {
+		return err
+	}
+	key := nodeCheckpointKey(s.nodeId)
+	if err = s.local.db.Put(key, cpBytes, writeOptions(sync)); err != nil {
+		return errors.Wrap(err, "save checkpoint failed")
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(key, cpBytes)
+	if err = s.append(batch); errors.Cause(err) != utils.ErrNotLeader {
+		return err
+	}
+	return nil
+}
+
+func (s *ReplicatedIndexStore) FetchCheckpoint() (*checkpoint, error) {
+	return s.local.fetchCheckpoint(nodeCheckpointKey(s.nodeId))
+}
+
+// NodeCheckpoint 获取集群中某个节点最后复制的写入位置
+func (s *ReplicatedIndexStore) NodeCheckpoint(nodeId string) (*LogPosition, error) {
+	cp, err := s.local.fetchCheckpoint(nodeCheckpointKey(nodeId))
+	if err != nil || cp == nil {
+		return nil, err
+	}
+	return &LogPosition{Seq: cp.lastFileSeq, Offset: int64(cp.lastFileSize)}, nil
+}
+
+// IndexSnapshot 索引数据库在某一时刻的快照
+type IndexSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+// Snapshot 获取本地索引数据库的快照，用于生成raft的快照
+func (s *ReplicatedIndexStore) Snapshot() (*IndexSnapshot, error) {
+	snapshot, err := s.local.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "get index store snapshot failed")
+	}
+	return &IndexSnapshot{snapshot: snapshot}, nil
+}
+
+// Dump 依次写入快照中的每个key和value，都使用varint长度前缀
+func (s *IndexSnapshot) Dump(w io.Writer) error {
+	iter := s.snapshot.NewIterator(nil, nil)
+	defer iter.Release()
+
+	buf := bufio.NewWriter(w)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for iter.Next() {
+		for _, data := range [][]byte{iter.Key(), iter.Value()} {
+			n := binary.PutUvarint(lenBuf, uint64(len(data)))
+			if _, err := buf.Write(lenBuf[:n]); err != nil {
+				return err
+			}
+			if _, err := buf.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return errors.Wrap(err, "iterate index store snapshot failed")
+	}
+	return buf.Flush()
+}
+
+func (s *IndexSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+// Restore 使用快照替换本地索引数据库中的所有数据，本节点自己的checkpoint保留
+func (s *ReplicatedIndexStore) Restore(r io.Reader) error {
+	ownCheckpoint := string(nodeCheckpointKey(s.nodeId))
+	batch := new(leveldb.Batch)
+	iter := s.local.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if string(iter.Key()) != ownCheckpoint {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return errors.Wrap(err, "iterate index store failed")
+	}
+
+	reader := bufio.NewReader(r)
+	readField := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, n)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	for {
+		key, err := readField()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read snapshot key failed")
+		}
+		value, err := readField()
+		if err != nil {
+			return errors.Wrap(err, "read snapshot value failed")
+		}
+		if string(key) != ownCheckpoint {
+			batch.Put(key, value)
+		}
+	}
+	return s.local.db.Write(batch, writeOptions(true))
+}
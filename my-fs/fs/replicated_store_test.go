@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+// fakeIndexLog 按顺序把修改应用到所有的store，模拟已经提交的raft日志
+type fakeIndexLog struct {
+	stores   []*ReplicatedIndexStore
+	isLeader bool
+}
+
+func (l *fakeIndexLog) Append(data []byte) error {
+	if !l.isLeader {
+		return utils.ErrNotLeader
+	}
+	for _, store := range l.stores {
+		if err := store.ApplyCommand(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *fakeIndexLog) ReadBarrier() error {
+	return nil
+}
+
+func newTestReplicatedStore(t *testing.T, nodeId string, log *fakeIndexLog) *ReplicatedIndexStore {
+	store := NewReplicatedIndexStore(nodeId, log)
+	if err := store.Open(filepath.Join(t.TempDir(), "indexstore")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	log.stores = append(log.stores, store)
+	return store
+}
+
+func TestReplicatedIndexStore(t *testing.T) {
+	log := &fakeIndexLog{isLeader: true}
+	a := newTestReplicatedStore(t, "a", log)
+	b := newTestReplicatedStore(t, "b", log)
+
+	index := &BlockIndex{Node: "a", FSeq: 1, BlockId: "chunk", Offset: 10, Bucket: DefaultBucket}
+	if err := a.SaveIndex(index, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.FetchBucketIndex(DefaultBucket, "chunk"); err != nil || *got != *index {
+		t.Fatalf("index is not replicated: %+v %v", got, err)
+	}
+
+	// 每个节点只能看到自己的checkpoint，其他节点的位置通过NodeCheckpoint获取
+	if err := a.SaveCheckpoint(&checkpoint{lastFileSeq: 2, lastFileSize: 100}, true); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err := b.FetchCheckpoint(); err != nil || cp != nil {
+		t.Fatalf("expect no checkpoint on b, got %+v %v", cp, err)
+	}
+	if pos, err := b.NodeCheckpoint("a"); err != nil || pos == nil || *pos != (LogPosition{Seq: 2, Offset: 100}) {
+		t.Fatalf("unexpected checkpoint of a on b: %+v %v", pos, err)
+	}
+
+	// 不是leader时修改失败，checkpoint只保存在本地
+	log.isLeader = false
+	if err := b.SaveIndex(&BlockIndex{BlockId: "other"}, true); errors.Cause(err) != utils.ErrNotLeader {
+		t.Fatalf("expect ErrNotLeader, got %v", err)
+	}
+	if err := b.SaveCheckpoint(&checkpoint{lastFileSeq: 5, lastFileSize: 7}, true); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := a.NodeCheckpoint("b"); err != nil || pos != nil {
+		t.Fatalf("expect checkpoint of b to stay local, got %+v %v", pos, err)
+	}
+
+	// 从快照恢复时替换所有数据，但保留自己的checkpoint
+	snapshot, err := a.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+	buf := new(bytes.Buffer)
+	if err = snapshot.Dump(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.local.db.Put([]byte("stale"), []byte("value"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Restore(buf); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.local.db.Has([]byte("stale"), nil); ok {
+		t.Fatal("stale key survives restore")
+	}
+	if got, err := b.FetchBucketIndex(DefaultBucket, "chunk"); err != nil || *got != *index {
+		t.Fatalf("index is not restored: %+v %v", got, err)
+	}
+	if cp, err := b.FetchCheckpoint(); err != nil || cp == nil || cp.lastFileSeq != 5 {
+		t.Fatalf("own checkpoint is lost after restore: %+v %v", cp, err)
+	}
+}
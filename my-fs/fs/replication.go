@@ -0,0 +1,548 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+// LogPosition 数据文件中的位置，从节点按照与主节点完全相同的布局写入数据文件，所以位置在主从节点上是通用的
+// 零值表示从主节点最旧的文件开始复制
+type LogPosition struct {
+	Seq    int
+	Offset int64
+}
+
+// covers 判断index指向的记录是否在位置p之前，也就是已经被复制
+func (p LogPosition) covers(index *BlockIndex) bool {
+	return index.FSeq < p.Seq || (index.FSeq == p.Seq && int64(index.Offset) < p.Offset)
+}
+
+// KeyState 主节点上某个id当前的索引状态，从节点直接使用该状态覆盖自己的索引
+type KeyState struct {
+	Bucket string
+	Id     string
+	// 最新的索引，Deleted为true表示id已经被删除，两者都为空表示最新的记录还没有复制，从节点保持不变
+	Latest  *BlockIndex `json:",omitempty"`
+	Deleted bool        `json:",omitempty"`
+	// 已经复制的所有版本，从旧到新
+	Versions []*BlockIndex `json:",omitempty"`
+}
+
+// LogBatch 主节点数据文件中一段连续的记录，以及从节点应用这些记录需要的元数据
+type LogBatch struct {
+	// 记录在主节点文件中的起始位置，以及下一次读取的位置，一个batch不会跨越文件
+	Start LogPosition
+	Next  LogPosition
+	// 文件中的原始数据，包括记录的长度前缀
+	Data []byte `json:",omitempty"`
+	// 这些记录涉及的id的索引状态
+	Keys []*KeyState `json:",omitempty"`
+	// bucket的创建、修改和删除不会写入数据文件，每个batch都带上所有的bucket
+	Buckets  []*Bucket
+	DataKeys []*DataKey `json:",omitempty"`
+	// 写入者的用量与bucket一样每次都全部带上
+	Owners []*OwnerUsage `json:",omitempty"`
+	// 主节点当前的写入位置，以及Next之后还没有复制的字节数
+	Head         LogPosition
+	PendingBytes int64
+	// 主节点上最旧的文件，从节点追上主节点后会删除更旧的文件
+	OldestSeq int
+}
+
+// SetReadOnly 设置是否只读，从节点只能通过ApplyLog写入
+func (fm *FileManager) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&fm.readOnly, v)
+}
+
+// ReadOnly 是否只读
+func (fm *FileManager) ReadOnly() bool {
+	return atomic.LoadInt32(&fm.readOnly) == 1
+}
+
+func (fm *FileManager) checkWritable() error {
+	if err := fm.checkOpen(); err != nil {
+		return err
+	}
+	if fm.ReadOnly() {
+		return utils.ErrReadOnly
+	}
+	return fm.checkAppendable()
+}
+
+// checkReplicable 复制直接传输数据文件的内容，纠删码模式下每个目录只保存分片，不支持复制
+func (fm *FileManager) checkReplicable() error {
+	if fm.erasure != nil {
+		return errors.New("replication is not supported with erasure coding")
+	}
+	return nil
+}
+
+// ReadLog 从from开始读取最多maxBytes的完整记录，至少读取一条记录，已经读到最新位置时返回不包含数据的batch
+// 读取时持有writeMutx，保证返回的记录对应的索引都已经写入
+func (fm *FileManager) ReadLog(from LogPosition, maxBytes int) (*LogBatch, error) {
+	if err := fm.checkReplicable(); err != nil {
+		return nil, err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	head := LogPosition{Seq: fm.checkpoint.lastFileSeq, Offset: int64(fm.checkpoint.lastFileSize)}
+	if len(seqs) == 0 {
+		seqs = []int{head.Seq}
+	}
+	pos, end, err := fm.resolveLogPosition(from, head, seqs)
+	if err != nil {
+		return nil, err
+	}
+	batch := &LogBatch{Start: pos, Next: pos, Head: head, OldestSeq: seqs[0]}
+	if pos.Offset < end {
+		if err = fm.readLogRecords(batch, end, maxBytes); err != nil {
+			return nil, err
+		}
+	}
+	if batch.PendingBytes, err = fm.pendingBytes(batch.Next, head, seqs); err != nil {
+		return nil, err
+	}
+	if batch.Buckets, err = fm.indexStore.ListBuckets(); err != nil {
+		return nil, err
+	}
+	if batch.DataKeys, err = fm.indexStore.ListDataKeys(); err != nil {
+		return nil, err
+	}
+	if batch.Owners, err = fm.indexStore.ListOwnerUsage(); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// resolveLogPosition 检查from是否仍然可以读取，已经读完的文件跳到下一个文件，返回读取位置以及该文件可以读取的结束位置
+func (fm *FileManager) resolveLogPosition(from, head LogPosition, seqs []int) (LogPosition, int64, error) {
+	pos := from
+	if pos.Seq == 0 {
+		pos = LogPosition{Seq: seqs[0]}
+	}
+	for {
+		if pos.Seq > head.Seq || (pos.Seq == head.Seq && pos.Offset > head.Offset) {
+			return pos, 0, errors.Wrapf(utils.ErrLogDiverged, "position %+v is ahead of primary %+v", pos, head)
+		}
+		if pos.Seq == head.Seq {
+			return pos, head.Offset, nil
+		}
+		exists, size, err := fm.statSegment(pos.Seq)
+		if err != nil {
+			return pos, 0, err
+		}
+		if !exists {
+			return pos, 0, errors.Wrapf(utils.ErrLogCompacted, "file [%s]", buildFileName(pos.Seq))
+		}
+		if pos.Offset > size {
+			return pos, 0, errors.Wrapf(utils.ErrLogDiverged, "position %+v is beyond file size %d", pos, size)
+		}
+		if pos.Offset < size {
+			return pos, size, nil
+		}
+		// 文件已经读完，从下一个文件开始
+		next := head.Seq
+		for _, seq := range seqs {
+			if seq > pos.Seq {
+				next = seq
+				break
+			}
+		}
+		pos = LogPosition{Seq: next}
+	}
+}
+
+// readLogRecords 读取batch.Start到end之间的完整记录，并收集这些记录涉及的id在当前的索引状态
+func (fm *FileManager) readLogRecords(batch *LogBatch, end int64, maxBytes int) error {
+	// 冷存储中的文件只下载一次，记录的内容从同一个文件读取
+	stream, err := fm.openFileStream(batch.Start.Seq, batch.Start.Offset)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+
+	type key struct{ bucket, id string }
+	touched := make(map[key]bool)
+	var keys []key
+	for stream.currentOffset < end && stream.currentOffset-batch.Start.Offset < int64(maxBytes) {
+		chunkBytes, _, err := stream.nextChunkBytesAndPlacement()
+		if err != nil {
+			return err
+		}
+		if chunkBytes == nil {
+			break
+		}
+		chunk, err := fm.decodeChunk(chunkBytes)
+		if err != nil {
+			return err
+		}
+		k := key{bucketOrDefault(chunk.Bucket), chunk.Id}
+		if !touched[k] {
+			touched[k] = true
+			keys = append(keys, k)
+		}
+	}
+	batch.Next = LogPosition{Seq: batch.Start.Seq, Offset: stream.currentOffset}
+
+	reader := &fileReader{file: stream.file}
+	if batch.Data, err = reader.read(int(batch.Start.Offset), int(batch.Next.Offset-batch.Start.Offset)); err != nil {
+		return errors.Wrap(err, "read records failed")
+	}
+
+	for _, k := range keys {
+		state, err := fm.keyState(k.bucket, k.id, batch.Next)
+		if err != nil {
+			return err
+		}
+		batch.Keys = append(batch.Keys, state)
+	}
+	return nil
+}
+
+// keyState 获取id当前的索引状态，只包含next之前已经复制的记录
+func (fm *FileManager) keyState(bucket, id string, next LogPosition) (*KeyState, error) {
+	state := &KeyState{Bucket: bucket, Id: id}
+	// 过期但是还没有清理的chunk仍然复制，清理时的删除标记会在之后复制
+	latest, err := fm.stat(id, &ReadOptions{Bucket: bucket})
+	switch {
+	case errors.Cause(err) == utils.ErrIndexNotFound:
+		state.Deleted = true
+	case err != nil:
+		return nil, err
+	case next.covers(latest):
+		state.Latest = latest
+	}
+	versions, err := fm.indexStore.ListVersions(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if next.covers(version) {
+			state.Versions = append(state.Versions, version)
+		}
+	}
+	return state, nil
+}
+
+// pendingBytes 计算next之后还没有复制的字节数
+func (fm *FileManager) pendingBytes(next, head LogPosition, seqs []int) (int64, error) {
+	if next.Seq == head.Seq {
+		return head.Offset - next.Offset, nil
+	}
+	pending := head.Offset
+	for _, seq := range seqs {
+		if seq < next.Seq || seq >= head.Seq {
+			continue
+		}
+		_, size, err := fm.statSegment(seq)
+		if err != nil {
+			return 0, err
+		}
+		if seq == next.Seq {
+			size -= next.Offset
+		}
+		pending += size
+	}
+	return pending, nil
+}
+
+// ReplicaPosition 从节点已经应用的主节点位置，从未复制过的空节点从头开始复制
+func (fm *FileManager) ReplicaPosition() (LogPosition, error) {
+	pos, err := fm.indexStore.FetchReplicaPosition()
+	if err != nil {
+		return LogPosition{}, err
+	}
+	if pos != nil {
+		return *pos, nil
+	}
+	fm.mutx.Lock()
+	cp := fm.checkpoint
+	fm.mutx.Unlock()
+	if cp.lastFileSeq > 1 || cp.lastFileSize > 0 {
+		return LogPosition{}, errors.Wrap(utils.ErrLogDiverged, "store holds data that was not replicated from primary")
+	}
+	return LogPosition{}, nil
+}
+
+// ApplyLog 从节点应用主节点读取的batch，数据按照主节点的位置写入文件，索引直接使用主节点的状态
+func (fm *FileManager) ApplyLog(batch *LogBatch) error {
+	if err := fm.checkReplicable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	applied, err := fm.ReplicaPosition()
+	if err != nil {
+		return err
+	}
+	if batch.Start != applied && !(batch.Start.Seq > applied.Seq && batch.Start.Offset == 0) {
+		return errors.Wrapf(utils.ErrLogDiverged, "batch starts at %+v, replica applied %+v", batch.Start, applied)
+	}
+	if err = fm.writeLogData(batch); err != nil {
+		return err
+	}
+	if err = fm.applyDataKeys(batch.DataKeys); err != nil {
+		return err
+	}
+	if err = fm.applyBuckets(batch.Buckets); err != nil {
+		return err
+	}
+
+	indexBatch := new(IndexBatch)
+	for _, state := range batch.Keys {
+		if err = fm.applyKeyState(indexBatch, state); err != nil {
+			return err
+		}
+	}
+	for _, bucket := range batch.Buckets {
+		indexBatch.PutBucket(bucket)
+	}
+	if err = fm.applyOwnerUsage(indexBatch, batch.Owners); err != nil {
+		return err
+	}
+	indexBatch.PutReplicaPosition(batch.Next)
+	if err = fm.indexStore.WriteBatch(indexBatch, true); err != nil {
+		return err
+	}
+	// 追上主节点时两边的索引完全一致，主节点已经压缩删除的文件不会再被引用
+	if batch.PendingBytes == 0 {
+		return fm.removeFilesBefore(batch.OldestSeq)
+	}
+	return nil
+}
+
+// writeLogData 将batch中的数据写入与主节点相同的位置
+func (fm *FileManager) writeLogData(batch *LogBatch) error {
+	if err := fm.checkOpen(); err != nil {
+		return err
+	}
+	cp := fm.checkpoint
+	switch {
+	case batch.Start.Seq < cp.lastFileSeq:
+		return errors.Wrapf(utils.ErrLogDiverged, "batch starts at %+v, replica is writing file %d", batch.Start, cp.lastFileSeq)
+	case batch.Start.Seq > cp.lastFileSeq:
+		emptyFile := buildFilePath(fm.rootDir, cp.lastFileSeq)
+		if err := fm.moveToFile(batch.Start.Seq); err != nil {
+			return err
+		}
+		// 没有数据的文件不会出现在主节点上
+		if cp.lastFileSize == 0 {
+			if err := os.Remove(emptyFile); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove file [%s] failed", emptyFile)
+			}
+		}
+	case int64(cp.lastFileSize) < batch.Start.Offset:
+		return errors.Wrapf(utils.ErrLogDiverged, "batch starts at %+v, replica file size is %d", batch.Start, cp.lastFileSize)
+	case int64(cp.lastFileSize) > batch.Start.Offset:
+		// 上次写入数据后没有应用索引就退出了，丢弃多余的数据
+		if err := fm.truncate(int(batch.Start.Offset)); err != nil {
+			return errors.Wrap(err, "truncate unapplied data failed")
+		}
+	}
+	if len(batch.Data) > 0 {
+		if err := fm.writer.write(batch.Data, true); err != nil {
+			return errors.Wrap(err, "write replicated data failed")
+		}
+	}
+	newCP := &checkpoint{lastFileSeq: batch.Start.Seq, lastFileSize: int(batch.Next.Offset)}
+	if err := fm.saveCheckpoint(newCP, true); err != nil {
+		return err
+	}
+	fm.updateCheckpoint(newCP)
+	return nil
+}
+
+// applyKeyState 使用主节点的索引状态覆盖从节点的索引
+func (fm *FileManager) applyKeyState(batch *IndexBatch, state *KeyState) error {
+	switch {
+	case state.Latest != nil:
+		batch.PutIndex(state.Latest)
+	case state.Deleted:
+		batch.DeleteIndex(state.Bucket, state.Id)
+	}
+	versions, err := fm.indexStore.ListVersions(state.Bucket, state.Id)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	for _, version := range state.Versions {
+		kept[version.VersionId] = true
+		batch.PutVersion(version)
+	}
+	// 主节点上已经永久删除的版本
+	for _, version := range versions {
+		if !kept[version.VersionId] {
+			batch.DeleteVersion(state.Bucket, state.Id, version.VersionId)
+		}
+	}
+	return nil
+}
+
+// applyBuckets 删除主节点上已经不存在的bucket，其余的bucket随索引一起保存
+func (fm *FileManager) applyBuckets(buckets []*Bucket) error {
+	names := make(map[string]bool)
+	for _, bucket := range buckets {
+		names[bucket.Name] = true
+	}
+	local, err := fm.indexStore.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range local {
+		if !names[bucket.Name] {
+			if err = fm.indexStore.DeleteBucket(bucket.Name, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyOwnerUsage 使用主节点的写入者用量覆盖从节点，删除主节点上已经不存在的记录
+func (fm *FileManager) applyOwnerUsage(batch *IndexBatch, owners []*OwnerUsage) error {
+	local, err := fm.indexStore.ListOwnerUsage()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, usage := range owners {
+		names[usage.Owner] = true
+		batch.PutOwnerUsage(usage)
+	}
+	for _, usage := range local {
+		if !names[usage.Owner] {
+			batch.DeleteOwnerUsage(usage.Owner)
+		}
+	}
+	return nil
+}
+
+// applyDataKeys 保存主节点的数据密钥，从节点配置了主密钥时同时加入keyring，主密钥不一致时返回ErrWrongMasterKey
+func (fm *FileManager) applyDataKeys(dataKeys []*DataKey) error {
+	local, err := fm.indexStore.ListDataKeys()
+	if err != nil {
+		return err
+	}
+	saved := make(map[uint64][]byte)
+	for _, dataKey := range local {
+		saved[dataKey.Version] = dataKey.WrappedKey
+	}
+	for _, dataKey := range dataKeys {
+		if bytes.Equal(saved[dataKey.Version], dataKey.WrappedKey) {
+			continue
+		}
+		if fm.keyring != nil {
+			if err = fm.keyring.addDataKey(dataKey); err != nil {
+				return err
+			}
+		}
+		if err = fm.indexStore.SaveDataKey(dataKey, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFilesBefore 删除seq之前的数据文件
+func (fm *FileManager) removeFilesBefore(seq int) error {
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return err
+	}
+	fm.segmentMutx.Lock()
+	defer fm.segmentMutx.Unlock()
+	for _, s := range seqs {
+		if s >= seq || s == fm.checkpoint.lastFileSeq {
+			continue
+		}
+		if err = fm.removeSegment(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetReplica 清空从节点的数据文件以及索引，之后从主节点最旧的文件重新开始复制
+// 从节点落后于主节点的压缩时，被压缩的删除记录已经无法复制，只能重新同步
+func (fm *FileManager) ResetReplica() error {
+	if err := fm.checkReplicable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+	fm.segmentMutx.Lock()
+	defer fm.segmentMutx.Unlock()
+
+	// 先保存复制位置，中途退出后仍然会重新同步
+	batch := new(IndexBatch)
+	batch.PutReplicaPosition(LogPosition{})
+	if err := fm.indexStore.WriteBatch(batch, true); err != nil {
+		return err
+	}
+	if err := fm.indexStore.ClearIndexes(true); err != nil {
+		return err
+	}
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return err
+	}
+	if fm.cache != nil {
+		fm.cache.purge()
+	}
+	// 冷存储中的文件先删除，之后第一个文件在本地重新创建
+	local := seqs[:0]
+	for _, seq := range seqs {
+		if fm.tieredSegment(seq) == nil {
+			local = append(local, seq)
+		} else if err = fm.removeSegment(seq); err != nil {
+			return err
+		}
+	}
+	seqs = local
+	if fm.checkpoint.lastFileSeq != 0 {
+		err = fm.moveToFile(0)
+	} else {
+		err = fm.truncate(0)
+	}
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq == 0 {
+			continue
+		}
+		if err = os.Remove(buildFilePath(fm.rootDir, seq)); err != nil {
+			return errors.Wrapf(err, "remove file [%s] failed", buildFileName(seq))
+		}
+	}
+	return nil
+}
+
+// Promote 从节点提升为主节点，之后可以正常写入
+func (fm *FileManager) Promote() error {
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	batch := new(IndexBatch)
+	batch.DeleteReplicaPosition()
+	if err := fm.indexStore.WriteBatch(batch, true); err != nil {
+		return err
+	}
+	fm.SetReadOnly(false)
+	return nil
+}
@@ -0,0 +1,539 @@
+package fs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"my-fs/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	snapshotManifestName = "manifest.json"
+	snapshotIndexName    = "index.dump"
+	snapshotSegmentsDir  = "segments"
+	// 正在生成的快照目录的前缀，完成之后重命名为快照id
+	snapshotTmpPrefix = ".tmp-"
+	// indexDumpMagic 索引导出文件的开头，最后一个字节为格式版本
+	indexDumpMagic = "MYFSIDX\x01"
+	// 索引数据库中单个key或value的最大长度，防止损坏的文件导致分配过多内存
+	maxIndexDumpEntrySize = 64 * 1024 * 1024
+)
+
+// SnapshotSegment 快照中的一个数据文件
+type SnapshotSegment struct {
+	Seq    int
+	Size   int64
+	SHA256 string
+	// 保存该文件的快照id，增量快照中没有变化的文件保存在之前的快照中
+	Snapshot string
+}
+
+// SnapshotManifest 快照的描述，保存在快照目录的manifest.json中
+type SnapshotManifest struct {
+	Id string
+	// 增量快照所基于的快照id，为空表示全量快照
+	Parent string `json:",omitempty"`
+	// 创建时间，unix纳秒
+	CreatedAt int64
+	// 快照时的checkpoint，最后一个文件只包含Offset之前的数据
+	FileSeq  int
+	Offset   int
+	Segments []SnapshotSegment
+	// 索引数据库中key的数量以及导出文件的sha256
+	IndexEntries int
+	IndexSHA256  string
+	// 本次快照新保存的数据文件大小，不包括之前的快照中已经保存的文件
+	CopiedBytes int64
+}
+
+// SnapshotOptions 生成快照时的可选参数
+type SnapshotOptions struct {
+	// 不为空时生成增量快照，该快照中已经封存的文件不再保存，而是引用该快照，
+	// Since必须与新快照在同一个目录下
+	Since string
+}
+
+// Snapshot 在线生成一致的快照，保存在root下以快照id命名的目录中
+// 持有写锁期间冻结checkpoint与索引数据库的快照，之后封存的文件使用硬链接，
+// 无法链接时复制，当前写入的文件只复制checkpoint之前的数据
+func (fm *FileManager) Snapshot(root string, opts *SnapshotOptions) (*SnapshotManifest, error) {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	// 纠删码模式下每个目录只保存分片，集群模式下索引可能指向其他节点的数据
+	if fm.erasure != nil {
+		return nil, errors.New("snapshots are not supported with erasure coding")
+	}
+	store, ok := fm.indexStore.(*indexStore)
+	if !ok || fm.opts.NodeId != "" {
+		return nil, errors.New("snapshots are not supported in cluster mode")
+	}
+	if err := fm.checkOpen(); err != nil {
+		return nil, err
+	}
+	var parent *SnapshotManifest
+	if opts.Since != "" {
+		if filepath.Base(opts.Since) != opts.Since || strings.HasPrefix(opts.Since, ".") {
+			return nil, errors.Wrapf(utils.ErrInvalidSnapshot, "invalid snapshot id [%s]", opts.Since)
+		}
+		var err error
+		if parent, err = ReadSnapshotManifest(filepath.Join(root, opts.Since)); err != nil {
+			return nil, errors.Wrapf(err, "read base snapshot [%s] failed", opts.Since)
+		}
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create snapshot dir [%s] failed", root)
+	}
+	manifest := &SnapshotManifest{Id: newSnapshotId(), Parent: opts.Since}
+	tmpDir := filepath.Join(root, snapshotTmpPrefix+manifest.Id)
+	if err := os.MkdirAll(filepath.Join(tmpDir, snapshotSegmentsDir), 0755); err != nil {
+		return nil, errors.Wrap(err, "create snapshot dir failed")
+	}
+	manifest, err := fm.snapshotTo(tmpDir, store, manifest, parent)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	if err = os.Rename(tmpDir, filepath.Join(root, manifest.Id)); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "rename snapshot dir failed")
+	}
+	return manifest, syncDir(root)
+}
+
+func (fm *FileManager) snapshotTo(dir string, store *indexStore, manifest *SnapshotManifest, parent *SnapshotManifest) (*SnapshotManifest, error) {
+	// 写锁保证checkpoint之前的数据对应的索引都已经写入，快照期间压缩不能删除文件
+	fm.writeMutx.Lock()
+	if err := fm.syncData(); err != nil {
+		fm.writeMutx.Unlock()
+		return nil, errors.Wrap(err, "sync data file failed")
+	}
+	fm.mutx.Lock()
+	cp := *fm.checkpoint
+	fm.mutx.Unlock()
+	dbSnapshot, err := store.db.GetSnapshot()
+	if err != nil {
+		fm.writeMutx.Unlock()
+		return nil, errors.Wrap(err, "snapshot index store failed")
+	}
+	defer dbSnapshot.Release()
+	fm.segmentMutx.RLock()
+	fm.writeMutx.Unlock()
+
+	manifest.CreatedAt = time.Now().UnixNano()
+	manifest.FileSeq, manifest.Offset = cp.lastFileSeq, cp.lastFileSize
+	err = fm.snapshotSegments(dir, manifest, parent)
+	fm.segmentMutx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.IndexEntries, manifest.IndexSHA256, err = dumpIndex(filepath.Join(dir, snapshotIndexName), dbSnapshot); err != nil {
+		return nil, err
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal snapshot manifest failed")
+	}
+	if err = writeFileSync(filepath.Join(dir, snapshotManifestName), content); err != nil {
+		return nil, err
+	}
+	return manifest, syncDir(dir)
+}
+
+// snapshotSegments 保存checkpoint之前的所有数据文件，调用方需要持有segmentMutx的读锁
+func (fm *FileManager) snapshotSegments(dir string, manifest *SnapshotManifest, parent *SnapshotManifest) error {
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return err
+	}
+	// 当前文件可能还没有创建
+	if len(seqs) == 0 || seqs[len(seqs)-1] < manifest.FileSeq {
+		seqs = append(seqs, manifest.FileSeq)
+	}
+	sealed := make(map[int]SnapshotSegment)
+	if parent != nil {
+		for _, segment := range parent.Segments {
+			if segment.Seq < parent.FileSeq {
+				sealed[segment.Seq] = segment
+			}
+		}
+	}
+	for _, seq := range seqs {
+		if seq > manifest.FileSeq {
+			break
+		}
+		// 文件序号只增不减，基础快照中已经封存的文件之后不会再改变
+		if segment, ok := sealed[seq]; ok {
+			manifest.Segments = append(manifest.Segments, segment)
+			continue
+		}
+		src := buildFilePath(fm.rootDir, seq)
+		dst := filepath.Join(dir, snapshotSegmentsDir, buildFileName(seq))
+		var size int64
+		var sum string
+		if segment := fm.tieredSegment(seq); segment != nil {
+			// 冷存储中的文件下载到快照中，快照不依赖冷存储
+			size, sum, err = fm.tiering.copyTo(segment, dst)
+		} else if seq == manifest.FileSeq {
+			size, sum, err = copyFilePrefix(src, dst, int64(manifest.Offset))
+		} else {
+			size, sum, err = linkOrCopyFile(src, dst)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "snapshot file [%s] failed", buildFileName(seq))
+		}
+		manifest.Segments = append(manifest.Segments, SnapshotSegment{Seq: seq, Size: size, SHA256: sum, Snapshot: manifest.Id})
+		manifest.CopiedBytes += size
+	}
+	return nil
+}
+
+// dumpIndex 导出索引数据库快照中所有的key与value，格式为magic之后依次为varint编码的长度与内容
+func dumpIndex(path string, dbSnapshot *leveldb.Snapshot) (int, string, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "create index dump failed")
+	}
+	defer file.Close()
+	digest := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(file, digest))
+	if _, err = writer.WriteString(indexDumpMagic); err != nil {
+		return 0, "", errors.Wrap(err, "write index dump failed")
+	}
+	iter := dbSnapshot.NewIterator(nil, nil)
+	defer iter.Release()
+	entries := 0
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for iter.Next() {
+		for _, part := range [][]byte{iter.Key(), iter.Value()} {
+			n := binary.PutUvarint(lenBuf, uint64(len(part)))
+			if _, err = writer.Write(lenBuf[:n]); err == nil {
+				_, err = writer.Write(part)
+			}
+			if err != nil {
+				return 0, "", errors.Wrap(err, "write index dump failed")
+			}
+		}
+		entries++
+	}
+	if err = iter.Error(); err != nil {
+		return 0, "", errors.Wrap(err, "iterate index store failed")
+	}
+	if err = writer.Flush(); err != nil {
+		return 0, "", errors.Wrap(err, "write index dump failed")
+	}
+	if err = file.Sync(); err != nil {
+		return 0, "", errors.Wrap(err, "sync index dump failed")
+	}
+	return entries, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// loadIndexDump 将dumpIndex导出的文件写入索引数据库，同时校验sha256
+func loadIndexDump(path string, db *leveldb.DB, manifest *SnapshotManifest) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open index dump failed")
+	}
+	defer file.Close()
+	digest := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(file, digest))
+	magic := make([]byte, len(indexDumpMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil || string(magic) != indexDumpMagic {
+		return errors.Wrap(utils.ErrInvalidSnapshot, "unknown index dump header")
+	}
+	batch := new(leveldb.Batch)
+	entries := 0
+	for {
+		key, err := readDumpPart(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		value, err := readDumpPart(reader)
+		if err == io.EOF {
+			return errors.Wrap(utils.ErrInvalidSnapshot, "truncated index dump")
+		}
+		if err != nil {
+			return err
+		}
+		batch.Put(key, value)
+		entries++
+		if batch.Len() >= 1000 {
+			if err = db.Write(batch, nil); err != nil {
+				return errors.Wrap(err, "write index store failed")
+			}
+			batch.Reset()
+		}
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != manifest.IndexSHA256 || entries != manifest.IndexEntries {
+		return errors.Wrapf(utils.ErrInvalidSnapshot, "index dump has %d entries with sha256 %s, expected %d entries with sha256 %s",
+			entries, sum, manifest.IndexEntries, manifest.IndexSHA256)
+	}
+	return errors.Wrap(db.Write(batch, writeOptions(true)), "write index store failed")
+}
+
+func readDumpPart(reader *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil || size > maxIndexDumpEntrySize {
+		return nil, errors.Wrap(utils.ErrInvalidSnapshot, "corrupt index dump entry")
+	}
+	part := make([]byte, size)
+	if _, err = io.ReadFull(reader, part); err != nil {
+		return nil, errors.Wrap(utils.ErrInvalidSnapshot, "truncated index dump")
+	}
+	return part, nil
+}
+
+// ReadSnapshotManifest 读取快照目录中的manifest.json
+func ReadSnapshotManifest(dir string) (*SnapshotManifest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, snapshotManifestName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read snapshot manifest in [%s] failed", dir)
+	}
+	manifest := new(SnapshotManifest)
+	if err = json.Unmarshal(content, manifest); err != nil {
+		return nil, errors.Wrapf(utils.ErrInvalidSnapshot, "decode manifest in [%s] failed: %s", dir, err)
+	}
+	return manifest, nil
+}
+
+// ListSnapshots 列出root下所有完成的快照，按创建时间排序
+func ListSnapshots(root string) ([]*SnapshotManifest, error) {
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read snapshot dir [%s] failed", root)
+	}
+	var manifests []*SnapshotManifest
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), snapshotTmpPrefix) {
+			continue
+		}
+		manifest, err := ReadSnapshotManifest(filepath.Join(root, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].CreatedAt < manifests[j].CreatedAt })
+	return manifests, nil
+}
+
+// path 数据文件在快照中的位置，增量快照引用的文件在同一目录下的其他快照中
+func (segment *SnapshotSegment) path(root string) string {
+	return filepath.Join(root, segment.Snapshot, snapshotSegmentsDir, buildFileName(segment.Seq))
+}
+
+// VerifySnapshot 校验快照引用的所有数据文件以及索引导出文件的大小与sha256
+func VerifySnapshot(dir string) (*SnapshotManifest, error) {
+	manifest, err := ReadSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Dir(filepath.Clean(dir))
+	for i := range manifest.Segments {
+		segment := &manifest.Segments[i]
+		if err = verifyFile(segment.path(root), segment.Size, segment.SHA256); err != nil {
+			return nil, err
+		}
+	}
+	if err = verifyFile(filepath.Join(dir, snapshotIndexName), -1, manifest.IndexSHA256); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func verifyFile(path string, size int64, sum string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(utils.ErrInvalidSnapshot, "open [%s] failed: %s", path, err)
+	}
+	defer file.Close()
+	digest := sha256.New()
+	n, err := io.Copy(digest, file)
+	if err != nil {
+		return errors.Wrapf(err, "read [%s] failed", path)
+	}
+	if (size >= 0 && n != size) || hex.EncodeToString(digest.Sum(nil)) != sum {
+		return errors.Wrapf(utils.ErrInvalidSnapshot, "[%s] does not match its size or checksum", path)
+	}
+	return nil
+}
+
+// RestoreStats 恢复的结果
+type RestoreStats struct {
+	Snapshot string
+	Segments int
+	Bytes    int64
+	// 恢复之后的一致性检查
+	Fsck *FsckReport
+}
+
+// RestoreSnapshot 将dir中的快照恢复到空的数据目录与索引目录，复制时校验每个文件的sha256，
+// 之后打开恢复的存储执行一致性检查，opts需要包含写入时使用的主密钥，
+// 失败时目标目录中可能留有部分数据，需要清空之后重试
+func RestoreSnapshot(dir, fileStorePath, indexStorePath string, opts *Options) (*RestoreStats, error) {
+	manifest, err := ReadSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{fileStorePath, indexStorePath} {
+		empty, err := createDirIfMissing(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create dir [%s] failed", path)
+		}
+		if !empty {
+			return nil, errors.Errorf("restore target [%s] is not empty", path)
+		}
+	}
+
+	stats := &RestoreStats{Snapshot: manifest.Id}
+	root := filepath.Dir(filepath.Clean(dir))
+	for i := range manifest.Segments {
+		segment := &manifest.Segments[i]
+		size, sum, err := copyFilePrefix(segment.path(root), buildFilePath(fileStorePath, segment.Seq), -1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "restore file [%s] failed", buildFileName(segment.Seq))
+		}
+		if size != segment.Size || sum != segment.SHA256 {
+			return nil, errors.Wrapf(utils.ErrInvalidSnapshot, "file [%s] of snapshot [%s] does not match its checksum",
+				buildFileName(segment.Seq), segment.Snapshot)
+		}
+		stats.Segments++
+		stats.Bytes += size
+	}
+	if err = syncDir(fileStorePath); err != nil {
+		return nil, err
+	}
+
+	store := &indexStore{}
+	if err = store.Open(indexStorePath); err != nil {
+		return nil, err
+	}
+	err = loadIndexDump(filepath.Join(dir, snapshotIndexName), store.db, manifest)
+	if err == nil {
+		// 索引导出中的checkpoint可能落后于快照时的位置
+		err = store.SaveCheckpoint(&checkpoint{lastFileSeq: manifest.FileSeq, lastFileSize: manifest.Offset}, true)
+	}
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fm, err := NewFileManagerWithOptions(fileStorePath, indexStorePath, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "open restored store failed")
+	}
+	stats.Fsck, err = fm.Fsck()
+	if closeErr := fm.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !stats.Fsck.Healthy() {
+		return stats, errors.Wrapf(utils.ErrInvalidSnapshot, "restored store has %d corrupt records and %d dangling indexes",
+			len(stats.Fsck.CorruptRecords), len(stats.Fsck.DanglingIndexes))
+	}
+	return stats, nil
+}
+
+// newSnapshotId 按时间排序的快照id
+func newSnapshotId() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z")
+}
+
+// linkOrCopyFile 为已经封存的文件创建硬链接，跨文件系统时复制，返回文件大小与sha256
+func linkOrCopyFile(src, dst string) (int64, string, error) {
+	if err := os.Link(src, dst); err != nil {
+		return copyFilePrefix(src, dst, -1)
+	}
+	file, err := os.Open(dst)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	size, err := io.Copy(digest, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// copyFilePrefix 复制src的前limit字节到dst并同步，limit为负数时复制整个文件，src不存在时视为空文件
+func copyFilePrefix(src, dst string, limit int64) (int64, string, error) {
+	var reader io.Reader = strings.NewReader("")
+	in, err := os.Open(src)
+	if err == nil {
+		defer in.Close()
+		reader = in
+	} else if !os.IsNotExist(err) {
+		return 0, "", err
+	}
+	if limit >= 0 {
+		reader = io.LimitReader(reader, limit)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, "", err
+	}
+	defer out.Close()
+	var digest hash.Hash = sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, digest), reader)
+	if err != nil {
+		return 0, "", err
+	}
+	if limit >= 0 && size != limit {
+		return 0, "", errors.Errorf("[%s] has %d bytes, expected at least %d", src, size, limit)
+	}
+	if err = out.Sync(); err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func writeFileSync(path string, content []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "create [%s] failed", path)
+	}
+	defer file.Close()
+	if _, err = file.Write(content); err != nil {
+		return errors.Wrapf(err, "write [%s] failed", path)
+	}
+	return errors.Wrapf(file.Sync(), "sync [%s] failed", path)
+}
+
+// syncDir 同步目录，保证其中新建或重命名的文件在崩溃后仍然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "open dir [%s] failed", dir)
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "sync dir [%s] failed", dir)
+}
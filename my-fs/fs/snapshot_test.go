@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"my-fs/utils"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// readAll 读取bucket中所有chunk的内容
+func readAll(t *testing.T, fm *FileManager, bucket string) map[string]string {
+	indexes, err := fm.List(bucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, index := range indexes {
+		data, err := fm.ReadWithOptions(index.BlockId, &ReadOptions{Bucket: bucket})
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[index.BlockId] = string(data)
+	}
+	return contents
+}
+
+func TestFileManager_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "snapshots")
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"), &Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	for i := 0; i < 20; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("key-%02d", i), []byte(fmt.Sprintf("first-%02d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full, err := fm.Snapshot(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Parent != "" || len(full.Segments) < 2 || full.CopiedBytes == 0 {
+		t.Fatalf("unexpected full snapshot %+v", full)
+	}
+
+	// 覆盖一半的key，基础快照中已经封存的文件被引用，不再保存
+	for i := 0; i < 10; i++ {
+		if _, err = fm.WriteWithKey(fmt.Sprintf("key-%02d", i), []byte(fmt.Sprintf("second-%02d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	incremental, err := fm.Snapshot(root, &SnapshotOptions{Since: full.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readAll(t, fm, DefaultBucket)
+	var reused *SnapshotSegment
+	for i, segment := range incremental.Segments {
+		if segment.Snapshot == full.Id {
+			reused = &incremental.Segments[i]
+		}
+	}
+	if incremental.Parent != full.Id || reused == nil {
+		t.Fatalf("incremental snapshot should reuse the sealed segments of its parent: %+v", incremental)
+	}
+	// 压缩会删除已经封存的文件，之后的增量快照只包含搬迁之后的文件
+	if _, err = fm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := fm.Snapshot(root, &SnapshotOptions{Since: incremental.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 快照之后的写入不应该出现在恢复的存储中
+	if _, err = fm.WriteWithKey("late", []byte("late"), nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := ListSnapshots(root)
+	if err != nil || len(snapshots) != 3 || snapshots[2].Id != compacted.Id {
+		t.Fatalf("unexpected snapshots %v, err %v", snapshots, err)
+	}
+
+	for _, manifest := range []*SnapshotManifest{incremental, compacted} {
+		restoreDir := t.TempDir()
+		stats, err := RestoreSnapshot(filepath.Join(root, manifest.Id), filepath.Join(restoreDir, "filestore"), filepath.Join(restoreDir, "indexstore"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Segments != len(manifest.Segments) || !stats.Fsck.Healthy() {
+			t.Fatalf("unexpected restore stats %+v", stats)
+		}
+		restored, err := NewFileManager(filepath.Join(restoreDir, "filestore"), filepath.Join(restoreDir, "indexstore"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readAll(t, restored, DefaultBucket)
+		restored.Close()
+		if len(got) != len(want) {
+			t.Fatalf("restored %d chunks from [%s], want %d", len(got), manifest.Id, len(want))
+		}
+		for id, data := range want {
+			if got[id] != data {
+				t.Fatalf("chunk [%s] restored as %q, want %q", id, got[id], data)
+			}
+		}
+		// 目标目录不为空
+		if _, err = RestoreSnapshot(filepath.Join(root, manifest.Id), filepath.Join(restoreDir, "filestore"), filepath.Join(dir, "other"), nil); err == nil {
+			t.Fatal("restore into a non-empty dir should fail")
+		}
+	}
+
+	// 损坏基础快照中的文件，引用该文件的增量快照也无法通过校验
+	if err = ioutil.WriteFile(reused.path(root), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{full.Id, incremental.Id} {
+		if _, err = VerifySnapshot(filepath.Join(root, id)); errors.Cause(err) != utils.ErrInvalidSnapshot {
+			t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+		}
+	}
+	restoreDir := t.TempDir()
+	if _, err = RestoreSnapshot(filepath.Join(root, incremental.Id), filepath.Join(restoreDir, "filestore"), filepath.Join(restoreDir, "indexstore"), nil); errors.Cause(err) != utils.ErrInvalidSnapshot {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+}
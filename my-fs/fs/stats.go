@@ -0,0 +1,254 @@
+package fs
+
+import (
+	"fmt"
+	pb "my-fs/proto"
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+// StorageStats 数据文件与索引的使用情况
+type StorageStats struct {
+	// 数据文件的数量
+	Segments int
+	// 仍然被索引或版本引用的记录占用的空间
+	LiveBytes int64
+	// 可以被压缩回收的空间，包括被覆盖、删除的记录以及删除标记
+	DeadBytes   int64
+	LiveRecords int
+	DeadRecords int
+	// 最新版本的索引数量
+	IndexEntries int64
+	// 版本记录的数量
+	VersionEntries int64
+	// 当前写入的文件序号以及偏移量
+	CheckpointFileSeq int
+	CheckpointOffset  int
+}
+
+// FsckReport 一致性检查的结果
+type FsckReport struct {
+	Segments int
+	Records  int
+	// 无法读取或解码的记录，格式为<文件名>@<偏移量>
+	CorruptRecords []string
+	// 检查的索引与版本数量
+	Indexes int
+	// 指向的记录不存在或者与记录不一致的索引，格式为<bucket>/<id>[@<版本号>]
+	DanglingIndexes []string
+}
+
+// Healthy 是否没有发现问题
+func (r *FsckReport) Healthy() bool {
+	return len(r.CorruptRecords) == 0 && len(r.DanglingIndexes) == 0
+}
+
+// Health 存储的健康状态
+type Health struct {
+	// 仍然可以读写，但是部分冗余已经丢失
+	Degraded bool
+	Reasons  []string
+}
+
+// indexScanner 可以遍历所有索引与版本的索引数据库
+type indexScanner interface {
+	scanIndexes(fn func(index *BlockIndex, version bool) error) error
+}
+
+// scanFunc 处理数据文件中(seq, offset)处长度为size的记录，chunkErr不为nil表示记录无法读取或解码
+type scanFunc func(seq int, offset int64, size int64, chunk *pb.Chunk, chunkErr error) error
+
+// scanSegments 依次读取所有数据文件中的记录，返回读取的文件数量
+// 无法读取长度的记录之后的数据会被跳过
+func (fm *FileManager) scanSegments(fn scanFunc) (int, error) {
+	// 防止读取过程中文件被压缩删除
+	fm.segmentMutx.RLock()
+	defer fm.segmentMutx.RUnlock()
+
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return 0, err
+	}
+	for i, seq := range seqs {
+		stream, err := fm.openSegmentStream(seq, 0)
+		if err != nil {
+			return i, err
+		}
+		err = fm.scanSegment(seq, stream, fn)
+		stream.close()
+		if err != nil {
+			return i + 1, err
+		}
+	}
+	return len(seqs), nil
+}
+
+func (fm *FileManager) scanSegment(seq int, stream segmentStream, fn scanFunc) error {
+	fm.mutx.Lock()
+	isCurrent := seq == fm.checkpoint.lastFileSeq
+	end := int64(fm.checkpoint.lastFileSize)
+	fm.mutx.Unlock()
+
+	for {
+		start := stream.offset()
+		// 当前文件只检查checkpoint之前的数据，之后可能是正在写入的记录
+		if isCurrent && start >= end {
+			return nil
+		}
+		chunkBytes, _, err := stream.nextChunkBytesAndPlacement()
+		if err == nil && chunkBytes == nil {
+			return nil
+		}
+		if err == utils.ErrUnexpectedEndOfFile && !isCurrent {
+			err = errors.Wrap(err, "incomplete record")
+		}
+		if err != nil {
+			return fn(seq, start, 0, nil, err)
+		}
+		chunk, err := fm.decodeChunk(chunkBytes)
+		if err = fn(seq, start, stream.offset()-start, chunk, err); err != nil {
+			return err
+		}
+	}
+}
+
+// StorageStats 统计数据文件中有效与可回收的空间，需要读取所有的数据文件
+func (fm *FileManager) StorageStats() (*StorageStats, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	fm.mutx.Lock()
+	stats := &StorageStats{
+		CheckpointFileSeq: fm.checkpoint.lastFileSeq,
+		CheckpointOffset:  fm.checkpoint.lastFileSize,
+	}
+	fm.mutx.Unlock()
+
+	var err error
+	stats.Segments, err = fm.scanSegments(func(seq int, offset, size int64, chunk *pb.Chunk, chunkErr error) error {
+		if chunkErr != nil {
+			stats.DeadBytes += size
+			stats.DeadRecords++
+			return nil
+		}
+		// 与压缩使用相同的规则，可回收的空间就是压缩之后会释放的空间
+		latest, version, err := fm.referencedIndexes(chunk, seq, offset)
+		if err != nil {
+			return err
+		}
+		if latest != nil || version != nil {
+			stats.LiveBytes += size
+			stats.LiveRecords++
+		} else {
+			stats.DeadBytes += size
+			stats.DeadRecords++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if scanner, ok := fm.indexStore.(indexScanner); ok {
+		err = scanner.scanIndexes(func(index *BlockIndex, version bool) error {
+			if version {
+				stats.VersionEntries++
+			} else {
+				stats.IndexEntries++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// recordInfo 一致性检查时记录的chunk信息，不保存数据
+type recordInfo struct {
+	bucket string
+	id     string
+}
+
+// Fsck 检查所有的记录是否可以解码，以及所有指向本节点的索引与版本是否指向对应的记录
+func (fm *FileManager) Fsck() (*FsckReport, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	report := &FsckReport{}
+	records := make(map[recordKey]*recordInfo)
+	var err error
+	report.Segments, err = fm.scanSegments(func(seq int, offset, size int64, chunk *pb.Chunk, chunkErr error) error {
+		report.Records++
+		if chunkErr != nil {
+			report.CorruptRecords = append(report.CorruptRecords,
+				fmt.Sprintf("%s@%d: %s", buildFileName(seq), offset, chunkErr))
+			return nil
+		}
+		records[recordKey{seq: seq, offset: uint64(offset)}] = &recordInfo{bucket: bucketOrDefault(chunk.Bucket), id: chunk.Id}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scanner, ok := fm.indexStore.(indexScanner)
+	if !ok {
+		return report, nil
+	}
+	err = scanner.scanIndexes(func(index *BlockIndex, version bool) error {
+		if index.Node != fm.opts.NodeId {
+			return nil
+		}
+		report.Indexes++
+		info, ok := records[recordKey{seq: index.FSeq, offset: index.Offset}]
+		if ok && info.id == index.BlockId && info.bucket == bucketOrDefault(index.Bucket) {
+			return nil
+		}
+		name := bucketOrDefault(index.Bucket) + "/" + index.BlockId
+		if version {
+			name += "@" + index.VersionId
+		}
+		report.DanglingIndexes = append(report.DanglingIndexes, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// FlushCheckpoint 将当前的checkpoint同步写入索引数据库，写入记录时checkpoint不会立即落盘
+func (fm *FileManager) FlushCheckpoint() error {
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	fm.mutx.Lock()
+	cp := *fm.checkpoint
+	fm.mutx.Unlock()
+	return fm.saveCheckpoint(&cp, true)
+}
+
+// Health 返回存储的健康状态，纠删码模式下有分片目录不可用时为降级状态
+func (fm *FileManager) Health() Health {
+	health := Health{}
+	if fm.erasure == nil {
+		return health
+	}
+	fm.writeMutx.Lock()
+	unavailable := 0
+	for _, file := range fm.erasure.files {
+		if file == nil {
+			unavailable++
+		}
+	}
+	fm.writeMutx.Unlock()
+	if unavailable > 0 {
+		health.Degraded = true
+		health.Reasons = append(health.Reasons,
+			fmt.Sprintf("%d of %d shard dirs are unavailable", unavailable, len(fm.erasure.dirs)))
+	}
+	return health
+}
@@ -0,0 +1,152 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileManager_StorageStats(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err = fm.CreateBucket("versioned", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.SetBucketVersioning("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 100)
+	if _, err = fm.WriteWithKey("a", payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("a", payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("b", payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	// 版本仍然被引用，删除标记也会被保留
+	if _, err = fm.WriteWithKey("doc", payload, &WriteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DeleteWithOptions("doc", &DeleteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := fm.StorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LiveRecords != 3 || stats.DeadRecords != 3 {
+		t.Fatalf("expect 3 live and 3 dead records, got %d and %d", stats.LiveRecords, stats.DeadRecords)
+	}
+	if stats.IndexEntries != 1 || stats.VersionEntries != 2 {
+		t.Fatalf("expect 1 index and 2 versions, got %d and %d", stats.IndexEntries, stats.VersionEntries)
+	}
+	seqs, _ := fm.listSegments()
+	var total int64
+	for _, seq := range seqs {
+		size, _ := fm.segmentSize(seq)
+		total += size
+	}
+	if stats.Segments != len(seqs) || stats.LiveBytes+stats.DeadBytes != total {
+		t.Fatalf("stats %+v do not match %d segments of %d bytes", stats, len(seqs), total)
+	}
+	if stats.CheckpointFileSeq != seqs[len(seqs)-1] || stats.CheckpointOffset <= 0 {
+		t.Fatalf("unexpected checkpoint %d/%d", stats.CheckpointFileSeq, stats.CheckpointOffset)
+	}
+
+	// 压缩之后不再有可回收的空间
+	if _, err = fm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = fm.StorageStats(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.DeadRecords != 0 || stats.LiveRecords != 3 {
+		t.Fatalf("expect only live records after compaction, got %+v", stats)
+	}
+}
+
+func TestFileManager_Fsck(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, indexStore := filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore")
+	fm, err := NewFileManagerWithOptions(fileStore, indexStore, &Options{MaxFileSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+
+	payload := make([]byte, 200)
+	first, err := fm.WriteWithKey("first", payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.WriteWithKey("second", payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	report, err := fm.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() || report.Records != 2 || report.Indexes != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// 破坏已经写满的文件中记录的长度，并添加一个指向不存在位置的索引
+	file, err := os.OpenFile(buildFilePath(fileStore, first.FSeq), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteAt([]byte{0xff, 0x7f}, int64(first.Offset)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err = fm.indexStore.SaveIndex(&BlockIndex{BlockId: "ghost", Bucket: DefaultBucket, FSeq: 99}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err = fm.Fsck(); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.CorruptRecords) != 1 {
+		t.Fatalf("expect 1 corrupt record, got %v", report.CorruptRecords)
+	}
+	if len(report.DanglingIndexes) != 2 {
+		t.Fatalf("expect first and ghost to be dangling, got %v", report.DanglingIndexes)
+	}
+}
+
+func TestFileManager_FlushCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if _, err = fm.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.FlushCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := fm.loadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cp != *fm.checkpoint {
+		t.Fatalf("expect flushed checkpoint %+v, got %+v", fm.checkpoint, cp)
+	}
+	if health := fm.Health(); health.Degraded {
+		t.Fatalf("expect healthy file manager, got %+v", health)
+	}
+}
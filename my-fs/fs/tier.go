@@ -0,0 +1,693 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"my-fs/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tierManifestName 数据目录中记录冷存储文件的manifest
+const tierManifestName = "tier_manifest.json"
+
+// 数据文件所在的位置
+const (
+	TierLocal  = "local"
+	TierRemote = "remote"
+)
+
+// TierStore 冷存储，保存从数据目录中移出的已封存数据文件，对象名为数据文件名
+// 多个节点共用一个存储时需要使用不同的前缀或目录
+type TierStore interface {
+	// Put 保存size字节的对象，已经存在时覆盖
+	Put(name string, r io.ReadSeeker, size int64) error
+	// Get 从offset开始读取对象
+	Get(name string, offset int64) (io.ReadCloser, error)
+	// Delete 删除对象，对象不存在时不返回错误
+	Delete(name string) error
+}
+
+// TieringOptions 冷热分层的配置，Store为nil时不分层，MinAge与ColdAfter满足任意一个的文件会被移出
+type TieringOptions struct {
+	Store TierStore
+	// 封存超过MinAge的文件被移到冷存储，0表示不按封存时间移动
+	MinAge time.Duration
+	// 超过ColdAfter没有被读取的文件被移到冷存储，0表示不按读取时间移动
+	ColdAfter time.Duration
+	// 后台检查的间隔，0表示只通过Tier手动移动
+	Interval time.Duration
+	// 本地缓存目录，不为空时冷存储中的文件先完整下载到该目录再读取，否则每次读取一条记录
+	CacheDir string
+	// 缓存目录的最大字节数，超过时删除最久没有读取的文件，0表示不限制
+	CacheBytes int64
+}
+
+// TieredSegment 已经移到冷存储的数据文件
+type TieredSegment struct {
+	Seq    int
+	Size   int64
+	SHA256 string
+	// 移出的时间，unix纳秒
+	TieredAt int64
+}
+
+// TierManifest 冷存储中的所有数据文件，保存在数据目录的tier_manifest.json中
+type TierManifest struct {
+	Segments []*TieredSegment
+}
+
+// SegmentLocation 数据文件所在的位置
+type SegmentLocation struct {
+	Seq  int
+	Size int64
+	// TierLocal或者TierRemote
+	Tier string
+	// 冷存储中的文件是否已经缓存在本地
+	Cached   bool  `json:",omitempty"`
+	TieredAt int64 `json:",omitempty"`
+}
+
+// TierStats 一次分层移动的统计
+type TierStats struct {
+	Segments int
+	Bytes    int64
+}
+
+// tiering 冷存储中的文件以及本地文件最后一次读取的时间
+type tiering struct {
+	opts         TieringOptions
+	rootDir      string
+	manifestPath string
+	cache        *segmentCache // CacheDir为空时为nil
+	// 串行化Tier
+	runMutx sync.Mutex
+
+	mutx     sync.Mutex
+	segments map[int]*TieredSegment
+	lastRead map[int]time.Time
+	started  time.Time
+}
+
+// newTiering 读取manifest，上次移动文件之后没有删除的本地文件在这里删除
+func newTiering(rootDir string, opts TieringOptions) (*tiering, error) {
+	t := &tiering{
+		opts:         opts,
+		rootDir:      rootDir,
+		manifestPath: filepath.Join(rootDir, tierManifestName),
+		segments:     make(map[int]*TieredSegment),
+		lastRead:     make(map[int]time.Time),
+		started:      time.Now(),
+	}
+	content, err := ioutil.ReadFile(t.manifestPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read tier manifest [%s] failed", t.manifestPath)
+	}
+	if err == nil {
+		manifest := new(TierManifest)
+		if err = json.Unmarshal(content, manifest); err != nil {
+			return nil, errors.Wrapf(err, "parse tier manifest [%s] failed", t.manifestPath)
+		}
+		for _, segment := range manifest.Segments {
+			t.segments[segment.Seq] = segment
+		}
+	}
+	for seq := range t.segments {
+		path := buildFilePath(rootDir, seq)
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "remove tiered file [%s] failed", path)
+		}
+	}
+	if opts.CacheDir != "" {
+		if t.cache, err = newSegmentCache(opts.CacheDir, opts.CacheBytes, t.segments); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *tiering) segment(seq int) *TieredSegment {
+	t.mutx.Lock()
+	defer t.mutx.Unlock()
+	return t.segments[seq]
+}
+
+// touch 记录本地文件被读取的时间
+func (t *tiering) touch(seq int, now time.Time) {
+	t.mutx.Lock()
+	t.lastRead[seq] = now
+	t.mutx.Unlock()
+}
+
+// cold 检测本地文件是否满足移出的条件，启动之后没有读取过的文件按启动时间计算
+func (t *tiering) cold(seq int, modTime, now time.Time) bool {
+	if t.opts.MinAge > 0 && now.Sub(modTime) >= t.opts.MinAge {
+		return true
+	}
+	if t.opts.ColdAfter <= 0 {
+		return false
+	}
+	t.mutx.Lock()
+	lastRead, ok := t.lastRead[seq]
+	t.mutx.Unlock()
+	if !ok {
+		lastRead = t.started
+		if modTime.After(lastRead) {
+			lastRead = modTime
+		}
+	}
+	return now.Sub(lastRead) >= t.opts.ColdAfter
+}
+
+// saveManifest 写入临时文件后重命名，调用方需要持有mutx
+func (t *tiering) saveManifest() error {
+	manifest := &TierManifest{}
+	for _, segment := range t.segments {
+		manifest.Segments = append(manifest.Segments, segment)
+	}
+	sort.Slice(manifest.Segments, func(i, j int) bool {
+		return manifest.Segments[i].Seq < manifest.Segments[j].Seq
+	})
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal tier manifest failed")
+	}
+	tmpPath := t.manifestPath + ".tmp"
+	if err = writeFileSync(tmpPath, content); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, t.manifestPath); err != nil {
+		return errors.Wrap(err, "rename tier manifest failed")
+	}
+	return syncDir(t.rootDir)
+}
+
+func (t *tiering) add(segment *TieredSegment) error {
+	t.mutx.Lock()
+	defer t.mutx.Unlock()
+	t.segments[segment.Seq] = segment
+	delete(t.lastRead, segment.Seq)
+	if err := t.saveManifest(); err != nil {
+		delete(t.segments, segment.Seq)
+		return err
+	}
+	return nil
+}
+
+// remove 删除冷存储中的文件，先删除对象，失败时manifest中仍然保留该文件
+func (t *tiering) remove(seq int) error {
+	if err := t.opts.Store.Delete(buildFileName(seq)); err != nil {
+		return errors.Wrapf(err, "delete tiered file [%s] failed", buildFileName(seq))
+	}
+	if t.cache != nil {
+		t.cache.remove(seq)
+	}
+	t.mutx.Lock()
+	defer t.mutx.Unlock()
+	segment := t.segments[seq]
+	delete(t.segments, seq)
+	if err := t.saveManifest(); err != nil {
+		t.segments[seq] = segment
+		return err
+	}
+	return nil
+}
+
+// mergeSeqs 将冷存储中的文件序号合并到本地文件的序号中，从小到大排序
+func (t *tiering) mergeSeqs(local []int) []int {
+	t.mutx.Lock()
+	defer t.mutx.Unlock()
+	seqs := append([]int(nil), local...)
+	for seq := range t.segments {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+// download 将冷存储中的文件写入w，并检查大小与sha256
+func (t *tiering) download(segment *TieredSegment, w io.Writer) error {
+	name := buildFileName(segment.Seq)
+	body, err := t.opts.Store.Get(name, 0)
+	if err != nil {
+		return errors.Wrapf(err, "get tiered file [%s] failed", name)
+	}
+	defer body.Close()
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, digest), body)
+	if err != nil {
+		return errors.Wrapf(err, "download tiered file [%s] failed", name)
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); size != segment.Size || sum != segment.SHA256 {
+		return errors.Errorf("tiered file [%s] has %d bytes with sha256 %s, expected %d bytes with sha256 %s",
+			name, size, sum, segment.Size, segment.SHA256)
+	}
+	return nil
+}
+
+// copyTo 将冷存储中的文件下载到dst并同步，返回文件大小与sha256
+func (t *tiering) copyTo(segment *TieredSegment, dst string) (int64, string, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	if err = t.download(segment, file); err != nil {
+		return 0, "", err
+	}
+	if err = file.Sync(); err != nil {
+		return 0, "", err
+	}
+	return segment.Size, segment.SHA256, nil
+}
+
+// open 打开冷存储中的文件，没有配置缓存时下载到数据目录中的临时文件，关闭后自动删除
+func (t *tiering) open(segment *TieredSegment) (*os.File, error) {
+	if t.cache != nil {
+		return t.cache.open(segment, t.download)
+	}
+	file, err := ioutil.TempFile(t.rootDir, "tier-download-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp file failed")
+	}
+	// 文件打开期间仍然可以读取，进程退出后不会留下临时文件
+	if err = os.Remove(file.Name()); err == nil {
+		if err = t.download(segment, file); err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// readRecord 从冷存储中offset处读取一条记录，只下载该记录之后的数据
+func (t *tiering) readRecord(segment *TieredSegment, offset int64) ([]byte, error) {
+	if offset >= segment.Size {
+		return nil, utils.ErrUnexpectedEndOfFile
+	}
+	body, err := t.opts.Store.Get(buildFileName(segment.Seq), offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get tiered file [%s] failed", buildFileName(segment.Seq))
+	}
+	defer body.Close()
+	reader := bufio.NewReader(body)
+	recordLen, err := binary.ReadUvarint(reader)
+	if err != nil || offset+int64(recordLen) > segment.Size {
+		return nil, utils.ErrUnexpectedEndOfFile
+	}
+	record := make([]byte, recordLen)
+	if _, err = io.ReadFull(reader, record); err != nil {
+		return nil, utils.ErrUnexpectedEndOfFile
+	}
+	return record, nil
+}
+
+// tieredSegment 返回冷存储中的文件，文件在本地或者没有开启分层时返回nil
+func (fm *FileManager) tieredSegment(seq int) *TieredSegment {
+	if fm.tiering == nil {
+		return nil
+	}
+	return fm.tiering.segment(seq)
+}
+
+// statSegment 返回数据文件是否存在以及大小，包括冷存储中的文件
+func (fm *FileManager) statSegment(seq int) (bool, int64, error) {
+	if segment := fm.tieredSegment(seq); segment != nil {
+		return true, segment.Size, nil
+	}
+	return fileExists(buildFilePath(fm.rootDir, seq))
+}
+
+// openSegmentFile 打开数据文件，冷存储中的文件先下载到本地
+func (fm *FileManager) openSegmentFile(seq int) (*os.File, error) {
+	if segment := fm.tieredSegment(seq); segment != nil {
+		return fm.tiering.open(segment)
+	}
+	filePath := buildFilePath(fm.rootDir, seq)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file [%s] failed", filePath)
+	}
+	return file, nil
+}
+
+// openFileStream 从数据文件的offset处开始顺序读取
+func (fm *FileManager) openFileStream(seq int, offset int64) (*fileStream, error) {
+	file, err := fm.openSegmentFile(seq)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStreamFromFile(file, seq, offset)
+}
+
+// readLocalRecord 读取非纠删码模式下的一条记录，没有缓存时冷存储中的记录直接从冷存储读取
+func (fm *FileManager) readLocalRecord(seq int, offset int64) ([]byte, error) {
+	if fm.tiering != nil {
+		segment := fm.tiering.segment(seq)
+		if segment == nil {
+			fm.tiering.touch(seq, time.Now())
+		} else if fm.tiering.cache == nil {
+			return fm.tiering.readRecord(segment, offset)
+		}
+	}
+	stream, err := fm.openFileStream(seq, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.close()
+	chunkBytes, err := stream.scanForNextChunk()
+	if err == nil && chunkBytes == nil {
+		err = utils.ErrUnexpectedEndOfFile
+	}
+	return chunkBytes, err
+}
+
+// Tier 将满足TieringOptions条件的已封存数据文件移到冷存储，之后读取时从冷存储获取
+// 上传并校验之后才记录到manifest并删除本地文件，中途失败时本地文件保持不变
+func (fm *FileManager) Tier() (*TierStats, error) {
+	if fm.tiering == nil {
+		return nil, errors.New("tiering is not configured")
+	}
+	if err := fm.checkOpen(); err != nil {
+		return nil, err
+	}
+	fm.tiering.runMutx.Lock()
+	defer fm.tiering.runMutx.Unlock()
+
+	seqs, err := listFileSeqs(fm.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	fm.writeMutx.Lock()
+	lastFileSeq := fm.checkpoint.lastFileSeq
+	fm.writeMutx.Unlock()
+
+	stats := &TierStats{}
+	now := time.Now()
+	for _, seq := range seqs {
+		if seq >= lastFileSeq {
+			break
+		}
+		info, err := os.Stat(buildFilePath(fm.rootDir, seq))
+		if os.IsNotExist(err) {
+			// 刚刚被压缩删除
+			continue
+		}
+		if err != nil {
+			return stats, errors.Wrapf(err, "stat file [%s] failed", buildFileName(seq))
+		}
+		if !fm.tiering.cold(seq, info.ModTime(), now) {
+			continue
+		}
+		moved, err := fm.tierSegment(seq)
+		if err != nil {
+			return stats, errors.Wrapf(err, "tier file [%s] failed", buildFileName(seq))
+		}
+		if moved != nil {
+			stats.Segments++
+			stats.Bytes += moved.Size
+		}
+	}
+	if stats.Segments > 0 {
+		log.Printf("tiered %d files, %d bytes", stats.Segments, stats.Bytes)
+	}
+	return stats, nil
+}
+
+// tierSegment 上传seq对应的本地文件，确认上传的内容完整之后删除本地文件，文件已经被压缩删除时返回nil
+func (fm *FileManager) tierSegment(seq int) (*TieredSegment, error) {
+	name := buildFileName(seq)
+	filePath := buildFilePath(fm.rootDir, seq)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file [%s] failed", filePath)
+	}
+	defer file.Close()
+	digest := sha256.New()
+	size, err := io.Copy(digest, file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file [%s] failed", filePath)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	segment := &TieredSegment{Seq: seq, Size: size, SHA256: hex.EncodeToString(digest.Sum(nil))}
+	if err = fm.tiering.opts.Store.Put(name, file, size); err != nil {
+		return nil, errors.Wrapf(err, "upload file [%s] failed", name)
+	}
+	if err = fm.tiering.download(segment, ioutil.Discard); err != nil {
+		return nil, err
+	}
+
+	// 更新manifest与删除本地文件之间不能有读取，否则可能找不到文件
+	fm.segmentMutx.Lock()
+	defer fm.segmentMutx.Unlock()
+	// 上传期间文件可能被压缩删除
+	if exists, _, err := fileExists(filePath); err != nil || !exists {
+		if deleteErr := fm.tiering.opts.Store.Delete(name); deleteErr != nil {
+			log.Printf("delete tiered file [%s] failed, err=%s", name, deleteErr)
+		}
+		return nil, err
+	}
+	segment.TieredAt = time.Now().UnixNano()
+	if err = fm.tiering.add(segment); err != nil {
+		return nil, err
+	}
+	// 删除失败时重启后根据manifest删除
+	if err = os.Remove(filePath); err != nil {
+		return nil, errors.Wrapf(err, "remove file [%s] failed", filePath)
+	}
+	return segment, nil
+}
+
+// SegmentLocations 返回所有数据文件所在的位置，从小到大排序
+func (fm *FileManager) SegmentLocations() ([]*SegmentLocation, error) {
+	seqs, err := fm.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	fm.segmentMutx.RLock()
+	defer fm.segmentMutx.RUnlock()
+	locations := make([]*SegmentLocation, 0, len(seqs))
+	for _, seq := range seqs {
+		if segment := fm.tieredSegment(seq); segment != nil {
+			locations = append(locations, &SegmentLocation{
+				Seq:      seq,
+				Size:     segment.Size,
+				Tier:     TierRemote,
+				Cached:   fm.tiering.cache != nil && fm.tiering.cache.contains(seq),
+				TieredAt: segment.TieredAt,
+			})
+			continue
+		}
+		size, err := fm.segmentSize(seq)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, &SegmentLocation{Seq: seq, Size: size, Tier: TierLocal})
+	}
+	return locations, nil
+}
+
+// tierLoop 定期将满足条件的文件移到冷存储
+func (fm *FileManager) tierLoop(ctx context.Context) {
+	ticker := time.NewTicker(fm.opts.Tiering.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := fm.Tier(); err != nil && errors.Cause(err) != utils.ErrClosed {
+				log.Printf("tier files failed, err=%s", err)
+			}
+		}
+	}
+}
+
+// segmentCache 冷存储中的文件在本地的完整缓存，超过maxBytes时删除最久没有读取的文件
+type segmentCache struct {
+	dir      string
+	maxBytes int64
+
+	mutx    sync.Mutex
+	entries map[int]*cachedSegment
+	size    int64
+	// 读取的次序，用于找到最久没有读取的文件
+	tick uint64
+	// 正在下载的文件，下载完成后关闭channel
+	loading map[int]chan struct{}
+}
+
+type cachedSegment struct {
+	size     int64
+	lastUsed uint64
+}
+
+// newSegmentCache 保留目录中大小与manifest一致的文件，删除其他文件
+func newSegmentCache(dir string, maxBytes int64, segments map[int]*TieredSegment) (*segmentCache, error) {
+	if _, err := createDirIfMissing(dir); err != nil {
+		return nil, errors.Wrapf(err, "create tier cache dir [%s] failed", dir)
+	}
+	c := &segmentCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[int]*cachedSegment),
+		loading:  make(map[int]chan struct{}),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read tier cache dir [%s] failed", dir)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if seq, ok := parseFileSeq(info.Name()); ok {
+			if segment, ok := segments[seq]; ok && segment.Size == info.Size() {
+				c.entries[seq] = &cachedSegment{size: info.Size()}
+				c.size += info.Size()
+				continue
+			}
+		}
+		if err = os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return nil, errors.Wrapf(err, "remove stale cache file [%s] failed", info.Name())
+		}
+	}
+	c.evict(-1)
+	return c, nil
+}
+
+// parseFileSeq 解析数据文件名中的序号
+func parseFileSeq(name string) (int, bool) {
+	seq, err := strconv.Atoi(strings.TrimPrefix(name, filePrefix))
+	return seq, err == nil && buildFileName(seq) == name
+}
+
+func (c *segmentCache) path(seq int) string {
+	return filepath.Join(c.dir, buildFileName(seq))
+}
+
+func (c *segmentCache) contains(seq int) bool {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	_, ok := c.entries[seq]
+	return ok
+}
+
+// open 打开缓存中的文件，不存在时通过fetch下载，同一个文件同时只下载一次
+func (c *segmentCache) open(segment *TieredSegment, fetch func(*TieredSegment, io.Writer) error) (*os.File, error) {
+	seq := segment.Seq
+	c.mutx.Lock()
+	for {
+		loading, ok := c.loading[seq]
+		if !ok {
+			break
+		}
+		c.mutx.Unlock()
+		<-loading
+		c.mutx.Lock()
+	}
+	if entry, ok := c.entries[seq]; ok {
+		c.tick++
+		entry.lastUsed = c.tick
+		// 缓存文件被删除或者淘汰之后，已经打开的文件仍然可以读取
+		file, err := os.Open(c.path(seq))
+		if err == nil {
+			c.mutx.Unlock()
+			return file, nil
+		}
+		c.size -= entry.size
+		delete(c.entries, seq)
+	}
+	loading := make(chan struct{})
+	c.loading[seq] = loading
+	c.mutx.Unlock()
+
+	file, err := c.load(segment, fetch)
+
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	delete(c.loading, seq)
+	close(loading)
+	if err != nil {
+		return nil, err
+	}
+	c.tick++
+	c.entries[seq] = &cachedSegment{size: segment.Size, lastUsed: c.tick}
+	c.size += segment.Size
+	c.evict(seq)
+	return file, nil
+}
+
+// load 下载到临时文件，校验通过后重命名为缓存文件
+func (c *segmentCache) load(segment *TieredSegment, fetch func(*TieredSegment, io.Writer) error) (*os.File, error) {
+	path := c.path(segment.Seq)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create cache file [%s] failed", tmpPath)
+	}
+	if err = fetch(segment, file); err == nil {
+		if err = os.Rename(tmpPath, path); err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return file, nil
+}
+
+// evict 删除最久没有读取的文件直到不超过maxBytes，keep为刚刚下载的文件，不会被删除
+func (c *segmentCache) evict(keep int) {
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		victim := -1
+		for seq, entry := range c.entries {
+			if seq != keep && (victim < 0 || entry.lastUsed < c.entries[victim].lastUsed) {
+				victim = seq
+			}
+		}
+		if victim < 0 {
+			return
+		}
+		c.removeLocked(victim)
+	}
+}
+
+func (c *segmentCache) remove(seq int) {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	c.removeLocked(seq)
+}
+
+func (c *segmentCache) removeLocked(seq int) {
+	entry, ok := c.entries[seq]
+	if !ok {
+		return
+	}
+	if err := os.Remove(c.path(seq)); err != nil && !os.IsNotExist(err) {
+		log.Printf("remove cache file [%s] failed, err=%s", c.path(seq), err)
+	}
+	c.size -= entry.size
+	delete(c.entries, seq)
+}
@@ -0,0 +1,243 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"my-fs/tier"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTieredFileManager 每个文件只能保存少量chunk，方便产生多个已封存的文件
+func newTieredFileManager(t *testing.T, dir string, tiering TieringOptions) *FileManager {
+	t.Helper()
+	if tiering.Store == nil {
+		store, err := tier.NewDirStore(filepath.Join(dir, "cold"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiering.Store = store
+	}
+	fm, err := NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&Options{MaxFileSize: 272, Tiering: tiering})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fm
+}
+
+// writeTierData 写入跨越多个文件的chunk，返回每个key的数据
+func writeTierData(t *testing.T, fm *FileManager, n int) map[string][]byte {
+	t.Helper()
+	data := make(map[string][]byte)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		data[key] = bytes.Repeat([]byte{byte('a' + i%26)}, 100)
+		if _, err := fm.WriteWithKey(key, data[key], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+func checkTierData(t *testing.T, fm *FileManager, data map[string][]byte) {
+	t.Helper()
+	for key, expect := range data {
+		got, err := fm.Read(key)
+		if err != nil || !bytes.Equal(got, expect) {
+			t.Fatalf("read %s failed, err %v", key, err)
+		}
+	}
+}
+
+func countTiers(t *testing.T, fm *FileManager) (int, int) {
+	t.Helper()
+	locations, err := fm.SegmentLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var local, remote int
+	for _, location := range locations {
+		if location.Tier == TierRemote {
+			remote++
+		} else {
+			local++
+		}
+	}
+	return local, remote
+}
+
+func TestFileManager_Tiering(t *testing.T) {
+	dir := t.TempDir()
+	fm := newTieredFileManager(t, dir, TieringOptions{MinAge: time.Nanosecond})
+	data := writeTierData(t, fm, 10)
+	// 文件序号从1开始，lastFileSeq是正在写入的文件
+	sealed := fm.checkpoint.lastFileSeq - 1
+	if sealed < 2 {
+		t.Fatalf("expect several sealed files, got %d", sealed)
+	}
+
+	stats, err := fm.Tier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segments != sealed {
+		t.Fatalf("expect %d files to be tiered, got %+v", sealed, stats)
+	}
+	// 当前写入的文件不会被移出
+	if local, remote := countTiers(t, fm); local != 1 || remote != sealed {
+		t.Fatalf("expect 1 local and %d remote files, got %d and %d", sealed, local, remote)
+	}
+	if exists, _, _ := fileExists(buildFilePath(fm.rootDir, 1)); exists {
+		t.Fatal("tiered file should be removed from the data dir")
+	}
+	checkTierData(t, fm, data)
+	// 重建索引、复制与快照都可以读取冷存储中的文件
+	if _, err = fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := fm.ReadLog(LogPosition{}, 1<<20)
+	if err != nil || batch.Start.Seq != 1 || len(batch.Data) == 0 {
+		t.Fatalf("read log from a tiered file failed, batch %+v, err %v", batch, err)
+	}
+	manifest, err := fm.Snapshot(filepath.Join(dir, "snapshots"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Segments) != sealed+1 {
+		t.Fatalf("snapshot should contain all files, got %+v", manifest.Segments)
+	}
+	if _, err = VerifySnapshot(filepath.Join(dir, "snapshots", manifest.Id)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后根据manifest读取，移出之后没有删除的本地文件在启动时删除
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cold, err := ioutil.ReadFile(filepath.Join(dir, "cold", buildFileName(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "filestore", buildFileName(1)), cold, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fm = newTieredFileManager(t, dir, TieringOptions{MinAge: time.Nanosecond})
+	defer fm.Close()
+	if exists, _, _ := fileExists(buildFilePath(fm.rootDir, 1)); exists {
+		t.Fatal("leftover local copy should be removed at startup")
+	}
+	checkTierData(t, fm, data)
+
+	// 压缩同样处理冷存储中的文件，不再被引用的文件从冷存储中删除
+	for key := range data {
+		if err = fm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = fm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, remote := countTiers(t, fm); remote != 0 {
+		t.Fatalf("compacted files should be removed from the cold store, got %d", remote)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "cold", buildFileName(1))); !os.IsNotExist(err) {
+		t.Fatalf("cold object should be deleted, got %v", err)
+	}
+}
+
+func TestFileManager_TieringColdAfter(t *testing.T) {
+	fm := newTieredFileManager(t, t.TempDir(), TieringOptions{ColdAfter: time.Hour})
+	defer fm.Close()
+	data := writeTierData(t, fm, 10)
+	// 刚启动时所有文件都不冷
+	if stats, err := fm.Tier(); err != nil || stats.Segments != 0 {
+		t.Fatalf("no file should be cold yet, got %+v, err %v", stats, err)
+	}
+
+	// 模拟两小时之前启动并写入的文件
+	old := time.Now().Add(-2 * time.Hour)
+	fm.tiering.started = old
+	seqs, err := listFileSeqs(fm.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range seqs {
+		if err = os.Chtimes(buildFilePath(fm.rootDir, seq), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := fm.Stat("key-00", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.Read("key-00"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := fm.Tier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segments != fm.checkpoint.lastFileSeq-2 {
+		t.Fatalf("expect all sealed files except the one just read to be tiered, got %+v", stats)
+	}
+	if fm.tieredSegment(index.FSeq) != nil {
+		t.Fatal("recently read file should stay local")
+	}
+	checkTierData(t, fm, data)
+}
+
+func TestFileManager_TieringCache(t *testing.T) {
+	dir := t.TempDir()
+	fm := newTieredFileManager(t, dir, TieringOptions{
+		MinAge:     time.Nanosecond,
+		CacheDir:   filepath.Join(dir, "cache"),
+		CacheBytes: 300,
+	})
+	defer fm.Close()
+	data := writeTierData(t, fm, 10)
+	if _, err := fm.Tier(); err != nil {
+		t.Fatal(err)
+	}
+	checkTierData(t, fm, data)
+
+	// 缓存不超过CacheBytes，最近读取的文件保留在缓存中
+	if _, err := fm.Read("key-00"); err != nil {
+		t.Fatal(err)
+	}
+	index, _ := fm.Stat("key-00", nil)
+	locations, err := fm.SegmentLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range locations {
+		if location.Tier == TierRemote && location.Cached != (location.Seq == index.FSeq) {
+			t.Fatalf("only file %d should be cached, got %+v", index.FSeq, location)
+		}
+	}
+	if fm.tiering.cache.size > 300 {
+		t.Fatalf("cache size %d exceeds the limit", fm.tiering.cache.size)
+	}
+
+	// 下载的文件与manifest不一致时读取失败，不会进入缓存
+	last, _ := fm.Stat("key-09", nil)
+	var victim string
+	for key := range data {
+		if index, _ := fm.Stat(key, nil); index.FSeq != last.FSeq && !fm.tiering.cache.contains(index.FSeq) {
+			victim = key
+			if err = ioutil.WriteFile(filepath.Join(dir, "cold", buildFileName(index.FSeq)), []byte("corrupted"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if _, err = fm.Read(victim); err == nil {
+		t.Fatal("read of a corrupted cold file should fail")
+	}
+	if index, _ := fm.Stat(victim, nil); fm.tiering.cache.contains(index.FSeq) {
+		t.Fatal("corrupted file should not be cached")
+	}
+}
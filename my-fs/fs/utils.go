@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -74,4 +75,27 @@ func fileExists(filePath string) (bool, int64, error) {
 	}
 
 	return true, fileInfo.Size(), nil
-}
\ No newline at end of file
+}
+
+// listFileSeqs 获取所有数据文件的序号，从小到大排序
+func listFileSeqs(rootDir string) ([]int, error) {
+	fileInfos, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading dir %s", rootDir)
+	}
+
+	var seqs []int
+	for _, info := range fileInfos {
+		name := info.Name()
+		if info.IsDir() || !checkValidFileName(name) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimPrefix(name, filePrefix))
+		if err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
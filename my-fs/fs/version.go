@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"fmt"
+	pb "my-fs/proto"
+	"my-fs/utils"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetBucketVersioning 开启或关闭bucket的版本控制，关闭后已有的版本仍然保留
+func (fm *FileManager) SetBucketVersioning(name string, enabled bool) error {
+	if err := fm.checkWritable(); err != nil {
+		return err
+	}
+	fm.writeMutx.Lock()
+	defer fm.writeMutx.Unlock()
+
+	bucket, err := fm.indexStore.FetchBucket(name)
+	if err != nil {
+		return err
+	}
+	bucket.Versioning = enabled
+	return fm.indexStore.SaveBucket(bucket, true)
+}
+
+// ListVersions 列出id的所有版本，包括删除标记，最新的版本在前
+func (fm *FileManager) ListVersions(bucket, blockId string) ([]*BlockIndex, error) {
+	if err := fm.readBarrier(); err != nil {
+		return nil, err
+	}
+	if _, err := fm.indexStore.FetchBucket(bucket); err != nil {
+		return nil, err
+	}
+	versions, err := fm.indexStore.ListVersions(bucket, blockId)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// nextVersionId 生成按字典序单调递增的版本号，调用方需要持有writeMutx
+func (fm *FileManager) nextVersionId() string {
+	now := time.Now().UnixNano()
+	if now <= fm.lastVersionTime {
+		now = fm.lastVersionTime + 1
+	}
+	fm.lastVersionTime = now
+	return fmt.Sprintf("%016x%s", now, uuid.New().String()[:8])
+}
+
+// deleteVersion 永久删除一个版本，如果删除的是最新的版本，则由剩下的最新版本作为id的最新数据，调用方需要持有writeMutx
+func (fm *FileManager) deleteVersion(bucket *Bucket, blockId, versionId string) error {
+	version, err := fm.indexStore.FetchVersion(bucket.Name, blockId, versionId)
+	if err != nil {
+		return err
+	}
+	latest, err := fm.indexStore.FetchBucketIndex(bucket.Name, blockId)
+	if err != nil && err != utils.ErrIndexNotFound {
+		return err
+	}
+	versions, err := fm.indexStore.ListVersions(bucket.Name, blockId)
+	if err != nil {
+		return err
+	}
+	if _, err = fm.appendChunk(&pb.Chunk{
+		Id:        blockId,
+		Bucket:    bucket.Name,
+		Deleted:   true,
+		VersionId: versionId,
+		Purge:     true,
+	}); err != nil {
+		return err
+	}
+
+	batch := new(IndexBatch)
+	batch.DeleteVersion(bucket.Name, blockId, versionId)
+	if !version.DeleteMarker {
+		bucket.UsedBytes -= version.Size
+		bucket.ObjectCount--
+		owners := fm.newOwnerUsages()
+		if err = owners.add(version.Owner, -version.Size, -1); err != nil {
+			return err
+		}
+		owners.save(batch)
+	}
+	batch.PutBucket(bucket)
+	// 没有版本号的最新数据不受影响，否则重新计算最新的版本
+	if latest == nil || latest.VersionId != "" {
+		var newest *BlockIndex
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i].VersionId != versionId {
+				newest = versions[i]
+				break
+			}
+		}
+		if newest != nil && !newest.DeleteMarker {
+			batch.PutIndex(newest)
+		} else if latest != nil {
+			batch.DeleteIndex(bucket.Name, blockId)
+		}
+	}
+	return fm.indexStore.WriteBatch(batch, true)
+}
@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"my-fs/utils"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFileManager_Versioning(t *testing.T) {
+	fm := newTestFileManager(t)
+	if err := fm.CreateBucket("docs", BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.SetBucketVersioning("docs", true); err != nil {
+		t.Fatal(err)
+	}
+	opts := &WriteOptions{Bucket: "docs"}
+	v1, err := fm.WriteWithKey("readme", []byte("v1"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := fm.WriteWithKey("readme", []byte("v2"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.VersionId == "" || v1.VersionId >= v2.VersionId {
+		t.Fatalf("version ids should increase, got %s and %s", v1.VersionId, v2.VersionId)
+	}
+
+	data, err := fm.ReadWithOptions("readme", &ReadOptions{Bucket: "docs"})
+	if err != nil || string(data) != "v2" {
+		t.Fatalf("latest version should be v2, got %q, err=%v", data, err)
+	}
+	data, err = fm.ReadWithOptions("readme", &ReadOptions{Bucket: "docs", VersionId: v1.VersionId})
+	if err != nil || string(data) != "v1" {
+		t.Fatalf("old version should be v1, got %q, err=%v", data, err)
+	}
+
+	// 删除只会写入删除标记，旧版本仍然可以读取
+	if err = fm.DeleteWithOptions("readme", &DeleteOptions{Bucket: "docs"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.ReadWithOptions("readme", &ReadOptions{Bucket: "docs"}); err != utils.ErrIndexNotFound {
+		t.Fatalf("err should be ErrIndexNotFound, got %v", err)
+	}
+	versions, err := fm.ListVersions("docs", "readme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || !versions[0].DeleteMarker || versions[2].VersionId != v1.VersionId {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	_, err = fm.ReadWithOptions("readme", &ReadOptions{Bucket: "docs", VersionId: versions[0].VersionId})
+	if errors.Cause(err) != utils.ErrIndexNotFound {
+		t.Fatalf("reading a delete marker should fail, err=%v", err)
+	}
+
+	// 删除删除标记后，v2重新成为最新版本
+	if err = fm.DeleteWithOptions("readme", &DeleteOptions{Bucket: "docs", VersionId: versions[0].VersionId}); err != nil {
+		t.Fatal(err)
+	}
+	data, err = fm.ReadWithOptions("readme", &ReadOptions{Bucket: "docs"})
+	if err != nil || string(data) != "v2" {
+		t.Fatalf("latest version should be v2 again, got %q, err=%v", data, err)
+	}
+	if err = fm.DeleteWithOptions("readme", &DeleteOptions{Bucket: "docs", VersionId: v2.VersionId}); err != nil {
+		t.Fatal(err)
+	}
+	data, err = fm.ReadWithOptions("readme", &ReadOptions{Bucket: "docs"})
+	if err != nil || string(data) != "v1" {
+		t.Fatalf("latest version should fall back to v1, got %q, err=%v", data, err)
+	}
+
+	bucket, err := fm.GetBucket("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.ObjectCount != 1 || bucket.UsedBytes != 2 {
+		t.Fatalf("bucket should hold one version of 2 bytes, got %d objects and %d bytes", bucket.ObjectCount, bucket.UsedBytes)
+	}
+}
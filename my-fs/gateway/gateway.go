@@ -0,0 +1,373 @@
+// Package gateway 在my-fs之上提供S3兼容的http接口，bucket对应my-fs的bucket，
+// object的key即为chunk在bucket中的id
+package gateway
+
+import (
+	"encoding/xml"
+	"my-fs/auth"
+	myfs "my-fs/fs"
+	"my-fs/limits"
+	"my-fs/utils"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	// multipartBucket 用于暂存分段上传的分段数据，对S3客户端不可见
+	multipartBucket = "s3-multipart"
+	timeFormat      = "2006-01-02T15:04:05.000Z"
+
+	defaultUploadTTL      = 24 * time.Hour
+	defaultMaxUploadBytes = 5 << 30
+)
+
+// Options S3网关的认证与审计，与http接口使用相同的token与权限
+type Options struct {
+	// 为nil时不认证请求，所有请求都被允许
+	Authenticator auth.Authenticator
+	// 为nil时不记录审计日志
+	Audit *auth.AuditLog
+	// 为nil时不限制请求体大小与请求频率，请求体大小与每个ip的请求频率在认证之前检查
+	Limiter *limits.Limiter
+	// 分段上传在创建之后超过UploadTTL没有完成会被清理，为0时使用defaultUploadTTL
+	UploadTTL time.Duration
+	// 一次分段上传所有分段的字节数上限，合并时需要全部读入内存，为0时使用defaultMaxUploadBytes
+	MaxUploadBytes int64
+}
+
+type Gateway struct {
+	fs     *myfs.FileManager
+	engine *gin.Engine
+
+	mutx           sync.Mutex
+	uploads        map[string]*multipartUpload
+	uploadTTL      time.Duration
+	maxUploadBytes int64
+}
+
+// NewGateway 创建不认证请求的S3网关
+func NewGateway(fs *myfs.FileManager) (*Gateway, error) {
+	return NewGatewayWithOptions(fs, nil)
+}
+
+// NewGatewayWithOptions 创建S3网关，上一次运行中未完成的分段上传会被清理
+// 从节点只读，分段上传的bucket由主节点复制过来
+func NewGatewayWithOptions(fs *myfs.FileManager, opts *Options) (*Gateway, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if !fs.ReadOnly() {
+		if err := fs.DeleteBucket(multipartBucket, true); err != nil && errors.Cause(err) != utils.ErrBucketNotFound {
+			return nil, err
+		}
+		if err := fs.CreateBucket(multipartBucket, myfs.BucketQuota{}); err != nil {
+			return nil, err
+		}
+	}
+
+	g := &Gateway{
+		fs:             fs,
+		engine:         gin.New(),
+		uploads:        make(map[string]*multipartUpload),
+		uploadTTL:      opts.UploadTTL,
+		maxUploadBytes: opts.MaxUploadBytes,
+	}
+	if g.uploadTTL <= 0 {
+		g.uploadTTL = defaultUploadTTL
+	}
+	if g.maxUploadBytes <= 0 {
+		g.maxUploadBytes = defaultMaxUploadBytes
+	}
+	g.engine.Use(gin.Logger(), gin.Recovery())
+	if opts.Limiter != nil {
+		g.engine.Use(opts.Limiter.Middleware(limitError))
+	}
+	g.engine.Use(auth.MiddlewareWithErrorHandler(opts.Authenticator, opts.Audit, authError))
+	if opts.Limiter != nil {
+		g.engine.Use(opts.Limiter.TokenMiddleware(limitError))
+	}
+	g.engine.Any("/*path", g.dispatch)
+	return g, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.engine.ServeHTTP(w, r)
+}
+
+// Run 在addr上启动S3网关
+func (g *Gateway) Run(addr string) error {
+	return g.engine.Run(addr)
+}
+
+// dispatch 使用path-style的寻址方式，根据路径和参数分发请求
+func (g *Gateway) dispatch(ctx *gin.Context) {
+	path := strings.TrimPrefix(ctx.Param("path"), "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket == multipartBucket {
+		responseError(ctx, utils.ErrBucketNotFound)
+		return
+	}
+
+	method := ctx.Request.Method
+	if bucket != "" {
+		if msg, ok := auth.Authorize(ctx, bucket, requiredPermission(ctx.Request, key)); !ok {
+			authError(ctx, http.StatusForbidden, msg)
+			return
+		}
+	}
+	switch {
+	case bucket == "" && method == http.MethodGet:
+		g.listBuckets(ctx)
+	case bucket == "":
+		responseS3Error(ctx, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed")
+	case key == "":
+		g.dispatchBucket(ctx, bucket)
+	default:
+		g.dispatchObject(ctx, bucket, key)
+	}
+}
+
+// requiredPermission 请求需要的权限，与http接口相同，修改bucket配置需要admin权限
+func requiredPermission(r *http.Request, key string) auth.Permission {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return auth.PermRead
+	case http.MethodPut, http.MethodPost:
+		if key == "" {
+			return auth.PermAdmin
+		}
+		return auth.PermWrite
+	case http.MethodDelete:
+		if key == "" {
+			return auth.PermAdmin
+		}
+		// 取消分段上传只会删除还没有完成的分段
+		if r.URL.Query().Get("uploadId") != "" {
+			return auth.PermWrite
+		}
+		return auth.PermDelete
+	default:
+		return auth.PermAdmin
+	}
+}
+
+// writeOptions 与http接口相同，写入计入token的用量，并检查token的配额与写入速率
+// 分段上传的分段不计入，完成时写入的对象整体计入
+func writeOptions(ctx *gin.Context, bucket string) *myfs.WriteOptions {
+	opts := &myfs.WriteOptions{Bucket: bucket}
+	if token := auth.IdentityFrom(ctx).Token; token != nil {
+		opts.Owner = token.Id
+		opts.OwnerQuota = myfs.BucketQuota{
+			MaxBytes:          token.Quota.MaxBytes,
+			MaxObjects:        token.Quota.MaxObjects,
+			MaxBytesPerSecond: token.Quota.MaxBytesPerSecond,
+		}
+	}
+	return opts
+}
+
+func (g *Gateway) dispatchBucket(ctx *gin.Context, bucket string) {
+	if _, ok := ctx.GetQuery("versioning"); ok {
+		g.dispatchBucketVersioning(ctx, bucket)
+		return
+	}
+	switch ctx.Request.Method {
+	case http.MethodPut:
+		g.createBucket(ctx, bucket)
+	case http.MethodDelete:
+		g.deleteBucket(ctx, bucket)
+	case http.MethodHead:
+		g.headBucket(ctx, bucket)
+	case http.MethodGet:
+		g.listObjects(ctx, bucket)
+	default:
+		responseS3Error(ctx, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed")
+	}
+}
+
+func (g *Gateway) dispatchObject(ctx *gin.Context, bucket, key string) {
+	_, isInitiate := ctx.GetQuery("uploads")
+	uploadId := ctx.Query("uploadId")
+
+	switch method := ctx.Request.Method; {
+	case method == http.MethodPost && isInitiate:
+		g.createMultipartUpload(ctx, bucket, key)
+	case method == http.MethodPost && uploadId != "":
+		g.completeMultipartUpload(ctx, bucket, key, uploadId)
+	case method == http.MethodPut && uploadId != "":
+		g.uploadPart(ctx, bucket, key, uploadId)
+	case method == http.MethodDelete && uploadId != "":
+		g.abortMultipartUpload(ctx, bucket, key, uploadId)
+	case method == http.MethodPut:
+		g.putObject(ctx, bucket, key)
+	case method == http.MethodGet:
+		g.getObject(ctx, bucket, key, true)
+	case method == http.MethodHead:
+		g.getObject(ctx, bucket, key, false)
+	case method == http.MethodDelete:
+		g.deleteObject(ctx, bucket, key)
+	default:
+		responseS3Error(ctx, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed")
+	}
+}
+
+// dispatchBucketVersioning 处理GetBucketVersioning与PutBucketVersioning，Suspended等同于关闭版本控制
+func (g *Gateway) dispatchBucketVersioning(ctx *gin.Context, bucket string) {
+	switch ctx.Request.Method {
+	case http.MethodGet:
+		b, err := g.fs.GetBucket(bucket)
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		config := &versioningConfiguration{Xmlns: s3Namespace}
+		if b.Versioning {
+			config.Status = "Enabled"
+		}
+		responseXML(ctx, http.StatusOK, config)
+	case http.MethodPut:
+		config := new(versioningConfiguration)
+		if err := xml.NewDecoder(ctx.Request.Body).Decode(config); err != nil {
+			responseS3Error(ctx, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		if err := g.fs.SetBucketVersioning(bucket, config.Status == "Enabled"); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.Status(http.StatusOK)
+	default:
+		responseS3Error(ctx, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed")
+	}
+}
+
+func (g *Gateway) listBuckets(ctx *gin.Context) {
+	buckets, err := g.fs.ListBuckets()
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+	result := &listAllMyBucketsResult{Xmlns: s3Namespace, Owner: owner{ID: "myfs", DisplayName: "myfs"}}
+	// 与http接口相同，只列出有读取权限的bucket
+	identity := auth.IdentityFrom(ctx)
+	for _, bucket := range buckets {
+		if bucket.Name == multipartBucket || !identity.Allowed(bucket.Name, auth.PermRead) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, bucketEntry{
+			Name:         bucket.Name,
+			CreationDate: time.Unix(bucket.CreatedAt, 0).UTC().Format(timeFormat),
+		})
+	}
+	responseXML(ctx, http.StatusOK, result)
+}
+
+func (g *Gateway) createBucket(ctx *gin.Context, bucket string) {
+	if err := g.fs.CreateBucket(bucket, myfs.BucketQuota{}); err != nil {
+		responseError(ctx, err)
+		return
+	}
+	ctx.Header("Location", "/"+bucket)
+	ctx.Status(http.StatusOK)
+}
+
+func (g *Gateway) deleteBucket(ctx *gin.Context, bucket string) {
+	if err := g.fs.DeleteBucket(bucket, false); err != nil {
+		responseError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (g *Gateway) headBucket(ctx *gin.Context, bucket string) {
+	if _, err := g.fs.GetBucket(bucket); err != nil {
+		responseError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// responseError 将存储层的错误转换为S3的错误码
+func responseError(ctx *gin.Context, err error) {
+	switch errors.Cause(err) {
+	case utils.ErrIndexNotFound:
+		responseS3Error(ctx, http.StatusNotFound, "NoSuchKey", err.Error())
+	case utils.ErrBucketNotFound:
+		responseS3Error(ctx, http.StatusNotFound, "NoSuchBucket", err.Error())
+	case utils.ErrBucketExists:
+		responseS3Error(ctx, http.StatusConflict, "BucketAlreadyOwnedByYou", err.Error())
+	case utils.ErrBucketNotEmpty:
+		responseS3Error(ctx, http.StatusConflict, "BucketNotEmpty", err.Error())
+	case utils.ErrInvalidBucketName:
+		responseS3Error(ctx, http.StatusBadRequest, "InvalidBucketName", err.Error())
+	case utils.ErrKeyExists, utils.ErrPreconditionFailed:
+		responseS3Error(ctx, http.StatusPreconditionFailed, "PreconditionFailed", err.Error())
+	case utils.ErrQuotaExceeded:
+		responseS3Error(ctx, http.StatusInsufficientStorage, "QuotaExceeded", err.Error())
+	case utils.ErrRateLimited, utils.ErrTooManyRequests:
+		responseS3Error(ctx, http.StatusServiceUnavailable, "SlowDown", err.Error())
+	case utils.ErrBodyTooLarge:
+		responseS3Error(ctx, http.StatusRequestEntityTooLarge, "EntityTooLarge", err.Error())
+	case utils.ErrReadOnly:
+		responseS3Error(ctx, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+	case utils.ErrUnauthenticated:
+		responseS3Error(ctx, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+	default:
+		responseS3Error(ctx, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+// authError 认证失败与没有权限都按S3的方式返回403 AccessDenied，校验签名时请求体超过限制返回413
+func authError(ctx *gin.Context, status int, msg string) {
+	if status == http.StatusRequestEntityTooLarge {
+		responseS3Error(ctx, status, "EntityTooLarge", msg)
+	} else {
+		responseS3Error(ctx, http.StatusForbidden, "AccessDenied", msg)
+	}
+	ctx.Abort()
+}
+
+// limitError 请求体超过限制或请求过于频繁，S3客户端遇到SlowDown时会退避重试
+func limitError(ctx *gin.Context, status int, err error) {
+	responseError(ctx, err)
+}
+
+// bodyError 读取请求体失败，签名校验失败时返回403，超过大小限制时返回413
+func bodyError(ctx *gin.Context, err error) {
+	switch errors.Cause(err) {
+	case utils.ErrUnauthenticated, utils.ErrBodyTooLarge:
+		responseError(ctx, err)
+		return
+	}
+	responseS3Error(ctx, http.StatusBadRequest, "IncompleteBody", err.Error())
+}
+
+func responseS3Error(ctx *gin.Context, status int, code, message string) {
+	// HEAD请求的响应不能带有body
+	if ctx.Request.Method == http.MethodHead {
+		ctx.Status(status)
+		return
+	}
+	responseXML(ctx, status, &errorResponse{
+		Code:     code,
+		Message:  message,
+		Resource: ctx.Request.URL.Path,
+	})
+}
+
+func responseXML(ctx *gin.Context, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	ctx.Data(status, "application/xml", append([]byte(xml.Header), data...))
+}
@@ -0,0 +1,507 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"my-fs/auth"
+	myfs "my-fs/fs"
+	"my-fs/limits"
+	"my-fs/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+func newTestClient(t *testing.T) (*s3.S3, *session.Session) {
+	url, _ := newTestServer(t, nil)
+	return newS3Client(t, url, "test", "test")
+}
+
+// newTestServer 启动S3网关，返回网关的地址与使用的存储
+func newTestServer(t *testing.T, opts *Options) (string, *myfs.FileManager) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	fm, err := myfs.NewFileManager(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	g, err := NewGatewayWithOptions(fm, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	return server.URL, fm
+}
+
+func newS3Client(t *testing.T, url, accessKey, secretKey string) (*s3.S3, *session.Session) {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(url),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3.New(sess), sess
+}
+
+func assertErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	aerr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		t.Fatalf("err should be an aws request failure, got %v", err)
+	}
+	if aerr.Code() != code {
+		t.Fatalf("error code should be %s, got %s", code, aerr.Code())
+	}
+}
+
+func TestGateway_ObjectLifecycle(t *testing.T) {
+	client, _ := newTestClient(t)
+	if _, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("photos")}); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := client.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, bucket := range buckets.Buckets {
+		names = append(names, *bucket.Name)
+	}
+	if fmt.Sprint(names) != "[default photos]" {
+		t.Fatalf("buckets should be [default photos], got %v", names)
+	}
+
+	body := []byte("hello, s3")
+	put, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("2021/cat.jpg"),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("photos"), Key: aws.String("2021/cat.jpg")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *head.ContentLength != int64(len(body)) || *head.ETag != *put.ETag {
+		t.Fatalf("unexpected head result %v", head)
+	}
+
+	get, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2021/cat.jpg")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(get.Body)
+	get.Body.Close()
+	if !bytes.Equal(data, body) {
+		t.Fatalf("read %q, want %q", data, body)
+	}
+
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("missing")})
+	assertErrorCode(t, err, s3.ErrCodeNoSuchKey)
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("photos")})
+	assertErrorCode(t, err, "BucketNotEmpty")
+
+	if _, err = client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("2021/cat.jpg")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("photos"), Key: aws.String("2021/cat.jpg")})
+	assertErrorCode(t, err, "NotFound")
+	if _, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("photos")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateway_ListObjectsV2(t *testing.T) {
+	client, _ := newTestClient(t)
+	if _, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("logs")}); err != nil {
+		t.Fatal(err)
+	}
+	// a/下的key多于一次读取的数量，公共前缀跨越多页
+	for _, key := range []string{"a/1", "a/2", "a/3", "a/4", "a/5", "b/1", "c", "d"} {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("logs"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(key)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []string
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String("logs"),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(2),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, cp := range page.CommonPrefixes {
+			entries = append(entries, *cp.Prefix)
+		}
+		for _, object := range page.Contents {
+			entries = append(entries, *object.Key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(entries) != "[a/ b/ c d]" {
+		t.Fatalf("entries should be [a/ b/ c d], got %v", entries)
+	}
+
+	list, err := client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("logs"), Prefix: aws.String("a/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *list.KeyCount != 5 || *list.Contents[1].Key != "a/2" || *list.Contents[1].Size != 3 {
+		t.Fatalf("unexpected list result %v", list)
+	}
+}
+
+func TestGateway_MultipartUpload(t *testing.T) {
+	client, sess := newTestClient(t)
+	if _, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("backups")}); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 11*1024*1024)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s3manager.MinUploadPartSize
+	})
+	if _, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String("backups"),
+		Key:    aws.String("dump.bin"),
+		Body:   bytes.NewReader(body),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
+		d.PartSize = 4 * 1024 * 1024
+	})
+	buffer := aws.NewWriteAtBuffer(nil)
+	n, err := downloader.Download(buffer, &s3.GetObjectInput{Bucket: aws.String("backups"), Key: aws.String("dump.bin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(body)) || !bytes.Equal(buffer.Bytes(), body) {
+		t.Fatal("downloaded object is not equal to the uploaded one")
+	}
+
+	create, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String("backups"),
+		Key:    aws.String("aborted.bin"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String("backups"),
+		Key:      aws.String("aborted.bin"),
+		UploadId: create.UploadId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String("backups"),
+		Key:        aws.String("aborted.bin"),
+		UploadId:   create.UploadId,
+		PartNumber: aws.Int64(1),
+		Body:       bytes.NewReader([]byte("late part")),
+	})
+	assertErrorCode(t, err, s3.ErrCodeNoSuchUpload)
+}
+
+func TestGateway_Versioning(t *testing.T) {
+	client, _ := newTestClient(t)
+	bucket := aws.String("history")
+	if _, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: bucket}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket:                  bucket,
+		VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := client.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String("k"), Body: bytes.NewReader([]byte("one"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String("k"), Body: bytes.NewReader([]byte("two"))}); err != nil {
+		t.Fatal(err)
+	}
+	get, err := client.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("k"), VersionId: v1.VersionId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(get.Body)
+	get.Body.Close()
+	if string(data) != "one" || *get.VersionId != *v1.VersionId {
+		t.Fatalf("read %q from version %s, want one", data, *get.VersionId)
+	}
+}
+
+// TestGateway_Auth S3网关与http接口使用相同的token与权限，access key为token的id，secret key为token的secret
+func TestGateway_Auth(t *testing.T) {
+	tokens, err := auth.NewTokenStore([]*auth.Token{
+		{Id: "admin", Secret: "admin-secret", Grants: []auth.Grant{{Bucket: auth.AllBuckets, Permissions: []auth.Permission{auth.PermAdmin}}}},
+		{Id: "reader", Secret: "reader-secret", Grants: []auth.Grant{{Bucket: "photos", Permissions: []auth.Permission{auth.PermRead}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditBuf := new(bytes.Buffer)
+	url, _ := newTestServer(t, &Options{Authenticator: auth.NewAuthenticator(tokens), Audit: auth.NewAuditLog(auditBuf)})
+
+	// 没有签名的请求被拒绝
+	resp, err := http.Get(url + "/photos/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unauthenticated request should be forbidden, got %d", resp.StatusCode)
+	}
+	wrong, _ := newS3Client(t, url, "admin", "wrong-secret")
+	if _, err = wrong.ListBuckets(&s3.ListBucketsInput{}); err == nil {
+		t.Fatal("request signed with a wrong secret should be rejected")
+	}
+	assertErrorCode(t, err, "AccessDenied")
+
+	admin, _ := newS3Client(t, url, "admin", "admin-secret")
+	for _, bucket := range []string{"photos", "logs"} {
+		if _, err = admin.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = admin.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("dir/a b.txt"),
+		Body:   bytes.NewReader([]byte("hello")),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _ := newS3Client(t, url, "reader", "reader-secret")
+	out, err := reader.GetObject(&s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("dir/a b.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, err %v", data, err)
+	}
+	buckets, err := reader.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets.Buckets) != 1 || *buckets.Buckets[0].Name != "photos" {
+		t.Fatalf("reader should only see photos, got %v", buckets.Buckets)
+	}
+	_, err = reader.PutObject(&s3.PutObjectInput{Bucket: aws.String("photos"), Key: aws.String("b"), Body: bytes.NewReader([]byte("x"))})
+	assertErrorCode(t, err, "AccessDenied")
+	_, err = reader.GetObject(&s3.GetObjectInput{Bucket: aws.String("logs"), Key: aws.String("a")})
+	assertErrorCode(t, err, "AccessDenied")
+	_, err = reader.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("dir/a b.txt")})
+	assertErrorCode(t, err, "AccessDenied")
+
+	if !strings.Contains(auditBuf.String(), `"identity":"reader","auth_method":"sigv4"`) ||
+		!strings.Contains(auditBuf.String(), "permission write on bucket photos is denied") {
+		t.Fatalf("requests should be audited, got %s", auditBuf)
+	}
+}
+
+// TestGateway_Limits 请求体大小与请求频率与http接口使用相同的限制
+func TestGateway_Limits(t *testing.T) {
+	limiter := limits.New(limits.Rule{MaxBodyBytes: 16, RequestsPerSecond: 1, Burst: 2}, nil, nil)
+	url, _ := newTestServer(t, &Options{Limiter: limiter})
+	client, _ := newS3Client(t, url, "test", "test")
+	if _, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("photos")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("large"),
+		Body:   bytes.NewReader(make([]byte, 17)),
+	})
+	assertErrorCode(t, err, "EntityTooLarge")
+	if _, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("small"),
+		Body:   bytes.NewReader(make([]byte, 16)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("photos")})
+	if aerr, ok := err.(awserr.RequestFailure); !ok || aerr.StatusCode() != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503 SlowDown after the burst, got %v", err)
+	}
+}
+
+// TestGateway_OwnerQuota 通过S3网关的写入计入token的用量并受token的配额限制
+func TestGateway_OwnerQuota(t *testing.T) {
+	tokens, err := auth.NewTokenStore([]*auth.Token{
+		{Id: "writer", Secret: "writer-secret", Grants: []auth.Grant{{Bucket: auth.AllBuckets, Permissions: []auth.Permission{auth.PermAdmin}}},
+			Quota: auth.Quota{MaxBytes: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, fm := newTestServer(t, &Options{Authenticator: auth.NewAuthenticator(tokens)})
+	client, sess := newS3Client(t, url, "writer", "writer-secret")
+	if _, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("photos")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("a"),
+		Body:   bytes.NewReader([]byte("hello")),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := fm.GetOwnerUsage("writer")
+	if err != nil || usage.UsedBytes != 5 || usage.ObjectCount != 1 {
+		t.Fatalf("put object should be counted for the token, got %+v, err %v", usage, err)
+	}
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("b"),
+		Body:   bytes.NewReader([]byte("world!")),
+	})
+	assertErrorCode(t, err, "QuotaExceeded")
+
+	// 完成分段上传时写入的对象同样计入
+	_, err = s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s3manager.MinUploadPartSize
+	}).Upload(&s3manager.UploadInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("large"),
+		Body:   bytes.NewReader(make([]byte, s3manager.MinUploadPartSize+1)),
+	})
+	if err == nil || !strings.Contains(err.Error(), "QuotaExceeded") {
+		t.Fatalf("multipart upload over the quota should fail, got %v", err)
+	}
+}
+
+// TestGateway_MultipartQuota 分段计入token的用量，超过目标bucket配额的分段在上传时被拒绝
+func TestGateway_MultipartQuota(t *testing.T) {
+	tokens, err := auth.NewTokenStore([]*auth.Token{
+		{Id: "writer", Secret: "writer-secret", Grants: []auth.Grant{{Bucket: auth.AllBuckets, Permissions: []auth.Permission{auth.PermAdmin}}},
+			Quota: auth.Quota{MaxBytes: 100}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, fm := newTestServer(t, &Options{Authenticator: auth.NewAuthenticator(tokens)})
+	client, _ := newS3Client(t, url, "writer", "writer-secret")
+	if err = fm.CreateBucket("small", myfs.BucketQuota{MaxBytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	create, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("small"), Key: aws.String("obj")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadPart := func(partNumber int64, data string) (*s3.UploadPartOutput, error) {
+		return client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String("small"),
+			Key:        aws.String("obj"),
+			UploadId:   create.UploadId,
+			PartNumber: aws.Int64(partNumber),
+			Body:       bytes.NewReader([]byte(data)),
+		})
+	}
+	part, err := uploadPart(1, "hello!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := fm.GetOwnerUsage("writer")
+	if err != nil || usage.UsedBytes != 6 || usage.ObjectCount != 1 {
+		t.Fatalf("uploaded part should be counted for the token, got %+v, err %v", usage, err)
+	}
+	_, err = uploadPart(2, "world!")
+	assertErrorCode(t, err, "QuotaExceeded")
+	// 重新上传同一个分段时不计算被替换的分段
+	if part, err = uploadPart(1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String("small"),
+		Key:      aws.String("obj"),
+		UploadId: create.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{
+			{ETag: part.ETag, PartNumber: aws.Int64(1)},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = fm.GetOwnerUsage("writer")
+	if err != nil || usage.UsedBytes != 5 || usage.ObjectCount != 1 {
+		t.Fatalf("parts should be released after completion, got %+v, err %v", usage, err)
+	}
+}
+
+// TestGateway_MultipartExpire 过期的分段上传与分段数据被清理，分段的总字节数受限
+func TestGateway_MultipartExpire(t *testing.T) {
+	url, fm := newTestServer(t, &Options{UploadTTL: 100 * time.Millisecond, MaxUploadBytes: 10})
+	client, _ := newS3Client(t, url, "test", "test")
+	if _, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("backups")}); err != nil {
+		t.Fatal(err)
+	}
+	create, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("backups"), Key: aws.String("obj")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadPart := func(partNumber int64, data string) error {
+		_, err := client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String("backups"),
+			Key:        aws.String("obj"),
+			UploadId:   create.UploadId,
+			PartNumber: aws.Int64(partNumber),
+			Body:       bytes.NewReader([]byte(data)),
+		})
+		return err
+	}
+	if err = uploadPart(1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	assertErrorCode(t, uploadPart(2, "world!"), "EntityTooLarge")
+
+	time.Sleep(200 * time.Millisecond)
+	// 创建新的分段上传时清理过期的分段上传
+	if _, err = client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("backups"), Key: aws.String("other")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.ReadWithOptions(partKey(*create.UploadId, 1), &myfs.ReadOptions{Bucket: multipartBucket}); errors.Cause(err) != utils.ErrIndexNotFound {
+		t.Fatalf("parts of the expired upload should be deleted, got %v", err)
+	}
+	assertErrorCode(t, uploadPart(1, "hello"), s3.ErrCodeNoSuchUpload)
+}
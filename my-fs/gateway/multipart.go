@@ -0,0 +1,244 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	myfs "my-fs/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxPartNumber = 10000
+
+// multipartUpload 保存在内存中的分段上传状态，分段数据保存在multipartBucket中
+type multipartUpload struct {
+	bucket string
+	key    string
+	parts  map[int]uploadedPart
+	// 所有分段的字节数
+	size      int64
+	createdAt time.Time
+}
+
+type uploadedPart struct {
+	etag string
+	size int64
+}
+
+func partKey(uploadId string, partNumber int) string {
+	return fmt.Sprintf("%s/%05d", uploadId, partNumber)
+}
+
+// upload 获取分段上传的状态，bucket和key必须与创建时一致，已经过期的分段上传视为不存在
+func (g *Gateway) upload(uploadId, bucket, key string) (*multipartUpload, bool) {
+	g.mutx.Lock()
+	upload, ok := g.uploads[uploadId]
+	g.mutx.Unlock()
+	if ok && g.expired(upload) {
+		g.removeUpload(uploadId)
+		return nil, false
+	}
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return nil, false
+	}
+	return upload, true
+}
+
+func (g *Gateway) expired(upload *multipartUpload) bool {
+	return time.Since(upload.createdAt) > g.uploadTTL
+}
+
+// sweepUploads 清理过期的分段上传以及暂存的分段数据，在创建分段上传时执行
+func (g *Gateway) sweepUploads() {
+	var expired []string
+	g.mutx.Lock()
+	for uploadId, upload := range g.uploads {
+		if g.expired(upload) {
+			expired = append(expired, uploadId)
+		}
+	}
+	g.mutx.Unlock()
+
+	for _, uploadId := range expired {
+		g.removeUpload(uploadId)
+	}
+}
+
+func (g *Gateway) createMultipartUpload(ctx *gin.Context, bucket, key string) {
+	if _, err := g.fs.GetBucket(bucket); err != nil {
+		responseError(ctx, err)
+		return
+	}
+	g.sweepUploads()
+	uploadId := uuid.New().String()
+	g.mutx.Lock()
+	g.uploads[uploadId] = &multipartUpload{bucket: bucket, key: key, parts: make(map[int]uploadedPart), createdAt: time.Now()}
+	g.mutx.Unlock()
+
+	responseXML(ctx, http.StatusOK, &initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: uploadId,
+	})
+}
+
+func (g *Gateway) uploadPart(ctx *gin.Context, bucket, key, uploadId string) {
+	partNumber, err := strconv.Atoi(ctx.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		responseS3Error(ctx, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	upload, ok := g.upload(uploadId, bucket, key)
+	if !ok {
+		responseS3Error(ctx, http.StatusNotFound, "NoSuchUpload", "upload "+uploadId+" does not exist")
+		return
+	}
+	data, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		bodyError(ctx, err)
+		return
+	}
+	g.mutx.Lock()
+	uploadedSize := upload.size - upload.parts[partNumber].size
+	g.mutx.Unlock()
+	if uploadedSize+int64(len(data)) > g.maxUploadBytes {
+		responseS3Error(ctx, http.StatusBadRequest, "EntityTooLarge",
+			fmt.Sprintf("parts of upload %s exceed %d bytes", uploadId, g.maxUploadBytes))
+		return
+	}
+	// 合并之后的对象写入bucket，提前检查bucket的配额，已经上传的分段也计算在内
+	b, err := g.fs.GetBucket(bucket)
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+	b.UsedBytes += uploadedSize
+	if err = b.CheckQuota(int64(len(data))); err != nil {
+		responseError(ctx, err)
+		return
+	}
+	// 分段计入token的用量并检查token的配额与写入速率，完成或取消上传时释放
+	opts := writeOptions(ctx, bucket)
+	opts.Bucket = multipartBucket
+	index, err := g.fs.WriteWithKey(partKey(uploadId, partNumber), data, opts)
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+
+	g.mutx.Lock()
+	upload.size += index.Size - upload.parts[partNumber].size
+	upload.parts[partNumber] = uploadedPart{etag: index.ETag, size: index.Size}
+	g.mutx.Unlock()
+	ctx.Header("ETag", quoteETag(index.ETag))
+	ctx.Status(http.StatusOK)
+}
+
+func (g *Gateway) completeMultipartUpload(ctx *gin.Context, bucket, key, uploadId string) {
+	upload, ok := g.upload(uploadId, bucket, key)
+	if !ok {
+		responseS3Error(ctx, http.StatusNotFound, "NoSuchUpload", "upload "+uploadId+" does not exist")
+		return
+	}
+	request := new(completeMultipartUpload)
+	if err := xml.NewDecoder(ctx.Request.Body).Decode(request); err != nil {
+		responseS3Error(ctx, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if len(request.Parts) == 0 {
+		responseS3Error(ctx, http.StatusBadRequest, "MalformedXML", "no part is specified")
+		return
+	}
+	// 分段编号必须严格递增，同一个分段不能合并两次
+	if !sort.SliceIsSorted(request.Parts, func(i, j int) bool {
+		return request.Parts[i].PartNumber <= request.Parts[j].PartNumber
+	}) {
+		responseS3Error(ctx, http.StatusBadRequest, "InvalidPartOrder", "parts must be in ascending order")
+		return
+	}
+
+	g.mutx.Lock()
+	parts := make(map[int]uploadedPart, len(upload.parts))
+	for partNumber, part := range upload.parts {
+		parts[partNumber] = part
+	}
+	uploadedSize := upload.size
+	g.mutx.Unlock()
+
+	var size int64
+	for _, part := range request.Parts {
+		uploaded, ok := parts[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != uploaded.etag {
+			responseS3Error(ctx, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d is not found", part.PartNumber))
+			return
+		}
+		size += uploaded.size
+	}
+	// 分段的总字节数在上传时已经限制在maxUploadBytes以内
+	buffer := bytes.NewBuffer(make([]byte, 0, size))
+	for _, part := range request.Parts {
+		data, err := g.fs.ReadWithOptions(partKey(uploadId, part.PartNumber), &myfs.ReadOptions{Bucket: multipartBucket})
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		buffer.Write(data)
+	}
+	opts := writeOptions(ctx, bucket)
+	// 写入之后分段被删除，检查token的配额时不计算这些分段，否则合并需要两倍的配额
+	if opts.OwnerQuota.MaxBytes > 0 {
+		opts.OwnerQuota.MaxBytes += uploadedSize
+	}
+	if opts.OwnerQuota.MaxObjects > 0 {
+		opts.OwnerQuota.MaxObjects += int64(len(parts))
+	}
+	index, err := g.fs.WriteWithKey(key, buffer.Bytes(), opts)
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+	g.removeUpload(uploadId)
+
+	responseXML(ctx, http.StatusOK, &completeMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     quoteETag(index.ETag),
+	})
+}
+
+func (g *Gateway) abortMultipartUpload(ctx *gin.Context, bucket, key, uploadId string) {
+	if _, ok := g.upload(uploadId, bucket, key); !ok {
+		responseS3Error(ctx, http.StatusNotFound, "NoSuchUpload", "upload "+uploadId+" does not exist")
+		return
+	}
+	g.removeUpload(uploadId)
+	ctx.Status(http.StatusNoContent)
+}
+
+// removeUpload 删除分段上传的状态以及暂存的分段数据
+func (g *Gateway) removeUpload(uploadId string) {
+	g.mutx.Lock()
+	var partNumbers []int
+	if upload, ok := g.uploads[uploadId]; ok {
+		for partNumber := range upload.parts {
+			partNumbers = append(partNumbers, partNumber)
+		}
+		delete(g.uploads, uploadId)
+	}
+	g.mutx.Unlock()
+
+	for _, partNumber := range partNumbers {
+		_ = g.fs.DeleteWithOptions(partKey(uploadId, partNumber), &myfs.DeleteOptions{Bucket: multipartBucket})
+	}
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	myfs "my-fs/fs"
+	"my-fs/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const maxListKeys = 1000
+
+func (g *Gateway) putObject(ctx *gin.Context, bucket, key string) {
+	data, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		bodyError(ctx, err)
+		return
+	}
+	opts := writeOptions(ctx, bucket)
+	if ctx.GetHeader("If-None-Match") == "*" {
+		opts.Overwrite = myfs.OverwriteFail
+	} else if ifMatch := ctx.GetHeader("If-Match"); ifMatch != "" {
+		opts.Overwrite = myfs.OverwriteIfMatch
+		opts.IfMatch = strings.Trim(ifMatch, `"`)
+	}
+	index, err := g.fs.WriteWithKey(key, data, opts)
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+	if index.VersionId != "" {
+		ctx.Header("x-amz-version-id", index.VersionId)
+	}
+	ctx.Header("ETag", quoteETag(index.ETag))
+	ctx.Status(http.StatusOK)
+}
+
+// getObject 处理GET与HEAD请求，withBody为false时只返回对象的元数据
+func (g *Gateway) getObject(ctx *gin.Context, bucket, key string, withBody bool) {
+	opts := &myfs.ReadOptions{Bucket: bucket, VersionId: ctx.Query("versionId")}
+	index, err := g.fs.Stat(key, opts)
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+	if index.VersionId != "" {
+		ctx.Header("x-amz-version-id", index.VersionId)
+	}
+	ctx.Header("ETag", quoteETag(index.ETag))
+	ctx.Header("Last-Modified", time.Unix(0, index.ModTime).UTC().Format(http.TimeFormat))
+	ctx.Header("Accept-Ranges", "bytes")
+	if !withBody {
+		ctx.Header("Content-Length", strconv.FormatInt(index.Size, 10))
+		ctx.Status(http.StatusOK)
+		return
+	}
+
+	data, err := g.fs.ReadWithOptions(key, opts)
+	if err != nil {
+		responseError(ctx, err)
+		return
+	}
+	rangeHeader := ctx.GetHeader("Range")
+	if rangeHeader == "" {
+		ctx.Data(http.StatusOK, "application/octet-stream", data)
+		return
+	}
+	start, end, ok := parseRange(rangeHeader, int64(len(data)))
+	if !ok {
+		ctx.Header("Content-Range", "bytes */"+strconv.Itoa(len(data)))
+		responseS3Error(ctx, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the requested range is not satisfiable")
+		return
+	}
+	ctx.Header("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.Itoa(len(data)))
+	ctx.Data(http.StatusPartialContent, "application/octet-stream", data[start:end+1])
+}
+
+func (g *Gateway) deleteObject(ctx *gin.Context, bucket, key string) {
+	err := g.fs.DeleteWithOptions(key, &myfs.DeleteOptions{Bucket: bucket, VersionId: ctx.Query("versionId")})
+	// 删除不存在的对象在S3中也是成功的
+	if err != nil && errors.Cause(err) != utils.ErrIndexNotFound {
+		responseError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// listObjects 同时支持ListObjects与ListObjectsV2，V2的continuation token是base64编码后的最后一个key
+func (g *Gateway) listObjects(ctx *gin.Context, bucket string) {
+	isV2 := ctx.Query("list-type") == "2"
+	prefix := ctx.Query("prefix")
+	delimiter := ctx.Query("delimiter")
+	maxKeys := maxListKeys
+	if v := ctx.Query("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			responseS3Error(ctx, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	result := &listBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	startAfter := ctx.Query("marker")
+	if isV2 {
+		result.StartAfter = ctx.Query("start-after")
+		result.ContinuationToken = ctx.Query("continuation-token")
+		startAfter = result.StartAfter
+		if result.ContinuationToken != "" {
+			token, err := base64.URLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				responseS3Error(ctx, http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+				return
+			}
+			startAfter = string(token)
+		}
+	} else {
+		result.Marker = startAfter
+	}
+
+	// 与http接口相同分页读取，每页多读一个用于判断是否还有下一页，遇到公共前缀时跳过该前缀下所有的key
+	listOpts := &myfs.ListOptions{Prefix: prefix, StartAfter: startAfter, Limit: maxKeys + 1}
+	var lastKey string
+list:
+	for {
+		indexes, err := g.fs.List(bucket, listOpts)
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		for _, index := range indexes {
+			key := index.BlockId
+			cp := ""
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					cp = key[:len(prefix)+i+len(delimiter)]
+				}
+			}
+			// 同一个公共前缀只返回一次
+			if cp != "" && len(result.CommonPrefixes) > 0 && result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix == cp {
+				continue
+			}
+			if result.KeyCount >= maxKeys {
+				result.IsTruncated = true
+				break list
+			}
+			result.KeyCount++
+			if cp != "" {
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: cp})
+				// 使下一页从所有以该公共前缀开头的key之后开始
+				lastKey = cp + "\xff"
+				continue
+			}
+			result.Contents = append(result.Contents, objectEntry{
+				Key:          key,
+				LastModified: time.Unix(0, index.ModTime).UTC().Format(timeFormat),
+				ETag:         quoteETag(index.ETag),
+				Size:         index.Size,
+				StorageClass: "STANDARD",
+			})
+			lastKey = key
+		}
+		if len(indexes) < listOpts.Limit {
+			break
+		}
+		listOpts.StartAfter = lastKey
+	}
+	if result.IsTruncated {
+		if isV2 {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(lastKey))
+		} else {
+			result.NextMarker = lastKey
+		}
+	}
+	if !isV2 {
+		// ListObjects的响应中没有KeyCount
+		result.KeyCount = 0
+	}
+	responseXML(ctx, http.StatusOK, result)
+}
+
+// parseRange 解析单个范围的Range请求头，返回闭区间[start, end]
+func parseRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	var start, end int64
+	var err error
+	switch {
+	case parts[0] == "":
+		// bytes=-n 表示最后n个字节
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, 0, false
+		}
+		end = size - 1
+		if parts[1] != "" {
+			if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+				return 0, 0, false
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	if start < 0 || start > end || start >= size {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
@@ -3,12 +3,18 @@ module my-fs
 go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.44.0
 	github.com/gin-gonic/gin v1.7.2
 	github.com/golang/protobuf v1.5.2
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/google/uuid v1.2.0
+	github.com/hashicorp/raft v1.5.0
+	github.com/hashicorp/raft-boltdb v0.0.0-20230125174641-2a8082862702
+	github.com/klauspost/compress v1.13.6
+	github.com/klauspost/reedsolomon v1.10.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2
 	github.com/syndtr/goleveldb v1.0.0
-	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
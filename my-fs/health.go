@@ -0,0 +1,292 @@
+package main
+
+import (
+	"my-fs/auth"
+	myfs "my-fs/fs"
+	"my-fs/model"
+	"my-fs/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+func (s *server) isReady() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+func (s *server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// admit 存储恢复完成之前拒绝所有请求，开始退出之后拒绝写入请求
+func (s *server) admit(r *http.Request) error {
+	if !s.isReady() {
+		if err := s.recoveryError(); err != nil {
+			return errors.Wrapf(utils.ErrNotReady, "recover store failed: %s", err)
+		}
+		return utils.ErrNotReady
+	}
+	if s.isDraining() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return utils.ErrShuttingDown
+	}
+	return nil
+}
+
+func (s *server) readyGate(ctx *gin.Context) {
+	if err := s.admit(ctx.Request); err != nil {
+		responseError(ctx, err)
+		ctx.Abort()
+	}
+}
+
+// serveGateway 通过admit检查之后才转发到S3网关
+func (s *server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	if err := s.admit(r); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	s.gateway.ServeHTTP(w, r)
+}
+
+// unreadyReasons 返回无法处理请求的原因，为空表示已经就绪
+func (s *server) unreadyReasons() []string {
+	if !s.isReady() {
+		if err := s.recoveryError(); err != nil {
+			return []string{"recovery failed: " + err.Error()}
+		}
+		return []string{"recovering"}
+	}
+	if s.isDraining() {
+		return []string{"shutting down"}
+	}
+	reasons := s.fs.Health().Reasons
+	if s.replica != nil && s.fs.ReadOnly() && !s.replica.Status().Connected {
+		reasons = append(reasons, "replica is disconnected from primary")
+	}
+	if s.node != nil && s.node.Leader() == nil {
+		reasons = append(reasons, "cluster has no leader")
+	}
+	return reasons
+}
+
+func (s *server) registerHealthRoutes() {
+	// 进程存活即可，恢复期间也返回200，避免被编排系统重启
+	s.engine.GET("/healthz", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{"status": "ok"}))
+	})
+
+	// 恢复期间或降级时返回503，编排系统不会把请求转发到该节点
+	s.engine.GET("/readyz", func(ctx *gin.Context) {
+		if reasons := s.unreadyReasons(); len(reasons) > 0 {
+			ctx.JSON(http.StatusServiceUnavailable, model.Response{
+				Code: http.StatusServiceUnavailable,
+				Data: gin.H{"ready": false, "reasons": reasons},
+				Err:  "not ready",
+			})
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{"ready": true}))
+	})
+}
+
+// exportErrorTrailer 导出失败时的错误信息，为空表示导出成功
+const exportErrorTrailer = "X-Export-Error"
+
+var exportTrailers = []string{exportErrorTrailer, "X-Export-Buckets", "X-Export-Chunks", "X-Export-Bytes"}
+
+func (s *server) registerAdminRoutes() {
+	admin := s.engine.Group("/admin", auth.Require(auth.PermAdmin, allBuckets))
+
+	// 统计数据文件中有效与可回收的空间，需要读取所有的数据文件
+	admin.GET("/stats", func(ctx *gin.Context) {
+		stats, err := s.fs.StorageStats()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"segments":        stats.Segments,
+			"live_bytes":      stats.LiveBytes,
+			"dead_bytes":      stats.DeadBytes,
+			"live_records":    stats.LiveRecords,
+			"dead_records":    stats.DeadRecords,
+			"index_entries":   stats.IndexEntries,
+			"version_entries": stats.VersionEntries,
+			"checkpoint": gin.H{
+				"file_seq": stats.CheckpointFileSeq,
+				"offset":   stats.CheckpointOffset,
+			},
+		}))
+	})
+
+	// 每个token写入的数据量，与bucket的用量统计方式相同
+	admin.GET("/usage", func(ctx *gin.Context) {
+		usages, err := s.fs.ListOwnerUsage()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		tokens := make([]gin.H, 0, len(usages))
+		for _, usage := range usages {
+			tokens = append(tokens, gin.H{
+				"token":        usage.Owner,
+				"used_bytes":   usage.UsedBytes,
+				"object_count": usage.ObjectCount,
+			})
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(tokens))
+	})
+
+	admin.POST("/compact", func(ctx *gin.Context) {
+		stats, err := s.fs.Compact()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"segments":        stats.Segments,
+			"live_records":    stats.LiveRecords,
+			"dropped_records": stats.DroppedRecords,
+			"reclaimed_bytes": stats.ReclaimedBytes,
+		}))
+	})
+
+	// 检查所有记录能否解码以及索引是否指向对应的记录，不会修改数据
+	admin.POST("/fsck", func(ctx *gin.Context) {
+		report, err := s.fs.Fsck()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"healthy":          report.Healthy(),
+			"segments":         report.Segments,
+			"records":          report.Records,
+			"corrupt_records":  report.CorruptRecords,
+			"indexes":          report.Indexes,
+			"dangling_indexes": report.DanglingIndexes,
+		}))
+	})
+
+	// 响应体为export生成的归档，数据已经开始发送，出错时只能通过trailer告知客户端
+	admin.GET("/export", func(ctx *gin.Context) {
+		opts := archiveOptionsFromRequest(ctx)
+		// 开始发送之前检查参数，使错误能够通过状态码返回
+		if err := myfs.CheckArchiveFormat(opts.Format); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		if opts.Bucket != "" {
+			if _, err := s.fs.GetBucket(opts.Bucket); err != nil {
+				responseError(ctx, err)
+				return
+			}
+		}
+		if opts.Format == myfs.ArchiveFormatTar {
+			ctx.Header("Content-Type", "application/x-tar")
+		} else {
+			ctx.Header("Content-Type", "application/octet-stream")
+		}
+		ctx.Header("Trailer", strings.Join(exportTrailers, ", "))
+		ctx.Status(http.StatusOK)
+		stats, err := s.fs.ExportWithOptions(ctx.Writer, opts)
+		if stats == nil {
+			stats = &myfs.ArchiveStats{}
+		}
+		trailer := ctx.Writer.Header()
+		trailer.Set(exportErrorTrailer, "")
+		if err != nil {
+			trailer.Set(exportErrorTrailer, err.Error())
+		}
+		trailer.Set("X-Export-Buckets", strconv.Itoa(stats.Buckets))
+		trailer.Set("X-Export-Chunks", strconv.Itoa(stats.Chunks))
+		trailer.Set("X-Export-Bytes", strconv.FormatInt(stats.Bytes, 10))
+	})
+
+	// 请求体为export生成的归档或tar，出错时data中为出错之前导入的统计信息
+	admin.POST("/import", func(ctx *gin.Context) {
+		stats, err := s.fs.ImportWithOptions(ctx.Request.Body, archiveOptionsFromRequest(ctx))
+		if err != nil {
+			code := errorCode(err)
+			ctx.JSON(code, model.Response{Code: code, Data: stats, Err: err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(stats))
+	})
+
+	// 在配置的snapshot_dir中生成快照，since不为空时生成基于该快照的增量快照
+	admin.POST("/snapshots", func(ctx *gin.Context) {
+		if s.conf.Storage.SnapshotDir == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("snapshot_dir is not configured"))
+			return
+		}
+		manifest, err := s.fs.Snapshot(s.conf.Storage.SnapshotDir, &myfs.SnapshotOptions{Since: ctx.Query("since")})
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(manifest))
+	})
+
+	admin.GET("/snapshots", func(ctx *gin.Context) {
+		if s.conf.Storage.SnapshotDir == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("snapshot_dir is not configured"))
+			return
+		}
+		manifests, err := myfs.ListSnapshots(s.conf.Storage.SnapshotDir)
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(manifests))
+	})
+
+	// 每个数据文件保存在本地还是冷存储
+	admin.GET("/segments", func(ctx *gin.Context) {
+		locations, err := s.fs.SegmentLocations()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(locations))
+	})
+
+	// 立即将满足条件的数据文件移到冷存储，不用等待下一次定期检查
+	admin.POST("/tier", func(ctx *gin.Context) {
+		if s.conf.Storage.Tiering.Target == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("tiering is not configured"))
+			return
+		}
+		stats, err := s.fs.Tier()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"segments": stats.Segments,
+			"bytes":    stats.Bytes,
+		}))
+	})
+
+	// 立即将checkpoint同步写入磁盘
+	admin.POST("/checkpoint", func(ctx *gin.Context) {
+		if err := s.fs.FlushCheckpoint(); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(nil))
+	})
+}
+
+// archiveOptionsFromRequest 从format、bucket与prefix参数中读取导出与导入的选项
+func archiveOptionsFromRequest(ctx *gin.Context) *myfs.ArchiveOptions {
+	return &myfs.ArchiveOptions{
+		Format: ctx.Query("format"),
+		Bucket: ctx.Query("bucket"),
+		Prefix: ctx.Query("prefix"),
+	}
+}
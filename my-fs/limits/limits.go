@@ -0,0 +1,265 @@
+// Package limits 限制http请求体的大小以及每个客户端的请求频率
+package limits
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"my-fs/auth"
+	"my-fs/model"
+	"my-fs/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// 请求被拒绝的原因，用于指标的reason标签
+const (
+	ReasonBodyTooLarge = "body_too_large"
+	ReasonRateLimited  = "rate_limited"
+)
+
+// defaultRule 没有单独配置的接口共用的规则名
+const defaultRule = "*"
+
+// sweepInterval 清理空闲令牌桶的间隔
+const sweepInterval = time.Minute
+
+// Rule 一个接口的限制，数值为0表示不限制
+type Rule struct {
+	// 请求体的最大字节数
+	MaxBodyBytes int64
+	// 每个客户端每秒的请求数
+	RequestsPerSecond int
+	// 允许的突发请求数，0表示等于RequestsPerSecond
+	Burst int
+}
+
+// Metrics 统计被拒绝的请求，route为注册的路由
+type Metrics interface {
+	RejectRequest(route, reason string)
+}
+
+// Limiter 按接口限制请求，认证之前按客户端ip计算频率，认证之后再按token计算频率
+type Limiter struct {
+	defaults Rule
+	// key为"<METHOD> <route>"或者对所有方法生效的"<route>"，route与gin注册的路由相同
+	routes  map[string]Rule
+	metrics Metrics
+	now     func() time.Time
+
+	mutx      sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New 创建Limiter，routes中没有的接口使用defaults，metrics可以为nil
+func New(defaults Rule, routes map[string]Rule, metrics Metrics) *Limiter {
+	return &Limiter{
+		defaults: defaults,
+		routes:   routes,
+		metrics:  metrics,
+		now:      time.Now,
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+// rule 返回请求适用的规则名与规则
+func (l *Limiter) rule(method, route string) (string, Rule) {
+	if route != "" {
+		if rule, ok := l.routes[method+" "+route]; ok {
+			return method + " " + route, rule
+		}
+		if rule, ok := l.routes[route]; ok {
+			return route, rule
+		}
+	}
+	return defaultRule, l.defaults
+}
+
+// ErrorHandler 拒绝请求时写入响应，为nil时返回json格式的错误
+type ErrorHandler func(ctx *gin.Context, status int, err error)
+
+func jsonError(ctx *gin.Context, status int, err error) {
+	ctx.AbortWithStatusJSON(status, model.NewErrorRespWithCode(status, err.Error()))
+}
+
+// match 返回请求的路由以及适用的规则名与规则
+func (l *Limiter) match(ctx *gin.Context) (string, string, Rule) {
+	route := ctx.FullPath()
+	name, rule := l.rule(ctx.Request.Method, route)
+	if route == "" {
+		route = "unmatched"
+	}
+	return route, name, rule
+}
+
+// Middleware 检查请求体大小与每个客户端ip的请求频率，需要在auth.Middleware之前执行，
+// 认证失败的请求同样被限制，认证读取的请求体也不会超过限制
+// 声明的Content-Length超过限制时直接返回413，否则读取请求体时超过限制返回utils.ErrBodyTooLarge
+func (l *Limiter) Middleware(onError ErrorHandler) gin.HandlerFunc {
+	if onError == nil {
+		onError = jsonError
+	}
+	return func(ctx *gin.Context) {
+		route, name, rule := l.match(ctx)
+		var body *limitedBody
+		if rule.MaxBodyBytes > 0 {
+			if ctx.Request.ContentLength > rule.MaxBodyBytes {
+				l.reject(ctx, onError, route, ReasonBodyTooLarge, http.StatusRequestEntityTooLarge, errors.Wrapf(utils.ErrBodyTooLarge,
+					"request body of %d bytes exceeds the limit of %d bytes", ctx.Request.ContentLength, rule.MaxBodyBytes))
+				return
+			}
+			body = &limitedBody{ReadCloser: ctx.Request.Body, remaining: rule.MaxBodyBytes, limit: rule.MaxBodyBytes}
+			ctx.Request.Body = body
+		}
+		if !l.allow(ctx, onError, route, name, "ip:"+ctx.ClientIP(), rule) {
+			return
+		}
+
+		ctx.Next()
+		// 认证或处理请求时读取到超过限制的请求体
+		if body != nil && body.exceeded && l.metrics != nil {
+			l.metrics.RejectRequest(route, ReasonBodyTooLarge)
+		}
+	}
+}
+
+// TokenMiddleware 按token检查请求频率，同一个token从多个ip发出的请求一起计算，需要在auth.Middleware之后执行
+func (l *Limiter) TokenMiddleware(onError ErrorHandler) gin.HandlerFunc {
+	if onError == nil {
+		onError = jsonError
+	}
+	return func(ctx *gin.Context) {
+		if token := auth.IdentityFrom(ctx).Token; token != nil {
+			route, name, rule := l.match(ctx)
+			if !l.allow(ctx, onError, route, name, "token:"+token.Id, rule) {
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// allow 从客户端的令牌桶中取出一个令牌，令牌不足时返回429并设置Retry-After
+func (l *Limiter) allow(ctx *gin.Context, onError ErrorHandler, route, name, client string, rule Rule) bool {
+	if rule.RequestsPerSecond <= 0 {
+		return true
+	}
+	wait, limited := l.take(name+" "+client, rule)
+	if !limited {
+		return true
+	}
+	ctx.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	l.reject(ctx, onError, route, ReasonRateLimited, http.StatusTooManyRequests, errors.Wrapf(utils.ErrTooManyRequests,
+		"%s allows %d requests per second, retry after %s", name, rule.RequestsPerSecond, wait))
+	return false
+}
+
+func (l *Limiter) reject(ctx *gin.Context, onError ErrorHandler, route, reason string, code int, err error) {
+	if l.metrics != nil {
+		l.metrics.RejectRequest(route, reason)
+	}
+	onError(ctx, code, err)
+	ctx.Abort()
+}
+
+// take 从key的令牌桶中取出一个令牌，令牌不足时返回需要等待的时间
+func (l *Limiter) take(key string, rule Rule) (time.Duration, bool) {
+	now := l.now()
+	l.mutx.Lock()
+	defer l.mutx.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(rule, now)
+		l.buckets[key] = b
+	}
+	return b.take(now)
+}
+
+// sweep 删除已经补满的令牌桶，它们与新建的令牌桶没有区别
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.refill(now) >= b.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// bucket 令牌桶，每秒补充rate个令牌，最多保存capacity个令牌
+type bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newBucket(rule Rule, now time.Time) *bucket {
+	capacity := rule.Burst
+	if capacity <= 0 {
+		capacity = rule.RequestsPerSecond
+	}
+	return &bucket{
+		rate:     float64(rule.RequestsPerSecond),
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		last:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) float64 {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	return b.tokens
+}
+
+func (b *bucket) take(now time.Time) (time.Duration, bool) {
+	if b.refill(now) >= 1 {
+		b.tokens--
+		return 0, false
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second))), true
+}
+
+// limitedBody 最多读取limit字节的请求体，与http.MaxBytesReader相同，超过时返回utils.ErrBodyTooLarge
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, b.err()
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// 多读一个字节，判断请求体是否正好等于limit
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n, b.remaining, b.exceeded = int(b.remaining), 0, true
+	return n, b.err()
+}
+
+func (b *limitedBody) err() error {
+	return errors.Wrapf(utils.ErrBodyTooLarge, "request body exceeds the limit of %d bytes", b.limit)
+}
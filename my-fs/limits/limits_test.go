@@ -0,0 +1,189 @@
+package limits
+
+import (
+	"bytes"
+	"io/ioutil"
+	"my-fs/auth"
+	"my-fs/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+type countingMetrics map[string]int
+
+func (m countingMetrics) RejectRequest(route, reason string) {
+	m[route+" "+reason]++
+}
+
+func newTestEngine(limiter *Limiter) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(limiter.Middleware(nil))
+	handler := func(ctx *gin.Context) {
+		data, err := ioutil.ReadAll(ctx.Request.Body)
+		if errors.Cause(err) == utils.ErrBodyTooLarge {
+			ctx.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		ctx.String(http.StatusOK, "%d", len(data))
+	}
+	engine.POST("/write", handler)
+	engine.POST("/import", handler)
+	engine.GET("/read", handler)
+	return engine
+}
+
+func serve(engine *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestLimiter_BodySize(t *testing.T) {
+	metrics := countingMetrics{}
+	limiter := New(Rule{MaxBodyBytes: 4}, map[string]Rule{"POST /import": {}}, metrics)
+	engine := newTestEngine(limiter)
+
+	// 声明的长度超过限制时不调用handler
+	if w := serve(engine, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("12345"))); w.Code != http.StatusRequestEntityTooLarge ||
+		!strings.Contains(w.Body.String(), utils.ErrBodyTooLarge.Error()) {
+		t.Fatalf("expect 413, got %d %s", w.Code, w.Body)
+	}
+	// 没有声明长度时读取超过限制返回错误
+	req := httptest.NewRequest(http.MethodPost, "/write", ioutil.NopCloser(strings.NewReader("12345")))
+	req.ContentLength = -1
+	if w := serve(engine, req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expect 413 when reading the body, got %d %s", w.Code, w.Body)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/write", ioutil.NopCloser(strings.NewReader("1234")))
+	req.ContentLength = -1
+	if w := serve(engine, req); w.Code != http.StatusOK || w.Body.String() != "4" {
+		t.Fatalf("body of exactly the limit should be accepted, got %d %s", w.Code, w.Body)
+	}
+	// 单独配置的接口不限制
+	if w := serve(engine, httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(make([]byte, 100)))); w.Code != http.StatusOK {
+		t.Fatalf("import should not be limited, got %d %s", w.Code, w.Body)
+	}
+	if metrics["/write "+ReasonBodyTooLarge] != 2 {
+		t.Fatalf("expect 2 rejected requests, got %v", metrics)
+	}
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	metrics := countingMetrics{}
+	limiter := New(Rule{RequestsPerSecond: 1, Burst: 2}, map[string]Rule{"/read": {RequestsPerSecond: 10}}, metrics)
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time { return now }
+	engine := newTestEngine(limiter)
+
+	request := func(method, path, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = addr
+		return serve(engine, req)
+	}
+	for i := 0; i < 2; i++ {
+		if w := request(http.MethodPost, "/write", "10.0.0.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("burst requests should be allowed, got %d", w.Code)
+		}
+	}
+	w := request(http.MethodPost, "/write", "10.0.0.1:1001")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" ||
+		!strings.Contains(w.Body.String(), utils.ErrTooManyRequests.Error()) {
+		t.Fatalf("expect 429 with retry after, got %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	// 全局规则对同一个客户端的所有接口共用令牌桶，单独配置的接口与其他客户端不受影响
+	if w = request(http.MethodPost, "/import", "10.0.0.1:1000"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expect 429 on other routes of the global rule, got %d", w.Code)
+	}
+	if w = request(http.MethodGet, "/read", "10.0.0.1:1000"); w.Code != http.StatusOK {
+		t.Fatalf("read has its own limit, got %d", w.Code)
+	}
+	if w = request(http.MethodPost, "/write", "10.0.0.2:1000"); w.Code != http.StatusOK {
+		t.Fatalf("other clients should not be limited, got %d", w.Code)
+	}
+	if metrics["/write "+ReasonRateLimited] != 1 || metrics["/import "+ReasonRateLimited] != 1 {
+		t.Fatalf("unexpected rejected requests %v", metrics)
+	}
+
+	now = now.Add(time.Second)
+	if w = request(http.MethodPost, "/write", "10.0.0.1:1000"); w.Code != http.StatusOK {
+		t.Fatalf("tokens should be refilled, got %d", w.Code)
+	}
+	// 补满的令牌桶被清理
+	now = now.Add(sweepInterval)
+	limiter.take("/read probe", Rule{RequestsPerSecond: 1})
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("idle buckets should be swept, got %d", len(limiter.buckets))
+	}
+}
+
+// TestLimiter_Auth 请求体大小与每个ip的频率在认证之前检查，token的频率在认证之后检查
+func TestLimiter_Auth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	token := &auth.Token{Id: "writer", Secret: "writer-secret", Grants: []auth.Grant{{Bucket: auth.AllBuckets, Permissions: []auth.Permission{auth.PermWrite}}}}
+	tokens, err := auth.NewTokenStore([]*auth.Token{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := countingMetrics{}
+	limiter := New(Rule{MaxBodyBytes: 4, RequestsPerSecond: 1, Burst: 2}, nil, metrics)
+	limiter.now = func() time.Time { return time.Unix(0, 0) }
+	engine := gin.New()
+	engine.Use(limiter.Middleware(nil), auth.Middleware(auth.NewAuthenticator(tokens), nil), limiter.TokenMiddleware(nil))
+	engine.POST("/write", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	request := func(addr string, body []byte, sign bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/write", ioutil.NopCloser(bytes.NewReader(body)))
+		req.ContentLength = -1
+		req.RemoteAddr = addr
+		if sign {
+			auth.SignRequest(req, token, body)
+		}
+		return serve(engine, req)
+	}
+	// 签名覆盖的请求体超过限制时，认证读取请求体返回413
+	if w := request("10.0.0.1:1000", []byte("12345"), true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expect 413 before buffering the body for authentication, got %d %s", w.Code, w.Body)
+	}
+	// 认证失败的请求同样消耗ip的令牌
+	if w := request("10.0.0.1:1000", nil, false); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expect 401, got %d", w.Code)
+	}
+	if w := request("10.0.0.1:1000", nil, false); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("unauthenticated requests should be rate limited, got %d", w.Code)
+	}
+	// 同一个token从不同的ip发出的请求一起计算
+	for _, addr := range []string{"10.0.0.2:1000", "10.0.0.3:1000"} {
+		if w := request(addr, []byte("1234"), true); w.Code != http.StatusOK {
+			t.Fatalf("expect 200, got %d %s", w.Code, w.Body)
+		}
+	}
+	if w := request("10.0.0.4:1000", []byte("1234"), true); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("token should be rate limited across addresses, got %d", w.Code)
+	}
+	if metrics["/write "+ReasonBodyTooLarge] != 1 || metrics["/write "+ReasonRateLimited] != 2 {
+		t.Fatalf("unexpected rejected requests %v", metrics)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBucket(Rule{RequestsPerSecond: 4}, now)
+	for i := 0; i < 4; i++ {
+		if _, limited := b.take(now); limited {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	if wait, limited := b.take(now); !limited || wait != 250*time.Millisecond {
+		t.Fatalf("expect to wait 250ms, got %s, %v", wait, limited)
+	}
+	if _, limited := b.take(now.Add(250 * time.Millisecond)); limited {
+		t.Fatal("token should be refilled after waiting")
+	}
+}
@@ -1,85 +1,832 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"log"
+	"my-fs/auth"
+	"my-fs/cluster"
+	"my-fs/config"
 	myfs "my-fs/fs"
+	"my-fs/gateway"
+	"my-fs/limits"
+	"my-fs/metrics"
 	"my-fs/model"
+	"my-fs/replication"
+	"my-fs/tlsutil"
+	"my-fs/utils"
+	"net"
 	"net/http"
-	"os"
-)
-
-const (
-	defaultHttpPort = 8080
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type server struct {
-	engine *gin.Engine
-	fs     myfs.FS
+	engine  *gin.Engine
+	fs      *myfs.FileManager
+	gateway *gateway.Gateway
+	// 从节点时不为nil
+	replica *replication.Replica
+	// 集群模式时不为nil
+	node           *cluster.Node
+	clusterHandler http.Handler
+	// 没有配置auth.tokens_file时为nil，不认证请求
+	authenticator auth.Authenticator
+	audit         *auth.AuditLog
+	// 访问其他节点使用的client，配置了auth.peer_token时携带该token
+	peerClient *http.Client
+	// 没有配置证书时为nil，使用http
+	tls     *tlsutil.Reloader
+	metrics *metrics.Prometheus
+	// 请求体大小与请求频率的限制
+	limiter *limits.Limiter
+	// gatewayLimiter S3网关的限制，与http接口分开计算
+	gatewayLimiter *limits.Limiter
+	conf           *config.Config
+	// 启动后在后台打开存储使用的选项
+	storeOpts *myfs.Options
+	// 存储恢复完成后为1，之前只有健康检查可以访问
+	ready int32
+	// 在后台开始恢复后为1，恢复结束时关闭recovered，失败的原因保存在recoverErr中
+	recovering int32
+	recovered  chan struct{}
+	recoverErr error
+	// 开始退出后为1，拒绝新的写入
+	draining int32
+	// 关闭http服务时被取消，结束复制等不会自行结束的长连接
+	streams     context.Context
+	stopStreams context.CancelFunc
 }
 
-func newServer() (*server, error) {
-	fileStorePath := os.Getenv("FILE_STORE_PATH")
-	if fileStorePath == "" {
-		return nil, errors.New("file store path can not be empty")
+func newServer(conf *config.Config) (*server, error) {
+	authenticator, audit, err := newAuth(conf.Auth)
+	if err != nil {
+		return nil, err
 	}
-	indexStorePath := os.Getenv("INDEX_STORE_PATH")
-	if indexStorePath == "" {
-		return nil, errors.New("index store path can not be empty")
+	reloader, err := newTLSReloader(conf.TLS)
+	if err != nil {
+		return nil, err
 	}
-
-	fs, err := myfs.NewFileManager(fileStorePath, indexStorePath)
+	storeOpts, err := conf.StoreOptions()
 	if err != nil {
 		return nil, err
 	}
-	engine := gin.Default()
-	return &server{engine, fs}, nil
+	prom := metrics.NewPrometheus()
+	storeOpts.Metrics = prom
+	globalLimit, routeLimits := conf.LimitRules()
+	streams, stopStreams := context.WithCancel(context.Background())
+	return &server{
+		engine:        gin.Default(),
+		authenticator: authenticator,
+		audit:         audit,
+		peerClient:    newPeerClient(reloader, conf.Auth.PeerToken),
+		tls:           reloader,
+		metrics:       prom,
+		limiter:       limits.New(globalLimit, routeLimits, prom),
+		// S3网关只有一个路由，使用全局的限制
+		gatewayLimiter: limits.New(globalLimit, nil, prom),
+		conf:           conf,
+		storeOpts:      storeOpts,
+		recovered:      make(chan struct{}),
+		streams:        streams,
+		stopStreams:    stopStreams,
+	}, nil
 }
 
-func (s *server) Start() error {
-	s.engine.POST("/write", func(ctx *gin.Context) {
-		upData := new(model.UploadData)
-		if err := ctx.Bind(upData); err != nil {
+// openStore 打开存储，启动时需要恢复checkpoint并修剪不完整的数据，完成之前服务不可用
+func (s *server) openStore() error {
+	if s.conf.Cluster.NodeId != "" {
+		return s.openCluster()
+	}
+	fs, err := myfs.NewFileManagerWithOptions(s.conf.Storage.FileStorePath, s.conf.Storage.IndexStorePath, s.storeOpts)
+	if err != nil {
+		return err
+	}
+	gw, err := gateway.NewGatewayWithOptions(fs, s.gatewayOptions())
+	if err != nil {
+		fs.Close()
+		return err
+	}
+	if replicaOf := s.conf.Replication.ReplicaOf; replicaOf != "" {
+		s.replica = replication.NewReplicaWithClient(fs, replicaOf, s.peerClient)
+		s.replica.Start()
+	}
+	s.fs, s.gateway = fs, gw
+	return nil
+}
+
+// gatewayOptions S3网关与http接口使用相同的token、权限、审计日志与限制
+func (s *server) gatewayOptions() *gateway.Options {
+	return &gateway.Options{Authenticator: s.authenticator, Audit: s.audit, Limiter: s.gatewayLimiter}
+}
+
+// newAuth 配置了tokens_file时开启认证，审计日志写入audit_log，默认为标准输出
+func newAuth(conf config.AuthConfig) (auth.Authenticator, *auth.AuditLog, error) {
+	var authenticator auth.Authenticator
+	if conf.TokensFile != "" {
+		tokens, err := auth.LoadTokens(conf.TokensFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		authenticator = auth.NewAuthenticator(tokens)
+	}
+	audit, err := auth.OpenAuditLog(conf.AuditLog)
+	if err != nil {
+		return nil, nil, err
+	}
+	return authenticator, audit, nil
+}
+
+// newTLSReloader 配置了证书时使用https，收到SIGHUP时重新加载证书
+func newTLSReloader(conf config.TLSConfig) (*tlsutil.Reloader, error) {
+	tlsConf := tlsutil.Config{
+		CertFile:     conf.CertFile,
+		KeyFile:      conf.KeyFile,
+		ClientCAFile: conf.ClientCAFile,
+		PeerCAFile:   conf.PeerCAFile,
+	}
+	if !tlsConf.Enabled() {
+		return nil, nil
+	}
+	return tlsutil.NewReloader(tlsConf)
+}
+
+// newPeerClient 访问其他节点使用的client，开启tls时使用本节点的证书作为客户端证书
+// peerToken为访问其他节点时使用的Bearer token，用于从节点复制以及集群节点之间的请求
+func newPeerClient(reloader *tlsutil.Reloader, peerToken string) *http.Client {
+	var transport http.RoundTripper
+	if reloader != nil {
+		base := http.DefaultTransport.(*http.Transport).Clone()
+		base.TLSClientConfig = reloader.ClientConfig()
+		transport = base
+	}
+	if peerToken != "" {
+		transport = &auth.BearerTransport{Secret: peerToken, Base: transport}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// openCluster 启动集群节点，cluster.http_addr为空时使用http(s)://<raft地址的host>:<http端口>
+func (s *server) openCluster() error {
+	conf := s.conf.Cluster
+	httpAddr := conf.HTTPAddr
+	if httpAddr == "" {
+		host, _, err := net.SplitHostPort(conf.RaftAddr)
+		if err != nil {
+			return errors.Wrap(err, "parse cluster raft address failed")
+		}
+		_, port, err := net.SplitHostPort(s.conf.Server.HTTPAddr)
+		if err != nil {
+			return errors.Wrap(err, "parse http address failed")
+		}
+		scheme := "http"
+		if s.tls != nil {
+			scheme = "https"
+		}
+		httpAddr = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port))
+	}
+	node, err := cluster.NewNode(cluster.Config{
+		NodeId:     conf.NodeId,
+		RaftAddr:   conf.RaftAddr,
+		HTTPAddr:   httpAddr,
+		DataDir:    s.conf.Storage.FileStorePath,
+		Bootstrap:  conf.Bootstrap,
+		Join:       conf.Join,
+		Options:    s.storeOpts,
+		HTTPClient: s.peerClient,
+	})
+	if err != nil {
+		return err
+	}
+	gw, err := gateway.NewGatewayWithOptions(node.FileManager(), s.gatewayOptions())
+	if err != nil {
+		node.Shutdown()
+		return err
+	}
+	s.node, s.fs, s.gateway, s.clusterHandler = node, node.FileManager(), gw, node.Handler()
+	return nil
+}
+
+// Close 关闭存储，集群模式下先停止raft，存储仍在后台恢复时等待恢复结束之后再关闭
+func (s *server) Close() error {
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	if atomic.LoadInt32(&s.recovering) == 1 {
+		<-s.recovered
+	}
+	// 恢复失败时已经打开的部分在openStore中关闭
+	if !s.isReady() {
+		return nil
+	}
+	if s.replica != nil {
+		s.replica.Stop()
+	}
+	if s.node != nil {
+		return s.node.Shutdown()
+	}
+	return s.fs.Close()
+}
+
+// errorCode 将存储层的错误转换为http状态码
+func errorCode(err error) int {
+	switch errors.Cause(err) {
+	case utils.ErrIndexNotFound, utils.ErrBucketNotFound:
+		return http.StatusNotFound
+	case utils.ErrBucketExists, utils.ErrBucketNotEmpty, utils.ErrKeyExists:
+		return http.StatusConflict
+	case utils.ErrIdempotencyConflict:
+		return http.StatusUnprocessableEntity
+	case utils.ErrPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case utils.ErrQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case utils.ErrRateLimited, utils.ErrTooManyRequests:
+		return http.StatusTooManyRequests
+	case utils.ErrBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case utils.ErrDecryptionFailed, utils.ErrEncryptionKeyMissing, utils.ErrShardsUnavailable:
+		return http.StatusInternalServerError
+	case utils.ErrReadOnly, utils.ErrNotReady, utils.ErrClosed, utils.ErrShuttingDown:
+		return http.StatusServiceUnavailable
+	case utils.ErrUnauthenticated:
+		return http.StatusUnauthorized
+	case utils.ErrNotLeader:
+		return http.StatusMisdirectedRequest
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func responseError(ctx *gin.Context, err error) {
+	code := errorCode(err)
+	// 限速时告诉客户端多久之后重试，向上取整到秒
+	var quotaErr *utils.QuotaError
+	if errors.As(err, &quotaErr) && quotaErr.RetryAfter > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int((quotaErr.RetryAfter+time.Second-1)/time.Second)))
+	}
+	ctx.JSON(code, model.NewErrorRespWithCode(code, err.Error()))
+}
+
+// bind 解析JSON请求体，请求体超过大小限制时返回413，其他错误与之前一样在响应体中返回
+func bind(ctx *gin.Context, v interface{}) bool {
+	if err := ctx.ShouldBind(v); err != nil {
+		if errors.Cause(err) == utils.ErrBodyTooLarge {
+			responseError(ctx, err)
+		} else {
 			ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
+		}
+		return false
+	}
+	return true
+}
+
+// writeOptionsFromRequest 从请求参数中解析写入选项，key为chunk的id，为空时由服务端生成
+// key参数指定chunk的id，overwrite参数可选fail、replace、ifmatch，ttl参数为存活时间，例如30m，
+// 请求头If-None-Match为*时等同于fail，带有If-Match请求头时等同于ifmatch
+// 通过token认证的写入计入token的用量，并受token配额的限制
+func writeOptionsFromRequest(ctx *gin.Context, key string) (*myfs.WriteOptions, error) {
+	opts := &myfs.WriteOptions{
+		Bucket:  ctx.Query("bucket"),
+		Key:     key,
+		IfMatch: ctx.GetHeader("If-Match"),
+		// 客户端重试时携带相同的Idempotency-Key，可以避免重复写入
+		IdempotencyKey: ctx.GetHeader("Idempotency-Key"),
+	}
+	switch ctx.Query("overwrite") {
+	case "", "replace":
+		opts.Overwrite = myfs.OverwriteReplace
+	case "fail":
+		opts.Overwrite = myfs.OverwriteFail
+	case "ifmatch":
+		opts.Overwrite = myfs.OverwriteIfMatch
+	default:
+		return nil, errors.Errorf("unknown overwrite mode [%s]", ctx.Query("overwrite"))
+	}
+	if ctx.GetHeader("If-None-Match") == "*" {
+		opts.Overwrite = myfs.OverwriteFail
+	} else if opts.IfMatch != "" {
+		opts.Overwrite = myfs.OverwriteIfMatch
+	}
+	if token := auth.IdentityFrom(ctx).Token; token != nil {
+		opts.Owner = token.Id
+		opts.OwnerQuota = myfs.BucketQuota{
+			MaxBytes:          token.Quota.MaxBytes,
+			MaxObjects:        token.Quota.MaxObjects,
+			MaxBytesPerSecond: token.Quota.MaxBytesPerSecond,
+		}
+	}
+	if opts.Key == "" && opts.Overwrite != myfs.OverwriteReplace {
+		return nil, errors.New("overwrite mode requires a key")
+	}
+	if ttl := ctx.Query("ttl"); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return nil, errors.Errorf("invalid ttl [%s], expect a positive duration such as 30m", ttl)
+		}
+		opts.TTL = duration
+	}
+	return opts, nil
+}
+
+// queryBucket 从请求参数中获取bucket，用于权限检查
+func queryBucket(ctx *gin.Context) string {
+	if bucket := ctx.Query("bucket"); bucket != "" {
+		return bucket
+	}
+	return myfs.DefaultBucket
+}
+
+func paramBucket(ctx *gin.Context) string {
+	return ctx.Param("bucket")
+}
+
+// allBuckets 整个服务的管理操作需要对所有bucket的权限
+func allBuckets(*gin.Context) string {
+	return auth.AllBuckets
+}
+
+// registerRoutes 注册所有的接口
+func (s *server) registerRoutes() {
+	// 健康检查在中间件之前注册，不需要认证，存储恢复期间也可以访问
+	s.registerHealthRoutes()
+	// 认证之前检查请求体大小与每个ip的请求频率，认证失败的请求同样被限制
+	// 所有的请求都需要认证，并记录审计日志，之后按token检查请求频率，存储恢复完成之前返回503
+	s.engine.Use(s.metrics.Middleware(), s.limiter.Middleware(nil), auth.Middleware(s.authenticator, s.audit),
+		s.limiter.TokenMiddleware(nil), s.readyGate)
+	s.engine.GET("/metrics", auth.Require(auth.PermAdmin, allBuckets), gin.WrapH(s.metrics.Handler()))
+
+	s.engine.POST("/write", auth.Require(auth.PermWrite, queryBucket), func(ctx *gin.Context) {
+		upData := new(model.UploadData)
+		if !bind(ctx, upData) {
 			return
 		}
 
-		chunkId, err := s.fs.Write([]byte(upData.Data))
+		opts, err := writeOptionsFromRequest(ctx, ctx.Query("key"))
 		if err != nil {
 			ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
 			return
 		}
-		ctx.JSON(http.StatusOK, model.NewSuccessResp(chunkId))
+		if opts.Key == "" {
+			chunkId, err := s.fs.WriteWithOptions([]byte(upData.Data), opts)
+			if err != nil {
+				responseError(ctx, err)
+				return
+			}
+			ctx.JSON(http.StatusOK, model.NewSuccessResp(chunkId))
+			return
+		}
+		index, err := s.fs.WriteWithKey(opts.Key, []byte(upData.Data), opts)
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.Header("ETag", index.ETag)
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(index.BlockId))
 	})
 
-	s.engine.GET("/read", func(ctx *gin.Context) {
+	s.engine.GET("/read", auth.Require(auth.PermRead, queryBucket), func(ctx *gin.Context) {
 		chunkId := ctx.Query("chunkid")
 		if chunkId == "" {
 			ctx.JSON(http.StatusOK, model.NewErrorResp("chunk id can not be empty"))
 			return
 		}
 
-		data, err := s.fs.Read(chunkId)
+		data, index, err := s.fs.ReadWithIndex(chunkId, &myfs.ReadOptions{
+			Bucket:    ctx.Query("bucket"),
+			VersionId: ctx.Query("version_id"),
+		})
 		if err != nil {
-			ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
+			responseError(ctx, err)
 			return
 		}
-
+		// 与写入时返回的ETag相同，开启加密时不是明文的md5
+		ctx.Header("ETag", index.ETag)
 		ctx.JSON(http.StatusOK, model.NewSuccessResp(string(data)))
 	})
 
-	return s.engine.Run(fmt.Sprintf(":%d", defaultHttpPort))
+	s.engine.DELETE("/delete", auth.Require(auth.PermDelete, queryBucket), func(ctx *gin.Context) {
+		chunkId := ctx.Query("chunkid")
+		if chunkId == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("chunk id can not be empty"))
+			return
+		}
+
+		if err := s.fs.DeleteWithOptions(chunkId, &myfs.DeleteOptions{
+			Bucket:    ctx.Query("bucket"),
+			VersionId: ctx.Query("version_id"),
+		}); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(chunkId))
+	})
+
+	s.engine.GET("/stats/compression", auth.Require(auth.PermAdmin, allBuckets), func(ctx *gin.Context) {
+		stats := s.fs.CompressionStats()
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"raw_bytes":         stats.RawBytes,
+			"stored_bytes":      stats.StoredBytes,
+			"compressed_chunks": stats.CompressedChunks,
+			"skipped_chunks":    stats.SkippedChunks,
+			"ratio":             stats.Ratio(),
+		}))
+	})
+
+	// 轮换数据密钥，并通过压缩使用新的密钥重新加密已经封存的文件
+	s.engine.POST("/admin/keys/rotate", auth.Require(auth.PermAdmin, allBuckets), func(ctx *gin.Context) {
+		version, err := s.fs.RotateDataKey()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		stats, err := s.fs.Compact()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"key_version":     version,
+			"segments":        stats.Segments,
+			"reclaimed_bytes": stats.ReclaimedBytes,
+		}))
+	})
+
+	// 重新生成纠删码模式下丢失或损坏的分片
+	s.engine.POST("/admin/repair", auth.Require(auth.PermAdmin, allBuckets), func(ctx *gin.Context) {
+		stats, err := s.fs.RepairShards()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"segments":        stats.Segments,
+			"records":         stats.Records,
+			"repaired_shards": stats.RepairedShards,
+			"lost_records":    stats.LostRecords,
+		}))
+	})
+
+	// 生成读取chunk的预签名url，只有使用token认证的请求可以生成
+	// expires参数为有效期，默认15分钟，超过auth.max_presign_expiry时被缩短
+	s.engine.GET("/presign", auth.Require(auth.PermRead, queryBucket), func(ctx *gin.Context) {
+		chunkId := ctx.Query("chunkid")
+		if chunkId == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("chunk id can not be empty"))
+			return
+		}
+		identity := auth.IdentityFrom(ctx)
+		if identity.Token == nil || identity.Method == auth.MethodPresigned {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("presigned url requires token authentication"))
+			return
+		}
+		expiry := 15 * time.Minute
+		if expires := ctx.Query("expires"); expires != "" {
+			d, err := time.ParseDuration(expires)
+			if err != nil {
+				ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
+				return
+			}
+			if d <= 0 {
+				ctx.JSON(http.StatusOK, model.NewErrorResp("expires must be positive"))
+				return
+			}
+			expiry = d
+		}
+		// 超过配置的最长有效期时缩短到最长有效期
+		maxExpiry := s.conf.Auth.MaxPresignExpiry
+		if maxExpiry == 0 {
+			maxExpiry = auth.MaxPresignExpiry
+		}
+		if expiry > maxExpiry {
+			expiry = maxExpiry
+		}
+		query := url.Values{"chunkid": {chunkId}}
+		if bucket := ctx.Query("bucket"); bucket != "" {
+			query.Set("bucket", bucket)
+		}
+		signed, err := auth.Presign(identity.Token, "/read", query, expiry)
+		if err != nil {
+			ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp("/read?"+signed.Encode()))
+	})
+
+	s.registerObjectRoutes()
+	s.registerBucketRoutes()
+	s.registerReplicationRoutes()
+	s.registerAdminRoutes()
+	if s.conf.Cluster.NodeId != "" {
+		// 集群内部的接口，包括成员管理、线性一致读以及读取其他节点上的记录
+		s.engine.Any("/cluster/*path", auth.Require(auth.PermAdmin, allBuckets), func(ctx *gin.Context) {
+			s.clusterHandler.ServeHTTP(ctx.Writer, ctx.Request)
+		})
+	}
 }
 
-func main() {
-	s, err := newServer()
-	if err != nil {
-		log.Panicln(err)
+// recoverStore 打开存储，完成后开始处理请求，只能调用一次
+func (s *server) recoverStore() error {
+	defer close(s.recovered)
+	start := time.Now()
+	if err := s.openStore(); err != nil {
+		s.recoverErr = err
+		return err
+	}
+	atomic.StoreInt32(&s.ready, 1)
+	log.Printf("store recovered in %s", time.Since(start))
+	return nil
+}
+
+// recoverInBackground 在后台恢复存储，失败时不退出进程，而是通过/readyz报告失败的原因
+func (s *server) recoverInBackground(ctx context.Context) {
+	atomic.StoreInt32(&s.recovering, 1)
+	go func() {
+		if err := s.recoverStore(); err != nil {
+			log.Printf("recover store failed, err=%s", err)
+			return
+		}
+		// 纠删码模式下配置了repair_interval时定期修复丢失的分片
+		if interval := s.conf.Storage.RepairInterval; interval > 0 {
+			go s.repairLoop(ctx, interval)
+		}
+	}()
+}
+
+// recoveryError 恢复失败的原因，恢复仍在进行或者成功时返回nil
+func (s *server) recoveryError() error {
+	select {
+	case <-s.recovered:
+		return s.recoverErr
+	default:
+		return nil
+	}
+}
+
+// Start 启动服务直到ctx被取消，之后拒绝新的写入，等待正在处理的请求完成并关闭存储
+func (s *server) Start(ctx context.Context) error {
+	s.registerRoutes()
+	// 先开始监听，编排系统可以通过/readyz等待恢复完成
+	s.recoverInBackground(ctx)
+
+	// 开启tls时两个端口都使用https
+	if s.tls != nil {
+		s.tls.ReloadOnSignal(ctx.Done())
+	}
+	servers := []*http.Server{
+		s.newHTTPServer(s.conf.Server.HTTPAddr, s.engine),
+		s.newHTTPServer(s.conf.Server.S3Addr, http.HandlerFunc(s.serveGateway)),
 	}
-	defer s.fs.Close()
-	if err = s.Start(); err != nil {
-		log.Panicln(err)
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errCh <- s.serve(srv)
+		}(srv)
+	}
+
+	// shutdown_timeout为退出时等待正在处理的请求完成的最长时间
+	shutdownTimeout := s.conf.Server.ShutdownTimeout
+	select {
+	case err := <-errCh:
+		// 某个端口无法监听，关闭其他端口后退出
+		s.shutdown(servers, shutdownTimeout)
+		return err
+	case <-ctx.Done():
+		return s.shutdown(servers, shutdownTimeout)
 	}
 }
+
+// shutdown 拒绝新的写入，在timeout内等待正在处理的请求完成，之后同步数据文件与checkpoint并关闭存储
+func (s *server) shutdown(servers []*http.Server, timeout time.Duration) error {
+	log.Printf("shutting down, waiting up to %s for in-flight requests", timeout)
+	atomic.StoreInt32(&s.draining, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var firstErr error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "drain requests on %s failed", srv.Addr)
+		}
+	}
+	if err := s.Close(); err != nil && firstErr == nil {
+		firstErr = errors.Wrap(err, "close store failed")
+	}
+	if firstErr == nil {
+		log.Println("shutdown complete")
+	}
+	return firstErr
+}
+
+func (s *server) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if s.tls != nil {
+		srv.TLSConfig = s.tls.ServerConfig()
+	}
+	// Shutdown只等待请求结束，不会取消请求，长连接需要主动结束
+	srv.RegisterOnShutdown(s.stopStreams)
+	return srv
+}
+
+// streaming 包装长连接的处理函数，关闭http服务时取消请求的context，处理函数需要在context取消后返回
+func (s *server) streaming(handler http.Handler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		reqCtx, cancel := context.WithCancel(ctx.Request.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.streams.Done():
+				cancel()
+			case <-reqCtx.Done():
+			}
+		}()
+		handler.ServeHTTP(ctx.Writer, ctx.Request.WithContext(reqCtx))
+	}
+}
+
+// serve 在srv.Addr上启动http服务，配置了证书时使用https，正常关闭时返回nil
+func (s *server) serve(srv *http.Server) error {
+	var err error
+	if s.tls == nil {
+		log.Printf("listening and serving HTTP on %s", srv.Addr)
+		err = srv.ListenAndServe()
+	} else {
+		log.Printf("listening and serving HTTPS on %s", srv.Addr)
+		// 证书由TLSConfig提供
+		err = srv.ListenAndServeTLS("", "")
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *server) repairLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.fs.RepairShards(); err != nil {
+			log.Printf("repair shards failed: %s", err)
+		}
+	}
+}
+
+func (s *server) registerBucketRoutes() {
+	// 只返回有读取权限的bucket
+	s.engine.GET("/buckets", func(ctx *gin.Context) {
+		buckets, err := s.fs.ListBuckets()
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		identity := auth.IdentityFrom(ctx)
+		visible := make([]*myfs.Bucket, 0, len(buckets))
+		for _, bucket := range buckets {
+			if identity.Allowed(bucket.Name, auth.PermRead) {
+				visible = append(visible, bucket)
+			}
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(visible))
+	})
+
+	s.engine.PUT("/buckets/:bucket", auth.Require(auth.PermAdmin, paramBucket), func(ctx *gin.Context) {
+		quota := new(model.BucketQuota)
+		if ctx.Request.ContentLength > 0 {
+			if !bind(ctx, quota) {
+				return
+			}
+		}
+		if err := s.fs.CreateBucket(ctx.Param("bucket"), myfs.BucketQuota{
+			MaxBytes:          quota.MaxBytes,
+			MaxObjects:        quota.MaxObjects,
+			MaxBytesPerSecond: quota.MaxBytesPerSecond,
+		}); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(ctx.Param("bucket")))
+	})
+
+	s.engine.PUT("/buckets/:bucket/quota", auth.Require(auth.PermAdmin, paramBucket), func(ctx *gin.Context) {
+		quota := new(model.BucketQuota)
+		if !bind(ctx, quota) {
+			return
+		}
+		if err := s.fs.SetBucketQuota(ctx.Param("bucket"), myfs.BucketQuota{
+			MaxBytes:          quota.MaxBytes,
+			MaxObjects:        quota.MaxObjects,
+			MaxBytesPerSecond: quota.MaxBytesPerSecond,
+		}); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(ctx.Param("bucket")))
+	})
+
+	s.engine.PUT("/buckets/:bucket/versioning", auth.Require(auth.PermAdmin, paramBucket), func(ctx *gin.Context) {
+		versioning := new(model.BucketVersioning)
+		if !bind(ctx, versioning) {
+			return
+		}
+		if err := s.fs.SetBucketVersioning(ctx.Param("bucket"), versioning.Enabled); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(ctx.Param("bucket")))
+	})
+
+	s.engine.GET("/buckets/:bucket/versions", auth.Require(auth.PermRead, paramBucket), func(ctx *gin.Context) {
+		chunkId := ctx.Query("chunkid")
+		if chunkId == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("chunk id can not be empty"))
+			return
+		}
+		versions, err := s.fs.ListVersions(ctx.Param("bucket"), chunkId)
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(versions))
+	})
+
+	s.engine.GET("/buckets/:bucket", auth.Require(auth.PermRead, paramBucket), func(ctx *gin.Context) {
+		bucket, err := s.fs.GetBucket(ctx.Param("bucket"))
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(bucket))
+	})
+
+	s.engine.DELETE("/buckets/:bucket", auth.Require(auth.PermAdmin, paramBucket), func(ctx *gin.Context) {
+		force, _ := strconv.ParseBool(ctx.Query("force"))
+		if err := s.fs.DeleteBucket(ctx.Param("bucket"), force); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(ctx.Param("bucket")))
+	})
+
+	s.engine.GET("/buckets/:bucket/chunks", auth.Require(auth.PermRead, paramBucket), func(ctx *gin.Context) {
+		limit, _ := strconv.Atoi(ctx.Query("limit"))
+		indexes, err := s.fs.List(ctx.Param("bucket"), &myfs.ListOptions{
+			Prefix:     ctx.Query("prefix"),
+			StartAfter: ctx.Query("start_after"),
+			Limit:      limit,
+		})
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(indexes))
+	})
+}
+
+func (s *server) registerReplicationRoutes() {
+	// 从节点通过该接口持续读取数据文件中的记录
+	// 注册路由时存储还没有打开，每个连接使用打开之后的存储
+	s.engine.GET("/replication/stream", auth.Require(auth.PermAdmin, allBuckets), s.streaming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replication.NewPrimary(s.fs).ServeHTTP(w, r)
+	})))
+
+	s.engine.GET("/replication/status", auth.Require(auth.PermAdmin, allBuckets), func(ctx *gin.Context) {
+		if s.replica == nil || !s.fs.ReadOnly() {
+			ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{"role": "primary"}))
+			return
+		}
+		status := s.replica.Status()
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(gin.H{
+			"role":         "replica",
+			"primary":      status.Primary,
+			"connected":    status.Connected,
+			"applied":      status.Applied,
+			"head":         status.Head,
+			"lag_bytes":    status.LagBytes,
+			"lag_seconds":  status.LagSeconds,
+			"last_contact": status.LastContact,
+			"last_error":   status.LastError,
+		}))
+	})
+
+	// 停止复制并提升为主节点
+	s.engine.POST("/replication/promote", auth.Require(auth.PermAdmin, allBuckets), func(ctx *gin.Context) {
+		if s.replica == nil || !s.fs.ReadOnly() {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("node is already primary"))
+			return
+		}
+		if err := s.replica.Promote(); err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, model.NewSuccessResp("promoted"))
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"my-fs/config"
+	myfs "my-fs/fs"
+	"my-fs/replication"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newUnstartedServer 创建注册了路由但是还没有打开存储的server
+func newUnstartedServer(t *testing.T, dir string) *server {
+	gin.SetMode(gin.TestMode)
+	conf := config.Default()
+	conf.Storage.FileStorePath = filepath.Join(dir, "data")
+	conf.Storage.IndexStorePath = filepath.Join(dir, "index")
+	conf.Auth.AuditLog = filepath.Join(dir, "audit.log")
+	s, err := newServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.registerRoutes()
+	return s
+}
+
+// TestServer_ShutdownWithReplica 从节点的复制长连接不会阻塞退出
+func TestServer_ShutdownWithReplica(t *testing.T) {
+	dir := t.TempDir()
+	s := newUnstartedServer(t, dir)
+	if err := s.recoverStore(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := s.newHTTPServer(ln.Addr().String(), s.engine)
+	go srv.Serve(ln)
+
+	fm, err := myfs.NewFileManager(filepath.Join(dir, "replica-data"), filepath.Join(dir, "replica-index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	replica := replication.NewReplica(fm, "http://"+ln.Addr().String())
+	replica.Start()
+	defer replica.Stop()
+	for deadline := time.Now().Add(5 * time.Second); !replica.Status().Connected; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("replica should connect to the primary")
+		}
+	}
+
+	start := time.Now()
+	if err = s.shutdown([]*http.Server{srv}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("shutdown should not wait for the replication stream, took %s", elapsed)
+	}
+}
+
+// TestServer_RecoveryFailure 恢复失败时进程不退出，/readyz返回失败的原因
+func TestServer_RecoveryFailure(t *testing.T) {
+	dir := t.TempDir()
+	s := newUnstartedServer(t, dir)
+	// 数据目录的位置是一个文件，无法打开存储
+	if err := ioutil.WriteFile(s.conf.Storage.FileStorePath, []byte("not a dir"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.recoverInBackground(context.Background())
+	<-s.recovered
+
+	recorder := httptest.NewRecorder()
+	s.engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "recovery failed") {
+		t.Fatalf("readyz should report the recovery error, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServer_CloseDuringRecovery 恢复期间关闭时等待恢复结束并关闭打开的存储
+func TestServer_CloseDuringRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s := newUnstartedServer(t, dir)
+	s.recoverInBackground(context.Background())
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fm, err := myfs.NewFileManager(s.conf.Storage.FileStorePath, s.conf.Storage.IndexStorePath)
+	if err != nil {
+		t.Fatalf("store should be closed after close, got %s", err)
+	}
+	fm.Close()
+}
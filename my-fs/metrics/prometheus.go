@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	myfs "my-fs/fs"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "myfs"
+
+var _ myfs.Metrics = &Prometheus{}
+
+// Prometheus 将FileManager以及http请求的指标导出为prometheus格式
+type Prometheus struct {
+	registry *prometheus.Registry
+
+	operations       *prometheus.CounterVec
+	operationLatency *prometheus.HistogramVec
+	bytesWritten     prometheus.Counter
+	bytesRead        prometheus.Counter
+	fsyncLatency     prometheus.Histogram
+	segments         prometheus.Gauge
+	segmentBytes     *prometheus.GaugeVec
+	indexBytes       prometheus.Gauge
+	checkpointSeq    prometheus.Gauge
+	checkpointOffset prometheus.Gauge
+	cacheRequests    *prometheus.CounterVec
+	cacheHitRatio    prometheus.GaugeFunc
+	recoverySeconds  prometheus.Gauge
+	httpRequests     *prometheus.CounterVec
+	httpLatency      *prometheus.HistogramVec
+	httpRejected     *prometheus.CounterVec
+
+	// 计算缓存命中率
+	cacheMutx               sync.Mutex
+	cacheHits, cacheLookups uint64
+}
+
+// NewPrometheus 创建指标并注册到新的registry中，同时包括go运行时以及进程的指标
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Number of chunk operations by type and result.",
+		}, []string{"op", "result"}),
+		operationLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of chunk operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"op"}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "written_bytes_total",
+			Help:      "Bytes of chunk data written.",
+		}),
+		bytesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "read_bytes_total",
+			Help:      "Bytes of chunk data read.",
+		}),
+		fsyncLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fsync_duration_seconds",
+			Help:      "Latency of fsync on data files.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		segments: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "segments",
+			Help:      "Number of data files.",
+		}),
+		segmentBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "segment_bytes",
+			Help:      "Size of each data file.",
+		}, []string{"segment"}),
+		indexBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "index_bytes",
+			Help:      "Disk space used by the index store.",
+		}),
+		checkpointSeq: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "checkpoint_file_sequence",
+			Help:      "Sequence of the data file currently written.",
+		}),
+		checkpointOffset: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "checkpoint_offset_bytes",
+			Help:      "Write offset in the current data file.",
+		}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_requests_total",
+			Help:      "Read cache lookups by result.",
+		}, []string{"result"}),
+		recoverySeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "recovery_duration_seconds",
+			Help:      "Time spent recovering the checkpoint at startup.",
+		}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route and status code.",
+		}, []string{"method", "route", "code"}),
+		httpLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		httpRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_rejected_requests_total",
+			Help:      "Number of HTTP requests rejected by size or rate limits.",
+		}, []string{"route", "reason"}),
+	}
+	p.cacheHitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_hit_ratio",
+		Help:      "Ratio of read cache lookups that hit since startup.",
+	}, p.hitRatio)
+
+	p.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		p.operations, p.operationLatency, p.bytesWritten, p.bytesRead, p.fsyncLatency,
+		p.segments, p.segmentBytes, p.indexBytes, p.checkpointSeq, p.checkpointOffset,
+		p.cacheRequests, p.cacheHitRatio, p.recoverySeconds, p.httpRequests, p.httpLatency,
+		p.httpRejected,
+	)
+	return p
+}
+
+// Handler 返回/metrics接口
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware 统计http请求的数量与耗时，route为注册的路由，没有匹配的请求记为unmatched
+func (p *Prometheus) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		p.httpRequests.WithLabelValues(method, route, strconv.Itoa(ctx.Writer.Status())).Inc()
+		p.httpLatency.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RejectRequest 统计被limits拒绝的请求
+func (p *Prometheus) RejectRequest(route, reason string) {
+	p.httpRejected.WithLabelValues(route, reason).Inc()
+}
+
+func (p *Prometheus) ObserveOperation(op myfs.Operation, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	p.operations.WithLabelValues(string(op), result).Inc()
+	p.operationLatency.WithLabelValues(string(op)).Observe(d.Seconds())
+}
+
+func (p *Prometheus) AddBytesWritten(n int) {
+	p.bytesWritten.Add(float64(n))
+}
+
+func (p *Prometheus) AddBytesRead(n int) {
+	p.bytesRead.Add(float64(n))
+}
+
+func (p *Prometheus) ObserveFsync(d time.Duration) {
+	p.fsyncLatency.Observe(d.Seconds())
+}
+
+func (p *Prometheus) SetSegments(sizes map[int]int64) {
+	p.segments.Set(float64(len(sizes)))
+	// 被压缩删除的文件不再导出
+	p.segmentBytes.Reset()
+	for seq, size := range sizes {
+		p.segmentBytes.WithLabelValues(fmt.Sprintf("%06d", seq)).Set(float64(size))
+	}
+}
+
+func (p *Prometheus) SetIndexSize(bytes int64) {
+	p.indexBytes.Set(float64(bytes))
+}
+
+func (p *Prometheus) SetCheckpoint(seq int, offset int) {
+	p.checkpointSeq.Set(float64(seq))
+	p.checkpointOffset.Set(float64(offset))
+}
+
+func (p *Prometheus) CacheAccess(hit bool) {
+	result := "miss"
+	p.cacheMutx.Lock()
+	p.cacheLookups++
+	if hit {
+		p.cacheHits++
+		result = "hit"
+	}
+	p.cacheMutx.Unlock()
+	p.cacheRequests.WithLabelValues(result).Inc()
+}
+
+func (p *Prometheus) hitRatio() float64 {
+	p.cacheMutx.Lock()
+	defer p.cacheMutx.Unlock()
+	if p.cacheLookups == 0 {
+		return 0
+	}
+	return float64(p.cacheHits) / float64(p.cacheLookups)
+}
+
+func (p *Prometheus) ObserveRecovery(d time.Duration) {
+	p.recoverySeconds.Set(d.Seconds())
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	myfs "my-fs/fs"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPrometheus(t *testing.T) {
+	dir := t.TempDir()
+	p := NewPrometheus()
+	fm, err := myfs.NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&myfs.Options{Metrics: p, CacheSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(p.Middleware())
+	engine.GET("/read/:id", func(ctx *gin.Context) {
+		data, err := fm.Read(ctx.Param("id"))
+		if err != nil {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		ctx.Data(http.StatusOK, "application/octet-stream", data)
+	})
+	engine.GET("/metrics", gin.WrapH(p.Handler()))
+
+	id, err := fm.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/read/" + id, "/read/" + id, "/read/missing", "/unknown"} {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	p.RejectRequest("/read/:id", "rate_limited")
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, expect := range []string{
+		`myfs_operations_total{op="write",result="success"} 1`,
+		`myfs_operations_total{op="read",result="success"} 2`,
+		`myfs_operations_total{op="read",result="error"} 1`,
+		`myfs_written_bytes_total 5`,
+		`myfs_read_bytes_total 10`,
+		`myfs_fsync_duration_seconds_count 1`,
+		`myfs_cache_requests_total{result="hit"} 1`,
+		`myfs_cache_hit_ratio 0.5`,
+		`myfs_recovery_duration_seconds`,
+		`myfs_http_requests_total{code="200",method="GET",route="/read/:id"} 2`,
+		`myfs_http_requests_total{code="404",method="GET",route="/read/:id"} 1`,
+		`myfs_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`myfs_http_rejected_requests_total{reason="rate_limited",route="/read/:id"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), expect) {
+			t.Errorf("metrics do not contain %s", expect)
+		}
+	}
+}
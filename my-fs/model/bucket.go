@@ -0,0 +1,11 @@
+package model
+
+type BucketQuota struct {
+	MaxBytes          int64 `json:"max_bytes"`
+	MaxObjects        int64 `json:"max_objects"`
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second"`
+}
+
+type BucketVersioning struct {
+	Enabled bool `json:"enabled"`
+}
@@ -19,3 +19,10 @@ func NewErrorResp(err string) Response {
 		Err:  err,
 	}
 }
+
+func NewErrorRespWithCode(code int, err string) Response {
+	return Response{
+		Code: code,
+		Err:  err,
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"my-fs/auth"
+	myfs "my-fs/fs"
+	"my-fs/model"
+	"my-fs/utils"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// objectKey 返回路径中的key，去掉通配符参数开头的/
+func objectKey(ctx *gin.Context) string {
+	return strings.TrimPrefix(ctx.Param("key"), "/")
+}
+
+// registerObjectRoutes 以原始二进制读写chunk的接口，不需要把数据编码为JSON字符串
+func (s *server) registerObjectRoutes() {
+	s.engine.GET("/stat", auth.Require(auth.PermRead, queryBucket), func(ctx *gin.Context) {
+		chunkId := ctx.Query("chunkid")
+		if chunkId == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("chunk id can not be empty"))
+			return
+		}
+		index, err := s.fs.Stat(chunkId, &myfs.ReadOptions{
+			Bucket:    ctx.Query("bucket"),
+			VersionId: ctx.Query("version_id"),
+		})
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.Header("ETag", index.ETag)
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(index))
+	})
+
+	// 请求体为chunk的原始数据，写入选项与/write相同，bucket与key来自路径
+	s.engine.PUT("/objects/:bucket/*key", auth.Require(auth.PermWrite, paramBucket), func(ctx *gin.Context) {
+		key := objectKey(ctx)
+		if key == "" {
+			ctx.JSON(http.StatusOK, model.NewErrorResp("key can not be empty"))
+			return
+		}
+		opts, err := writeOptionsFromRequest(ctx, key)
+		if err != nil {
+			ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
+			return
+		}
+		data, err := ioutil.ReadAll(ctx.Request.Body)
+		if errors.Cause(err) == utils.ErrBodyTooLarge {
+			responseError(ctx, err)
+			return
+		} else if err != nil {
+			ctx.JSON(http.StatusOK, model.NewErrorResp(err.Error()))
+			return
+		}
+		opts.Bucket = ctx.Param("bucket")
+		index, err := s.fs.WriteWithKey(key, data, opts)
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.Header("ETag", index.ETag)
+		ctx.JSON(http.StatusOK, model.NewSuccessResp(index))
+	})
+
+	// 响应体为chunk的原始数据，出错时返回JSON
+	s.engine.GET("/objects/:bucket/*key", auth.Require(auth.PermRead, paramBucket), func(ctx *gin.Context) {
+		data, index, err := s.fs.ReadWithIndex(objectKey(ctx), &myfs.ReadOptions{
+			Bucket:    ctx.Param("bucket"),
+			VersionId: ctx.Query("version_id"),
+		})
+		if err != nil {
+			responseError(ctx, err)
+			return
+		}
+		ctx.Header("ETag", index.ETag)
+		ctx.Data(http.StatusOK, "application/octet-stream", data)
+	})
+}
@@ -0,0 +1,108 @@
+package replication
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	myfs "my-fs/fs"
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxBatchBytes 每个batch最多包含的记录字节数
+	maxBatchBytes = 1024 * 1024
+	// heartbeatInterval 没有新数据时发送心跳的间隔，心跳中带有主节点的写入位置，用于计算复制延迟，
+	// 以及没有写入数据文件的bucket、数据密钥与用量的修改
+	heartbeatInterval = time.Second
+)
+
+// frame 复制连接中的一条消息，每条消息是一行json
+type frame struct {
+	Batch *myfs.LogBatch `json:",omitempty"`
+	// 从节点的位置已经被压缩，需要重新同步
+	Resync bool   `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// Primary 主节点的复制服务，从节点通过一个长连接持续读取数据文件中的记录
+type Primary struct {
+	fs *myfs.FileManager
+}
+
+func NewPrimary(fs *myfs.FileManager) *Primary {
+	return &Primary{fs: fs}
+}
+
+// ServeHTTP 从seq和offset参数指定的位置开始推送记录，直到从节点断开连接或者请求的context被取消
+func (p *Primary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pos, err := parsePosition(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+
+	var lastSent time.Time
+	for {
+		// ReadLog需要持有写锁，追上主节点之后只在有新的记录或者需要发送心跳时读取
+		appended := p.fs.LogAppended()
+		batch, err := p.fs.ReadLog(pos, maxBatchBytes)
+		if err != nil {
+			// 出错后发送最后一条消息，由从节点决定重连还是重新同步
+			_ = encoder.Encode(&frame{Resync: errors.Cause(err) == utils.ErrLogCompacted, Error: err.Error()})
+			flusher.Flush()
+			return
+		}
+		if len(batch.Data) > 0 || batch.Next != pos || time.Since(lastSent) >= heartbeatInterval {
+			if err = encoder.Encode(&frame{Batch: batch}); err != nil {
+				return
+			}
+			flusher.Flush()
+			lastSent = time.Now()
+		}
+		pos = batch.Next
+		// 服务关闭时请求的context被取消，即使还有没有发送的数据也立即结束
+		if r.Context().Err() != nil {
+			return
+		}
+		if batch.PendingBytes > 0 {
+			continue
+		}
+		heartbeat := time.NewTimer(heartbeatInterval - time.Since(lastSent))
+		select {
+		case <-r.Context().Done():
+			heartbeat.Stop()
+			return
+		case <-appended:
+			heartbeat.Stop()
+		case <-heartbeat.C:
+		}
+	}
+}
+
+func parsePosition(r *http.Request) (myfs.LogPosition, error) {
+	var pos myfs.LogPosition
+	var err error
+	if seq := r.URL.Query().Get("seq"); seq != "" {
+		if pos.Seq, err = strconv.Atoi(seq); err != nil {
+			return pos, errors.Wrap(err, "invalid seq")
+		}
+	}
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		if pos.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			return pos, errors.Wrap(err, "invalid offset")
+		}
+	}
+	return pos, nil
+}
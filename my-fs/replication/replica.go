@@ -0,0 +1,189 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	myfs "my-fs/fs"
+
+	"github.com/pkg/errors"
+)
+
+// retryInterval 连接断开后重新连接主节点的间隔
+const retryInterval = time.Second
+
+// Status 从节点的复制状态
+type Status struct {
+	Primary   string
+	Connected bool
+	// 已经应用的主节点位置以及主节点当前的写入位置
+	Applied myfs.LogPosition
+	Head    myfs.LogPosition
+	// 还没有复制的字节数
+	LagBytes int64
+	// 距离上一次追上主节点的时间，追上时为0
+	LagSeconds  float64
+	LastContact time.Time `json:",omitempty"`
+	LastError   string    `json:",omitempty"`
+}
+
+// Replica 从节点，持续从主节点复制数据文件中的记录并提供只读服务
+// 幂等key的记录不会被复制，从节点提升为主节点后，之前的幂等key会失效
+type Replica struct {
+	fs         *myfs.FileManager
+	primaryURL string
+	client     *http.Client
+
+	mutx       sync.Mutex
+	status     Status
+	caughtUpAt time.Time
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// NewReplica 创建从节点，primaryURL为主节点http服务的地址，例如http://127.0.0.1:8080
+func NewReplica(fs *myfs.FileManager, primaryURL string) *Replica {
+	return NewReplicaWithClient(fs, primaryURL, &http.Client{})
+}
+
+// NewReplicaWithClient 使用client访问主节点，主节点开启认证时由client携带凭证
+func NewReplicaWithClient(fs *myfs.FileManager, primaryURL string, client *http.Client) *Replica {
+	return &Replica{
+		fs:         fs,
+		primaryURL: strings.TrimSuffix(primaryURL, "/"),
+		client:     client,
+		status:     Status{Primary: primaryURL},
+	}
+}
+
+// Start 将存储设置为只读，并在后台开始复制
+func (r *Replica) Start() {
+	r.fs.SetReadOnly(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.caughtUpAt = time.Now()
+	go r.run(ctx)
+}
+
+// Stop 停止复制，存储仍然只读
+func (r *Replica) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+}
+
+// Promote 停止复制并提升为主节点，之后的写入不会再与原来的主节点同步
+func (r *Replica) Promote() error {
+	r.Stop()
+	return r.fs.Promote()
+}
+
+// Status 获取复制状态
+func (r *Replica) Status() Status {
+	r.mutx.Lock()
+	defer r.mutx.Unlock()
+
+	status := r.status
+	if status.LagBytes > 0 {
+		status.LagSeconds = time.Since(r.caughtUpAt).Seconds()
+	}
+	return status
+}
+
+func (r *Replica) run(ctx context.Context) {
+	defer close(r.done)
+	for {
+		err := r.follow(ctx)
+		r.mutx.Lock()
+		r.status.Connected = false
+		if err != nil {
+			r.status.LastError = err.Error()
+		}
+		r.mutx.Unlock()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("replicate from %s failed: %s", r.primaryURL, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// follow 连接主节点并应用收到的batch，直到连接断开
+func (r *Replica) follow(ctx context.Context) error {
+	pos, err := r.fs.ReplicaPosition()
+	if err != nil {
+		return err
+	}
+	if pos.Seq == 0 {
+		// 从头开始复制，清理上一次没有完成的同步
+		if err = r.fs.ResetReplica(); err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%s/replication/stream?seq=%d&offset=%d", r.primaryURL, pos.Seq, pos.Offset)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "connect to primary failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("primary responded with status %d", resp.StatusCode)
+	}
+
+	r.mutx.Lock()
+	r.status.Connected = true
+	r.mutx.Unlock()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		f := &frame{}
+		if err = decoder.Decode(f); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "read from primary failed")
+		}
+		if f.Resync {
+			log.Printf("replica fell behind compaction on primary, resync: %s", f.Error)
+			return r.fs.ResetReplica()
+		}
+		if f.Error != "" {
+			return errors.New(f.Error)
+		}
+		if err = r.fs.ApplyLog(f.Batch); err != nil {
+			return err
+		}
+		r.updateStatus(f.Batch)
+	}
+}
+
+func (r *Replica) updateStatus(batch *myfs.LogBatch) {
+	r.mutx.Lock()
+	defer r.mutx.Unlock()
+
+	now := time.Now()
+	r.status.Applied = batch.Next
+	r.status.Head = batch.Head
+	r.status.LagBytes = batch.PendingBytes
+	r.status.LastContact = now
+	r.status.LastError = ""
+	if batch.PendingBytes == 0 {
+		r.caughtUpAt = now
+	}
+}
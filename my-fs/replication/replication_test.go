@@ -0,0 +1,226 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	myfs "my-fs/fs"
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+func newTestNode(t *testing.T, opts *myfs.Options) *myfs.FileManager {
+	dir := t.TempDir()
+	fm, err := myfs.NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	return fm
+}
+
+func newTestPrimary(t *testing.T, fm *myfs.FileManager) string {
+	mux := http.NewServeMux()
+	mux.Handle("/replication/stream", NewPrimary(fm))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func waitUntil(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readEquals(fm *myfs.FileManager, id string, opts *myfs.ReadOptions, expect []byte) bool {
+	data, err := fm.ReadWithOptions(id, opts)
+	return err == nil && bytes.Equal(data, expect)
+}
+
+func isNotFound(fm *myfs.FileManager, id string, opts *myfs.ReadOptions) bool {
+	_, err := fm.ReadWithOptions(id, opts)
+	return errors.Cause(err) == utils.ErrIndexNotFound
+}
+
+func TestReplica_FollowsPrimary(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{1}, myfs.MasterKeySize)
+	primary := newTestNode(t, &myfs.Options{MaxFileSize: 512, MasterKey: masterKey})
+	replica := newTestNode(t, &myfs.Options{MaxFileSize: 512, MasterKey: masterKey})
+
+	// 复制开始之前写入的数据
+	for i := 0; i < 10; i++ {
+		if _, err := primary.WriteWithKey(fmt.Sprintf("key-%d", i), bytes.Repeat([]byte{byte(i)}, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := primary.CreateBucket("versioned", myfs.BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.SetBucketVersioning("versioned", true); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := primary.WriteWithKey("doc", []byte("v1"), &myfs.WriteOptions{Bucket: "versioned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReplica(replica, newTestPrimary(t, primary))
+	r.Start()
+	defer r.Stop()
+	waitUntil(t, "initial sync", func() bool { return readEquals(replica, "doc", &myfs.ReadOptions{Bucket: "versioned"}, []byte("v1")) })
+	for i := 0; i < 10; i++ {
+		if !readEquals(replica, fmt.Sprintf("key-%d", i), nil, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatalf("key-%d is not replicated", i)
+		}
+	}
+
+	// 复制过程中的写入、覆盖、删除以及版本
+	if _, err = primary.WriteWithKey("key-0", []byte("overwritten"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = primary.Delete("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = primary.WriteWithKey("doc", []byte("v2"), &myfs.WriteOptions{Bucket: "versioned"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = primary.CreateBucket("late", myfs.BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "doc v2", func() bool { return readEquals(replica, "doc", &myfs.ReadOptions{Bucket: "versioned"}, []byte("v2")) })
+	if !readEquals(replica, "key-0", nil, []byte("overwritten")) {
+		t.Fatal("overwrite is not replicated")
+	}
+	if !isNotFound(replica, "key-1", nil) {
+		t.Fatal("delete is not replicated")
+	}
+	if !readEquals(replica, "doc", &myfs.ReadOptions{Bucket: "versioned", VersionId: v1.VersionId}, []byte("v1")) {
+		t.Fatal("old version is not replicated")
+	}
+	waitUntil(t, "bucket creation", func() bool {
+		_, err := replica.GetBucket("late")
+		return err == nil
+	})
+
+	// 永久删除最新版本后，上一个版本重新成为最新版本
+	versions, err := primary.ListVersions("versioned", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = primary.DeleteWithOptions("doc", &myfs.DeleteOptions{Bucket: "versioned", VersionId: versions[0].VersionId}); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "version purge", func() bool { return readEquals(replica, "doc", &myfs.ReadOptions{Bucket: "versioned"}, []byte("v1")) })
+
+	waitUntil(t, "caught up", func() bool {
+		status := r.Status()
+		return status.Connected && status.LagBytes == 0 && status.Applied == status.Head
+	})
+	if _, err = replica.Write([]byte("local")); errors.Cause(err) != utils.ErrReadOnly {
+		t.Fatalf("replica should be read only, got %v", err)
+	}
+
+	// 提升为主节点后可以写入
+	if err = r.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = replica.WriteWithKey("after-promote", []byte("new primary"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !readEquals(replica, "after-promote", nil, []byte("new primary")) || !readEquals(replica, "key-0", nil, []byte("overwritten")) {
+		t.Fatal("promoted replica should serve old and new data")
+	}
+}
+
+func TestReplica_ResyncAfterCompaction(t *testing.T) {
+	primary := newTestNode(t, &myfs.Options{MaxFileSize: 256})
+	replica := newTestNode(t, &myfs.Options{MaxFileSize: 256})
+	url := newTestPrimary(t, primary)
+
+	payload := make([]byte, 100)
+	for i := 0; i < 6; i++ {
+		if _, err := primary.WriteWithKey(fmt.Sprintf("key-%d", i), payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReplica(replica, url)
+	r.Start()
+	waitUntil(t, "initial sync", func() bool { return readEquals(replica, "key-5", nil, payload) })
+	r.Stop()
+
+	// 从节点停止期间，删除记录被压缩丢弃，从节点只能重新同步
+	for i := 0; i < 3; i++ {
+		if err := primary.Delete(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := primary.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := primary.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewReplica(replica, url)
+	r.Start()
+	defer r.Stop()
+	waitUntil(t, "resync", func() bool { return isNotFound(replica, "key-0", nil) && readEquals(replica, "key-5", nil, payload) })
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("key-%d", i)
+		if i < 3 && !isNotFound(replica, id, nil) {
+			t.Fatalf("%s should be deleted on replica", id)
+		}
+		if i >= 3 && !readEquals(replica, id, nil, payload) {
+			t.Fatalf("%s should survive resync", id)
+		}
+	}
+	waitUntil(t, "caught up", func() bool {
+		status := r.Status()
+		return status.LagBytes == 0 && status.Applied == status.Head
+	})
+}
+
+// TestPrimary_WakesOnAppend 追上主节点之后不再轮询，写入之后立即推送，没有写入时只发送心跳
+func TestPrimary_WakesOnAppend(t *testing.T) {
+	fm := newTestNode(t, nil)
+	resp, err := http.Get(newTestPrimary(t, fm) + "/replication/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&frame{}); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		fm.WriteWithKey("a", []byte("hello"), nil)
+		written <- time.Now()
+	}()
+	f := &frame{}
+	if err = decoder.Decode(f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Batch == nil || len(f.Batch.Data) == 0 {
+		t.Fatalf("expect the new record, got %+v", f)
+	}
+	if delay := time.Since(<-written); delay > heartbeatInterval/2 {
+		t.Fatalf("record should be pushed on append, took %s", delay)
+	}
+}
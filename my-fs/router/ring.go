@@ -0,0 +1,118 @@
+package router
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes 每个节点在ring上的虚拟节点数量
+const DefaultVirtualNodes = 128
+
+// Ring 一致性哈希环，每个节点对应多个虚拟节点，使key在节点之间均匀分布，
+// 增加或删除一个节点时只有该节点相邻区间的key需要移动
+type Ring struct {
+	virtualNodes int
+	hashes       []uint32
+	owners       map[uint32]string
+	nodes        map[string]bool
+}
+
+func NewRing(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint32]string),
+		nodes:        make(map[string]bool),
+	}
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// Add 将节点加入ring，节点已经存在时不做任何修改
+func (r *Ring) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	r.addVirtualNodes(node)
+	r.rebuild()
+}
+
+func (r *Ring) addVirtualNodes(node string) {
+	for i := 0; i < r.virtualNodes; i++ {
+		h := hashKey(node + "#" + strconv.Itoa(i))
+		// 哈希冲突时保留字典序较小的节点，保证结果与加入顺序无关
+		if owner, ok := r.owners[h]; ok && owner < node {
+			continue
+		}
+		r.owners[h] = node
+	}
+}
+
+// Remove 将节点移出ring
+func (r *Ring) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	// 重新计算所有的虚拟节点，被冲突覆盖的其他节点的虚拟节点需要恢复
+	r.owners = make(map[uint32]string)
+	for n := range r.nodes {
+		r.addVirtualNodes(n)
+	}
+	r.rebuild()
+}
+
+func (r *Ring) rebuild() {
+	r.hashes = r.hashes[:0]
+	for h := range r.owners {
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Get 返回key所属的节点，即ring上顺时针方向的第一个虚拟节点，ring为空时返回空字符串
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// Has 节点是否在ring中
+func (r *Ring) Has(node string) bool {
+	return r.nodes[node]
+}
+
+// Nodes 返回所有的节点，按字典序排序
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// clone 复制ring，修改副本不影响原来的ring
+func (r *Ring) clone() *Ring {
+	c := NewRing(r.virtualNodes)
+	for h, owner := range r.owners {
+		c.owners[h] = owner
+	}
+	for node := range r.nodes {
+		c.nodes[node] = true
+	}
+	c.hashes = append(c.hashes, r.hashes...)
+	return c
+}
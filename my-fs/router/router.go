@@ -0,0 +1,411 @@
+package router
+
+import (
+	"log"
+	"sync"
+
+	myfs "my-fs/fs"
+	"my-fs/utils"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// listPageSize 迁移时每次列出的索引数量
+const listPageSize = 256
+
+// idempotencyNamespace 根据幂等key生成chunk id使用的命名空间
+var idempotencyNamespace = uuid.MustParse("6f0b5c1e-6d1a-4c55-9a59-3f6b7a0f2c11")
+
+// Backend 路由的后端存储，FileManager实现了该接口
+type Backend interface {
+	myfs.FS
+	WriteWithKey(key string, data []byte, opts *myfs.WriteOptions) (*myfs.BlockIndex, error)
+	ReadWithOptions(blockId string, opts *myfs.ReadOptions) ([]byte, error)
+	DeleteWithOptions(blockId string, opts *myfs.DeleteOptions) error
+	CreateBucket(name string, quota myfs.BucketQuota) error
+	SetBucketVersioning(name string, enabled bool) error
+	ListBuckets() ([]*myfs.Bucket, error)
+	List(bucket string, opts *myfs.ListOptions) ([]*myfs.BlockIndex, error)
+}
+
+var _ Backend = &myfs.FileManager{}
+var _ myfs.FS = &Router{}
+
+// Router 将chunk分散保存到多个后端，chunk所在的后端由bucket和id在一致性哈希环上的位置决定，
+// 因此返回的id与单机时相同，不需要额外保存chunk的位置
+// 增加或删除后端时，位置发生变化的chunk会被移动到新的后端，移动过程中仍然可以读写
+type Router struct {
+	mutx     sync.RWMutex
+	ring     *Ring
+	backends map[string]Backend
+	// 正在迁移时为true，此时在所属的后端中找不到的chunk会在其他后端中查找
+	rebalancing bool
+
+	// 保证同一时间只有一次迁移
+	rebalanceMutx sync.Mutex
+	// 写入和删除持有读锁，移动单个chunk时持有写锁，避免移动覆盖新写入的数据或者恢复已经删除的数据
+	moveMutx sync.RWMutex
+}
+
+// RebalanceStats 一次迁移的统计
+type RebalanceStats struct {
+	// 移动的chunk数量
+	Moved int
+	// 移动的数据量
+	MovedBytes int64
+}
+
+// NewRouter 使用已有的后端创建Router，后端中已经保存的chunk必须在ring上对应的位置，
+// 否则需要调用Rebalance移动
+func NewRouter(backends map[string]Backend, virtualNodes int) *Router {
+	r := &Router{ring: NewRing(virtualNodes), backends: make(map[string]Backend)}
+	for name, backend := range backends {
+		r.ring.Add(name)
+		r.backends[name] = backend
+	}
+	return r
+}
+
+// shardKey chunk在ring上的key，不同bucket中相同的id分布在不同的后端
+func shardKey(bucket, id string) string {
+	if bucket == "" {
+		bucket = myfs.DefaultBucket
+	}
+	return bucket + "/" + id
+}
+
+// locate 返回chunk所属的后端
+func (r *Router) locate(bucket, id string) (string, Backend, error) {
+	r.mutx.RLock()
+	defer r.mutx.RUnlock()
+	name := r.ring.Get(shardKey(bucket, id))
+	if name == "" {
+		return "", nil, utils.ErrNoBackend
+	}
+	return name, r.backends[name], nil
+}
+
+// Locate 返回chunk所属的后端的名字
+func (r *Router) Locate(bucket, id string) (string, error) {
+	name, _, err := r.locate(bucket, id)
+	return name, err
+}
+
+// Nodes 返回ring中所有后端的名字
+func (r *Router) Nodes() []string {
+	r.mutx.RLock()
+	defer r.mutx.RUnlock()
+	return r.ring.Nodes()
+}
+
+// others 返回除name以外的所有后端，迁移时用于查找还没有移动的chunk
+func (r *Router) others(name string) []Backend {
+	r.mutx.RLock()
+	defer r.mutx.RUnlock()
+	if !r.rebalancing {
+		return nil
+	}
+	backends := make([]Backend, 0, len(r.backends))
+	for n, backend := range r.backends {
+		if n != name {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+func (r *Router) Write(data []byte) (string, error) {
+	return r.WriteWithOptions(data, nil)
+}
+
+// WriteWithOptions 生成id后写入id所属的后端
+// 带有幂等key时id由幂等key生成，重试的请求会发送到同一个后端，由后端去重
+func (r *Router) WriteWithOptions(data []byte, opts *myfs.WriteOptions) (string, error) {
+	keyOpts := myfs.WriteOptions{}
+	if opts != nil {
+		keyOpts = *opts
+	}
+	id := keyOpts.Key
+	if id == "" {
+		if keyOpts.IdempotencyKey != "" {
+			id = uuid.NewSHA1(idempotencyNamespace, []byte(shardKey(keyOpts.Bucket, keyOpts.IdempotencyKey))).String()
+		} else {
+			id = uuid.New().String()
+		}
+	}
+	index, err := r.WriteWithKey(id, data, &keyOpts)
+	if err != nil {
+		return "", err
+	}
+	return index.BlockId, nil
+}
+
+// WriteWithKey 使用指定的key写入所属的后端
+func (r *Router) WriteWithKey(key string, data []byte, opts *myfs.WriteOptions) (*myfs.BlockIndex, error) {
+	bucket := ""
+	if opts != nil {
+		bucket = opts.Bucket
+	}
+	r.moveMutx.RLock()
+	defer r.moveMutx.RUnlock()
+	_, backend, err := r.locate(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return backend.WriteWithKey(key, data, opts)
+}
+
+func (r *Router) Read(blockId string) ([]byte, error) {
+	return r.ReadWithOptions(blockId, nil)
+}
+
+// ReadWithOptions 从所属的后端读取，迁移过程中找不到时在其他后端中查找
+func (r *Router) ReadWithOptions(blockId string, opts *myfs.ReadOptions) ([]byte, error) {
+	bucket := ""
+	if opts != nil {
+		bucket = opts.Bucket
+	}
+	name, backend, err := r.locate(bucket, blockId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := backend.ReadWithOptions(blockId, opts)
+	if errors.Cause(err) != utils.ErrIndexNotFound {
+		return data, err
+	}
+	for _, other := range r.others(name) {
+		data, otherErr := other.ReadWithOptions(blockId, opts)
+		if errors.Cause(otherErr) != utils.ErrIndexNotFound {
+			return data, otherErr
+		}
+	}
+	return nil, err
+}
+
+func (r *Router) Delete(blockId string) error {
+	return r.DeleteWithOptions(blockId, nil)
+}
+
+// DeleteWithOptions 从所属的后端删除，迁移过程中同时删除其他后端中还没有移动的chunk
+func (r *Router) DeleteWithOptions(blockId string, opts *myfs.DeleteOptions) error {
+	bucket := ""
+	if opts != nil {
+		bucket = opts.Bucket
+	}
+	r.moveMutx.RLock()
+	defer r.moveMutx.RUnlock()
+	name, backend, err := r.locate(bucket, blockId)
+	if err != nil {
+		return err
+	}
+	err = backend.DeleteWithOptions(blockId, opts)
+	if errors.Cause(err) != utils.ErrIndexNotFound {
+		return err
+	}
+	for _, other := range r.others(name) {
+		otherErr := other.DeleteWithOptions(blockId, opts)
+		if errors.Cause(otherErr) != utils.ErrIndexNotFound {
+			return otherErr
+		}
+	}
+	return err
+}
+
+// CreateBucket 在所有的后端中创建bucket，配额在每个后端中单独计算
+func (r *Router) CreateBucket(name string, quota myfs.BucketQuota) error {
+	r.mutx.RLock()
+	defer r.mutx.RUnlock()
+	for _, backend := range r.backends {
+		if err := backend.CreateBucket(name, quota); err != nil && errors.Cause(err) != utils.ErrBucketExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭所有的后端
+func (r *Router) Close() error {
+	r.mutx.Lock()
+	defer r.mutx.Unlock()
+	var firstErr error
+	for _, backend := range r.backends {
+		if err := backend.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// AddNode 增加后端，并将ring上属于新后端的chunk移动过去
+func (r *Router) AddNode(name string, backend Backend) (*RebalanceStats, error) {
+	r.rebalanceMutx.Lock()
+	defer r.rebalanceMutx.Unlock()
+
+	r.mutx.Lock()
+	if _, ok := r.backends[name]; ok {
+		r.mutx.Unlock()
+		return nil, errors.Errorf("backend [%s] already exists", name)
+	}
+	r.backends[name] = backend
+	ring := r.ring.clone()
+	ring.Add(name)
+	r.ring = ring
+	r.rebalancing = true
+	r.mutx.Unlock()
+
+	return r.rebalance()
+}
+
+// RemoveNode 将后端中的chunk移动到其他后端后删除该后端，被删除的后端不会被关闭
+func (r *Router) RemoveNode(name string) (*RebalanceStats, error) {
+	r.rebalanceMutx.Lock()
+	defer r.rebalanceMutx.Unlock()
+
+	r.mutx.Lock()
+	if !r.ring.Has(name) {
+		r.mutx.Unlock()
+		return nil, errors.Errorf("backend [%s] is not found", name)
+	}
+	if len(r.ring.Nodes()) == 1 {
+		r.mutx.Unlock()
+		return nil, errors.Wrap(utils.ErrNoBackend, "can not remove the last backend")
+	}
+	ring := r.ring.clone()
+	ring.Remove(name)
+	r.ring = ring
+	r.rebalancing = true
+	r.mutx.Unlock()
+
+	return r.rebalance()
+}
+
+// Rebalance 将所有不在所属后端中的chunk移动到所属的后端，
+// AddNode或RemoveNode迁移失败后可以再次调用继续迁移
+func (r *Router) Rebalance() (*RebalanceStats, error) {
+	r.rebalanceMutx.Lock()
+	defer r.rebalanceMutx.Unlock()
+
+	r.mutx.Lock()
+	r.rebalancing = true
+	r.mutx.Unlock()
+	return r.rebalance()
+}
+
+// rebalance 依次检查每个后端，全部移动完成后删除已经不在ring中的后端
+func (r *Router) rebalance() (*RebalanceStats, error) {
+	r.mutx.RLock()
+	backends := make(map[string]Backend, len(r.backends))
+	for name, backend := range r.backends {
+		backends[name] = backend
+	}
+	r.mutx.RUnlock()
+
+	stats := &RebalanceStats{}
+	if err := r.copyBuckets(backends); err != nil {
+		return stats, err
+	}
+	for name, backend := range backends {
+		if err := r.migrate(name, backend, stats); err != nil {
+			return stats, errors.WithMessagef(err, "rebalance backend [%s] failed", name)
+		}
+	}
+
+	r.mutx.Lock()
+	for name := range r.backends {
+		if !r.ring.Has(name) {
+			delete(r.backends, name)
+		}
+	}
+	r.rebalancing = false
+	r.mutx.Unlock()
+	log.Printf("rebalance moved %d chunks, %d bytes", stats.Moved, stats.MovedBytes)
+	return stats, nil
+}
+
+// copyBuckets 保证所有后端都有相同的bucket，新加入的后端需要先创建bucket才能接收移动的chunk
+func (r *Router) copyBuckets(backends map[string]Backend) error {
+	buckets := make(map[string]*myfs.Bucket)
+	for _, backend := range backends {
+		list, err := backend.ListBuckets()
+		if err != nil {
+			return err
+		}
+		for _, bucket := range list {
+			buckets[bucket.Name] = bucket
+		}
+	}
+	for _, backend := range backends {
+		for _, bucket := range buckets {
+			err := backend.CreateBucket(bucket.Name, bucket.Quota)
+			if errors.Cause(err) == utils.ErrBucketExists {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if bucket.Versioning {
+				if err = backend.SetBucketVersioning(bucket.Name, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// migrate 移动name后端中不属于该后端的chunk，只移动最新的版本
+func (r *Router) migrate(name string, backend Backend, stats *RebalanceStats) error {
+	buckets, err := backend.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		startAfter := ""
+		for {
+			indexes, err := backend.List(bucket.Name, &myfs.ListOptions{StartAfter: startAfter, Limit: listPageSize})
+			if err != nil {
+				return err
+			}
+			for _, index := range indexes {
+				if err = r.move(name, backend, bucket.Name, index.BlockId, stats); err != nil {
+					return err
+				}
+			}
+			if len(indexes) < listPageSize {
+				break
+			}
+			startAfter = indexes[len(indexes)-1].BlockId
+		}
+	}
+	return nil
+}
+
+// move 将一个chunk复制到所属的后端后从原来的后端删除
+func (r *Router) move(name string, backend Backend, bucket, id string, stats *RebalanceStats) error {
+	r.moveMutx.Lock()
+	defer r.moveMutx.Unlock()
+
+	owner, target, err := r.locate(bucket, id)
+	if err != nil || owner == name {
+		return err
+	}
+	data, err := backend.ReadWithOptions(id, &myfs.ReadOptions{Bucket: bucket})
+	if errors.Cause(err) == utils.ErrIndexNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 目标后端中已经有该chunk时，说明迁移开始后有新的写入，保留新的数据
+	_, err = target.WriteWithKey(id, data, &myfs.WriteOptions{Bucket: bucket, Overwrite: myfs.OverwriteFail})
+	if err != nil && errors.Cause(err) != utils.ErrKeyExists {
+		return err
+	}
+	if err = backend.DeleteWithOptions(id, &myfs.DeleteOptions{Bucket: bucket}); err != nil {
+		return err
+	}
+	stats.Moved++
+	stats.MovedBytes += int64(len(data))
+	return nil
+}
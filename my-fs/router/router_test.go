@@ -0,0 +1,171 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	myfs "my-fs/fs"
+	"my-fs/utils"
+
+	"github.com/pkg/errors"
+)
+
+func newTestBackend(t *testing.T) *myfs.FileManager {
+	dir := t.TempDir()
+	fm, err := myfs.NewFileManager(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	return fm
+}
+
+func countChunks(t *testing.T, backend Backend, bucket string) int {
+	indexes, err := backend.List(bucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(indexes)
+}
+
+func TestRing_MinimalMovement(t *testing.T) {
+	ring := NewRing(0)
+	for _, node := range []string{"a", "b", "c"} {
+		ring.Add(node)
+	}
+	before := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = ring.Get(key)
+		counts[before[key]]++
+	}
+	for node, count := range counts {
+		if count < 500 {
+			t.Fatalf("node %s only owns %d of 3000 keys", node, count)
+		}
+	}
+
+	// 增加节点时只有移动到新节点的key会改变位置
+	added := ring.clone()
+	added.Add("d")
+	moved := 0
+	for key, owner := range before {
+		if now := added.Get(key); now != owner {
+			if now != "d" {
+				t.Fatalf("key %s moved from %s to %s", key, owner, now)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Fatalf("unexpected moved keys %d", moved)
+	}
+
+	// 删除节点后恢复原来的分布
+	added.Remove("d")
+	for key, owner := range before {
+		if now := added.Get(key); now != owner {
+			t.Fatalf("key %s owned by %s after remove, expect %s", key, now, owner)
+		}
+	}
+}
+
+func TestRouter_Rebalance(t *testing.T) {
+	backends := map[string]Backend{
+		"node-0": newTestBackend(t),
+		"node-1": newTestBackend(t),
+		"node-2": newTestBackend(t),
+	}
+	r := NewRouter(backends, 0)
+	if err := r.CreateBucket("photos", myfs.BucketQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		data := []byte(fmt.Sprintf("chunk-%d", i))
+		id, err := r.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written[id] = data
+	}
+	if _, err := r.WriteWithKey("cat.jpg", []byte("meow"), &myfs.WriteOptions{Bucket: "photos"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, backend := range backends {
+		if n := countChunks(t, backend, myfs.DefaultBucket); n == 0 {
+			t.Fatalf("backend %s holds no chunks", name)
+		}
+	}
+
+	// 幂等写入的重试发送到同一个后端
+	first, err := r.WriteWithOptions([]byte("once"), &myfs.WriteOptions{IdempotencyKey: "retry-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.WriteWithOptions([]byte("once"), &myfs.WriteOptions{IdempotencyKey: "retry-1"})
+	if err != nil || second != first {
+		t.Fatalf("retry returns %s %v, expect %s", second, err, first)
+	}
+	written[first] = []byte("once")
+
+	checkAll := func() {
+		t.Helper()
+		for id, data := range written {
+			got, err := r.Read(id)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %s: %q %v", id, got, err)
+			}
+			// chunk保存在ring上所属的后端中
+			owner, err := r.Locate("", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = r.backends[owner].Read(id); err != nil {
+				t.Fatalf("chunk %s is not on owner %s: %v", id, owner, err)
+			}
+		}
+		got, err := r.ReadWithOptions("cat.jpg", &myfs.ReadOptions{Bucket: "photos"})
+		if err != nil || string(got) != "meow" {
+			t.Fatalf("read cat.jpg: %q %v", got, err)
+		}
+	}
+
+	added := newTestBackend(t)
+	stats, err := r.AddNode("node-3", added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved == 0 || stats.Moved >= len(written) {
+		t.Fatalf("unexpected rebalance stats %+v", stats)
+	}
+	if n := countChunks(t, added, myfs.DefaultBucket); n == 0 {
+		t.Fatal("no chunk is moved to the new backend")
+	}
+	checkAll()
+
+	if _, err = r.RemoveNode("node-0"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, backends["node-0"], myfs.DefaultBucket); n != 0 {
+		t.Fatalf("removed backend still holds %d chunks", n)
+	}
+	if nodes := r.Nodes(); len(nodes) != 3 || nodes[0] != "node-1" {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	checkAll()
+
+	for id := range written {
+		if err = r.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.Read(id); errors.Cause(err) != utils.ErrIndexNotFound {
+			t.Fatalf("expect ErrIndexNotFound after delete, got %v", err)
+		}
+		break
+	}
+}
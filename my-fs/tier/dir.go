@@ -0,0 +1,71 @@
+// Package tier 冷热分层使用的冷存储，实现fs.TierStore
+package tier
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DirStore 将文件保存在本地目录中，通常是挂载在较慢磁盘上的目录
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore 创建DirStore，目录不存在时创建
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create tier dir [%s] failed", dir)
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// Put 先写入临时文件并同步，之后重命名，读取时不会看到不完整的文件
+func (s *DirStore) Put(name string, r io.ReadSeeker, size int64) error {
+	tmp, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "create temp file failed")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		return errors.Wrapf(err, "write [%s] failed", name)
+	}
+	if written != size {
+		return errors.Errorf("write [%s] failed, expected %d bytes, got %d", name, size, written)
+	}
+	if err = tmp.Sync(); err != nil {
+		return errors.Wrapf(err, "sync [%s] failed", name)
+	}
+	if err = os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return errors.Wrapf(err, "rename [%s] failed", name)
+	}
+	return nil
+}
+
+func (s *DirStore) Get(name string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "seek [%s] to %d failed", name, offset)
+	}
+	return file, nil
+}
+
+func (s *DirStore) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DirStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
@@ -0,0 +1,92 @@
+package tier
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+const defaultRegion = "us-east-1"
+
+// S3Options S3兼容的对象存储
+type S3Options struct {
+	// 为空时使用AWS，其他兼容S3的服务使用path style访问
+	Endpoint string
+	// 为空时使用us-east-1
+	Region string
+	Bucket string
+	// 对象名的前缀，多个节点共用一个bucket时需要使用不同的前缀
+	Prefix string
+	// 为空时使用aws默认的凭证链，例如AWS_ACCESS_KEY_ID环境变量
+	AccessKey string
+	SecretKey string
+}
+
+// S3Store 将文件保存在S3兼容的对象存储中，bucket需要已经存在
+type S3Store struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+// NewS3Store 创建S3Store，不会访问对象存储
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("s3 bucket can not be empty")
+	}
+	region := opts.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	config := &aws.Config{Region: aws.String(region)}
+	if opts.Endpoint != "" {
+		config.Endpoint = aws.String(opts.Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if opts.AccessKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(opts.AccessKey, opts.SecretKey, "")
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "create s3 session failed")
+	}
+	prefix := opts.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Store{client: s3.New(sess), bucket: opts.Bucket, prefix: prefix}, nil
+}
+
+func (s *S3Store) Put(name string, r io.ReadSeeker, size int64) error {
+	_, err := s.client.PutObject(&s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(s.prefix + name),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	})
+	return errors.Wrapf(err, "put object [%s] failed", s.prefix+name)
+}
+
+// Get offset大于0时使用Range请求，只下载offset之后的数据
+func (s *S3Store) Get(name string, offset int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.prefix + name)}
+	if offset > 0 {
+		input.Range = aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-")
+	}
+	output, err := s.client.GetObject(input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get object [%s] failed", s.prefix+name)
+	}
+	return output.Body, nil
+}
+
+func (s *S3Store) Delete(name string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.prefix + name)})
+	return errors.Wrapf(err, "delete object [%s] failed", s.prefix+name)
+}
@@ -0,0 +1,126 @@
+package tier
+
+import (
+	"bytes"
+	"io/ioutil"
+	myfs "my-fs/fs"
+	"my-fs/gateway"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// newTestS3Store 使用本地的s3网关代替对象存储
+func newTestS3Store(t *testing.T) *S3Store {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	fm, err := myfs.NewFileManager(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	g, err := gateway.NewGateway(fm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Store(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "cold",
+		Prefix:    "node-1",
+		AccessKey: "test",
+		SecretKey: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("cold")}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func testStore(t *testing.T, store myfs.TierStore) {
+	data := []byte("0123456789abcdef")
+	if err := store.Put("file_000001", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 10} {
+		r, err := store.Get("file_000001", offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data[offset:]) {
+			t.Fatalf("get from offset %d failed, got %q, err %v", offset, got, err)
+		}
+	}
+	if err := store.Delete("file_000001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("file_000001", 0); err == nil {
+		t.Fatal("get of a deleted object should fail")
+	}
+	// 删除不存在的对象不返回错误
+	if err := store.Delete("file_000001"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+	if err = store.Put("file_000002", bytes.NewReader([]byte("short")), 10); err == nil {
+		t.Fatal("put with a wrong size should fail")
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	store := newTestS3Store(t)
+	testStore(t, store)
+	if _, err := store.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("cold"), Key: aws.String("node-1/file_000001")}); err == nil {
+		t.Fatal("object should be deleted")
+	}
+}
+
+// TestS3Store_Tiering 文件移到对象存储之后仍然可以读取
+func TestS3Store_Tiering(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := myfs.NewFileManagerWithOptions(filepath.Join(dir, "filestore"), filepath.Join(dir, "indexstore"),
+		&myfs.Options{MaxFileSize: 256, Tiering: myfs.TieringOptions{Store: newTestS3Store(t), MinAge: time.Nanosecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	data := map[string][]byte{}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		data[key] = bytes.Repeat([]byte(key), 100)
+		if _, err = fm.WriteWithKey(key, data[key], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := fm.Tier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segments == 0 {
+		t.Fatal("sealed files should be tiered")
+	}
+	for key, expect := range data {
+		got, err := fm.Read(key)
+		if err != nil || !bytes.Equal(got, expect) {
+			t.Fatalf("read %s failed, err %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Config TLS的配置，CertFile与KeyFile为空时不开启TLS
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// 不为空时要求客户端提供由该CA签发的证书
+	ClientCAFile string
+	// 访问其他节点时用于验证对方证书的CA，为空时使用系统的CA
+	PeerCAFile string
+}
+
+// Enabled 是否配置了证书
+func (c Config) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Reloader 持有当前的证书以及客户端CA，Reload之后新的连接使用新的证书，已经建立的连接不受影响
+type Reloader struct {
+	conf Config
+
+	mutx     sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	peerCA   *x509.CertPool
+}
+
+// NewReloader 加载证书，文件不存在或者格式错误时返回错误
+func NewReloader(conf Config) (*Reloader, error) {
+	if !conf.Enabled() {
+		return nil, errors.New("tls cert file and key file can not be empty")
+	}
+	r := &Reloader{conf: conf}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新读取证书与CA文件，读取失败时继续使用之前的证书
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "load tls key pair failed")
+	}
+	clientCA, err := loadCertPool(r.conf.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	peerCA, err := loadCertPool(r.conf.PeerCAFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutx.Lock()
+	defer r.mutx.Unlock()
+	r.cert, r.clientCA, r.peerCA = &cert, clientCA, peerCA
+	return nil
+}
+
+// ReloadOnSignal 收到SIGHUP时重新加载证书，直到stop被关闭
+func (r *Reloader) ReloadOnSignal(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				if err := r.Reload(); err != nil {
+					log.Printf("reload tls certificate failed: %s", err)
+					continue
+				}
+				log.Printf("reloaded tls certificate from [%s]", r.conf.CertFile)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Certificate 返回当前的证书
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mutx.RLock()
+	defer r.mutx.RUnlock()
+	return r.cert
+}
+
+// ServerConfig 返回服务端使用的tls配置，每次握手时读取当前的证书与客户端CA
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutx.RLock()
+			defer r.mutx.RUnlock()
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCA != nil {
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+				conf.ClientCAs = r.clientCA
+			}
+			return conf, nil
+		},
+	}
+}
+
+// ClientConfig 返回访问其他节点时使用的tls配置，使用本节点的证书作为客户端证书
+// 客户端证书在每次握手时读取，PeerCA在调用时确定
+func (r *Reloader) ClientConfig() *tls.Config {
+	r.mutx.RLock()
+	defer r.mutx.RUnlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    r.peerCA,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read ca file [%s] failed", file)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificate found in ca file [%s]", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,183 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert 生成证书，parent为nil时生成自签名的CA
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write 将证书与私钥写入dir，返回文件路径
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func newTLSServer(t *testing.T, r *Reloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = r.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// servedSerial 返回服务端当前使用的证书序列号
+func servedSerial(t *testing.T, addr string, conf *tls.Config) *big.Int {
+	conn, err := tls.Dial("tcp", addr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "server", ca)
+	certFile, keyFile := first.write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, PeerCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSServer(t, r)
+	addr := server.Listener.Addr().String()
+	client := r.ClientConfig()
+	if serial := servedSerial(t, addr, client); serial.Cmp(first.cert.SerialNumber) != 0 {
+		t.Fatalf("expect first certificate, got serial %s", serial)
+	}
+
+	// 文件损坏时继续使用之前的证书
+	if err = ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Reload(); err == nil {
+		t.Fatal("expect reload of broken certificate to fail")
+	}
+	if serial := servedSerial(t, addr, client); serial.Cmp(first.cert.SerialNumber) != 0 {
+		t.Fatalf("expect first certificate after failed reload, got serial %s", serial)
+	}
+
+	// 收到SIGHUP后新的连接使用新的证书
+	second := newTestCert(t, "server", ca)
+	second.write(t, dir, "server")
+	stop := make(chan struct{})
+	defer close(stop)
+	r.ReloadOnSignal(stop)
+	if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, addr, client).Cmp(second.cert.SerialNumber) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloader_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, PeerCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSServer(t, r)
+
+	get := func(conf *tls.Config) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// 使用同一个CA签发的证书的节点可以访问
+	if err = get(r.ClientConfig()); err != nil {
+		t.Fatalf("expect peer with certificate to connect: %s", err)
+	}
+	// 没有客户端证书
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	if err = get(&tls.Config{RootCAs: pool}); err == nil {
+		t.Fatal("expect client without certificate to be rejected")
+	}
+	// 其他CA签发的客户端证书
+	other := newTestCert(t, "intruder", newTestCert(t, "other-ca", nil))
+	otherCert := tls.Certificate{Certificate: [][]byte{other.der}, PrivateKey: other.key}
+	if err = get(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{otherCert}}); err == nil {
+		t.Fatal("expect client certificate from another ca to be rejected")
+	}
+}
@@ -1,8 +1,115 @@
 package utils
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 var (
 	ErrIndexNotFound       = errors.New("index not found")
 	ErrUnexpectedEndOfFile = errors.New("unexpected end of file")
+	ErrBucketNotFound      = errors.New("bucket not found")
+	ErrBucketExists        = errors.New("bucket already exists")
+	ErrBucketNotEmpty      = errors.New("bucket is not empty")
+	ErrInvalidBucketName   = errors.New("invalid bucket name")
+	ErrQuotaExceeded       = errors.New("quota exceeded")
+	ErrKeyExists           = errors.New("key already exists")
+	ErrPreconditionFailed  = errors.New("precondition failed")
+	// 主密钥无法解密保存的数据密钥
+	ErrWrongMasterKey = errors.New("wrong master key")
+	// 记录无法解密，密钥错误或者数据被篡改
+	ErrDecryptionFailed = errors.New("decrypt record failed")
+	// 记录是加密的，但是没有配置主密钥
+	ErrEncryptionKeyMissing = errors.New("record is encrypted but no master key is configured")
+	// 从节点只能读取，写入需要发送到主节点
+	ErrReadOnly = errors.New("file manager is read only")
+	// 复制的位置所在的文件已经被主节点压缩删除，从节点需要重新同步
+	ErrLogCompacted = errors.New("replication position has been compacted")
+	// 从节点的数据与主节点不一致
+	ErrLogDiverged = errors.New("replica diverged from primary")
+	// 集群模式下只有leader可以提交索引的修改
+	ErrNotLeader = errors.New("node is not the cluster leader")
+	// 路由中没有可用的后端
+	ErrNoBackend = errors.New("no backend available")
+	// 纠删码模式下可用的分片少于数据分片数量，无法恢复记录
+	ErrShardsUnavailable = errors.New("not enough shards available")
+	// 请求中没有某种认证方式的凭证，认证时尝试下一种方式
+	ErrNoCredentials = errors.New("no credentials")
+	// 请求的凭证无效
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// 存储仍在恢复，暂时无法处理请求
+	ErrNotReady = errors.New("store is not ready")
+	// FileManager已经关闭
+	ErrClosed = errors.New("file manager is closed")
+	// 服务正在关闭，不再接受新的写入
+	ErrShuttingDown = errors.New("server is shutting down")
+	// 归档格式错误或者数据与元数据不一致
+	ErrInvalidArchive = errors.New("invalid archive")
+	// 快照中的文件缺失或者与manifest中的校验和不一致
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	// 写入速度超过配额，稍后重试
+	ErrRateLimited = errors.New("write rate limit exceeded")
+	// 请求体超过接口允许的大小
+	ErrBodyTooLarge = errors.New("request body too large")
+	// 客户端的请求频率超过接口的限制，稍后重试
+	ErrTooManyRequests = errors.New("too many requests")
+	// 幂等key已经被内容不同的请求使用
+	ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+)
+
+// 配额的范围
+const (
+	QuotaScopeBucket = "bucket"
+	QuotaScopeToken  = "token"
+	// 数据目录所在磁盘的剩余空间
+	QuotaScopeDisk = "disk"
+)
+
+// 配额限制的资源
+const (
+	QuotaResourceBytes   = "bytes"
+	QuotaResourceObjects = "objects"
+	// 每秒写入的字节数，超过时返回ErrRateLimited
+	QuotaResourceRate = "bytes per second"
 )
+
+// QuotaError 写入超过配额时返回的错误，errors.Cause返回ErrQuotaExceeded，限速时返回ErrRateLimited
+type QuotaError struct {
+	// 超过的配额的范围，以及bucket名称、token id或者数据目录
+	Scope string
+	Name  string
+	// 超过的限制，QuotaResourceBytes等
+	Resource string
+	// 写入之后的用量与限制，磁盘为写入之后剩余的字节数与要求保留的字节数
+	Used  int64
+	Limit int64
+	// 限速时可以重试的等待时间
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	if e.Resource == QuotaResourceRate {
+		return fmt.Sprintf("%s: %s [%s] allows %d %s, retry after %s",
+			e.Cause(), e.Scope, e.Name, e.Limit, e.Resource, e.RetryAfter)
+	}
+	if e.Scope == QuotaScopeDisk {
+		return fmt.Sprintf("%s: disk of [%s] would have %d bytes free, below the watermark of %d",
+			e.Cause(), e.Name, e.Used, e.Limit)
+	}
+	return fmt.Sprintf("%s: %s [%s] would use %d of %d %s", e.Cause(), e.Scope, e.Name, e.Used, e.Limit, e.Resource)
+}
+
+// Cause 与errors.Cause配合，返回对应的错误
+func (e *QuotaError) Cause() error {
+	if e.Resource == QuotaResourceRate {
+		return ErrRateLimited
+	}
+	return ErrQuotaExceeded
+}
+
+// Unwrap 与errors.Is配合
+func (e *QuotaError) Unwrap() error {
+	return e.Cause()
+}